@@ -0,0 +1,7 @@
+module consistent-hashing
+
+go 1.24
+
+require membership v0.0.0
+
+replace membership => ../membership
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"hash/fnv"
 	"log"
 	"sort"
@@ -94,6 +95,13 @@ func (hr *HashRing) GetNodeForKey(key string) int {
 }
 
 func main() {
+	members := flag.Int("members", 0, "run this many members of a SWIM group and keep the ring in step with it instead")
+	flag.Parse()
+	if *members > 0 {
+		runMembership(*members)
+		return
+	}
+
 	// Create a new hash ring
 	hashRing := newHashRing()
 
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"membership"
+)
+
+// ringFollower keeps a HashRing's nodes in step with a SWIM membership
+// group, rather than adding and deleting them by hand: every member goes on
+// the ring as a node named by its address, and comes off it when it leaves
+// or fails.
+type ringFollower struct {
+	ring *HashRing
+
+	mu     sync.Mutex
+	onRing map[string]bool // the ring refuses a node twice, and deletes the wrong one if it has not got it
+}
+
+// followMembership puts every member ml knows of on hr, and from then on
+// adds each member that joins and deletes each one that leaves or fails,
+// until ml stops. It returns once the members already known are on the ring.
+func followMembership(hr *HashRing, ml *membership.Memberlist) {
+	f := &ringFollower{ring: hr, onRing: make(map[string]bool)}
+	events := ml.Subscribe()
+	for _, m := range ml.Members() {
+		f.add(m.Addr)
+	}
+	go func() {
+		for e := range events {
+			switch e.Type {
+			case membership.EventJoin:
+				f.add(e.Member.Addr)
+			case membership.EventLeave, membership.EventFail:
+				f.remove(e.Member.Addr)
+			}
+		}
+	}()
+}
+
+func (f *ringFollower) add(node string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.onRing[node] {
+		return
+	}
+	f.onRing[node] = true
+	f.ring.AddNodeToRing(node)
+}
+
+func (f *ringFollower) remove(node string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.onRing[node] {
+		return
+	}
+	delete(f.onRing, node)
+	f.ring.DeleteNodeFromRing(node)
+	log.Printf("node %s is gone from the membership", node)
+}
+
+// owners counts how many of keys keys, key0 to keyN, each node owns.
+func owners(hr *HashRing, keys int) map[string]int {
+	o := make(map[string]int)
+	for i := range keys {
+		id := hr.GetNodeForKey(fmt.Sprintf("key%d", i))
+		hr.mu.RLock()
+		o[hr.hashMap[id]]++
+		hr.mu.RUnlock()
+	}
+	return o
+}
+
+// runMembership runs n members of a SWIM group in this process, puts them on
+// a ring that follows the first one's view of the group, and crashes the
+// last, which the ring drops once the group has seen it fail.
+func runMembership(n int) {
+	network := membership.NewMemNetwork(1)
+	var members []*membership.Memberlist
+	for i := range n {
+		name := fmt.Sprintf("node%d", i)
+		ml := membership.NewMemberlist(membership.DefaultConfig(name), network.Transport(name))
+		network.Register(name, ml.Handle)
+		if i == 0 {
+			ml.Start()
+		} else {
+			ml.Start("node0")
+		}
+		members = append(members, ml)
+	}
+	for len(members[0].Members()) < n {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	hashRing := newHashRing()
+	followMembership(hashRing, members[0])
+	log.Printf("owners of 1000 keys: %v", owners(hashRing, 1000))
+
+	crashed := members[n-1]
+	crashed.Shutdown()
+	for len(owners(hashRing, 1000)) == n {
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Printf("%s crashed, owners of 1000 keys: %v", crashed.Addr(), owners(hashRing, 1000))
+	for _, ml := range members {
+		ml.Shutdown()
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"membership"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// A ring that follows a SWIM group has every member on it, loses one that
+// crashes, and gets it back when it rejoins.
+func TestRingFollowsMembership(t *testing.T) {
+	network := membership.NewMemNetwork(1)
+	start := func(name string, seeds ...string) *membership.Memberlist {
+		cfg := membership.DefaultConfig(name)
+		cfg.ProbeInterval = 10 * time.Millisecond
+		cfg.ProbeTimeout = 4 * time.Millisecond
+		cfg.SuspicionTimeout = 100 * time.Millisecond
+		ml := membership.NewMemberlist(cfg, network.Transport(name))
+		network.Register(name, ml.Handle)
+		ml.Start(seeds...)
+		t.Cleanup(ml.Shutdown)
+		return ml
+	}
+	a := start("a")
+	hr := newHashRing()
+	followMembership(hr, a)
+	start("b", "a")
+	c := start("c", "a")
+
+	await := func(what string, want ...string) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+			o := owners(hr, 1000)
+			ok := len(o) == len(want)
+			for _, node := range want {
+				ok = ok && o[node] > 0
+			}
+			if ok {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: keys are owned by %v, want %v", what, o, want)
+			}
+		}
+	}
+	await("joined", "a", "b", "c")
+	c.Shutdown()
+	await("c crashed", "a", "b")
+	start("c", "a")
+	await("c rejoined", "a", "b", "c")
+}
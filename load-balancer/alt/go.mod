@@ -0,0 +1,3 @@
+module load-balancer/alt
+
+go 1.24
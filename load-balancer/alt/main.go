@@ -1,8 +1,13 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"log"
 	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"strings"
 	"sync"
 	"time"
 )
@@ -14,6 +19,7 @@ type Task struct {
 type Worker struct {
 	id     int
 	taskCh chan Task
+	proxy  *httputil.ReverseProxy // forwards to the worker's backend, when it proxies HTTP
 }
 
 type LoadBalancer struct {
@@ -67,14 +73,18 @@ func (w *Worker) start(wg *sync.WaitGroup) {
 }
 
 func (lb *LoadBalancer) DistributeTasks(task Task) {
+	lb.next().taskCh <- task
+}
+
+// next picks the worker the next task or request goes to.
+func (lb *LoadBalancer) next() *Worker {
 	lb.mu.Lock()
+	defer lb.mu.Unlock()
 	worker := lb.workers[lb.nextWorker]
 
 	// Classic Round Robin Algorithm
 	lb.nextWorker = (lb.nextWorker + 1) % len(lb.workers)
-	lb.mu.Unlock()
-
-	worker.taskCh <- task
+	return worker
 }
 
 func (lb *LoadBalancer) Stop() {
@@ -84,6 +94,19 @@ func (lb *LoadBalancer) Stop() {
 }
 
 func main() {
+	backends := flag.String("backends", "", "comma-separated backend URLs to proxy HTTP requests to, instead of simulating tasks")
+	addr := flag.String("addr", ":8080", "address the proxy listens on")
+	flag.Parse()
+
+	if *backends != "" {
+		lb, err := newProxyLoadBalancer(strings.Split(*backends, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("proxying %s round robin to %s", *addr, *backends)
+		log.Fatal(http.ListenAndServe(*addr, lb))
+	}
+
 	numWorkers, numTasks := 3, 10
 
 	lb := newLoadBalancer(numWorkers)
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// newProxyLoadBalancer returns a load balancer whose workers forward HTTP
+// requests to backends, one worker per backend URL.
+func newProxyLoadBalancer(backends []string) (*LoadBalancer, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("no backends")
+	}
+	lb := newLoadBalancer(len(backends))
+	for i, backend := range backends {
+		target, err := url.Parse(backend)
+		if err != nil {
+			return nil, fmt.Errorf("backend %q: %v", backend, err)
+		}
+		if target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("backend %q: want an absolute URL", backend)
+		}
+		lb.workers[i].proxy = newProxy(target)
+	}
+	return lb, nil
+}
+
+// newProxy forwards requests to target with their headers, host and bodies
+// as they came, and appends the client to X-Forwarded-For.
+func newProxy(target *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			// SetURL sets the Host header to the backend's; keep the one the
+			// client asked for.
+			r.Out.Host = r.In.Host
+			// Rewrite starts from a request without the X-Forwarded headers;
+			// keep the chain of proxies before this one.
+			r.Out.Header["X-Forwarded-For"] = r.In.Header["X-Forwarded-For"]
+			r.SetXForwarded()
+		},
+		// Pass on each part of a streamed response as soon as it arrives.
+		FlushInterval: -1,
+	}
+}
+
+// ServeHTTP hands each request to the next worker in round robin order.
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lb.next().proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBackend counts the requests it serves and answers according to the
+// path:
+//
+//	/up    reads the body a line at a time, signalling up after the first
+//	/down  sends a line, waits for down, then sends another
+//	else   echoes the request's headers and host back as its own, and its body
+type fakeBackend struct {
+	id       int
+	mu       sync.Mutex
+	requests int
+	up, down chan struct{}
+}
+
+// take returns how many requests the backend has served since it was last
+// asked.
+func (b *fakeBackend) take() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := b.requests
+	b.requests = 0
+	return n
+}
+
+func (b *fakeBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	b.requests++
+	b.mu.Unlock()
+	w.Header().Set("X-Backend", strconv.Itoa(b.id))
+
+	switch r.URL.Path {
+	case "/up":
+		lines := bufio.NewScanner(r.Body)
+		var n int
+		for lines.Scan() {
+			if n++; n == 1 {
+				b.up <- struct{}{}
+			}
+		}
+		fmt.Fprintf(w, "%d lines\n", n)
+	case "/down":
+		fmt.Fprintln(w, "first")
+		w.(http.Flusher).Flush()
+		select {
+		case <-b.down:
+		case <-time.After(5 * time.Second):
+		}
+		fmt.Fprintln(w, "second")
+	default:
+		for k, v := range r.Header {
+			w.Header()["Echo-"+k] = v
+		}
+		w.Header().Set("Echo-Host", r.Host)
+		io.Copy(w, r.Body)
+	}
+}
+
+// startProxy puts a proxy load balancer in front of numBackends fake
+// backends until the test ends, and returns its URL and the backends.
+func startProxy(t *testing.T, numBackends int) (string, []*fakeBackend) {
+	t.Helper()
+	up, down := make(chan struct{}, 1), make(chan struct{}, 1)
+	var backends []*fakeBackend
+	var urls []string
+	for i := range numBackends {
+		b := &fakeBackend{id: i + 1, up: up, down: down}
+		s := httptest.NewServer(b)
+		t.Cleanup(s.Close)
+		backends = append(backends, b)
+		urls = append(urls, s.URL)
+	}
+	lb, err := newProxyLoadBalancer(urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(lb)
+	t.Cleanup(front.Close)
+	return front.URL, backends
+}
+
+// One at a time, requests go to the backends in turn, with their headers
+// and the client's host passed on, X-Forwarded-For added, and bodies both
+// ways.
+func TestProxyRoundRobin(t *testing.T) {
+	const numBackends, numRequests = 3, 30
+	front, _ := startProxy(t, numBackends)
+	for i := range numRequests {
+		req, _ := http.NewRequest("POST", front+"/echo", strings.NewReader("hello"))
+		req.Host = "lb.example"
+		req.Header.Add("X-Check", "a")
+		req.Header.Add("X-Check", "b")
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strconv.Itoa(i%numBackends + 1); resp.Header.Get("X-Backend") != want {
+			t.Fatalf("request %d went to backend %s, want %s", i, resp.Header.Get("X-Backend"), want)
+		}
+		if string(body) != "hello" {
+			t.Fatalf("request %d: body %q, want %q", i, body, "hello")
+		}
+		if got := resp.Header.Values("Echo-X-Check"); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+			t.Fatalf("request %d: backend saw X-Check %q, want [a b]", i, got)
+		}
+		if got, want := resp.Header.Get("Echo-X-Forwarded-For"), "203.0.113.7, 127.0.0.1"; got != want {
+			t.Fatalf("request %d: backend saw X-Forwarded-For %q, want %q", i, got, want)
+		}
+		if got := resp.Header.Get("Echo-Host"); got != "lb.example" {
+			t.Fatalf("request %d: backend saw host %q, want the client's %q", i, got, "lb.example")
+		}
+	}
+}
+
+// Many requests at once, every backend still gets its equal share.
+func TestProxyConcurrentShare(t *testing.T) {
+	const numBackends, numRequests = 3, 30
+	front, backends := startProxy(t, numBackends)
+	var wg sync.WaitGroup
+	errs := make(chan error, numRequests)
+	for range numRequests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(front + "/echo")
+			if err != nil {
+				errs <- err
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	lo, hi := numRequests/numBackends, (numRequests+numBackends-1)/numBackends
+	for _, b := range backends {
+		if n := b.take(); n < lo || n > hi {
+			t.Errorf("backend %d served %d of %d concurrent requests, want %d to %d", b.id, n, numRequests, lo, hi)
+		}
+	}
+}
+
+// A request body reaches the backend before the client has finished it.
+func TestProxyStreamsRequest(t *testing.T) {
+	front, backends := startProxy(t, 1)
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.Post(front+"/up", "text/plain", pr)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	fmt.Fprintln(pw, "first")
+	select {
+	case <-backends[0].up:
+	case <-time.After(5 * time.Second):
+		pw.Close()
+		t.Fatal("the request body was not streamed: the backend saw nothing of it")
+	}
+	fmt.Fprintln(pw, "second")
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A response reaches the client before the backend has finished it.
+func TestProxyStreamsResponse(t *testing.T) {
+	front, backends := startProxy(t, 1)
+	resp, err := http.Get(front + "/down")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewReader(resp.Body)
+	first := make(chan string, 1)
+	go func() {
+		line, _ := lines.ReadString('\n')
+		first <- line
+	}()
+	select {
+	case line := <-first:
+		if line != "first\n" {
+			t.Fatalf("streamed response began %q, want %q", line, "first\n")
+		}
+	case <-time.After(time.Second):
+		backends[0].down <- struct{}{}
+		t.Fatal("the response was not streamed: nothing arrived before the backend finished")
+	}
+	backends[0].down <- struct{}{}
+	if rest, _ := io.ReadAll(lines); string(rest) != "second\n" {
+		t.Fatalf("streamed response ended %q, want %q", rest, "second\n")
+	}
+}
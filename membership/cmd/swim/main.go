@@ -0,0 +1,186 @@
+// Command swim runs a SWIM membership group in one process, crashes, removes
+// and restarts members, and checks every member sees each change.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"membership"
+)
+
+// node is one member of the demo group and whatever it runs on.
+type node struct {
+	ml    *membership.Memberlist
+	close func() // closes its transport, if it has one to close
+}
+
+// cluster starts members on an in-memory network or on UDP sockets.
+type cluster struct {
+	udp     bool
+	network *membership.MemNetwork
+}
+
+func (c *cluster) start(name string, seeds ...string) (*node, error) {
+	if !c.udp {
+		ml := membership.NewMemberlist(membership.DefaultConfig(name), c.network.Transport(name))
+		c.network.Register(name, ml.Handle)
+		ml.Start(seeds...)
+		return &node{ml: ml, close: func() {}}, nil
+	}
+
+	t, err := membership.NewUDPTransport(name)
+	if err != nil {
+		return nil, err
+	}
+	ml := membership.NewMemberlist(membership.DefaultConfig(t.Addr()), t)
+	go t.Serve(ml.Handle)
+	ml.Start(seeds...)
+	return &node{ml: ml, close: func() { t.Close() }}, nil
+}
+
+func (n *node) addr() string {
+	return n.ml.Addr()
+}
+
+// await waits up to timeout for every node in nodes to see exactly want as
+// the live members.
+func await(nodes []*node, want []string, timeout time.Duration) error {
+	slices.Sort(want)
+	deadline := time.Now().Add(timeout)
+	for {
+		var wrong *node
+		var got []string
+		for _, n := range nodes {
+			got = got[:0]
+			for _, m := range n.ml.Members() {
+				got = append(got, m.Addr)
+			}
+			if !slices.Equal(got, want) {
+				wrong = n
+				break
+			}
+		}
+		if wrong == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s sees %v, want %v", wrong.addr(), got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func addrs(nodes []*node) []string {
+	var a []string
+	for _, n := range nodes {
+		a = append(a, n.addr())
+	}
+	return a
+}
+
+func without(nodes []*node, gone *node) []*node {
+	return slices.DeleteFunc(slices.Clone(nodes), func(n *node) bool { return n == gone })
+}
+
+func main() {
+	size := flag.Int("nodes", 5, "members in the group")
+	udp := flag.Bool("udp", false, "run the members on UDP sockets on localhost instead of an in-memory network")
+	drop := flag.Float64("drop", 0.05, "on the in-memory network, the chance each message is lost")
+	seed := flag.Int64("seed", 1, "seed of the in-memory network's losses and delays")
+	flag.Parse()
+
+	if *size < 3 {
+		log.Fatal("-nodes must be at least 3")
+	}
+	c := &cluster{udp: *udp, network: membership.NewMemNetwork(*seed)}
+	c.network.SetUnreliable(*drop, time.Millisecond, 3*time.Millisecond)
+	name := func(i int) string {
+		if *udp {
+			return "127.0.0.1:0"
+		}
+		return fmt.Sprintf("node%d", i)
+	}
+	timeout := 5 * time.Second
+
+	// Everybody joins through the first member.
+	first, err := c.start(name(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	nodes := []*node{first}
+	for i := 1; i < *size; i++ {
+		n, err := c.start(name(i), first.addr())
+		if err != nil {
+			log.Fatal(err)
+		}
+		nodes = append(nodes, n)
+	}
+	start := time.Now()
+	if err := await(nodes, addrs(nodes), timeout); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("all %d members see each other after %v", len(nodes), time.Since(start).Round(time.Millisecond))
+
+	// A crashed member is suspected, fails to refute and is declared dead.
+	crashed := nodes[len(nodes)-1]
+	crashed.ml.Shutdown()
+	crashed.close()
+	nodes = without(nodes, crashed)
+	start = time.Now()
+	if err := await(nodes, addrs(nodes), timeout); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%s crashed, every member saw it fail after %v", crashed.addr(), time.Since(start).Round(time.Millisecond))
+
+	// A member that leaves says so, and is gone at once.
+	leaving := nodes[len(nodes)-1]
+	leaving.ml.Leave()
+	leaving.close()
+	nodes = without(nodes, leaving)
+	start = time.Now()
+	if err := await(nodes, addrs(nodes), timeout); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%s left, every member saw it leave after %v", leaving.addr(), time.Since(start).Round(time.Millisecond))
+
+	// The crashed member comes back at the same address, and refutes being
+	// dead to rejoin.
+	if *udp {
+		name = func(int) string { return crashed.addr() }
+	}
+	back, err := c.start(name(*size-1), first.addr())
+	if err != nil {
+		log.Fatal(err)
+	}
+	nodes = append(nodes, back)
+	start = time.Now()
+	if err := await(nodes, addrs(nodes), timeout); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%s restarted, every member saw it rejoin after %v", back.addr(), time.Since(start).Round(time.Millisecond))
+
+	// With nobody else joining or failing, lost messages alone must not make
+	// a live member fail.
+	events := first.ml.Subscribe()
+	time.Sleep(2 * time.Second)
+	first.ml.Unsubscribe(events)
+	for e := range events {
+		if e.Type == membership.EventFail {
+			log.Fatalf("%s saw live member %s fail", first.addr(), e.Member.Addr)
+		}
+	}
+	loss := *drop
+	if *udp {
+		loss = 0
+	}
+	log.Printf("no live member failed over 2s losing %.0f%% of messages", 100*loss)
+
+	for _, n := range nodes {
+		n.ml.Shutdown()
+		n.close()
+	}
+}
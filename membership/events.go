@@ -0,0 +1,76 @@
+package membership
+
+import "time"
+
+// EventType is the kind of change an Event reports.
+type EventType string
+
+const (
+	EventJoin  EventType = "join"  // a member joined, or came back after failing or leaving
+	EventLeave EventType = "leave" // a member said it was leaving
+	EventFail  EventType = "fail"  // a member stopped answering and did not refute the suspicion
+)
+
+// eventBuffer is how many changes wait in a subscription for its reader.
+const eventBuffer = 256
+
+// Event is a change in the membership as one member sees it.
+type Event struct {
+	Type   EventType
+	Time   time.Time
+	Member Member
+}
+
+// Subscribe starts a feed of the changes this member sees from now on.
+// Changes wait in the feed for its reader, up to eventBuffer of them; past
+// that, probing goes on and the reader misses them, as EventsDropped counts.
+// The feed ends, closing the channel, with Unsubscribe or once the member
+// stops.
+func (ml *Memberlist) Subscribe() <-chan Event {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	ch := make(chan Event, eventBuffer)
+	if ml.stopped {
+		close(ch)
+		return ch
+	}
+	ml.subscribers = append(ml.subscribers, ch)
+	return ch
+}
+
+// Unsubscribe ends a feed Subscribe started, closing its channel. A channel
+// the member is not feeding is left alone.
+func (ml *Memberlist) Unsubscribe(events <-chan Event) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	for i, ch := range ml.subscribers {
+		if ch == events {
+			close(ch)
+			ml.subscribers = append(ml.subscribers[:i], ml.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+// EventsDropped returns how many changes subscribers missed for having a
+// full feed.
+func (ml *Memberlist) EventsDropped() int {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	return ml.dropped
+}
+
+// emit puts a change in every feed with room for it. It is called with mu
+// held.
+func (ml *Memberlist) emit(typ EventType, m Member) {
+	e := Event{Type: typ, Time: time.Now(), Member: m}
+	for _, ch := range ml.subscribers {
+		select {
+		case ch <- e:
+		default:
+			ml.dropped++
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module membership
+
+go 1.24
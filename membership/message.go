@@ -0,0 +1,52 @@
+package membership
+
+type MsgType string
+
+const (
+	MsgPing    MsgType = "Ping"
+	MsgAck     MsgType = "Ack"
+	MsgPingReq MsgType = "PingReq" // ping Target on the sender's behalf and relay its ack
+	MsgJoin    MsgType = "Join"
+	MsgSync    MsgType = "Sync" // every member the sender knows of, in reply to a Join
+)
+
+// Message is the single envelope exchanged between members. Every message is
+// one-way and may be lost, and every one piggybacks the membership updates
+// the sender is still spreading.
+type Message struct {
+	Type MsgType
+	From string
+	To   string
+	Seq  uint64 // of the probe a Ping, PingReq or Ack belongs to
+
+	// PingReq
+	Target string
+
+	Updates []Update
+}
+
+type State string
+
+const (
+	StateAlive   State = "alive"
+	StateSuspect State = "suspect"
+	StateDead    State = "dead"
+	StateLeft    State = "left"
+)
+
+// Update is what one member says about another, or about itself. A member's
+// incarnation only it may raise, to refute being suspected; an update about
+// a member replaces what is known of it when its incarnation is higher, or
+// equal and the update is graver.
+type Update struct {
+	Addr        string
+	State       State
+	Incarnation uint64
+}
+
+// graver orders states by how they override each other at the same
+// incarnation.
+func graver(a, b State) bool {
+	rank := map[State]int{StateAlive: 0, StateSuspect: 1, StateDead: 2, StateLeft: 2}
+	return rank[a] > rank[b]
+}
@@ -0,0 +1,436 @@
+// Package membership keeps track of which members of a group are up, with
+// the SWIM failure detector, and tells subscribers as members join, leave
+// and fail, so that whatever spreads work over the members need not
+// hard-code them.
+package membership
+
+import (
+	"cmp"
+	"math/bits"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Config tunes a Memberlist.
+type Config struct {
+	Addr             string        // this member's address, which the others know it by
+	ProbeInterval    time.Duration // how often a member probes one other
+	ProbeTimeout     time.Duration // how long a direct ping waits before asking others to ping
+	IndirectChecks   int           // members asked to ping a target that did not answer
+	SuspicionTimeout time.Duration // how long a suspect has to refute it before it is declared dead
+	RetransmitMult   int           // an update is piggybacked RetransmitMult*log2(n+1) times
+	MaxPiggyback     int           // updates piggybacked on one message
+}
+
+// DefaultConfig returns settings that detect a failure within a few tenths
+// of a second on a local network.
+func DefaultConfig(addr string) Config {
+	return Config{
+		Addr:             addr,
+		ProbeInterval:    50 * time.Millisecond,
+		ProbeTimeout:     20 * time.Millisecond,
+		IndirectChecks:   3,
+		SuspicionTimeout: 300 * time.Millisecond,
+		RetransmitMult:   4,
+		MaxPiggyback:     8,
+	}
+}
+
+// Member is one member of the group as some member sees it.
+type Member struct {
+	Addr        string
+	State       State
+	Incarnation uint64
+}
+
+type member struct {
+	Member
+	suspicion *time.Timer // declares the member dead unless it refutes in time
+}
+
+// broadcast is an update being piggybacked until it has been sent enough
+// times to have reached everybody with high probability.
+type broadcast struct {
+	update    Update
+	transmits int
+}
+
+// relay is a ping sent on behalf of a PingReq, whose ack goes back to the
+// member that asked.
+type relay struct {
+	to  string
+	seq uint64
+}
+
+// Memberlist is one member of a group whose members track each other with
+// SWIM. Every ProbeInterval it pings one other member, in a shuffled round
+// robin; a member that does not ack within ProbeTimeout is pinged through
+// IndirectChecks others, and if none of them hears back either it is
+// suspected. A suspect that does not refute by raising its incarnation
+// within SuspicionTimeout is declared dead. Joins, suspicions, deaths and
+// leaves spread by being piggybacked on the probes' own messages, so
+// failure detection and dissemination cost a constant number of messages
+// per member per ProbeInterval, however big the group.
+type Memberlist struct {
+	cfg       Config
+	transport Transport
+
+	mu          sync.Mutex
+	incarnation uint64
+	members     map[string]*member // every other member ever heard of, dead or alive
+	order       []string           // probe order
+	next        int
+	seq         uint64
+	probes      map[uint64]chan struct{} // closed when the probe's ack arrives
+	relays      map[uint64]relay
+	queue       []*broadcast
+	subscribers []chan Event
+	dropped     int      // events subscribers missed
+	seeds       []string // asked to join through until some member is known
+	rand        *rand.Rand
+	done        chan struct{}
+	stopped     bool
+}
+
+func NewMemberlist(cfg Config, transport Transport) *Memberlist {
+	return &Memberlist{
+		cfg:       cfg,
+		transport: transport,
+		members:   make(map[string]*member),
+		probes:    make(map[uint64]chan struct{}),
+		relays:    make(map[uint64]relay),
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start begins probing. The member learns of the group from the members at
+// seeds, none of which need be up yet, asking them again every ProbeInterval
+// until it knows of another member; with no seeds it starts a new group.
+func (ml *Memberlist) Start(seeds ...string) {
+	ml.mu.Lock()
+	ml.seeds = seeds
+	ml.enqueue(Update{Addr: ml.cfg.Addr, State: StateAlive, Incarnation: ml.incarnation})
+	ml.mu.Unlock()
+	go ml.probeLoop()
+}
+
+// Leave tells the group this member is leaving and stops it. The others see
+// a leave rather than a failure.
+func (ml *Memberlist) Leave() {
+	ml.mu.Lock()
+	ml.incarnation++
+	left := Update{Addr: ml.cfg.Addr, State: StateLeft, Incarnation: ml.incarnation}
+	ml.enqueue(left)
+	var alive []string
+	for addr, m := range ml.members {
+		if m.State == StateAlive || m.State == StateSuspect {
+			alive = append(alive, addr)
+		}
+	}
+	ml.mu.Unlock()
+
+	// Tell everybody at once, rather than hope the update gets piggybacked
+	// enough before this member stops answering.
+	for _, addr := range alive {
+		ml.send(Message{Type: MsgPing, To: addr, Updates: []Update{left}})
+	}
+	ml.Shutdown()
+}
+
+// Shutdown stops the member without telling anybody, as if it crashed.
+func (ml *Memberlist) Shutdown() {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if ml.stopped {
+		return
+	}
+	ml.stopped = true
+	close(ml.done)
+	for _, m := range ml.members {
+		if m.suspicion != nil {
+			m.suspicion.Stop()
+		}
+	}
+	for _, ch := range ml.subscribers {
+		close(ch)
+	}
+	ml.subscribers = nil
+}
+
+// Addr returns the address this member is known by.
+func (ml *Memberlist) Addr() string {
+	return ml.cfg.Addr
+}
+
+// Members returns the members this one believes are in the group, itself
+// included, in address order.
+func (ml *Memberlist) Members() []Member {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	members := []Member{{Addr: ml.cfg.Addr, State: StateAlive, Incarnation: ml.incarnation}}
+	for _, m := range ml.members {
+		if m.State == StateAlive || m.State == StateSuspect {
+			members = append(members, m.Member)
+		}
+	}
+	slices.SortFunc(members, func(a, b Member) int { return cmp.Compare(a.Addr, b.Addr) })
+	return members
+}
+
+func (ml *Memberlist) probeLoop() {
+	for {
+		start := time.Now()
+		if target, ok := ml.nextTarget(); ok {
+			ml.probe(target)
+		} else {
+			for _, seed := range ml.seeds {
+				ml.send(Message{Type: MsgJoin, To: seed})
+			}
+		}
+		select {
+		case <-time.After(time.Until(start.Add(ml.cfg.ProbeInterval))):
+		case <-ml.done:
+			return
+		}
+	}
+}
+
+// nextTarget returns the next member to probe, going round the live members
+// in an order shuffled afresh every time round.
+func (ml *Memberlist) nextTarget() (string, bool) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	for range 2 {
+		for ; ml.next < len(ml.order); ml.next++ {
+			if m := ml.members[ml.order[ml.next]]; m.State == StateAlive || m.State == StateSuspect {
+				ml.next++
+				return m.Addr, true
+			}
+		}
+		ml.order = ml.order[:0]
+		for addr, m := range ml.members {
+			if m.State == StateAlive || m.State == StateSuspect {
+				ml.order = append(ml.order, addr)
+			}
+		}
+		ml.rand.Shuffle(len(ml.order), func(i, j int) { ml.order[i], ml.order[j] = ml.order[j], ml.order[i] })
+		ml.next = 0
+	}
+	return "", false
+}
+
+// probe pings target, directly and then through others, and suspects it if
+// no ack comes back within the probe interval.
+func (ml *Memberlist) probe(target string) {
+	seq, acked := ml.newProbe()
+	defer func() {
+		ml.mu.Lock()
+		delete(ml.probes, seq)
+		ml.mu.Unlock()
+	}()
+
+	ml.send(Message{Type: MsgPing, To: target, Seq: seq})
+	select {
+	case <-acked:
+		return
+	case <-time.After(ml.cfg.ProbeTimeout):
+	case <-ml.done:
+		return
+	}
+
+	for _, addr := range ml.randomMembers(ml.cfg.IndirectChecks, target) {
+		ml.send(Message{Type: MsgPingReq, To: addr, Seq: seq, Target: target})
+	}
+	select {
+	case <-acked:
+		return
+	case <-time.After(ml.cfg.ProbeInterval - ml.cfg.ProbeTimeout):
+	case <-ml.done:
+		return
+	}
+
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if m, ok := ml.members[target]; ok {
+		ml.apply(Update{Addr: target, State: StateSuspect, Incarnation: m.Incarnation})
+	}
+}
+
+func (ml *Memberlist) newProbe() (uint64, chan struct{}) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.seq++
+	ch := make(chan struct{})
+	ml.probes[ml.seq] = ch
+	return ml.seq, ch
+}
+
+// randomMembers returns up to k live members other than except.
+func (ml *Memberlist) randomMembers(k int, except string) []string {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	var addrs []string
+	for addr, m := range ml.members {
+		if addr != except && m.State == StateAlive {
+			addrs = append(addrs, addr)
+		}
+	}
+	ml.rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	return addrs[:min(k, len(addrs))]
+}
+
+// send piggybacks the updates being spread on m and sends it.
+func (ml *Memberlist) send(m Message) {
+	ml.mu.Lock()
+	m.Updates = append(m.Updates, ml.piggyback()...)
+	ml.mu.Unlock()
+	ml.transport.Send(m)
+}
+
+// piggyback takes the updates sent least often so far, and forgets those
+// sent often enough. It is called with mu held.
+func (ml *Memberlist) piggyback() []Update {
+	slices.SortStableFunc(ml.queue, func(a, b *broadcast) int { return a.transmits - b.transmits })
+	limit := ml.cfg.RetransmitMult * bits.Len(uint(len(ml.members)+1))
+
+	var updates []Update
+	for _, b := range ml.queue[:min(ml.cfg.MaxPiggyback, len(ml.queue))] {
+		updates = append(updates, b.update)
+		b.transmits++
+	}
+	ml.queue = slices.DeleteFunc(ml.queue, func(b *broadcast) bool { return b.transmits >= limit })
+	return updates
+}
+
+// enqueue starts spreading u, in place of any older update about the same
+// member. It is called with mu held.
+func (ml *Memberlist) enqueue(u Update) {
+	ml.queue = slices.DeleteFunc(ml.queue, func(b *broadcast) bool { return b.update.Addr == u.Addr })
+	ml.queue = append(ml.queue, &broadcast{update: u})
+}
+
+// Handle processes a message from another member.
+func (ml *Memberlist) Handle(m Message) {
+	ml.mu.Lock()
+	if ml.stopped {
+		ml.mu.Unlock()
+		return
+	}
+	for _, u := range m.Updates {
+		ml.apply(u)
+	}
+
+	switch m.Type {
+	case MsgPing:
+		ack := Message{Type: MsgAck, To: m.From, Seq: m.Seq}
+		if from, ok := ml.members[m.From]; ok && from.State == StateDead {
+			// Nobody probes a dead member, so without being told it would
+			// never learn it has to refute.
+			ack.Updates = []Update{{Addr: from.Addr, State: StateDead, Incarnation: from.Incarnation}}
+		}
+		ml.mu.Unlock()
+		ml.send(ack)
+	case MsgPingReq:
+		ml.seq++
+		seq := ml.seq
+		ml.relays[seq] = relay{to: m.From, seq: m.Seq}
+		time.AfterFunc(ml.cfg.ProbeInterval, func() {
+			ml.mu.Lock()
+			delete(ml.relays, seq)
+			ml.mu.Unlock()
+		})
+		ml.mu.Unlock()
+		ml.send(Message{Type: MsgPing, To: m.Target, Seq: seq})
+	case MsgAck:
+		if ch, ok := ml.probes[m.Seq]; ok {
+			close(ch)
+			delete(ml.probes, m.Seq)
+		}
+		r, ok := ml.relays[m.Seq]
+		delete(ml.relays, m.Seq)
+		ml.mu.Unlock()
+		if ok {
+			ml.send(Message{Type: MsgAck, To: r.to, Seq: r.seq})
+		}
+	case MsgJoin:
+		reply := Message{Type: MsgSync, To: m.From}
+		reply.Updates = append(reply.Updates, Update{Addr: ml.cfg.Addr, State: StateAlive, Incarnation: ml.incarnation})
+		for _, mem := range ml.members {
+			reply.Updates = append(reply.Updates, Update{Addr: mem.Addr, State: mem.State, Incarnation: mem.Incarnation})
+		}
+		ml.mu.Unlock()
+		ml.transport.Send(reply)
+	default:
+		ml.mu.Unlock()
+	}
+}
+
+// apply merges what an update says into what this member knows, and
+// spreads it further if it was news. It is called with mu held.
+func (ml *Memberlist) apply(u Update) {
+	if u.Addr == ml.cfg.Addr {
+		// Only this member may say it is alive, and it does so by outbidding
+		// whoever says it is not.
+		if u.State != StateAlive && u.Incarnation >= ml.incarnation {
+			ml.incarnation = u.Incarnation + 1
+			ml.enqueue(Update{Addr: ml.cfg.Addr, State: StateAlive, Incarnation: ml.incarnation})
+		}
+		return
+	}
+
+	m, known := ml.members[u.Addr]
+	if !known {
+		if u.State != StateAlive {
+			// A member first heard of as gone is remembered, so a stale
+			// alive cannot bring it back.
+			ml.members[u.Addr] = &member{Member: Member(u)}
+			return
+		}
+		ml.members[u.Addr] = &member{Member: Member(u)}
+		ml.order = append(ml.order, u.Addr)
+		ml.enqueue(u)
+		ml.emit(EventJoin, Member(u))
+		return
+	}
+	if u.Incarnation < m.Incarnation || (u.Incarnation == m.Incarnation && !graver(u.State, m.State)) {
+		return
+	}
+
+	was := m.State
+	m.Member = Member(u)
+	ml.enqueue(u)
+	if m.suspicion != nil {
+		m.suspicion.Stop()
+		m.suspicion = nil
+	}
+	switch u.State {
+	case StateAlive:
+		if was == StateDead || was == StateLeft {
+			ml.order = append(ml.order, u.Addr)
+			ml.emit(EventJoin, m.Member)
+		}
+	case StateSuspect:
+		inc := u.Incarnation
+		m.suspicion = time.AfterFunc(ml.cfg.SuspicionTimeout, func() {
+			ml.mu.Lock()
+			defer ml.mu.Unlock()
+			if !ml.stopped {
+				ml.apply(Update{Addr: u.Addr, State: StateDead, Incarnation: inc})
+			}
+		})
+	case StateDead:
+		if was != StateDead && was != StateLeft {
+			ml.emit(EventFail, m.Member)
+		}
+	case StateLeft:
+		if was != StateDead && was != StateLeft {
+			ml.emit(EventLeave, m.Member)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package membership
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// testConfig probes fast, so that failures are detected within a test.
+func testConfig(addr string) Config {
+	cfg := DefaultConfig(addr)
+	cfg.ProbeInterval = 10 * time.Millisecond
+	cfg.ProbeTimeout = 4 * time.Millisecond
+	cfg.SuspicionTimeout = 150 * time.Millisecond
+	return cfg
+}
+
+// start starts a member called name on network, joining through seeds, and
+// shuts it down when the test ends.
+func start(t *testing.T, network *MemNetwork, name string, seeds ...string) *Memberlist {
+	t.Helper()
+	return startConfig(t, network, testConfig(name), seeds...)
+}
+
+// startConfig is start for a member with its own settings.
+func startConfig(t *testing.T, network *MemNetwork, cfg Config, seeds ...string) *Memberlist {
+	t.Helper()
+	ml := NewMemberlist(cfg, network.Transport(cfg.Addr))
+	network.Register(cfg.Addr, ml.Handle)
+	ml.Start(seeds...)
+	t.Cleanup(ml.Shutdown)
+	return ml
+}
+
+// sees reports whether every one of mls counts exactly the members at addrs
+// in the group.
+func sees(mls []*Memberlist, addrs ...string) func() bool {
+	return func() bool {
+		for _, ml := range mls {
+			var got []string
+			for _, m := range ml.Members() {
+				got = append(got, m.Addr)
+			}
+			if !slices.Equal(got, addrs) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// lookup returns what ml knows of the member at addr, if it thinks it is in
+// the group.
+func lookup(ml *Memberlist, addr string) (Member, bool) {
+	for _, m := range ml.Members() {
+		if m.Addr == addr {
+			return m, true
+		}
+	}
+	return Member{}, false
+}
+
+// await waits up to timeout for cond to hold.
+func await(t *testing.T, what string, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: not within %v", what, timeout)
+		}
+	}
+}
+
+// recorder keeps every event a subscriber gets, so that events about one
+// member can be waited for in order without losing those about others.
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+	next   map[string]int // addr -> its events already expected
+	closed bool           // whether the subscription ended
+}
+
+func record(events <-chan Event) *recorder {
+	r := &recorder{next: make(map[string]int)}
+	go func() {
+		for e := range events {
+			r.mu.Lock()
+			r.events = append(r.events, e)
+			r.mu.Unlock()
+		}
+		r.mu.Lock()
+		r.closed = true
+		r.mu.Unlock()
+	}()
+	return r
+}
+
+// expect waits up to timeout for the next event about addr, and fails
+// unless it is of type typ.
+func (r *recorder) expect(t *testing.T, typ EventType, addr string, timeout time.Duration) Event {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		r.mu.Lock()
+		n := 0
+		for _, e := range r.events {
+			if e.Member.Addr != addr {
+				continue
+			}
+			if n++; n <= r.next[addr] {
+				continue
+			}
+			r.next[addr]++
+			r.mu.Unlock()
+			if e.Type != typ {
+				t.Fatalf("got %s %s, want %s", addr, e.Type, typ)
+			}
+			return e
+		}
+		r.mu.Unlock()
+	}
+	t.Fatalf("no %s %s within %v", addr, typ, timeout)
+	return Event{}
+}
+
+func (r *recorder) ended() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+// about returns every event about addr so far.
+func (r *recorder) about(addr string) []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var about []Event
+	for _, e := range r.events {
+		if e.Member.Addr == addr {
+			about = append(about, e)
+		}
+	}
+	return about
+}
+
+// A member that stops answering is suspected first, stays in the group
+// while it has the suspicion timeout to refute, and only then is declared
+// dead.
+func TestSuspicionTimeout(t *testing.T) {
+	network := NewMemNetwork(1)
+	a := start(t, network, "a")
+	b := start(t, network, "b", "a")
+	await(t, "a sees b", time.Second, func() bool { _, ok := lookup(a, "b"); return ok })
+	events := record(a.Subscribe())
+
+	b.Shutdown()
+	await(t, "a suspects b", time.Second, func() bool {
+		m, _ := lookup(a, "b")
+		return m.State == StateSuspect
+	})
+	suspected := time.Now()
+
+	timeout := a.cfg.SuspicionTimeout
+	if m, ok := lookup(a, "b"); !ok || time.Since(suspected) > timeout/2 {
+		t.Fatalf("b left the group %v into its suspicion as %v", time.Since(suspected), m.State)
+	}
+	e := events.expect(t, EventFail, "b", 2*timeout)
+	if took := e.Time.Sub(suspected); took < timeout-5*time.Millisecond {
+		t.Errorf("b declared dead %v after it was suspected, the suspicion timeout is %v", took, timeout)
+	}
+	if _, ok := lookup(a, "b"); ok {
+		t.Errorf("a still counts b in the group after it failed")
+	}
+}
+
+// A live member that hears it is suspected refutes it by raising its
+// incarnation, and is not declared dead.
+func TestRefuteSuspicion(t *testing.T) {
+	network := NewMemNetwork(1)
+	a := start(t, network, "a")
+	start(t, network, "b", "a")
+	start(t, network, "c", "a")
+	await(t, "a sees b and c", time.Second, func() bool { return len(a.Members()) == 3 })
+	events := record(a.Subscribe())
+
+	// As if a lost b's acks for a while.
+	b, _ := lookup(a, "b")
+	a.Handle(Message{Type: MsgSync, From: "c", Updates: []Update{{Addr: "b", State: StateSuspect, Incarnation: b.Incarnation}}})
+	if m, _ := lookup(a, "b"); m.State != StateSuspect {
+		t.Fatalf("b is %s after a was told it is suspect", m.State)
+	}
+	await(t, "b refutes", a.cfg.SuspicionTimeout, func() bool {
+		m, _ := lookup(a, "b")
+		return m.State == StateAlive && m.Incarnation > b.Incarnation
+	})
+
+	time.Sleep(2 * a.cfg.SuspicionTimeout)
+	for _, e := range events.about("b") {
+		t.Errorf("a saw b %s after it refuted the suspicion", e.Type)
+	}
+}
+
+// Subscribers get a join for every member that comes, a leave for one that
+// says it is going, a fail for one that crashes, and a join again when it
+// comes back, and their channel is closed when the member stops.
+func TestEvents(t *testing.T) {
+	network := NewMemNetwork(1)
+	a := start(t, network, "a")
+	events := record(a.Subscribe())
+	const timeout = time.Second
+
+	b := start(t, network, "b", "a")
+	c := start(t, network, "c", "a")
+	events.expect(t, EventJoin, "b", timeout)
+	events.expect(t, EventJoin, "c", timeout)
+
+	if m, _ := lookup(a, "b"); m.State != StateAlive {
+		t.Errorf("joined member b is %s", m.State)
+	}
+
+	c.Leave()
+	events.expect(t, EventLeave, "c", timeout)
+
+	b.Shutdown()
+	events.expect(t, EventFail, "b", timeout)
+
+	// b restarts at the same address and refutes being dead.
+	start(t, network, "b", "a")
+	events.expect(t, EventJoin, "b", timeout)
+
+	other := a.Subscribe()
+	a.Unsubscribe(other)
+	if _, ok := <-other; ok {
+		t.Errorf("got an event after unsubscribing")
+	}
+	a.Shutdown()
+	await(t, "events end when a stops", timeout, events.ended)
+	if _, ok := <-a.Subscribe(); ok {
+		t.Errorf("subscribed to a stopped member")
+	}
+}
+
+// A member that cannot reach another directly, but can through others, asks
+// them to ping it and does not suspect it. Without anybody to ask, it does.
+func TestIndirectPing(t *testing.T) {
+	for _, checks := range []int{3, 0} {
+		network := NewMemNetwork(1)
+		cfg := func(name string) Config {
+			cfg := testConfig(name)
+			cfg.ProbeInterval = 20 * time.Millisecond
+			cfg.IndirectChecks = checks
+			return cfg
+		}
+		a := startConfig(t, network, cfg("a"))
+		names := []string{"a", "b", "c", "d", "t"}
+		mls := []*Memberlist{a}
+		for _, name := range names[1:] {
+			mls = append(mls, startConfig(t, network, cfg(name), "a"))
+		}
+		await(t, "everybody sees everybody", time.Second, sees(mls, names...))
+		events := record(a.Subscribe())
+
+		network.CutLink("a", "t")
+		suspected := false
+		for deadline := time.Now().Add(5 * a.cfg.SuspicionTimeout); time.Now().Before(deadline) && !suspected; time.Sleep(time.Millisecond) {
+			m, ok := lookup(a, "t")
+			suspected = !ok || m.State != StateAlive
+		}
+		if checks > 0 && suspected {
+			t.Errorf("a suspected t, which %d others could reach for it", checks)
+		}
+		if checks == 0 && !suspected {
+			t.Errorf("a never suspected t, which it cannot reach and had nobody to ask about")
+		}
+		if seen := events.about("t"); checks > 0 && len(seen) > 0 {
+			t.Errorf("a saw t %s through a cut link", seen[0].Type)
+		}
+		for _, ml := range mls {
+			ml.Shutdown()
+		}
+	}
+}
+
+// With a tenth of all messages lost, word of members joining and failing
+// still reaches every member.
+func TestDisseminationUnderLoss(t *testing.T) {
+	network := NewMemNetwork(1)
+	network.SetUnreliable(0.1, 0, 2*time.Millisecond)
+	names := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	var mls []*Memberlist
+	for _, name := range names {
+		mls = append(mls, start(t, network, name, "a"))
+	}
+	await(t, "everybody sees everybody", 5*time.Second, sees(mls, names...))
+
+	mls[len(mls)-1].Shutdown()
+	mls, names = mls[:len(mls)-1], names[:len(names)-1]
+	await(t, "everybody sees h fail", 5*time.Second, sees(mls, names...))
+
+	mls = append(mls, start(t, network, "i", "c"))
+	names = append(names, "i")
+	await(t, "everybody sees i join", 5*time.Second, sees(mls, names...))
+}
@@ -0,0 +1,166 @@
+package membership
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Transport carries messages between members. Send must never block on the
+// receiver: delivery is best effort, and SWIM copes with lost, delayed and
+// reordered messages on its own.
+type Transport interface {
+	Send(m Message)
+}
+
+// MemNetwork is an in-process network for demos and tests. Every message is
+// handed to the receiver on its own goroutine after a random delay, unless
+// it is lost or the link between the two members is cut.
+type MemNetwork struct {
+	mu       sync.Mutex
+	handlers map[string]func(Message)
+	cut      map[[2]string]bool // links that carry nothing, each under both orders of its ends
+	rand     *rand.Rand
+
+	dropRate float64
+	minDelay time.Duration
+	maxDelay time.Duration
+}
+
+func NewMemNetwork(seed int64) *MemNetwork {
+	return &MemNetwork{
+		handlers: make(map[string]func(Message)),
+		cut:      make(map[[2]string]bool),
+		rand:     rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Register routes messages addressed to addr into handler.
+func (n *MemNetwork) Register(addr string, handler func(Message)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.handlers[addr] = handler
+}
+
+// Transport returns the endpoint the member at addr sends through.
+func (n *MemNetwork) Transport(addr string) Transport {
+	return &memTransport{addr: addr, net: n}
+}
+
+// SetUnreliable drops each message with probability dropRate and delays the rest by a random amount in [minDelay, maxDelay).
+func (n *MemNetwork) SetUnreliable(dropRate float64, minDelay, maxDelay time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dropRate, n.minDelay, n.maxDelay = dropRate, minDelay, maxDelay
+}
+
+// CutLink stops messages between the members at a and b, both ways, while
+// leaving each free to talk to everybody else.
+func (n *MemNetwork) CutLink(a, b string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cut[[2]string{a, b}] = true
+	n.cut[[2]string{b, a}] = true
+}
+
+// HealLink undoes CutLink.
+func (n *MemNetwork) HealLink(a, b string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.cut, [2]string{a, b})
+	delete(n.cut, [2]string{b, a})
+}
+
+func (n *MemNetwork) deliver(m Message) {
+	n.mu.Lock()
+	handler, ok := n.handlers[m.To]
+	if !ok || n.cut[[2]string{m.From, m.To}] || n.rand.Float64() < n.dropRate {
+		n.mu.Unlock()
+		return
+	}
+	delay := n.minDelay
+	if n.maxDelay > n.minDelay {
+		delay += time.Duration(n.rand.Int63n(int64(n.maxDelay - n.minDelay)))
+	}
+	n.mu.Unlock()
+
+	go func() {
+		time.Sleep(delay)
+		handler(m)
+	}()
+}
+
+type memTransport struct {
+	addr string
+	net  *MemNetwork
+}
+
+func (t *memTransport) Send(m Message) {
+	m.From = t.addr
+	t.net.deliver(m)
+}
+
+// maxPacketSize is the largest UDP datagram a UDPTransport reads.
+const maxPacketSize = 64 << 10
+
+// UDPTransport sends each message as one JSON datagram.
+type UDPTransport struct {
+	conn *net.UDPConn
+}
+
+// NewUDPTransport listens on addr, which may leave the port to the system.
+func NewUDPTransport(addr string) (*UDPTransport, error) {
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", a)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPTransport{conn: conn}, nil
+}
+
+// Addr is the address the transport listens on, which members know it by.
+func (t *UDPTransport) Addr() string {
+	return t.conn.LocalAddr().String()
+}
+
+// Serve hands every incoming message to handler until the transport is
+// closed.
+func (t *UDPTransport) Serve(handler func(Message)) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var m Message
+		if err := json.Unmarshal(buf[:n], &m); err != nil {
+			log.Printf("dropping malformed packet from %v: %v", from, err)
+			continue
+		}
+		handler(m)
+	}
+}
+
+func (t *UDPTransport) Send(m Message) {
+	m.From = t.Addr()
+	to, err := net.ResolveUDPAddr("udp", m.To)
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		log.Printf("cannot encode %s to %s: %v", m.Type, m.To, err)
+		return
+	}
+	t.conn.WriteToUDP(data, to)
+}
+
+func (t *UDPTransport) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,90 @@
+package membership
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// A cut link carries nothing either way, while both its ends still reach
+// everybody else, until it is healed.
+func TestMemNetworkCutLink(t *testing.T) {
+	network := NewMemNetwork(1)
+	got := make(chan Message, 10)
+	for _, addr := range []string{"a", "b", "c"} {
+		network.Register(addr, func(m Message) { got <- m })
+	}
+	send := func(from, to string) {
+		network.Transport(from).Send(Message{Type: MsgPing, To: to})
+	}
+	expect := func(from, to string, delivered bool) {
+		t.Helper()
+		send(from, to)
+		select {
+		case m := <-got:
+			if !delivered {
+				t.Fatalf("%s to %s delivered over a cut link", m.From, m.To)
+			}
+			if m.From != from || m.To != to {
+				t.Fatalf("got %s to %s, want %s to %s", m.From, m.To, from, to)
+			}
+		case <-time.After(50 * time.Millisecond):
+			if delivered {
+				t.Fatalf("%s to %s not delivered", from, to)
+			}
+		}
+	}
+
+	network.CutLink("a", "b")
+	expect("a", "b", false)
+	expect("b", "a", false)
+	expect("a", "c", true)
+	expect("c", "b", true)
+	network.HealLink("b", "a")
+	expect("a", "b", true)
+	expect("b", "a", true)
+}
+
+// Members on UDP transports find each other through a seed, ignore packets
+// that are not messages, and see a member fail once its transport closes.
+func TestUDPTransport(t *testing.T) {
+	var mls []*Memberlist
+	var addrs []string
+	var transports []*UDPTransport
+	for i := range 3 {
+		tr, err := NewUDPTransport("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ml := NewMemberlist(testConfig(tr.Addr()), tr)
+		go tr.Serve(ml.Handle)
+		t.Cleanup(func() {
+			ml.Shutdown()
+			tr.Close()
+		})
+		var seeds []string
+		if i > 0 {
+			seeds = append(seeds, addrs[0])
+		}
+		ml.Start(seeds...)
+		mls, addrs, transports = append(mls, ml), append(addrs, tr.Addr()), append(transports, tr)
+	}
+	want := append([]string(nil), addrs...)
+	slices.Sort(want)
+	await(t, "everybody sees everybody", 2*time.Second, sees(mls, want...))
+
+	conn, err := net.Dial("udp", addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("not a message"))
+	conn.Close()
+
+	events := record(mls[0].Subscribe())
+	mls[2].Shutdown()
+	transports[2].Close()
+	events.expect(t, EventFail, addrs[2], 2*time.Second)
+	survivors := slices.Sorted(slices.Values(addrs[:2]))
+	await(t, "the survivors see it fail", 2*time.Second, sees(mls[:2], survivors...))
+}
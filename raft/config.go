@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+)
+
+var (
+	errNotLeader            = errors.New("not the leader")
+	errConfChangeInProgress = errors.New("a configuration change is already in progress")
+	errAlreadyMember        = errors.New("server is already a member")
+	errNotMember            = errors.New("server is not a member")
+)
+
+// Membership is replicated through the log one server at a time (§4.1 of the
+// Raft thesis). Any two majorities of configurations that differ by a single
+// server overlap, so no joint consensus phase is needed as long as only one
+// change is in flight. A server uses the latest configuration in its log the
+// moment the entry is appended, committed or not.
+
+// AddServer proposes adding server id to the cluster. It returns the index
+// of the configuration entry; the change is complete once that index commits.
+func (s *server) AddServer(id int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if slices.Contains(s.peers, id) {
+		return -1, errAlreadyMember
+	}
+	return s.proposeConfig(append(slices.Clone(s.peers), id))
+}
+
+// RemoveServer proposes removing server id from the cluster. A leader that
+// removes itself keeps leading until the change commits and then steps down.
+func (s *server) RemoveServer(id int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !slices.Contains(s.peers, id) {
+		return -1, errNotMember
+	}
+	return s.proposeConfig(without(s.peers, id))
+}
+
+func (s *server) proposeConfig(peers []int) (int, error) {
+	if s.state != Leader {
+		return -1, errNotLeader
+	}
+	if s.transfer != nil {
+		return -1, errTransferInProgress
+	}
+	// One change at a time, and not before an entry of our own term has
+	// committed, or a change from a previous leader might still be pending.
+	if s.configIndex > s.commitIndex || s.termAt(s.commitIndex) != s.currentTerm {
+		return -1, errConfChangeInProgress
+	}
+
+	slices.Sort(peers)
+	data, err := json.Marshal(peers)
+	if err != nil {
+		return -1, err
+	}
+	index := s.appendEntry(EntryConfChange, data)
+	s.broadcastAppend()
+	return index, nil
+}
+
+// updateConfig switches to the latest configuration in the log. It runs
+// whenever the log changes, since truncating a conflicting suffix can roll a
+// configuration back as well as forward.
+func (s *server) updateConfig() {
+	peers, index := s.configAt(s.lastIndex())
+	s.configIndex = index
+	if slices.Equal(peers, s.peers) {
+		return
+	}
+
+	log.Printf("server%d switching to configuration %v at index %d\n", s.id, peers, index)
+	old := s.peers
+	s.peers = peers
+	if s.state == Leader {
+		// A server that was not a member starts from scratch, even one that
+		// was removed and is added back, perhaps having lost its log, rather
+		// than be counted as holding what it held before.
+		for _, peer := range peers {
+			if _, ok := s.nextIndex[peer]; !ok || peer != s.id && !slices.Contains(old, peer) {
+				s.nextIndex[peer] = s.lastIndex() + 1
+				s.matchIndex[peer] = 0
+				delete(s.snapshotOffset, peer)
+			}
+		}
+	}
+}
+
+// configAt returns the configuration in effect at index and the index of the
+// entry that introduced it, falling back to the snapshot's configuration.
+func (s *server) configAt(index int) ([]int, int) {
+	for i := index - s.log[0].Index; i > 0; i-- {
+		if e := s.log[i]; e.Type == EntryConfChange {
+			var peers []int
+			if err := json.Unmarshal(e.Command, &peers); err != nil {
+				log.Fatalf("server%d found a corrupt configuration at index %d: %v", s.id, e.Index, err)
+			}
+			return peers, e.Index
+		}
+	}
+	return s.snapshot.Peers, s.snapshot.LastIncludedIndex
+}
+
+func (s *server) isMember() bool {
+	return slices.Contains(s.peers, s.id)
+}
+
+// Members returns the servers in the configuration this server is using.
+func (s *server) Members() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.peers)
+}
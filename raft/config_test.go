@@ -0,0 +1,184 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+// changeMembership grows sim's cluster from servers 0 to 2 to five by adding
+// servers 3 and 4, and shrinks it back to three by removing whichever server
+// leads at the time and then server 4. Each change is proposed to the
+// leader until it commits. It returns the members at the end and the
+// servers removed.
+func changeMembership(t *testing.T, sim *simulator, seed int64) (members, removed []int) {
+	t.Helper()
+	// A change of -1 removes the current leader.
+	changes := []struct {
+		add bool
+		id  int
+	}{{true, 3}, {true, 4}, {false, -1}, {false, 4}}
+	members = slices.Clone(sim.peers)
+	for _, change := range changes {
+		id := change.id
+		waitFor(t, sim, 5*time.Second, "configuration change", func() bool {
+			leader := sim.leader()
+			if leader < 0 {
+				return false
+			}
+			s := sim.nodes[leader].srv
+			s.mu.Lock()
+			peers, committed := slices.Clone(s.peers), s.commitIndex >= s.configIndex
+			s.mu.Unlock()
+
+			if id < 0 {
+				id = leader
+			}
+			want := append(slices.Clone(members), id)
+			if !change.add {
+				want = without(members, id)
+			}
+			slices.Sort(want)
+			if slices.Equal(peers, want) {
+				if !committed {
+					return false
+				}
+				if !change.add {
+					removed = append(removed, id)
+				}
+				members = want
+				return true
+			}
+			// Not proposed yet, or lost with a leader that was deposed.
+			if change.add {
+				s.AddServer(id)
+			} else {
+				s.RemoveServer(id)
+			}
+			return false
+		})
+		if sim.err != nil {
+			t.Fatalf("seed %d: %v", seed, sim.err)
+		}
+	}
+	return members, removed
+}
+
+// The cluster grows from three servers to five and shrinks back to three,
+// removing whichever server leads at the time along the way, while proposals
+// keep coming and the network drops messages. Every member must apply the
+// same sequence, servers that were removed a prefix of it, and nothing
+// committed may go missing.
+func TestMembershipChangesApplySameSequence(t *testing.T) {
+	for seed := range int64(5) {
+		sim := newTestSim(seed, 5, 3)
+		sim.dropRate = 0.02
+		sim.startAll()
+		applied := recordApplied(sim, 20)
+		awaitLeader(t, sim)
+		proposeFor(sim, 8*time.Second)
+
+		members, removed := changeMembership(t, sim, seed)
+		if len(members) != 3 {
+			t.Fatalf("seed %d: ended up with members %v, want three", seed, members)
+		}
+
+		sim.runFor(8 * time.Second)
+		waitFor(t, sim, 5*time.Second, "agreement", func() bool {
+			for _, id := range members {
+				if !slices.Equal(applied[id], applied[members[0]]) {
+					return false
+				}
+			}
+			return true
+		})
+		final := applied[members[0]]
+		if len(final) == 0 {
+			t.Fatalf("seed %d: members %v applied nothing", seed, members)
+		}
+		for _, id := range removed {
+			if !slices.Equal(applied[id], final[:min(len(applied[id]), len(final))]) {
+				t.Fatalf("seed %d: removed server%d applied %v, not a prefix of %v", seed, id, applied[id], final)
+			}
+		}
+
+		// Every command that ever committed is in the final sequence, in
+		// order.
+		var committed []string
+		for i := 1; i <= sim.maxCommitted; i++ {
+			if e, ok := sim.committed[i]; ok && e.Type == EntryNormal {
+				committed = append(committed, string(e.Command))
+			}
+		}
+		if !isSubsequence(committed, final) {
+			t.Fatalf("seed %d: committed commands %v missing from the applied sequence %v", seed, committed, final)
+		}
+		if len(final) < sim.proposed/2 {
+			t.Fatalf("seed %d: only %d of %d proposals applied", seed, len(final), sim.proposed)
+		}
+	}
+}
+
+// isSubsequence reports whether sub appears in seq in order, not necessarily
+// contiguously.
+func isSubsequence(sub, seq []string) bool {
+	for _, s := range seq {
+		if len(sub) > 0 && sub[0] == s {
+			sub = sub[1:]
+		}
+	}
+	return len(sub) == 0
+}
+
+// Clients issue random requests to a key-value store while its cluster grows
+// from three servers to five and shrinks back to three, losing its leader
+// along the way, on a network that drops messages. Whatever the clients saw
+// must be linearizable.
+func TestMembershipChangesLinearizable(t *testing.T) {
+	for seed := range int64(5) {
+		sim := newTestSim(seed, 5, 3)
+		sim.dropRate = 0.02
+		kvs := make([]*KVServer, len(sim.nodes))
+		sim.newApp = func(id int) simApp {
+			kvs[id] = newKVServer(sim.nodes[id].srv, nil)
+			return kvs[id].applyMsg
+		}
+		sim.startAll()
+
+		var history []kvOperation
+		var clients []*simClient
+		for id := range 5 {
+			c := &simClient{id: id, sim: sim, kvs: kvs, leader: id % 3, history: &history}
+			clients = append(clients, c)
+			sim.after(time.Duration(id)*time.Millisecond, c.next)
+		}
+		awaitLeader(t, sim)
+		sim.runFor(500 * time.Millisecond)
+		members, _ := changeMembership(t, sim, seed)
+		sim.runFor(500 * time.Millisecond)
+
+		for _, c := range clients {
+			c.stopped = true
+		}
+		waitFor(t, sim, 10*time.Second, "clients done", func() bool {
+			return !slices.ContainsFunc(clients, func(c *simClient) bool { return c.busy })
+		})
+		if sim.err != nil {
+			t.Fatalf("seed %d: %v", seed, sim.err)
+		}
+
+		answered := 0
+		for _, op := range history {
+			if op.ret != math.MaxInt64 {
+				answered++
+			}
+		}
+		if answered < len(history)/2 {
+			t.Fatalf("seed %d: only %d of %d requests answered", seed, answered, len(history))
+		}
+		if !linearizable(history) {
+			t.Fatalf("seed %d: history across the changes to %v is not linearizable:\n%s", seed, members, formatHistory(history))
+		}
+	}
+}
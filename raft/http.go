@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// Status is what a server reports about itself on /status.
+type Status struct {
+	ID            int                `json:"id"`
+	Role          string             `json:"role"`
+	Term          int                `json:"term"`
+	Leader        int                `json:"leader"`
+	Members       []int              `json:"members"`
+	CommitIndex   int                `json:"commit_index"`
+	LastApplied   int                `json:"last_applied"`
+	LastIndex     int                `json:"last_index"`
+	SnapshotIndex int                `json:"snapshot_index"`
+	Peers         map[int]PeerStatus `json:"peers,omitempty"` // leader only
+	Metrics       Metrics            `json:"metrics"`
+}
+
+// PeerStatus is how far a leader has replicated its log to one peer.
+type PeerStatus struct {
+	MatchIndex int `json:"match_index"`
+	NextIndex  int `json:"next_index"`
+}
+
+func (s *server) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := Status{
+		ID:            s.id,
+		Role:          s.state,
+		Term:          s.currentTerm,
+		Leader:        s.leaderID,
+		Members:       slices.Clone(s.peers),
+		CommitIndex:   s.commitIndex,
+		LastApplied:   s.lastApplied,
+		LastIndex:     s.lastIndex(),
+		SnapshotIndex: s.log[0].Index,
+		Metrics:       s.metricsLocked(),
+	}
+	if s.state == Leader {
+		st.Peers = make(map[int]PeerStatus)
+		for _, peer := range s.peers {
+			if peer != s.id {
+				st.Peers[peer] = PeerStatus{MatchIndex: s.matchIndex[peer], NextIndex: s.nextIndex[peer]}
+			}
+		}
+	}
+	return st
+}
+
+// proposeResult is the reply to POST /propose.
+type proposeResult struct {
+	Index int `json:"index"`
+	Term  int `json:"term"`
+}
+
+// apiError is the body of every failed request. Leader is where a request
+// that needs the leader should be sent instead, or -1 if not known.
+type apiError struct {
+	Error  string `json:"error"`
+	Leader int    `json:"leader"`
+}
+
+// newHTTPHandler serves the API of whatever server current returns, so the
+// handler keeps working across a crash and restart:
+//
+//	GET  /status          a Status as JSON
+//	GET  /events          the event stream, one JSON Event per line, until
+//	                      the client goes away or the server is killed
+//	POST /propose         append the request body to the log; leader only
+//	POST /transfer?to=id  hand leadership to server id; leader only
+func newHTTPHandler(current func() *server) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(current().Status())
+	})
+
+	mux.HandleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+		srv := current()
+		events := srv.Subscribe()
+		defer srv.Unsubscribe(events)
+
+		// Send the headers now, so the client has the stream before the
+		// first event.
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				if err := enc.Encode(e); err != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+
+	mux.HandleFunc("POST /propose", func(w http.ResponseWriter, r *http.Request) {
+		srv := current()
+		value, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err, srv)
+			return
+		}
+		index, term, isLeader := srv.Start(value)
+		if !isLeader {
+			writeError(w, http.StatusServiceUnavailable, errNotLeader, srv)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(proposeResult{Index: index, Term: term})
+	})
+
+	mux.HandleFunc("POST /transfer", func(w http.ResponseWriter, r *http.Request) {
+		srv := current()
+		target, err := strconv.Atoi(r.URL.Query().Get("to"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("to must be a server id"), srv)
+			return
+		}
+		switch err := srv.TransferLeadership(target); {
+		case err == nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errors.Is(err, errTransferTimeout):
+			writeError(w, http.StatusGatewayTimeout, err, srv)
+		case errors.Is(err, errNotMember):
+			writeError(w, http.StatusBadRequest, err, srv)
+		default:
+			writeError(w, http.StatusServiceUnavailable, err, srv)
+		}
+	})
+
+	return mux
+}
+
+func writeError(w http.ResponseWriter, code int, err error, srv *server) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(apiError{Error: err.Error(), Leader: srv.Status().Leader})
+}
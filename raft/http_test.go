@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// serveSim serves the HTTP API of every server of sim until the test ends.
+func serveSim(t *testing.T, sim *simulator) []string {
+	t.Helper()
+	var urls []string
+	for _, n := range sim.nodes {
+		front := httptest.NewServer(newHTTPHandler(func() *server { return n.srv }))
+		t.Cleanup(front.Close)
+		urls = append(urls, front.URL)
+	}
+	return urls
+}
+
+// getJSON decodes the JSON body of GET url into v.
+func getJSON(t *testing.T, url string, v any) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+}
+
+// streamEvents reads the event stream at url until it ends, and sends
+// everything it read once it has.
+func streamEvents(t *testing.T, url string) <-chan []Event {
+	t.Helper()
+	resp, err := http.Get(url + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("event stream has content type %q", ct)
+	}
+	done := make(chan []Event, 1)
+	go func() {
+		defer resp.Body.Close()
+		var events []Event
+		lines := bufio.NewScanner(resp.Body)
+		for lines.Scan() {
+			var e Event
+			if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+				break
+			}
+			events = append(events, e)
+		}
+		done <- events
+	}()
+	return done
+}
+
+// hasInOrder reports whether events contains, in this order though not
+// necessarily next to each other, an event matching each of want.
+func hasInOrder(events []Event, want ...func(Event) bool) bool {
+	for _, e := range events {
+		if len(want) > 0 && want[0](e) {
+			want = want[1:]
+		}
+	}
+	return len(want) == 0
+}
+
+// A three server cluster elects a leader and commits a few entries. Every
+// server's /status reports its role, term, leader and members, the leader's
+// also how far each peer has the log, and the metrics count the elections.
+// Each server's event stream has its changes of term, role, vote and commit
+// index in the order they happened.
+func TestHTTPStatusAndEvents(t *testing.T) {
+	sim := newTestSim(1, 3, 3)
+	sim.startAll()
+	recordApplied(sim, 1000)
+	urls := serveSim(t, sim)
+	var streams []<-chan []Event
+	for _, url := range urls {
+		streams = append(streams, streamEvents(t, url))
+	}
+
+	leader := awaitLeader(t, sim)
+	for range 5 {
+		sim.propose()
+		sim.runFor(20 * time.Millisecond)
+	}
+	sim.runFor(time.Second)
+	if sim.err != nil {
+		t.Fatal(sim.err)
+	}
+
+	var statuses []Status
+	for _, url := range urls {
+		var st Status
+		getJSON(t, url+"/status", &st)
+		statuses = append(statuses, st)
+	}
+	lead := statuses[leader]
+	term := lead.Term
+	if lead.Role != Leader || lead.Leader != leader || lead.CommitIndex < 5 {
+		t.Errorf("leader server%d reports role %q, leader %d, commit index %d", leader, lead.Role, lead.Leader, lead.CommitIndex)
+	}
+	if lead.Metrics.ElectionsWon != 1 || lead.Metrics.Term != term || lead.Metrics.CommitIndex != lead.CommitIndex {
+		t.Errorf("leader's metrics are %+v", lead.Metrics)
+	}
+	if lead.Metrics.ApplyLag != lead.CommitIndex-lead.LastApplied {
+		t.Errorf("leader's apply lag is %d, committed %d and applied %d", lead.Metrics.ApplyLag, lead.CommitIndex, lead.LastApplied)
+	}
+	elections := 0
+	for id, st := range statuses {
+		elections += st.Metrics.ElectionsStarted
+		if st.ID != id || st.Term != term || st.Leader != leader || !slices.Equal(st.Members, []int{0, 1, 2}) {
+			t.Errorf("server%d reports id %d, term %d, leader %d, members %v; want term %d and leader %d", id, st.ID, st.Term, st.Leader, st.Members, term, leader)
+		}
+		if id == leader {
+			continue
+		}
+		if st.Role != Follower || st.Peers != nil || st.Metrics.HeartbeatLatency != nil {
+			t.Errorf("follower server%d reports role %q, peers %v and heartbeat latency %v", id, st.Role, st.Peers, st.Metrics.HeartbeatLatency)
+		}
+		if p := lead.Peers[id]; p.MatchIndex != lead.LastIndex || p.NextIndex != lead.LastIndex+1 {
+			t.Errorf("leader reports server%d at match index %d and next index %d, its log ends at %d", id, p.MatchIndex, p.NextIndex, lead.LastIndex)
+		}
+		if _, ok := lead.Metrics.HeartbeatLatency[id]; !ok {
+			t.Errorf("leader reports no heartbeat latency for server%d", id)
+		}
+	}
+	if elections < 1 {
+		t.Errorf("%d elections started, one was won", elections)
+	}
+
+	// Killing a server ends its event stream.
+	for _, n := range sim.nodes {
+		n.srv.Kill()
+	}
+	is := func(typ EventType, check func(Event) bool) func(Event) bool {
+		return func(e Event) bool { return e.Type == typ && e.Term == term && check(e) }
+	}
+	anything := func(Event) bool { return true }
+	voted := 0
+	for id, stream := range streams {
+		var events []Event
+		select {
+		case events = <-stream:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("server%d's event stream did not end when it was killed", id)
+		}
+		if len(events) == 0 {
+			t.Fatalf("server%d's event stream is empty", id)
+		}
+		for i, e := range events {
+			if e.Server != id {
+				t.Fatalf("server%d's stream has an event of server%d", id, e.Server)
+			}
+			if i > 0 && (e.Term < events[i-1].Term || e.CommitIndex < events[i-1].CommitIndex || e.Time.Before(events[i-1].Time)) {
+				t.Fatalf("server%d's event %d %+v went back from %+v", id, i, e, events[i-1])
+			}
+		}
+		if last := events[len(events)-1]; last.CommitIndex != statuses[id].CommitIndex {
+			t.Errorf("server%d's last event has commit index %d, its status %d", id, last.CommitIndex, statuses[id].CommitIndex)
+		}
+
+		if id == leader {
+			if !hasInOrder(events,
+				is(EventTermChange, anything),
+				is(EventRoleChange, func(e Event) bool { return e.Role == Candidate && e.VotedFor == id }),
+				is(EventRoleChange, func(e Event) bool { return e.Role == Leader && e.Leader == id }),
+				is(EventCommit, func(e Event) bool { return e.CommitIndex > 0 })) {
+				t.Errorf("leader server%d's events do not go term, candidate, leader, commit: %+v", id, events)
+			}
+			continue
+		}
+		if !hasInOrder(events,
+			is(EventTermChange, anything),
+			is(EventCommit, func(e Event) bool { return e.Leader == leader && e.CommitIndex > 0 })) {
+			t.Errorf("follower server%d's events do not go term, commit: %+v", id, events)
+		}
+		if hasInOrder(events,
+			is(EventTermChange, anything),
+			is(EventVote, func(e Event) bool { return e.VotedFor == leader }),
+			is(EventCommit, anything)) {
+			voted++
+		}
+	}
+	if voted == 0 {
+		t.Errorf("neither follower's events go term, vote for the leader, commit")
+	}
+}
+
+// A subscriber that stops reading misses the events past its buffer, and the
+// server counts them rather than stall.
+func TestEventsDroppedForStalledSubscriber(t *testing.T) {
+	s := newServer(0, []int{0}, &recordingTransport{}, newMemStorage(), nil)
+	stalled := s.Subscribe()
+	s.mu.Lock()
+	for range eventBuffer + 10 {
+		s.emit(EventCommit)
+	}
+	s.mu.Unlock()
+	if got := s.Metrics().EventsDropped; got != 10 {
+		t.Errorf("%d events dropped, want 10", got)
+	}
+	if len(stalled) != eventBuffer {
+		t.Errorf("stalled subscriber has %d events queued, want %d", len(stalled), eventBuffer)
+	}
+	s.Unsubscribe(stalled)
+	for range stalled {
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type KVOpType string
+
+const (
+	OpGet    KVOpType = "get"
+	OpPut    KVOpType = "put"
+	OpAppend KVOpType = "append"
+	OpCAS    KVOpType = "cas"
+)
+
+const (
+	kvRequestTimeout = 500 * time.Millisecond
+	kvSnapshotEvery  = 100 // applied entries between snapshots
+)
+
+var errTimeout = errors.New("request timed out")
+
+// KVOp is what a client asks for. ClientID and Seq identify the request so a
+// retry that was already applied is answered from the cache instead of being
+// applied twice.
+type KVOp struct {
+	Type     KVOpType
+	Key      string
+	Value    string
+	Expected string // CAS only
+	ClientID int64
+	Seq      int64
+}
+
+type KVResult struct {
+	Value   string
+	Swapped bool // CAS only
+}
+
+// KVServer is a linearizable key-value state machine driven by the raft apply
+// channel. Writes go through the log; reads use ReadIndex and are served
+// locally once the server has caught up.
+type KVServer struct {
+	mu      sync.Mutex
+	applied *sync.Cond // broadcast whenever lastApplied moves
+	rf      *server
+
+	data     map[string]string
+	lastSeq  map[int64]int64    // highest Seq applied per client
+	lastResp map[int64]KVResult // result of that Seq, for answering retries
+
+	lastApplied   int
+	sinceSnapshot int                    // entries applied since the last snapshot
+	waiters       map[int]chan appliedOp // log index -> the request waiting for it
+}
+
+type appliedOp struct {
+	op     KVOp
+	result KVResult
+}
+
+// newKVServer starts applying everything rf delivers on applyCh. With a nil
+// applyCh nothing is started and the caller hands each message to applyMsg
+// itself, as the simulator does.
+func newKVServer(rf *server, applyCh chan ApplyMsg) *KVServer {
+	kv := &KVServer{
+		rf:       rf,
+		data:     make(map[string]string),
+		lastSeq:  make(map[int64]int64),
+		lastResp: make(map[int64]KVResult),
+		waiters:  make(map[int]chan appliedOp),
+	}
+	kv.applied = sync.NewCond(&kv.mu)
+	if applyCh != nil {
+		go kv.applier(applyCh)
+	}
+	return kv
+}
+
+// Submit proposes op and waits for it to be applied. It returns errNotLeader
+// if this server cannot commit it, so the client should try another server.
+func (kv *KVServer) Submit(op KVOp) (KVResult, error) {
+	if op.Type == OpGet {
+		return kv.read(op.Key)
+	}
+
+	kv.mu.Lock()
+	if op.Seq <= kv.lastSeq[op.ClientID] {
+		result := kv.lastResp[op.ClientID]
+		kv.mu.Unlock()
+		return result, nil
+	}
+	kv.mu.Unlock()
+
+	index, ch, err := kv.propose(op)
+	if err != nil {
+		return KVResult{}, err
+	}
+	defer kv.forget(index, ch)
+
+	select {
+	case applied := <-ch:
+		return checkApplied(op, applied)
+	case <-time.After(kvRequestTimeout):
+		return KVResult{}, errTimeout
+	}
+}
+
+// propose appends op to the log and returns the index it went to and the
+// channel its result is delivered on once it is applied.
+func (kv *KVServer) propose(op KVOp) (int, chan appliedOp, error) {
+	cmd, err := json.Marshal(op)
+	if err != nil {
+		return -1, nil, err
+	}
+
+	// The waiter has to be in place before the entry can be applied, which
+	// on a single server cluster happens before Start even returns. The
+	// applier cannot get past kv.mu until it is.
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	index, _, isLeader := kv.rf.Start(cmd)
+	if !isLeader {
+		return -1, nil, errNotLeader
+	}
+	ch := make(chan appliedOp, 1)
+	kv.waiters[index] = ch
+	return index, ch, nil
+}
+
+// forget stops waiting for index, unless a later proposal at the same index
+// has taken over the slot.
+func (kv *KVServer) forget(index int, ch chan appliedOp) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.waiters[index] == ch {
+		delete(kv.waiters, index)
+	}
+}
+
+// checkApplied returns the result of op from what was applied at its index.
+func checkApplied(op KVOp, applied appliedOp) (KVResult, error) {
+	// A different request landed at our index: we lost leadership and our
+	// entry was overwritten.
+	if applied.op.ClientID != op.ClientID || applied.op.Seq != op.Seq {
+		return KVResult{}, errNotLeader
+	}
+	return applied.result, nil
+}
+
+// read serves a Get without appending to the log. Once the leader has
+// confirmed its commit index and we have applied up to it, local state
+// reflects every write that completed before the read began.
+func (kv *KVServer) read(key string) (KVResult, error) {
+	index, err := kv.rf.ReadIndex()
+	if err != nil {
+		return KVResult{}, err
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	deadline := time.Now().Add(kvRequestTimeout)
+	timer := time.AfterFunc(kvRequestTimeout, kv.applied.Broadcast)
+	defer timer.Stop()
+
+	for kv.lastApplied < index {
+		if time.Now().After(deadline) {
+			return KVResult{}, errTimeout
+		}
+		kv.applied.Wait()
+	}
+	return KVResult{Value: kv.data[key]}, nil
+}
+
+func (kv *KVServer) applier(applyCh chan ApplyMsg) {
+	for msg := range applyCh {
+		if snapshot := kv.applyMsg(msg); snapshot != nil {
+			kv.rf.Snapshot(msg.CommandIndex, snapshot)
+		}
+	}
+}
+
+// applyMsg applies one message from raft and returns a snapshot to take at
+// its index, if it is time for one.
+func (kv *KVServer) applyMsg(msg ApplyMsg) []byte {
+	if msg.SnapshotValid {
+		kv.restore(msg.Snapshot, msg.SnapshotIndex)
+		return nil
+	}
+	if !msg.CommandValid {
+		kv.mu.Lock()
+		kv.lastApplied = msg.CommandIndex
+		kv.applied.Broadcast()
+		kv.mu.Unlock()
+		return nil
+	}
+
+	var op KVOp
+	if err := json.Unmarshal(msg.Command, &op); err != nil {
+		log.Fatalf("server%d applied a corrupt command at index %d: %v", kv.rf.id, msg.CommandIndex, err)
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	result := kv.apply(op)
+	kv.lastApplied = msg.CommandIndex
+	kv.applied.Broadcast()
+	if ch, ok := kv.waiters[msg.CommandIndex]; ok {
+		ch <- appliedOp{op: op, result: result}
+		delete(kv.waiters, msg.CommandIndex)
+	}
+	if kv.sinceSnapshot++; kv.sinceSnapshot >= kvSnapshotEvery {
+		kv.sinceSnapshot = 0
+		return kv.encode()
+	}
+	return nil
+}
+
+func (kv *KVServer) apply(op KVOp) KVResult {
+	if op.Seq <= kv.lastSeq[op.ClientID] {
+		return kv.lastResp[op.ClientID]
+	}
+
+	var result KVResult
+	switch op.Type {
+	case OpGet:
+		result.Value = kv.data[op.Key]
+	case OpPut:
+		kv.data[op.Key] = op.Value
+	case OpAppend:
+		kv.data[op.Key] += op.Value
+	case OpCAS:
+		result.Value = kv.data[op.Key]
+		if result.Value == op.Expected {
+			kv.data[op.Key] = op.Value
+			result.Swapped = true
+		}
+	}
+
+	kv.lastSeq[op.ClientID] = op.Seq
+	kv.lastResp[op.ClientID] = result
+	return result
+}
+
+type kvSnapshot struct {
+	Data     map[string]string
+	LastSeq  map[int64]int64
+	LastResp map[int64]KVResult
+}
+
+func (kv *KVServer) encode() []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(kvSnapshot{Data: kv.data, LastSeq: kv.lastSeq, LastResp: kv.lastResp}); err != nil {
+		log.Fatalf("server%d failed to encode its snapshot: %v", kv.rf.id, err)
+	}
+	return buf.Bytes()
+}
+
+func (kv *KVServer) restore(snapshot []byte, index int) {
+	var snap kvSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(snapshot)).Decode(&snap); err != nil {
+		log.Fatalf("server%d failed to decode its snapshot: %v", kv.rf.id, err)
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.data, kv.lastSeq, kv.lastResp = snap.Data, snap.LastSeq, snap.LastResp
+	kv.lastApplied = index
+	kv.applied.Broadcast()
+}
+
+// Clerk is a KV client. It remembers which server led last time and moves on
+// to the next one whenever a server turns out not to be the leader.
+type Clerk struct {
+	servers  []*KVServer
+	clientID int64
+	seq      int64
+	leader   int
+}
+
+func newClerk(servers []*KVServer) *Clerk {
+	return &Clerk{servers: servers, clientID: rand.Int63()}
+}
+
+func (ck *Clerk) Get(key string) string {
+	return ck.do(KVOp{Type: OpGet, Key: key}).Value
+}
+
+func (ck *Clerk) Put(key, value string) {
+	ck.do(KVOp{Type: OpPut, Key: key, Value: value})
+}
+
+func (ck *Clerk) Append(key, value string) {
+	ck.do(KVOp{Type: OpAppend, Key: key, Value: value})
+}
+
+// CAS sets key to value if it currently holds expected, and reports whether it did.
+func (ck *Clerk) CAS(key, expected, value string) bool {
+	return ck.do(KVOp{Type: OpCAS, Key: key, Expected: expected, Value: value}).Swapped
+}
+
+// do retries op against every server in turn until one commits it. The
+// sequence number stays the same across retries so it is applied once.
+func (ck *Clerk) do(op KVOp) KVResult {
+	ck.seq++
+	op.ClientID, op.Seq = ck.clientID, ck.seq
+
+	for {
+		for range ck.servers {
+			result, err := ck.servers[ck.leader].Submit(op)
+			if err == nil {
+				return result
+			}
+			ck.leader = (ck.leader + 1) % len(ck.servers)
+		}
+		// Nobody could commit it, probably mid-election. Back off a little.
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// kvOperation is one client request as the client saw it: when it was
+// issued, when the answer came back, and the answer. Times are virtual.
+type kvOperation struct {
+	client    int
+	call, ret int64 // ret is math.MaxInt64 for a request never answered
+	op        KVOp
+	output    string // Get only
+}
+
+// kvStep applies op to the value of its key, as the KV model sees it, and
+// reports whether the operation's output is consistent with that value.
+func kvStep(value string, op kvOperation) (string, bool) {
+	switch op.op.Type {
+	case OpGet:
+		return value, op.output == value
+	case OpPut:
+		return op.op.Value, true
+	case OpAppend:
+		return value + op.op.Value, true
+	}
+	return value, false
+}
+
+// linearizable reports whether history can be put in an order in which every
+// operation takes effect at one instant between its call and its return and
+// sees the effects of everything before it (Herlihy and Wing). Keys are
+// independent, so each key's operations are checked on their own. A Get that
+// was never answered changed nothing and is left out.
+func linearizable(history []kvOperation) bool {
+	byKey := make(map[string][]kvOperation)
+	for _, op := range history {
+		if op.op.Type == OpGet && op.ret == math.MaxInt64 {
+			continue
+		}
+		byKey[op.op.Key] = append(byKey[op.op.Key], op)
+	}
+	for _, ops := range byKey {
+		if !linearizableKey(ops) {
+			return false
+		}
+	}
+	return true
+}
+
+// linearizableKey searches for an order of ops, all on the same key, depth
+// first as Porcupine does. Any operation whose call precedes the return of
+// every operation not yet placed may go next. A set of placed operations
+// that already failed with the same value is not searched again.
+func linearizableKey(ops []kvOperation) bool {
+	ops = slices.Clone(ops)
+	slices.SortFunc(ops, func(a, b kvOperation) int { return int(a.call - b.call) })
+
+	placed := make([]byte, (len(ops)+7)/8)
+	failed := make(map[string]bool)
+	var search func(value string, left int) bool
+	search = func(value string, left int) bool {
+		if left == 0 {
+			return true
+		}
+		key := string(placed) + "\x00" + value
+		if failed[key] {
+			return false
+		}
+
+		earliest := int64(math.MaxInt64)
+		for i, op := range ops {
+			if placed[i/8]&(1<<(i%8)) == 0 {
+				earliest = min(earliest, op.ret)
+			}
+		}
+		for i, op := range ops {
+			if op.call >= earliest {
+				break
+			}
+			if placed[i/8]&(1<<(i%8)) != 0 {
+				continue
+			}
+			next, ok := kvStep(value, op)
+			if !ok {
+				continue
+			}
+			placed[i/8] |= 1 << (i % 8)
+			if search(next, left-1) {
+				return true
+			}
+			placed[i/8] &^= 1 << (i % 8)
+		}
+		failed[key] = true
+		return false
+	}
+	return search("", len(ops))
+}
+
+func TestLinearizableChecker(t *testing.T) {
+	put := func(call, ret int64, v string) kvOperation {
+		return kvOperation{call: call, ret: ret, op: KVOp{Type: OpPut, Key: "x", Value: v}}
+	}
+	get := func(call, ret int64, v string) kvOperation {
+		return kvOperation{call: call, ret: ret, op: KVOp{Type: OpGet, Key: "x"}, output: v}
+	}
+	tests := []struct {
+		what    string
+		history []kvOperation
+		want    bool
+	}{
+		{"sequential", []kvOperation{put(0, 10, "1"), put(20, 30, "2"), get(40, 50, "2")}, true},
+		{"stale read", []kvOperation{put(0, 10, "1"), put(20, 30, "2"), get(40, 50, "1")}, false},
+		{"read concurrent with a write", []kvOperation{put(0, 10, "1"), put(20, 50, "2"), get(30, 40, "1")}, true},
+		{"reads disagree on the order", []kvOperation{put(0, 100, "1"), put(0, 100, "2"), get(10, 20, "1"), get(30, 40, "2"), get(50, 60, "1")}, false},
+		{"write never answered", []kvOperation{put(0, 10, "1"), put(20, math.MaxInt64, "2"), get(30, 40, "2")}, true},
+	}
+	for _, tt := range tests {
+		if got := linearizable(tt.history); got != tt.want {
+			t.Errorf("%s: linearizable = %v, want %v", tt.what, got, tt.want)
+		}
+	}
+}
+
+// simClient is a KV client of a simulated cluster. It works like Clerk, but
+// never blocks: it polls for its answer on the virtual clock instead.
+type simClient struct {
+	id      int
+	sim     *simulator
+	kvs     []*KVServer // the KV service on each server, replaced on restart
+	seq     int64
+	leader  int
+	tried   int  // servers tried since the last success
+	stopped bool // issue no new requests
+	busy    bool
+
+	history *[]kvOperation
+}
+
+const (
+	simPollEvery = time.Millisecond
+
+	// simClientTimeout is shorter than kvRequestTimeout so clients move on
+	// from a deposed leader while it still believes it leads.
+	simClientTimeout = 100 * time.Millisecond
+)
+
+// next issues the client's next request, a random Get, Put or Append on one
+// of a few keys.
+func (c *simClient) next() {
+	c.busy = false
+	if c.stopped {
+		return
+	}
+	c.busy = true
+	c.seq++
+	op := KVOp{Key: fmt.Sprintf("k%d", c.sim.rand.Intn(3)), ClientID: int64(c.id), Seq: c.seq}
+	switch r := c.sim.rand.Intn(10); {
+	case r < 4:
+		op.Type = OpGet
+	case r < 6:
+		op.Type, op.Value = OpPut, fmt.Sprintf("<%d.%d>", c.id, c.seq)
+	default:
+		op.Type, op.Value = OpAppend, fmt.Sprintf("<%d.%d>", c.id, c.seq)
+	}
+	*c.history = append(*c.history, kvOperation{client: c.id, call: c.now(), ret: math.MaxInt64, op: op})
+	c.try(len(*c.history)-1, op)
+}
+
+func (c *simClient) now() int64 {
+	return c.sim.clock.now.Sub(simEpoch).Nanoseconds()
+}
+
+// try sends op to the server the client believes leads.
+func (c *simClient) try(h int, op KVOp) {
+	id := c.leader
+	n, kv := c.sim.nodes[id], c.kvs[id]
+	if !n.up || kv == nil {
+		c.retry(h, op)
+		return
+	}
+
+	deadline := c.sim.clock.now.Add(simClientTimeout)
+	if op.Type == OpGet {
+		n.srv.mu.Lock()
+		index, req, err := n.srv.beginRead()
+		n.srv.mu.Unlock()
+		if err != nil {
+			c.retry(h, op)
+			return
+		}
+		c.poll(h, op, deadline, func() (bool, error) {
+			if req != nil {
+				select {
+				case <-req.done:
+				default:
+					return false, nil
+				}
+				n.srv.mu.Lock()
+				err := n.srv.readConfirmed(req)
+				n.srv.mu.Unlock()
+				if err != nil {
+					return false, err
+				}
+				req = nil
+			}
+			kv.mu.Lock()
+			defer kv.mu.Unlock()
+			if kv.lastApplied < index {
+				return false, nil
+			}
+			(*c.history)[h].output = kv.data[op.Key]
+			return true, nil
+		})
+		return
+	}
+
+	index, ch, err := kv.propose(op)
+	if err != nil {
+		c.retry(h, op)
+		return
+	}
+	c.poll(h, op, deadline, func() (bool, error) {
+		select {
+		case applied := <-ch:
+			kv.forget(index, ch)
+			_, err := checkApplied(op, applied)
+			return err == nil, err
+		default:
+		}
+		if !c.sim.clock.now.Before(deadline) {
+			kv.forget(index, ch)
+		}
+		return false, nil
+	})
+}
+
+// poll checks for the answer every simPollEvery until done says it is in,
+// and moves on to the next server if it fails or does not come by deadline.
+func (c *simClient) poll(h int, op KVOp, deadline time.Time, done func() (bool, error)) {
+	c.sim.after(simPollEvery, func() {
+		ok, err := done()
+		switch {
+		case ok:
+			(*c.history)[h].ret = c.now()
+			c.tried = 0
+			c.sim.after(time.Duration(1+c.sim.rand.Intn(20))*time.Millisecond, c.next)
+		case err != nil || !c.sim.clock.now.Before(deadline):
+			c.retry(h, op)
+		default:
+			c.poll(h, op, deadline, done)
+		}
+	})
+}
+
+// retry tries the next server, backing off once all of them have failed.
+func (c *simClient) retry(h int, op KVOp) {
+	c.leader = (c.leader + 1) % len(c.kvs)
+	wait := simPollEvery
+	if c.tried++; c.tried%len(c.kvs) == 0 {
+		wait = 50 * time.Millisecond
+	}
+	c.sim.after(wait, func() { c.try(h, op) })
+}
+
+// Clients issue random requests while the simulator partitions, crashes and
+// restarts servers and moves leadership around. Whatever the clients saw
+// must be linearizable, with reads confirmed by a heartbeat round or by the
+// leader's lease.
+func TestKVLinearizable(t *testing.T) {
+	for _, mode := range []ReadOnlyOption{ReadOnlySafe, ReadOnlyLeaseBased} {
+		for seed := range int64(10) {
+			sim := newTestSim(seed, 5, 5)
+			sim.dropRate = 0.05
+			sim.readOnly = mode
+			kvs := make([]*KVServer, len(sim.nodes))
+			sim.newApp = func(id int) simApp {
+				kvs[id] = newKVServer(sim.nodes[id].srv, nil)
+				return kvs[id].applyMsg
+			}
+			sim.startAll()
+			sim.every(simChaosEvery, func() {
+				if !sim.healed {
+					sim.chaos()
+				}
+			})
+
+			var history []kvOperation
+			var clients []*simClient
+			for id := range 5 {
+				c := &simClient{id: id, sim: sim, kvs: kvs, leader: id % len(kvs), history: &history}
+				clients = append(clients, c)
+				sim.after(time.Duration(id)*time.Millisecond, c.next)
+			}
+			sim.runFor(4 * time.Second)
+			if sim.err != nil {
+				t.Fatalf("%s reads, seed %d: %v", mode, seed, sim.err)
+			}
+
+			// Heal, and let every client finish what it is doing.
+			sim.healed = true
+			sim.heal()
+			for id, n := range sim.nodes {
+				if !n.up {
+					sim.start(id)
+				}
+			}
+			for _, c := range clients {
+				c.stopped = true
+			}
+			waitFor(t, sim, 10*time.Second, "clients done", func() bool {
+				return !slices.ContainsFunc(clients, func(c *simClient) bool { return c.busy })
+			})
+
+			answered := 0
+			for _, op := range history {
+				if op.ret != math.MaxInt64 {
+					answered++
+				}
+			}
+			if answered < len(history)/2 {
+				t.Fatalf("%s reads, seed %d: only %d of %d requests answered", mode, seed, answered, len(history))
+			}
+			if !linearizable(history) {
+				t.Fatalf("%s reads, seed %d: history is not linearizable:\n%s", mode, seed, formatHistory(history))
+			}
+		}
+	}
+}
+
+func formatHistory(history []kvOperation) string {
+	var b strings.Builder
+	for _, op := range history {
+		fmt.Fprintf(&b, "client%d %v..%v %s %s %q -> %q\n", op.client, time.Duration(op.call), time.Duration(op.ret), op.op.Type, op.op.Key, op.op.Value, op.output)
+	}
+	return b.String()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"log"
+	"slices"
+)
+
+type EntryType string
+
+const (
+	EntryNormal     EntryType = "normal"
+	EntryNoop       EntryType = "noop" // appended by every new leader to commit entries from earlier terms
+	EntryConfChange EntryType = "config"
+)
+
+// maxAppendEntries caps how many entries ride on a single AppendEntries message.
+const maxAppendEntries = 64
+
+type LogEntry struct {
+	Index   int
+	Term    int
+	Type    EntryType
+	Command []byte
+}
+
+// ApplyMsg is delivered on the apply channel for every committed entry, in log
+// order. CommandValid is false for raft's own entries (no-ops and
+// configuration changes); the application only needs their index. When
+// SnapshotValid is set instead, the application must replace its state with
+// Snapshot, which covers every entry up to SnapshotIndex.
+type ApplyMsg struct {
+	CommandValid bool
+	Command      []byte
+	CommandIndex int
+	CommandTerm  int
+
+	SnapshotValid bool
+	Snapshot      []byte
+	SnapshotIndex int
+	SnapshotTerm  int
+}
+
+// The log always starts with a sentinel entry so that index 0 has a term and
+// PrevLogIndex/PrevLogTerm lookups never fall off the front. After a snapshot
+// the sentinel is the snapshot's last included entry.
+
+func (s *server) lastIndex() int {
+	return s.log[len(s.log)-1].Index
+}
+
+func (s *server) lastTerm() int {
+	return s.log[len(s.log)-1].Term
+}
+
+func (s *server) entry(index int) LogEntry {
+	return s.log[index-s.log[0].Index]
+}
+
+func (s *server) termAt(index int) int {
+	return s.entry(index).Term
+}
+
+// isUpToDate reports whether a candidate's log is at least as up-to-date as ours (§5.4.1).
+func (s *server) isUpToDate(lastIndex, lastTerm int) bool {
+	if lastTerm != s.lastTerm() {
+		return lastTerm > s.lastTerm()
+	}
+	return lastIndex >= s.lastIndex()
+}
+
+// Start proposes command for replication. It returns the index the command
+// will occupy if it is ever committed, the current term and whether this
+// server believes it is the leader. There is no guarantee the command will be
+// committed; callers watch the apply channel for it.
+func (s *server) Start(command []byte) (int, int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A leader handing over to another server takes no new proposals.
+	if s.state != Leader || s.transfer != nil {
+		return -1, s.currentTerm, false
+	}
+
+	index := s.appendEntry(EntryNormal, command)
+	s.broadcastAppend()
+	return index, s.currentTerm, true
+}
+
+func (s *server) appendEntry(typ EntryType, command []byte) int {
+	index := s.lastIndex() + 1
+	e := LogEntry{Index: index, Term: s.currentTerm, Type: typ, Command: command}
+	s.persistEntries([]LogEntry{e})
+	s.log = append(s.log, e)
+	if typ == EntryConfChange {
+		s.updateConfig()
+	}
+	s.matchIndex[s.id] = index
+	s.nextIndex[s.id] = index + 1
+	s.maybeCommit()
+	return index
+}
+
+func (s *server) broadcastAppend() {
+	for _, peer := range s.peers {
+		if peer != s.id {
+			s.sendAppend(peer)
+		}
+	}
+}
+
+// sendAppend sends the entries peer is missing, or an empty heartbeat if it is up to date.
+func (s *server) sendAppend(peer int) {
+	prev := s.nextIndex[peer] - 1
+	if prev < s.log[0].Index {
+		s.sendSnapshot(peer)
+		return
+	}
+	last := min(s.lastIndex(), prev+maxAppendEntries)
+
+	entries := make([]LogEntry, last-prev)
+	copy(entries, s.log[prev+1-s.log[0].Index:])
+
+	s.send(Message{
+		Type:         MsgAppendEntries,
+		To:           peer,
+		Term:         s.currentTerm,
+		PrevLogIndex: prev,
+		PrevLogTerm:  s.termAt(prev),
+		Entries:      entries,
+		LeaderCommit: s.commitIndex,
+		Probe:        s.probe,
+	})
+}
+
+func (s *server) handleAppendEntries(m Message) {
+	reply := Message{Type: MsgAppendEntriesResp, To: m.From, Term: s.currentTerm, Probe: m.Probe}
+	if m.Term < s.currentTerm {
+		s.send(reply)
+		return
+	}
+
+	// A valid leader exists for this term, so candidates step down.
+	s.becomeFollower(m.Term)
+	s.leaderID = m.From
+	s.resetElectionTimer()
+
+	// Entries up to our snapshot are committed and so already match; skip them.
+	if base := s.log[0].Index; m.PrevLogIndex < base {
+		m.Entries = m.Entries[min(base-m.PrevLogIndex, len(m.Entries)):]
+		m.PrevLogIndex, m.PrevLogTerm = base, s.log[0].Term
+	}
+
+	// Consistency check: our log must contain an entry at PrevLogIndex whose
+	// term matches PrevLogTerm, otherwise the leader has to back up.
+	if m.PrevLogIndex > s.lastIndex() {
+		reply.ConflictIndex = s.lastIndex() + 1
+		s.send(reply)
+		return
+	}
+	if term := s.termAt(m.PrevLogIndex); term != m.PrevLogTerm {
+		// Skip the whole conflicting term in one round trip instead of one entry at a time.
+		index := m.PrevLogIndex
+		for index > s.commitIndex+1 && s.termAt(index-1) == term {
+			index--
+		}
+		reply.ConflictIndex = index
+		s.send(reply)
+		return
+	}
+
+	// Append any new entries, truncating our log at the first conflict. Entries
+	// we already have are left alone so a stale, reordered message can never
+	// shorten the log.
+	for i, e := range m.Entries {
+		if e.Index > s.lastIndex() || s.termAt(e.Index) != e.Term {
+			s.persistEntries(m.Entries[i:])
+			s.log = append(s.log[:e.Index-s.log[0].Index], m.Entries[i:]...)
+			if s.configIndex >= e.Index || slices.ContainsFunc(m.Entries[i:], isConfChange) {
+				s.updateConfig()
+			}
+			break
+		}
+	}
+
+	lastNew := m.PrevLogIndex + len(m.Entries)
+	s.commitTo(min(m.LeaderCommit, lastNew))
+
+	reply.Success = true
+	reply.MatchIndex = lastNew
+	s.send(reply)
+}
+
+func (s *server) handleAppendEntriesResp(m Message) {
+	if s.state != Leader || m.Term != s.currentTerm {
+		return
+	}
+	s.lastActive[m.From] = s.clock.Now()
+	s.handleProbeAck(m.From, m.Probe)
+
+	if m.Success {
+		if m.MatchIndex > s.matchIndex[m.From] {
+			s.matchIndex[m.From] = m.MatchIndex
+			s.nextIndex[m.From] = m.MatchIndex + 1
+			s.maybeCommit()
+			s.maybeSendTimeoutNow()
+		}
+		if s.nextIndex[m.From] <= s.lastIndex() {
+			s.sendAppend(m.From)
+		}
+		return
+	}
+
+	// Ignore rejections that arrive after we already moved past them.
+	if m.ConflictIndex < s.nextIndex[m.From] {
+		s.nextIndex[m.From] = max(m.ConflictIndex, s.matchIndex[m.From]+1)
+		s.sendAppend(m.From)
+	}
+}
+
+// maybeCommit advances commitIndex to the highest index replicated on a
+// majority. Only entries from the current term are committed by counting
+// replicas (§5.4.2); earlier entries are committed indirectly.
+func (s *server) maybeCommit() {
+	for n := s.lastIndex(); n > s.commitIndex && s.termAt(n) == s.currentTerm; n-- {
+		count := 0
+		for _, peer := range s.peers {
+			if s.matchIndex[peer] >= n {
+				count++
+			}
+		}
+		if count >= s.quorum() {
+			s.commitTo(n)
+			return
+		}
+	}
+}
+
+// commitTo advances commitIndex to index and wakes the applier. It never
+// moves commitIndex back; a stale message may well know of less.
+func (s *server) commitTo(index int) {
+	if index <= s.commitIndex {
+		return
+	}
+	s.commitIndex = index
+	s.applyCond.Broadcast()
+	s.emit(EventCommit)
+}
+
+func isConfChange(e LogEntry) bool {
+	return e.Type == EntryConfChange
+}
+
+func (s *server) persistEntries(entries []LogEntry) {
+	if err := s.storage.Append(entries); err != nil {
+		log.Fatalf("server%d failed to persist its log: %v", s.id, err)
+	}
+}
+
+// applier delivers committed entries on applyCh in log order. It runs in its
+// own goroutine so a slow consumer never holds up the raft state machine.
+func (s *server) applier() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.dead {
+		if s.lastApplied >= s.commitIndex && !s.snapshotPending {
+			s.applyCond.Wait()
+			continue
+		}
+
+		msgs := s.takeCommitted()
+
+		s.mu.Unlock()
+		for _, msg := range msgs {
+			s.applyCh <- msg
+		}
+		s.mu.Lock()
+	}
+}
+
+// takeCommitted marks every committed entry as applied and returns them.
+func (s *server) takeCommitted() []ApplyMsg {
+	var msgs []ApplyMsg
+	if s.snapshotPending {
+		s.snapshotPending = false
+		s.lastApplied = s.snapshot.LastIncludedIndex
+		msgs = append(msgs, ApplyMsg{
+			SnapshotValid: true,
+			Snapshot:      s.snapshot.Data,
+			SnapshotIndex: s.snapshot.LastIncludedIndex,
+			SnapshotTerm:  s.snapshot.LastIncludedTerm,
+		})
+	}
+	for s.lastApplied < s.commitIndex {
+		s.lastApplied++
+		e := s.entry(s.lastApplied)
+		msgs = append(msgs, ApplyMsg{
+			CommandValid: e.Type == EntryNormal,
+			Command:      e.Command,
+			CommandIndex: e.Index,
+			CommandTerm:  e.Term,
+		})
+	}
+	return msgs
+}
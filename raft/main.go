@@ -1,150 +1,804 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"math/rand"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
-var servers []*server = []*server{
-	{id: 0, currentTerm: 0, state: Follower},
-	{id: 1, currentTerm: 0, state: Follower},
-	{id: 2, currentTerm: 0, state: Follower},
-	{id: 3, currentTerm: 0, state: Follower},
-	{id: 4, currentTerm: 0, state: Follower},
-}
-
 type server struct {
-	id            int
-	currentTerm   int
-	votedFor      int
-	votesReceived int
+	id          int
+	peers       []int // current configuration: every member of the cluster, possibly including this one
+	configIndex int   // index of the entry that introduced peers
+	trans       Transport
+	storage     Storage
+	clock       Clock
+	rand        *rand.Rand // election timeouts; seeded by the simulator so runs replay
+
+	// Persistent state on all servers
+	currentTerm int
+	votedFor    int
+	log         []LogEntry
+
+	// Volatile state on all servers
+	commitIndex int
+	lastApplied int
+	leaderID    int
+
+	// Snapshot state
+	snapshot        Snapshot
+	snapshotPending bool              // snapshot not yet handed to the application
+	incoming        *incomingSnapshot // follower: snapshot being received in chunks
+
+	// Volatile state on leaders, reinitialized after each election
+	nextIndex      map[int]int
+	matchIndex     map[int]int
+	snapshotOffset map[int]int // peers currently being sent a snapshot, and the next chunk offset
 
 	state string
-	mu    sync.Mutex
+	votes map[int]bool // pre-votes or votes received in the current round
+
+	lastHeard       time.Time // last time we heard from the leader or granted a vote
+	electionTimeout time.Duration
+	lastHeartbeat   time.Time
+
+	// CheckQuorum: when a leader last heard from each member
+	lastActive map[int]time.Time
+
+	// Linearizable reads
+	readOnly     ReadOnlyOption
+	probe        int
+	probeSent    map[int]time.Time // when each unconfirmed probe was sent
+	probeAcked   map[int]int       // highest probe each peer acknowledged
+	pendingReads []*readRequest
+
+	transfer *leaderTransfer // leadership handover in progress, if any
+
+	// Observability
+	subscribers  []chan Event
+	metrics      Metrics               // counters only; Metrics() fills in the gauges
+	heartbeatRTT map[int]time.Duration // leader: latest heartbeat round trip per peer
+
+	applyCh   chan ApplyMsg
+	applyCond *sync.Cond
+	mu        sync.Mutex
+	dead      bool
 }
 
 const (
-	Follower  string = "follower"
-	Leader    string = "leader"
-	Candidate string = "candidate"
+	Follower     string = "follower"
+	Leader       string = "leader"
+	Candidate    string = "candidate"
+	PreCandidate string = "pre-candidate"
 )
 
-func (s *server) run() {
-	for {
-		switch s.state {
-		case Leader:
-			s.leader()
-		case Follower:
-			s.follower()
-		case Candidate:
-			s.candidate()
+const (
+	tickInterval      = 10 * time.Millisecond
+	heartbeatInterval = 50 * time.Millisecond
+	snapshotEvery     = 5 // entries the demo application applies between snapshots
+
+	// The election timeout is randomized between these bounds.
+	minElectionTimeout = 150 * time.Millisecond
+	maxElectionTimeout = 450 * time.Millisecond
+
+	// A leader that has not heard from a majority for checkQuorumInterval
+	// steps down. Members answer every heartbeat, so an isolated leader steps
+	// down within checkQuorumInterval plus a heartbeat round, less than
+	// maxElectionTimeout.
+	checkQuorumInterval = 2 * minElectionTimeout
+)
+
+// newServer creates a server, restoring whatever storage recorded before a
+// crash. peers is the configuration the cluster was bootstrapped with; it is
+// only used until the log or a snapshot says otherwise. A server joining an
+// existing cluster is started with no peers and learns the configuration from
+// the leader once it has been added.
+func newServer(id int, peers []int, trans Transport, storage Storage, applyCh chan ApplyMsg) *server {
+	term, votedFor, entries, err := storage.Load()
+	if err != nil {
+		log.Fatalf("server%d failed to load its state: %v", id, err)
+	}
+	snap, err := storage.LoadSnapshot()
+	if err != nil {
+		log.Fatalf("server%d failed to load its snapshot: %v", id, err)
+	}
+
+	s := &server{
+		id:             id,
+		trans:          trans,
+		storage:        storage,
+		clock:          realClock{},
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano() + int64(id))),
+		readOnly:       ReadOnlySafe,
+		currentTerm:    term,
+		votedFor:       votedFor,
+		log:            []LogEntry{{Index: snap.LastIncludedIndex, Term: snap.LastIncludedTerm}},
+		commitIndex:    snap.LastIncludedIndex,
+		snapshot:       snap,
+		leaderID:       -1,
+		nextIndex:      make(map[int]int),
+		matchIndex:     make(map[int]int),
+		snapshotOffset: make(map[int]int),
+		state:          Follower,
+		applyCh:        applyCh,
+	}
+	// Entries past the snapshot only belong to it if the log agrees with the
+	// snapshot at its last index. A crash halfway through installing a
+	// snapshot from the leader can leave stale ones behind.
+	matched := snap.LastIncludedIndex == 0
+	for _, e := range entries {
+		if e.Index == snap.LastIncludedIndex {
+			matched = e.Term == snap.LastIncludedTerm
+		}
+		if e.Index > snap.LastIncludedIndex && matched {
+			s.log = append(s.log, e)
 		}
 	}
+	if snap.LastIncludedIndex == 0 {
+		s.snapshot.Peers = peers
+	}
+	s.updateConfig()
+
+	// The application starts empty, so it has to be handed the snapshot first.
+	s.snapshotPending = snap.LastIncludedIndex > 0
+	s.applyCond = sync.NewCond(&s.mu)
+	s.resetElectionTimer()
+	return s
 }
 
-func (s *server) follower() {
+func (s *server) run() {
 	log.Printf("server%d is a follower\n", s.id)
-	timeout := time.Duration(rand.Intn(300)+150) * time.Millisecond
-	ticker := time.NewTicker(timeout)
+	go s.applier()
+
+	ticker := time.NewTicker(tickInterval)
 	defer ticker.Stop()
 
-	for {
-		select {
-		case <-ticker.C:
-			s.mu.Lock()
-			s.state = Candidate
-			s.mu.Unlock()
-			return // IMPORTANT
+	for range ticker.C {
+		if s.killed() {
+			return
 		}
+		s.tick()
 	}
 }
 
-func (s *server) leader() {
-	log.Printf("server%d is the leader for term %d\n", s.id, s.currentTerm)
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+// Kill stops the server as if it crashed. Only what is in storage survives.
+func (s *server) Kill() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dead = true
+	s.applyCond.Broadcast()
+	for _, ch := range s.subscribers {
+		close(ch)
+	}
+	s.subscribers = nil
+}
 
+func (s *server) killed() bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	i := 0
-	for i < 5 {
-		select {
-		case <-ticker.C:
-			s.sendHeartBeats()
-			i++
+	return s.dead
+}
+
+func (s *server) tick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dead {
+		return
+	}
+
+	switch s.state {
+	case Leader:
+		s.leader()
+	case Follower:
+		s.follower()
+	case Candidate, PreCandidate:
+		s.candidate()
+	}
+}
+
+// GetState returns the current term and whether this server believes it is the leader.
+func (s *server) GetState() (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.currentTerm, s.state == Leader
+}
+
+func (s *server) follower() {
+	// Servers outside the configuration never start elections.
+	if !s.isMember() {
+		s.resetElectionTimer()
+		return
+	}
+	if s.clock.Now().Sub(s.lastHeard) >= s.electionTimeout {
+		s.preCampaign()
+	}
+}
+
+func (s *server) candidate() {
+	if !s.isMember() {
+		s.becomeFollower(s.currentTerm)
+		return
+	}
+	// Split vote, or no majority reachable: try again.
+	if s.clock.Now().Sub(s.lastHeard) >= s.electionTimeout {
+		s.preCampaign()
+	}
+}
+
+func (s *server) leader() {
+	// A leader that removed itself hands over once the change is committed.
+	if !s.isMember() && s.commitIndex >= s.configIndex {
+		log.Printf("server%d is no longer a member and steps down\n", s.id)
+		s.becomeFollower(s.currentTerm)
+		return
+	}
+
+	// CheckQuorum: a leader cut off from the majority steps down instead of
+	// carrying on, unaware that the rest of the cluster has moved on.
+	active := map[int]bool{s.id: true}
+	for peer, heard := range s.lastActive {
+		if s.clock.Now().Sub(heard) < checkQuorumInterval {
+			active[peer] = true
 		}
 	}
+	if !s.hasQuorum(active) {
+		log.Printf("server%d lost contact with a majority and steps down\n", s.id)
+		s.becomeFollower(s.currentTerm)
+		return
+	}
+
+	s.checkTransfer()
+
+	if s.clock.Now().Sub(s.lastHeartbeat) >= heartbeatInterval {
+		s.sendHeartBeats()
+	}
 }
 
 // send heart beats to all your followers
 func (s *server) sendHeartBeats() {
-	var wg sync.WaitGroup
-	for i := 0; i < 5; i++ {
-		if i != s.id {
-			wg.Add(1)
-			go func(i int) {
-				defer wg.Done()
-				log.Printf("Leader server%d sending heartbeat to server%d\n", s.id, i)
-			}(i)
+	s.lastHeartbeat = s.clock.Now()
+	s.newProbe()
+	s.broadcastAppend()
+}
+
+func (s *server) resetElectionTimer() {
+	s.lastHeard = s.clock.Now()
+	s.electionTimeout = minElectionTimeout + time.Duration(s.rand.Intn(int((maxElectionTimeout-minElectionTimeout)/time.Millisecond)))*time.Millisecond
+}
+
+func (s *server) hasLiveLeader() bool {
+	if s.state == Leader {
+		return true
+	}
+	return s.leaderID != -1 && s.clock.Now().Sub(s.lastHeard) < minElectionTimeout
+}
+
+func (s *server) quorum() int {
+	return len(s.peers)/2 + 1
+}
+
+// hasQuorum reports whether the servers in set form a majority of the current configuration.
+func (s *server) hasQuorum(set map[int]bool) bool {
+	count := 0
+	for _, peer := range s.peers {
+		if set[peer] {
+			count++
 		}
 	}
-	wg.Wait()
+	return count >= s.quorum()
 }
 
-func (s *server) candidate() {
-	log.Printf("server%d is now a candidate and attempting an election for term %d\n", s.id, s.currentTerm+1)
+// persistState saves currentTerm and votedFor. It must run before any
+// message that depends on them leaves this server, or a restart could vote
+// twice in the same term.
+func (s *server) persistState() {
+	if err := s.storage.SaveState(s.currentTerm, s.votedFor); err != nil {
+		log.Fatalf("server%d failed to persist its state: %v", s.id, err)
+	}
+}
 
-	s.mu.Lock()
+func (s *server) becomeFollower(term int) {
+	newTerm := term > s.currentTerm
+	if newTerm {
+		s.currentTerm = term
+		s.votedFor = -1
+		s.leaderID = -1
+		s.persistState()
+		s.emit(EventTermChange)
+	}
+	if s.state == Leader {
+		// Give the next leader a full timeout to make itself known.
+		s.resetElectionTimer()
+		s.failPendingReads()
+		// Stepping down for a newer term is what a successful transfer looks like.
+		if newTerm {
+			s.finishTransfer(nil)
+		} else {
+			s.finishTransfer(errNotLeader)
+		}
+	}
+	if s.state != Follower {
+		s.state = Follower
+		log.Printf("server%d is a follower\n", s.id)
+		s.emit(EventRoleChange)
+	}
+}
+
+// preCampaign asks the cluster whether we could win an election before
+// actually starting one (§9.6 of the Raft thesis). Nothing changes on any
+// server during a pre-vote, so a server that was partitioned away can keep
+// timing out without inflating its term, and it cannot depose a healthy
+// leader when it rejoins.
+func (s *server) preCampaign() {
+	wasPreCandidate := s.state == PreCandidate
+	s.state = PreCandidate
+	s.votes = map[int]bool{s.id: true}
+	s.leaderID = -1
+	s.resetElectionTimer()
+	log.Printf("server%d is a pre-candidate checking whether it could win term %d\n", s.id, s.currentTerm+1)
+	if !wasPreCandidate {
+		s.emit(EventRoleChange)
+	}
+
+	if s.hasQuorum(s.votes) {
+		s.campaign(false)
+		return
+	}
+
+	for _, peer := range s.peers {
+		if peer != s.id {
+			s.send(Message{
+				Type:         MsgPreVote,
+				To:           peer,
+				Term:         s.currentTerm + 1,
+				LastLogIndex: s.lastIndex(),
+				LastLogTerm:  s.lastTerm(),
+			})
+		}
+	}
+}
+
+func (s *server) handlePreVote(m Message) {
+	// Unlike a real vote, a pre-vote neither bumps our term nor records who we voted for.
+	grant := m.Term > s.currentTerm &&
+		!s.hasLiveLeader() &&
+		s.isUpToDate(m.LastLogIndex, m.LastLogTerm)
+
+	reply := Message{Type: MsgPreVoteResp, To: m.From, Term: s.currentTerm, VoteGranted: grant}
+	if grant {
+		// Echo the candidate's future term so the response is not mistaken for a stale one.
+		reply.Term = m.Term
+	}
+	s.send(reply)
+}
+
+func (s *server) handlePreVoteResp(m Message) {
+	if s.state != PreCandidate || m.Term != s.currentTerm+1 || !m.VoteGranted {
+		return
+	}
+
+	s.votes[m.From] = true
+	if s.hasQuorum(s.votes) {
+		s.campaign(false)
+	}
+}
+
+// campaign starts an election for the next term. transfer marks the votes as
+// requested by the leader, so voters grant them even though they still hear
+// from that leader.
+func (s *server) campaign(transfer bool) {
+	s.state = Candidate
 	s.currentTerm++
 	s.votedFor = s.id
-	s.votesReceived = 1 // Reset vote to 1 for each term
-	s.mu.Unlock()
+	s.votes = map[int]bool{s.id: true} // Reset votes for each term
+	s.leaderID = -1
+	s.persistState()
+	s.resetElectionTimer()
+	log.Printf("server%d is now a candidate and attempting an election for term %d\n", s.id, s.currentTerm)
+	s.metrics.ElectionsStarted++
+	s.emit(EventTermChange)
+	s.emit(EventRoleChange)
 
-	var wg sync.WaitGroup
-	for i := 0; i < 5; i++ {
-		if i != s.id {
-			wg.Add(1)
-			go func(i int) {
-				defer wg.Done()
-				if s.requestVote(i) {
-					s.mu.Lock()
-					s.votesReceived++
-					s.mu.Unlock()
-				}
-			}(i)
+	if s.hasQuorum(s.votes) {
+		s.becomeLeader()
+		return
+	}
+
+	for _, peer := range s.peers {
+		if peer != s.id {
+			s.send(Message{
+				Type:         MsgRequestVote,
+				To:           peer,
+				Term:         s.currentTerm,
+				LastLogIndex: s.lastIndex(),
+				LastLogTerm:  s.lastTerm(),
+				Transfer:     transfer,
+			})
 		}
 	}
+}
+
+func (s *server) becomeLeader() {
+	log.Printf("server%d WON the election and is now the leader for term %d\n", s.id, s.currentTerm)
+	s.state = Leader
+	s.leaderID = s.id
+	s.snapshotOffset = make(map[int]int)
+	s.lastActive = make(map[int]time.Time)
+	s.probeSent = make(map[int]time.Time)
+	s.probeAcked = make(map[int]int)
+	s.heartbeatRTT = make(map[int]time.Duration)
+	s.metrics.ElectionsWon++
+	s.emit(EventRoleChange)
+	for _, peer := range s.peers {
+		s.nextIndex[peer] = s.lastIndex() + 1
+		s.matchIndex[peer] = 0
+		// Give every member a full interval to answer the first heartbeat.
+		s.lastActive[peer] = s.clock.Now()
+	}
 
-	wg.Wait()
+	// A no-op entry from the new term lets the leader commit everything it inherited.
+	s.appendEntry(EntryNoop, nil)
+	s.sendHeartBeats()
+}
 
+// Step processes a message received from a peer.
+func (s *server) Step(m Message) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.votesReceived > 2 {
-		log.Printf("server%d WON the election and is now the leader for term %d\n", s.id, s.currentTerm)
-		s.state = Leader
-	} else {
-		s.state = Follower
+	if s.dead {
+		return
+	}
+
+	// A server removed from the configuration no longer hears from the
+	// leader, times out and campaigns with ever higher terms. While we still
+	// have a live leader, such votes are ignored outright rather than let the
+	// higher term depose it (§4.2.3 of the Raft thesis).
+	if m.Type == MsgRequestVote && !m.Transfer && m.Term > s.currentTerm && s.hasLiveLeader() {
+		return
+	}
+
+	switch {
+	case m.Type == MsgPreVote:
+		// Pre-votes carry the term the sender would campaign in; they never change ours.
+	case m.Type == MsgPreVoteResp && m.VoteGranted:
+		// A granted pre-vote echoes our own future term.
+	case m.Term > s.currentTerm:
+		// Any other message from a newer term means we are out of date.
+		s.becomeFollower(m.Term)
 	}
 
+	switch m.Type {
+	case MsgPreVote:
+		s.handlePreVote(m)
+	case MsgPreVoteResp:
+		s.handlePreVoteResp(m)
+	case MsgRequestVote:
+		s.handleRequestVote(m)
+	case MsgRequestVoteResp:
+		s.handleRequestVoteResp(m)
+	case MsgAppendEntries:
+		s.handleAppendEntries(m)
+	case MsgAppendEntriesResp:
+		s.handleAppendEntriesResp(m)
+	case MsgInstallSnapshot:
+		s.handleInstallSnapshot(m)
+	case MsgInstallSnapshotResp:
+		s.handleInstallSnapshotResp(m)
+	case MsgTimeoutNow:
+		s.handleTimeoutNow(m)
+	}
+}
+
+func (s *server) handleRequestVote(m Message) {
+	grant := m.Term == s.currentTerm &&
+		(s.votedFor == -1 || s.votedFor == m.From) &&
+		s.isUpToDate(m.LastLogIndex, m.LastLogTerm)
+
+	if grant {
+		s.votedFor = m.From
+		s.persistState()
+		s.resetElectionTimer()
+		s.emit(EventVote)
+	}
+
+	s.send(Message{Type: MsgRequestVoteResp, To: m.From, Term: s.currentTerm, VoteGranted: grant})
 }
 
-func (s *server) requestVote(i int) bool {
-	voter := servers[i]
-	voter.mu.Lock()
-	voter.currentTerm++
-	voter.mu.Unlock()
+func (s *server) handleRequestVoteResp(m Message) {
+	if s.state != Candidate || m.Term != s.currentTerm || !m.VoteGranted {
+		return
+	}
+
+	s.votes[m.From] = true
+	if s.hasQuorum(s.votes) {
+		s.becomeLeader()
+	}
+}
 
-	return rand.Intn(2) == 0
+func (s *server) send(m Message) {
+	m.From = s.id
+	s.trans.Send(m)
 }
 
 func main() {
+	transport := flag.String("transport", "mem", "how servers talk to each other: mem or tcp")
+	dataDir := flag.String("data", "", "directory to persist raft state in; state is kept in memory if empty")
+	kvDemo := flag.Bool("kv", false, "run clients against a replicated key-value store instead")
+	readOnly := flag.String("read", string(ReadOnlySafe), "how the key-value store confirms reads: safe or lease")
+	sims := flag.Int("sim", 0, "run this many deterministic simulations instead, checking raft's safety invariants")
+	seed := flag.Int64("seed", 1, "first seed to simulate")
+	statusPort := flag.Int("status", 8000, "serve each server's HTTP API on this port plus its id; 0 disables")
+	nodeID := flag.Int("id", -1, "run only this server, talking to the others over TCP; requires -peers")
+	peerAddrs := flag.String("peers", "", "with -id, every server in the cluster as id=host:port,...")
+	gossipPort := flag.Int("gossip", 0, "with -id, track which servers are up with SWIM over UDP on this port plus their ids; 0 disables")
+	removeAfter := flag.Duration("reconfigure", 0, "with -gossip, have the leader remove servers the group has been without this long, never below -peers, and add them back when they rejoin; 0 leaves the configuration alone")
+	flag.Parse()
+
+	if *nodeID >= 0 {
+		runNode(*nodeID, *peerAddrs, *dataDir, *statusPort, *gossipPort, *removeAfter)
+		return
+	}
+
+	if *sims > 0 {
+		runSimulations(*sims, *seed)
+		return
+	}
+
+	if *kvDemo {
+		runKVDemo(ReadOnlyOption(*readOnly))
+		return
+	}
+
+	// Servers 3 and 4 start outside the cluster and are added and later
+	// removed again, growing it from three to five members and back.
+	peers := []int{0, 1, 2, 3, 4}
+	bootstrap := []int{0, 1, 2}
+	network := newMemNetwork()
+	addrs := make(map[int]string)
+	for _, id := range peers {
+		addrs[id] = fmt.Sprintf("127.0.0.1:%d", 7000+id)
+	}
+
+	storages := make(map[int]Storage)
+	for _, id := range peers {
+		if *dataDir == "" {
+			storages[id] = newMemStorage()
+			continue
+		}
+		fs, err := newFileStorage(filepath.Join(*dataDir, fmt.Sprintf("server%d", id)))
+		if err != nil {
+			log.Fatal(err)
+		}
+		storages[id] = fs
+	}
+
+	// start boots server id from whatever its storage holds, which is how a
+	// crashed server comes back.
+	start := func(id int) *server {
+		applyCh := make(chan ApplyMsg)
 
-	for _, srv := range servers {
+		var initial []int
+		if slices.Contains(bootstrap, id) {
+			initial = bootstrap
+		}
+
+		var srv *server
+		switch *transport {
+		case "mem":
+			srv = newServer(id, initial, network.Transport(id), storages[id], applyCh)
+			network.Register(id, srv.Step)
+		case "tcp":
+			trans := newTCPTransport(id, addrs)
+			srv = newServer(id, initial, trans, storages[id], applyCh)
+			if err := trans.Serve(srv.Step); err != nil {
+				log.Fatal(err)
+			}
+		default:
+			log.Fatalf("unknown transport %q", *transport)
+		}
+
+		go countValues(srv, applyCh)
 		go srv.run()
+		return srv
+	}
+
+	var serversMu sync.Mutex // the HTTP handlers read servers while restarts replace them
+	servers := make([]*server, len(peers))
+	for _, id := range peers {
+		servers[id] = start(id)
+	}
+
+	if *statusPort > 0 {
+		for _, id := range peers {
+			addr := fmt.Sprintf("127.0.0.1:%d", *statusPort+id)
+			handler := newHTTPHandler(func() *server {
+				serversMu.Lock()
+				defer serversMu.Unlock()
+				return servers[id]
+			})
+			go func() {
+				log.Printf("HTTP API on %s stopped: %v\n", addr, http.ListenAndServe(addr, handler))
+			}()
+		}
+	}
+
+	changes := []struct {
+		add bool
+		id  int
+	}{{true, 3}, {true, 4}, {false, 4}, {false, 3}}
+
+	// Keep proposing values to whichever server currently leads, and work
+	// through the membership changes. Every few seconds the leader hands
+	// leadership to another member. With the in-memory network the leader is
+	// also cut off every few seconds and healed again, and now and then a
+	// follower crashes and restarts, so the log has to survive leader changes,
+	// restarts and reconfiguration.
+	for i := 1; ; i++ {
+		time.Sleep(1 * time.Second)
+		for _, srv := range servers {
+			if _, isLeader := srv.GetState(); isLeader {
+				srv.Start([]byte(fmt.Sprintf("value-%d", i)))
+
+				if len(changes) > 0 && i%3 == 0 {
+					change := changes[0]
+					var err error
+					if change.add {
+						_, err = srv.AddServer(change.id)
+					} else {
+						_, err = srv.RemoveServer(change.id)
+					}
+					if err == nil {
+						changes = changes[1:]
+					}
+				}
+
+				if others := without(srv.Members(), srv.id); i%5 == 4 && len(others) > 0 {
+					leader, target := srv, others[i%len(others)]
+					go func() {
+						if err := leader.TransferLeadership(target); err != nil {
+							log.Printf("server%d could not hand leadership to server%d: %v\n", leader.id, target, err)
+						}
+					}()
+				}
+
+				if *transport == "mem" && i%5 == 0 {
+					log.Printf("partitioning server%d away from the cluster\n", srv.id)
+					network.Partition(without(peers, srv.id))
+				}
+				if *transport == "mem" && i%10 == 7 {
+					victim := servers[(srv.id+1)%len(servers)]
+					log.Printf("crashing and restarting server%d\n", victim.id)
+					victim.Kill()
+					restarted := start(victim.id)
+					serversMu.Lock()
+					servers[victim.id] = restarted
+					serversMu.Unlock()
+				}
+				break
+			}
+		}
+		if *transport == "mem" && i%5 == 2 {
+			log.Println("healing the network")
+			network.Heal()
+		}
 	}
+}
 
-	select {}
+// countValues is the demo application. It only remembers how many values it
+// has seen, and snapshots that count every few entries so followers that fall
+// far behind catch up by snapshot.
+func countValues(srv *server, applyCh chan ApplyMsg) {
+	applied := 0
+	for msg := range applyCh {
+		if msg.SnapshotValid {
+			applied, _ = strconv.Atoi(string(msg.Snapshot))
+			log.Printf("server%d restored snapshot at index %d: %d values\n", srv.id, msg.SnapshotIndex, applied)
+			continue
+		}
+		if !msg.CommandValid {
+			continue
+		}
+
+		applied++
+		log.Printf("server%d applied index %d: %s\n", srv.id, msg.CommandIndex, msg.Command)
+		if applied%snapshotEvery == 0 {
+			srv.Snapshot(msg.CommandIndex, []byte(strconv.Itoa(applied)))
+		}
+	}
+}
+
+// runKVDemo has a few clients append to shared keys on a three server KV
+// store while the network keeps partitioning the leader away, then checks
+// that every append landed exactly once and in order, and that no client ever
+// read back a value missing its own earlier appends.
+func runKVDemo(readOnly ReadOnlyOption) {
+	peers := []int{0, 1, 2}
+	network := newMemNetwork()
+	network.SetUnreliable(0.05, 0, 10*time.Millisecond)
+
+	var kvs []*KVServer
+	var servers []*server
+	for _, id := range peers {
+		applyCh := make(chan ApplyMsg)
+		srv := newServer(id, peers, network.Transport(id), newMemStorage(), applyCh)
+		srv.readOnly = readOnly
+		network.Register(id, srv.Step)
+		kvs = append(kvs, newKVServer(srv, applyCh))
+		servers = append(servers, srv)
+		go srv.run()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(500 * time.Millisecond):
+			}
+			for _, srv := range servers {
+				if _, isLeader := srv.GetState(); isLeader {
+					log.Printf("partitioning server%d away from the cluster\n", srv.id)
+					network.Partition(without(peers, srv.id))
+					break
+				}
+			}
+			time.Sleep(500 * time.Millisecond)
+			network.Heal()
+		}
+	}()
+
+	const clients, appends = 3, 100
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			ck := newClerk(kvs)
+			for i := 0; i < appends; i++ {
+				elem := fmt.Sprintf("[%d.%d]", c, i)
+				ck.Append("log", elem)
+				if i%10 == 0 && !strings.Contains(ck.Get("log"), elem) {
+					log.Fatalf("client%d read a stale value missing %s", c, elem)
+				}
+			}
+			ck.Put(fmt.Sprintf("client%d", c), "done")
+		}(c)
+	}
+	wg.Wait()
+	close(done)
+
+	value := newClerk(kvs).Get("log")
+	for c := 0; c < clients; c++ {
+		last := -1
+		for i := 0; i < appends; i++ {
+			elem := fmt.Sprintf("[%d.%d]", c, i)
+			pos := strings.Index(value, elem)
+			if pos < 0 || strings.Count(value, elem) != 1 || pos < last {
+				log.Fatalf("append %s missing, duplicated or out of order in %q", elem, value)
+			}
+			last = pos
+		}
+	}
+	log.Printf("all %d appends applied exactly once and in order\n", clients*appends)
+}
+
+func without(ids []int, id int) []int {
+	var rest []int
+	for _, other := range ids {
+		if other != id {
+			rest = append(rest, other)
+		}
+	}
+	return rest
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"time"
+
+	"membership"
+)
+
+// reconfigure says how a leader following a SWIM group may change the
+// cluster's configuration to match it.
+type reconfigure struct {
+	// bootstrap is the cluster's initial configuration. Nothing changes
+	// until the group has seen every one of these servers up at least
+	// once, so that servers started one at a time are not removed before
+	// they come up, and the configuration never shrinks below as many
+	// servers.
+	bootstrap []int
+	// removeAfter is how long the group must have been without a member
+	// before it is removed, so that one that restarts or is briefly cut off
+	// keeps its place.
+	removeAfter time.Duration
+}
+
+// followMembership has srv, whenever it leads, keep the cluster's
+// configuration in step with the SWIM group ml belongs to, as far as opts
+// allows: a server that has been gone from the group for opts.removeAfter is
+// removed, so that it no longer counts towards a quorum, and one that joins
+// is added. idOf gives the id of the server at a member's address, or false
+// for a member that is not one. Changes are proposed one at a time, as each
+// commits, and retried every heartbeat while another change is in flight or
+// srv does not lead. It runs until ml stops or srv is killed.
+func followMembership(srv *server, ml *membership.Memberlist, idOf func(addr string) (int, bool), opts reconfigure) {
+	events := ml.Subscribe()
+	r := &reconciler{srv: srv, opts: opts, seen: make(map[int]bool), gone: make(map[int]time.Time)}
+	go func() {
+		defer ml.Unsubscribe(events)
+		retry := time.NewTicker(heartbeatInterval)
+		defer retry.Stop()
+		for !srv.killed() {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					return
+				}
+			case <-retry.C:
+			}
+
+			up := []int{srv.id}
+			for _, m := range ml.Members() {
+				if id, ok := idOf(m.Addr); ok {
+					up = append(up, id)
+				}
+			}
+			r.observe(up, time.Now())
+			r.reconcile(time.Now())
+		}
+	}()
+}
+
+// reconciler is what followMembership knows of the group's history.
+type reconciler struct {
+	srv  *server
+	opts reconfigure
+
+	seen map[int]bool      // servers the group has had up at some point
+	up   []int             // servers the group has up now
+	gone map[int]time.Time // since when each member of the configuration that is not up has been gone
+}
+
+// observe records that the servers in up were the group's members at now.
+func (r *reconciler) observe(up []int, now time.Time) {
+	r.up = up
+	for _, id := range up {
+		r.seen[id] = true
+		delete(r.gone, id)
+	}
+	for _, id := range r.srv.Members() {
+		if _, ok := r.gone[id]; !ok && !slices.Contains(up, id) {
+			r.gone[id] = now
+		}
+	}
+}
+
+// reconcile proposes the first change that brings srv's configuration
+// closer to the group, if srv leads: removing a member that has been gone
+// for long enough, or else adding one that is up and not a member.
+func (r *reconciler) reconcile(now time.Time) {
+	if _, isLeader := r.srv.GetState(); !isLeader {
+		return
+	}
+	for _, id := range r.opts.bootstrap {
+		if !r.seen[id] {
+			return
+		}
+	}
+	members := r.srv.Members()
+	if len(members) > len(r.opts.bootstrap) {
+		for _, id := range members {
+			since, ok := r.gone[id]
+			if !ok || now.Sub(since) < r.opts.removeAfter {
+				continue
+			}
+			if _, err := r.srv.RemoveServer(id); err == nil {
+				log.Printf("server%d removing server%d, which the membership has not seen for %v\n", r.srv.id, id, now.Sub(since).Round(time.Millisecond))
+			}
+			return
+		}
+	}
+	for _, id := range r.up {
+		if !slices.Contains(members, id) {
+			if _, err := r.srv.AddServer(id); err == nil {
+				log.Printf("server%d adding server%d, which the membership saw join\n", r.srv.id, id)
+			}
+			return
+		}
+	}
+}
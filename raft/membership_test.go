@@ -0,0 +1,205 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"membership"
+)
+
+// gossipCluster is servers that follow a SWIM group over in-memory
+// networks, started one at a time.
+type gossipCluster struct {
+	t       *testing.T
+	network *memNetwork
+	group   *membership.MemNetwork
+	opts    reconfigure
+
+	mu       sync.Mutex
+	servers  map[int]*server
+	members  map[int]*membership.Memberlist
+	storages map[int]Storage
+}
+
+func newGossipCluster(t *testing.T, opts reconfigure) *gossipCluster {
+	return &gossipCluster{
+		t:        t,
+		network:  newMemNetwork(),
+		group:    membership.NewMemNetwork(1),
+		opts:     opts,
+		servers:  make(map[int]*server),
+		members:  make(map[int]*membership.Memberlist),
+		storages: make(map[int]Storage),
+	}
+}
+
+// start starts server id with the initial configuration peers, and a member
+// of the group that joins it through seeds. A server that ran before
+// restarts with what it had on disk.
+func (c *gossipCluster) start(id int, peers []int, seeds ...string) {
+	c.mu.Lock()
+	storage, ok := c.storages[id]
+	if !ok {
+		storage = newMemStorage()
+		c.storages[id] = storage
+	}
+	c.mu.Unlock()
+
+	applyCh := make(chan ApplyMsg)
+	srv := newServer(id, peers, c.network.Transport(id), storage, applyCh)
+	c.network.Register(id, srv.Step)
+	go func() {
+		for range applyCh {
+		}
+	}()
+	go srv.run()
+	c.t.Cleanup(srv.Kill)
+
+	name := strconv.Itoa(id)
+	cfg := membership.DefaultConfig(name)
+	cfg.ProbeInterval = 10 * time.Millisecond
+	cfg.ProbeTimeout = 4 * time.Millisecond
+	cfg.SuspicionTimeout = 100 * time.Millisecond
+	ml := membership.NewMemberlist(cfg, c.group.Transport(name))
+	c.group.Register(name, ml.Handle)
+	ml.Start(seeds...)
+	c.t.Cleanup(ml.Shutdown)
+	followMembership(srv, ml, func(addr string) (int, bool) {
+		id, err := strconv.Atoi(addr)
+		return id, err == nil
+	}, c.opts)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.servers[id], c.members[id] = srv, ml
+}
+
+// crash kills server id and its member of the group.
+func (c *gossipCluster) crash(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.servers[id].Kill()
+	c.members[id].Shutdown()
+}
+
+// leader returns a server that leads with configuration want, or nil.
+func (c *gossipCluster) leader(want []int) *server {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, srv := range c.servers {
+		if _, isLeader := srv.GetState(); isLeader && !srv.killed() && slices.Equal(srv.Members(), want) {
+			return srv
+		}
+	}
+	return nil
+}
+
+// await waits for a leader whose configuration is want, and returns it.
+func (c *gossipCluster) await(what string, want ...int) *server {
+	c.t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if srv := c.leader(want); srv != nil {
+			return srv
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("%s: no leader with configuration %v", what, want)
+		}
+	}
+}
+
+// hold fails unless, for d, no running server's configuration leaves out
+// any of want.
+func (c *gossipCluster) hold(what string, d time.Duration, want ...int) {
+	c.t.Helper()
+	for deadline := time.Now().Add(d); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		c.mu.Lock()
+		for _, srv := range c.servers {
+			if members := srv.Members(); !srv.killed() && len(members) > 0 {
+				for _, id := range want {
+					if !slices.Contains(members, id) {
+						c.mu.Unlock()
+						c.t.Fatalf("%s: server%d has configuration %v, without server%d", what, srv.id, members, id)
+					}
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Servers of the initial configuration started one at a time, each a
+// while after the last, are not removed for not having come up yet, however
+// long they take and even with another server joining meanwhile: the
+// leader changes nothing until the group has seen them all.
+func TestMembershipStartup(t *testing.T) {
+	const removeAfter = 100 * time.Millisecond
+	bootstrap := []int{0, 1, 2}
+	c := newGossipCluster(t, reconfigure{bootstrap: bootstrap, removeAfter: removeAfter})
+
+	c.start(0, bootstrap, "0")
+	c.hold("server0 alone", 3*removeAfter, bootstrap...)
+	c.start(1, bootstrap, "0")
+	c.await("two started", bootstrap...)
+	c.start(3, nil, "0")
+	c.hold("two started and one joined", 5*removeAfter, bootstrap...)
+	c.await("two started and one joined", bootstrap...)
+	c.start(2, bootstrap, "1")
+	c.hold("all started", 3*removeAfter, bootstrap...)
+	c.await("all started", 0, 1, 2, 3)
+}
+
+// A leader following a SWIM group adds a server that joins it, and removes
+// a server once the group has been without it for removeAfter, but never
+// shrinks the configuration below the initial one, however long a server of
+// that has been gone. One that restarts catches up.
+func TestConfigurationFollowsMembership(t *testing.T) {
+	const removeAfter = 200 * time.Millisecond
+	bootstrap := []int{0, 1, 2}
+	c := newGossipCluster(t, reconfigure{bootstrap: bootstrap, removeAfter: removeAfter})
+	for _, id := range bootstrap {
+		c.start(id, bootstrap, "0")
+	}
+	leader := c.await("started", bootstrap...)
+
+	c.start(3, nil, strconv.Itoa(leader.id))
+	leader = c.await("joined", 0, 1, 2, 3)
+
+	crashed := (leader.id + 1) % 4
+	crashedAt := time.Now()
+	c.crash(crashed)
+	leader = c.await("crashed", without([]int{0, 1, 2, 3}, crashed)...)
+	if took := time.Since(crashedAt); took < removeAfter {
+		t.Fatalf("server%d removed %v after it crashed, before %v", crashed, took, removeAfter)
+	}
+	if _, _, isLeader := leader.Start([]byte("without")); !isLeader {
+		t.Fatalf("server%d lost the lead", leader.id)
+	}
+
+	// Down to as many servers as the initial configuration, the next to
+	// crash keeps its place.
+	members := leader.Members()
+	next := members[0]
+	if next == leader.id {
+		next = members[1]
+	}
+	c.crash(next)
+	c.hold("crashed again", 5*removeAfter, members...)
+	c.await("crashed again", members...)
+
+	c.start(next, bootstrap, strconv.Itoa(leader.id))
+	c.await("rejoined", members...)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		c.mu.Lock()
+		got := c.servers[next].Members()
+		c.mu.Unlock()
+		if slices.Equal(got, members) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rejoined server%d has configuration %v, want %v", next, got, members)
+		}
+	}
+}
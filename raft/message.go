@@ -0,0 +1,56 @@
+package main
+
+type MsgType string
+
+const (
+	MsgPreVote             MsgType = "PreVote"
+	MsgPreVoteResp         MsgType = "PreVoteResp"
+	MsgRequestVote         MsgType = "RequestVote"
+	MsgRequestVoteResp     MsgType = "RequestVoteResp"
+	MsgAppendEntries       MsgType = "AppendEntries"
+	MsgAppendEntriesResp   MsgType = "AppendEntriesResp"
+	MsgInstallSnapshot     MsgType = "InstallSnapshot"
+	MsgInstallSnapshotResp MsgType = "InstallSnapshotResp"
+	MsgTimeoutNow          MsgType = "TimeoutNow"
+	MsgBatch               MsgType = "Batch" // messages of several groups for one host; see Host
+)
+
+// Message is the single envelope exchanged between raft servers. Requests and
+// their responses are both one-way messages, so a server never blocks waiting
+// on a peer and a slow or dead peer cannot stall the sender.
+type Message struct {
+	Type  MsgType
+	From  int
+	To    int
+	Term  int
+	Group int // raft group the message belongs to when a Host runs several
+
+	// Batch
+	Batch []Message
+
+	// RequestVote
+	LastLogIndex int
+	LastLogTerm  int
+	VoteGranted  bool
+	Transfer     bool // the leader asked the candidate to take over; see TransferLeadership
+
+	// AppendEntries
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []LogEntry
+	LeaderCommit int
+	Probe        int // echoed back in the response; see ReadIndex
+
+	// AppendEntriesResp
+	Success       bool
+	MatchIndex    int // highest index known to match the leader on success
+	ConflictIndex int // where the leader should retry from on failure
+
+	// InstallSnapshot, sent in chunks of Data starting at Offset
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	Peers             []int
+	Offset            int
+	Data              []byte
+	Done              bool
+}
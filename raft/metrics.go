@@ -0,0 +1,119 @@
+package main
+
+import "time"
+
+type EventType string
+
+const (
+	EventRoleChange EventType = "role"
+	EventTermChange EventType = "term"
+	EventVote       EventType = "vote"
+	EventCommit     EventType = "commit"
+)
+
+// eventBuffer is how many events a subscriber may fall behind before it
+// starts missing them.
+const eventBuffer = 256
+
+// Event is a state change on a server. Every event carries the server's state
+// right after the change, whatever its type.
+type Event struct {
+	Type        EventType `json:"type"`
+	Time        time.Time `json:"time"`
+	Server      int       `json:"server"`
+	Role        string    `json:"role"`
+	Term        int       `json:"term"`
+	Leader      int       `json:"leader"`
+	VotedFor    int       `json:"voted_for"`
+	CommitIndex int       `json:"commit_index"`
+}
+
+// Metrics are a server's counters, which only ever grow, and gauges, which
+// describe it right now.
+type Metrics struct {
+	ElectionsStarted int `json:"elections_started"`
+	ElectionsWon     int `json:"elections_won"`
+	EventsDropped    int `json:"events_dropped"`
+
+	Term        int `json:"term"`
+	CommitIndex int `json:"commit_index"`
+	LastApplied int `json:"last_applied"`
+	ApplyLag    int `json:"apply_lag"` // committed entries not yet handed to the application
+
+	// Leader only: round trip of the latest heartbeat each peer acknowledged.
+	HeartbeatLatency map[int]time.Duration `json:"heartbeat_latency_ns,omitempty"`
+}
+
+// Subscribe returns a channel that receives every event from now on. A
+// subscriber that falls eventBuffer events behind misses events rather than
+// stall the server. The channel is closed by Unsubscribe or when the server
+// is killed.
+func (s *server) Subscribe() <-chan Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch := make(chan Event, eventBuffer)
+	if s.dead {
+		close(ch)
+		return ch
+	}
+	s.subscribers = append(s.subscribers, ch)
+	return ch
+}
+
+// Unsubscribe closes events, which Subscribe returned, and sends it nothing
+// more.
+func (s *server) Unsubscribe(events <-chan Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, ch := range s.subscribers {
+		if ch == events {
+			close(ch)
+			s.subscribers = append(s.subscribers[:i], s.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *server) emit(typ EventType) {
+	e := Event{
+		Type:        typ,
+		Time:        s.clock.Now(),
+		Server:      s.id,
+		Role:        s.state,
+		Term:        s.currentTerm,
+		Leader:      s.leaderID,
+		VotedFor:    s.votedFor,
+		CommitIndex: s.commitIndex,
+	}
+	for _, ch := range s.subscribers {
+		select {
+		case ch <- e:
+		default:
+			s.metrics.EventsDropped++
+		}
+	}
+}
+
+// Metrics returns the server's counters and current gauges.
+func (s *server) Metrics() Metrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metricsLocked()
+}
+
+func (s *server) metricsLocked() Metrics {
+	m := s.metrics
+	m.Term = s.currentTerm
+	m.CommitIndex = s.commitIndex
+	m.LastApplied = s.lastApplied
+	m.ApplyLag = s.commitIndex - s.lastApplied
+	if s.state == Leader {
+		m.HeartbeatLatency = make(map[int]time.Duration, len(s.heartbeatRTT))
+		for peer, rtt := range s.heartbeatRTT {
+			m.HeartbeatLatency[peer] = rtt
+		}
+	}
+	return m
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Host runs many raft groups in one process, for data sharded into ranges
+// that are each replicated by their own group. A server of every group the
+// host runs has the host's id, and all of them share:
+//
+//   - one Transport. Messages are queued per destination host and sent as a
+//     single batch once per tick and after every batch received, so the
+//     heartbeats of hundreds of groups cost one message per peer.
+//   - one tick loop, which also hands committed entries to the application,
+//     instead of a ticker and an applier goroutine per group.
+//   - one Storage, typically a sharedStorage.
+//
+// The number of goroutines therefore does not grow with the number of groups.
+type Host struct {
+	id      int
+	trans   Transport
+	storage func(group int) Storage
+	apply   func(group int, msg ApplyMsg) // called from the tick loop; must not block
+
+	mu     sync.Mutex
+	groups map[int]*server
+	dead   bool
+
+	outMu  sync.Mutex
+	outbox map[int][]Message // destination host -> messages waiting to be batched
+	sent   int               // transport messages sent, batches counting once
+	queued int               // raft messages sent, batched or not
+}
+
+func newHost(id int, trans Transport, storage func(group int) Storage, apply func(group int, msg ApplyMsg)) *Host {
+	return &Host{
+		id:      id,
+		trans:   trans,
+		storage: storage,
+		apply:   apply,
+		groups:  make(map[int]*server),
+		outbox:  make(map[int][]Message),
+	}
+}
+
+// AddGroup starts this host's server of group. peers are the hosts the group
+// was bootstrapped with, as for newServer.
+func (h *Host) AddGroup(group int, peers []int) *server {
+	srv := newServer(h.id, peers, &groupTransport{host: h, group: group}, h.storage(group), nil)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.groups[group] = srv
+	return srv
+}
+
+// Group returns this host's server of group, or nil if it runs none.
+func (h *Host) Group(group int) *server {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.groups[group]
+}
+
+// Step is the Transport handler of a host: it hands every message to the
+// server of its group.
+func (h *Host) Step(m Message) {
+	if m.Type != MsgBatch {
+		h.route(m)
+	} else {
+		for _, inner := range m.Batch {
+			h.route(inner)
+		}
+	}
+	h.flush()
+}
+
+func (h *Host) route(m Message) {
+	h.mu.Lock()
+	srv, ok := h.groups[m.Group]
+	h.mu.Unlock()
+	if ok {
+		srv.Step(m)
+	}
+}
+
+func (h *Host) run() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.mu.Lock()
+		if h.dead {
+			h.mu.Unlock()
+			return
+		}
+		ids := make([]int, 0, len(h.groups))
+		for id := range h.groups {
+			ids = append(ids, id)
+		}
+		h.mu.Unlock()
+		slices.Sort(ids)
+
+		for _, id := range ids {
+			srv := h.Group(id)
+			srv.tick()
+
+			srv.mu.Lock()
+			msgs := srv.takeCommitted()
+			srv.mu.Unlock()
+			for _, msg := range msgs {
+				h.apply(id, msg)
+			}
+		}
+		h.flush()
+	}
+}
+
+// Kill stops the host and every group on it, as if the process crashed.
+func (h *Host) Kill() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dead = true
+	for _, srv := range h.groups {
+		srv.Kill()
+	}
+}
+
+func (h *Host) enqueue(m Message) {
+	h.outMu.Lock()
+	defer h.outMu.Unlock()
+	h.outbox[m.To] = append(h.outbox[m.To], m)
+}
+
+// flush sends everything queued, one message per destination host.
+func (h *Host) flush() {
+	h.outMu.Lock()
+	outbox := h.outbox
+	h.outbox = make(map[int][]Message, len(outbox))
+	for _, msgs := range outbox {
+		h.sent++
+		h.queued += len(msgs)
+	}
+	h.outMu.Unlock()
+
+	for to, msgs := range outbox {
+		if len(msgs) == 1 {
+			h.trans.Send(msgs[0])
+			continue
+		}
+		h.trans.Send(Message{Type: MsgBatch, To: to, Batch: msgs})
+	}
+}
+
+// Counts returns how many raft messages the host has sent and how many
+// transport messages they took.
+func (h *Host) Counts() (queued, sent int) {
+	h.outMu.Lock()
+	defer h.outMu.Unlock()
+	return h.queued, h.sent
+}
+
+// groupTransport is the Transport of one group's server on a Host.
+type groupTransport struct {
+	host  *Host
+	group int
+}
+
+func (t *groupTransport) Send(m Message) {
+	m.From = t.host.id
+	m.Group = t.group
+	t.host.enqueue(m)
+}
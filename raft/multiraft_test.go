@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sentLog records every message a transport sends before passing it on.
+type sentLog struct {
+	Transport
+	mu   sync.Mutex
+	sent []Message
+}
+
+func (l *sentLog) Send(m Message) {
+	l.mu.Lock()
+	l.sent = append(l.sent, m)
+	l.mu.Unlock()
+	l.Transport.Send(m)
+}
+
+// hostApplied records the commands each group applied on each host.
+type hostApplied struct {
+	mu       sync.Mutex
+	commands map[[2]int][]string // host, group -> commands in the order applied
+}
+
+func (a *hostApplied) get(host, group int) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Clone(a.commands[[2]int{host, group}])
+}
+
+// startHosts runs hosts 0 to 2, each with groups groups, over the in-memory
+// network until the test ends.
+func startHosts(t *testing.T, groups int) ([]*Host, []*sentLog, *hostApplied) {
+	t.Helper()
+	peers := []int{0, 1, 2}
+	network := newMemNetwork()
+	applied := &hostApplied{commands: make(map[[2]int][]string)}
+	var hosts []*Host
+	var logs []*sentLog
+	for _, id := range peers {
+		ss := openShared(t, filepath.Join(t.TempDir(), fmt.Sprintf("host%d", id)))
+		sent := &sentLog{Transport: network.Transport(id)}
+		h := newHost(id, sent, ss.Group, func(group int, msg ApplyMsg) {
+			if !msg.CommandValid || len(msg.Command) == 0 {
+				return
+			}
+			applied.mu.Lock()
+			defer applied.mu.Unlock()
+			k := [2]int{id, group}
+			applied.commands[k] = append(applied.commands[k], string(msg.Command))
+		})
+		for g := range groups {
+			h.AddGroup(g, peers)
+		}
+		network.Register(id, h.Step)
+		go h.run()
+		t.Cleanup(h.Kill)
+		hosts = append(hosts, h)
+		logs = append(logs, sent)
+	}
+	for deadline := time.Now().Add(10 * time.Second); !allElected(hosts, groups); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("not every group elected a leader")
+		}
+	}
+	return hosts, logs, applied
+}
+
+// leaderOf returns the host whose server of group leads, and its term.
+func leaderOf(hosts []*Host, group int) (*Host, int) {
+	for _, h := range hosts {
+		if term, isLeader := h.Group(group).GetState(); isLeader {
+			return h, term
+		}
+	}
+	return nil, 0
+}
+
+// Every group commits its own commands, and each host hands each group's
+// commands to the application of that group alone. Messages of all the
+// groups go out batched per destination host, far fewer transport messages
+// than raft messages.
+func TestHostBatchesAndRoutesGroups(t *testing.T) {
+	const groups = 20
+	hosts, logs, applied := startHosts(t, groups)
+
+	want := make([][]string, groups)
+	for i := range 3 {
+		for g := range groups {
+			cmd := fmt.Sprintf("group%d-%d", g, i)
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+				if leader, _ := leaderOf(hosts, g); leader != nil {
+					if _, _, ok := leader.Group(g).Start([]byte(cmd)); ok {
+						break
+					}
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("group %d has no leader to propose to", g)
+				}
+			}
+			want[g] = append(want[g], cmd)
+		}
+	}
+	for _, h := range hosts {
+		for g := range groups {
+			for deadline := time.Now().Add(5 * time.Second); !slices.Equal(applied.get(h.id, g), want[g]); time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("host%d applied %v to group %d, want %v", h.id, applied.get(h.id, g), g, want[g])
+				}
+			}
+		}
+	}
+
+	batched := false
+	for id, l := range logs {
+		l.mu.Lock()
+		for _, m := range l.sent {
+			if m.Type != MsgBatch {
+				continue
+			}
+			seen := make(map[int]bool)
+			for _, inner := range m.Batch {
+				if inner.To != m.To || inner.From != id {
+					l.mu.Unlock()
+					t.Fatalf("host%d batched a message from %d to %d in a batch to host%d", id, inner.From, inner.To, m.To)
+				}
+				seen[inner.Group] = true
+			}
+			batched = batched || len(seen) > 1
+		}
+		l.mu.Unlock()
+	}
+	if !batched {
+		t.Errorf("no batch carried messages of more than one group")
+	}
+	if queued, sent := countAll(hosts); sent*2 > queued {
+		t.Errorf("%d raft messages took %d transport messages", queued, sent)
+	}
+}
+
+// A leadership transfer in one group leaves every other group with the
+// leader and term it had.
+func TestHostGroupsElectIndependently(t *testing.T) {
+	const groups = 10
+	hosts, _, _ := startHosts(t, groups)
+
+	leaders := make([]*Host, groups)
+	terms := make([]int, groups)
+	for g := range groups {
+		leaders[g], terms[g] = leaderOf(hosts, g)
+	}
+	target := (leaders[0].id + 1) % len(hosts)
+	if err := leaders[0].Group(0).TransferLeadership(target); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if leader, term := leaderOf(hosts, 0); leader != nil && leader.id == target && term > terms[0] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("group 0 did not move to host%d in a later term than %d", target, terms[0])
+		}
+	}
+	for g := 1; g < groups; g++ {
+		if leader, term := leaderOf(hosts, g); leader != leaders[g] || term != terms[g] {
+			t.Errorf("group %d changed leader or term when group 0 transferred", g)
+		}
+	}
+}
+
+// BenchmarkHost runs three hosts over the in-memory network with more and
+// more groups and measures what the idle cluster costs once every group has
+// elected a leader. An iteration is one tick. Besides the time, it reports
+// how long the elections took, the goroutines running, the CPU the process
+// used as a share of one core, and raft messages against the transport
+// messages that carried them.
+func BenchmarkHost(b *testing.B) {
+	for _, groups := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("groups=%d", groups), func(b *testing.B) {
+			peers := []int{0, 1, 2}
+			network := newMemNetwork()
+			var hosts []*Host
+			for _, id := range peers {
+				ss, err := openSharedStorage(filepath.Join(b.TempDir(), fmt.Sprintf("host%d", id)))
+				if err != nil {
+					b.Fatal(err)
+				}
+				h := newHost(id, network.Transport(id), ss.Group, func(int, ApplyMsg) {})
+				for g := range groups {
+					h.AddGroup(g, peers)
+				}
+				network.Register(id, h.Step)
+				go h.run()
+				hosts = append(hosts, h)
+				b.Cleanup(func() {
+					h.Kill()
+					ss.Close()
+				})
+			}
+
+			start := time.Now()
+			for !allElected(hosts, groups) {
+				if time.Since(start) > time.Minute {
+					b.Fatalf("not every group elected a leader in %v", time.Minute)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			elected := time.Since(start)
+
+			queued0, sent0 := countAll(hosts)
+			cpu0 := cpuTime(b)
+			peak := 0
+			b.ResetTimer()
+			for range b.N {
+				time.Sleep(tickInterval)
+				peak = max(peak, runtime.NumGoroutine())
+			}
+			b.StopTimer()
+			elapsed := b.Elapsed().Seconds()
+			cpu := cpuTime(b) - cpu0
+			queued, sent := countAll(hosts)
+
+			b.ReportMetric(float64(elected.Milliseconds()), "ms-to-elect")
+			b.ReportMetric(float64(peak), "goroutines")
+			b.ReportMetric(100*cpu.Seconds()/elapsed, "%cpu")
+			b.ReportMetric(float64(queued-queued0)/elapsed, "raft-msgs/s")
+			b.ReportMetric(float64(sent-sent0)/elapsed, "transport-msgs/s")
+		})
+	}
+}
+
+func allElected(hosts []*Host, groups int) bool {
+	for g := range groups {
+		led := false
+		for _, h := range hosts {
+			if _, isLeader := h.Group(g).GetState(); isLeader {
+				led = true
+			}
+		}
+		if !led {
+			return false
+		}
+	}
+	return true
+}
+
+func countAll(hosts []*Host) (queued, sent int) {
+	for _, h := range hosts {
+		q, s := h.Counts()
+		queued, sent = queued+q, sent+s
+	}
+	return queued, sent
+}
+
+// cpuTime is the user and system CPU time this process has used so far.
+func cpuTime(b *testing.B) time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"membership"
+)
+
+// runNode runs a single server in this process, so a cluster can be made of
+// separate processes that are killed and restarted by hand. Every server
+// listed in peerAddrs is part of the initial configuration. The HTTP API
+// listens on the host of the server's raft address, at statusPort plus its id.
+// With a gossipPort, the servers also form a SWIM membership group over UDP
+// on their hosts at gossipPort plus their ids, and log who the group sees
+// come and go. Only with removeAfter as well does the leader act on it: once
+// the group has seen every server in peerAddrs, it removes a server the group
+// has been without for removeAfter, as long as as many servers as peerAddrs
+// lists are left, and adds one back once it rejoins.
+func runNode(id int, peerAddrs, dataDir string, statusPort, gossipPort int, removeAfter time.Duration) {
+	addrs, err := parsePeers(peerAddrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, ok := addrs[id]; !ok {
+		log.Fatalf("server%d is not in -peers", id)
+	}
+
+	var storage Storage
+	if dataDir == "" {
+		log.Printf("no -data given; server%d forgets everything when it exits\n", id)
+		storage = newMemStorage()
+	} else {
+		fs, err := newFileStorage(filepath.Join(dataDir, fmt.Sprintf("server%d", id)))
+		if err != nil {
+			log.Fatal(err)
+		}
+		storage = fs
+	}
+
+	var peers []int
+	for peer := range addrs {
+		peers = append(peers, peer)
+	}
+	slices.Sort(peers)
+
+	applyCh := make(chan ApplyMsg)
+	trans := newTCPTransport(id, addrs)
+	srv := newServer(id, peers, trans, storage, applyCh)
+	if err := trans.Serve(srv.Step); err != nil {
+		log.Fatal(err)
+	}
+	go countValues(srv, applyCh)
+
+	if gossipPort > 0 {
+		if err := gossip(srv, addrs, gossipPort, removeAfter); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if statusPort > 0 {
+		host, _, _ := strings.Cut(addrs[id], ":")
+		addr := fmt.Sprintf("%s:%d", host, statusPort+id)
+		handler := newHTTPHandler(func() *server { return srv })
+		go func() {
+			log.Fatalf("HTTP API on %s stopped: %v", addr, http.ListenAndServe(addr, handler))
+		}()
+		log.Printf("server%d serving its HTTP API on %s\n", id, addr)
+	}
+
+	srv.run()
+}
+
+// gossip has srv join the SWIM group of the servers in addrs, each at
+// gossipPort plus its id, and log its events, or follow it if removeAfter
+// is set.
+func gossip(srv *server, addrs map[int]string, gossipPort int, removeAfter time.Duration) error {
+	gossipAddr := func(id int) string {
+		host, _, _ := strings.Cut(addrs[id], ":")
+		return net.JoinHostPort(host, strconv.Itoa(gossipPort+id))
+	}
+	t, err := membership.NewUDPTransport(gossipAddr(srv.id))
+	if err != nil {
+		return err
+	}
+	ml := membership.NewMemberlist(membership.DefaultConfig(t.Addr()), t)
+	go t.Serve(ml.Handle)
+
+	var seeds []string
+	for id := range addrs {
+		if id != srv.id {
+			seeds = append(seeds, gossipAddr(id))
+		}
+	}
+	ml.Start(seeds...)
+	log.Printf("server%d gossiping membership on %s\n", srv.id, t.Addr())
+	if removeAfter <= 0 {
+		go func() {
+			for e := range ml.Subscribe() {
+				log.Printf("server%d: membership saw %s %s\n", srv.id, e.Member.Addr, e.Type)
+			}
+		}()
+		return nil
+	}
+
+	bootstrap := slices.Sorted(maps.Keys(addrs))
+	// A member's address may have its host resolved, so go by the port.
+	idOf := func(addr string) (int, bool) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return 0, false
+		}
+		n, err := strconv.Atoi(port)
+		_, ok := addrs[n-gossipPort]
+		return n - gossipPort, err == nil && ok
+	}
+	followMembership(srv, ml, idOf, reconfigure{bootstrap: bootstrap, removeAfter: removeAfter})
+	return nil
+}
+
+// parsePeers parses a list of servers given as id=host:port,id=host:port.
+func parsePeers(s string) (map[int]string, error) {
+	addrs := make(map[int]string)
+	for _, peer := range strings.Split(s, ",") {
+		idStr, addr, ok := strings.Cut(strings.TrimSpace(peer), "=")
+		if !ok {
+			return nil, fmt.Errorf("peer %q is not id=host:port", peer)
+		}
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, fmt.Errorf("peer %q: bad id: %v", peer, err)
+		}
+		addrs[id] = addr
+	}
+	return addrs, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// recordingTransport keeps what a server sends instead of delivering it.
+type recordingTransport struct {
+	sent []Message
+}
+
+func (t *recordingTransport) Send(m Message) {
+	t.sent = append(t.sent, m)
+}
+
+// newTestSim returns a simulated cluster of nodes servers, the first members
+// of which form the initial configuration, none of them started yet.
+func newTestSim(seed int64, nodes, members int) *simulator {
+	sim := newSimCluster(rand.New(rand.NewSource(seed)), nodes, members)
+	sim.maxDelay = 5 * time.Millisecond
+	return sim
+}
+
+// useFileStorage gives every server of sim a fileStorage in a directory of
+// its own, and returns the directories.
+func useFileStorage(t *testing.T, sim *simulator) []string {
+	t.Helper()
+	var dirs []string
+	for _, n := range sim.nodes {
+		dir := t.TempDir()
+		n.storage = openStorage(t, dir)
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// restartFromDisk crashes server id and starts it again on a fileStorage
+// opened afresh on dir, as a new process would.
+func restartFromDisk(t *testing.T, sim *simulator, id int, dir string) {
+	t.Helper()
+	n := sim.nodes[id]
+	if n.up {
+		sim.crash(id)
+	}
+	n.storage.(*fileStorage).Close()
+	n.storage = openStorage(t, dir)
+	sim.start(id)
+}
+
+// waitFor runs sim until cond holds and fails the test if it does not within
+// timeout of virtual time, or if an invariant breaks first.
+func waitFor(t *testing.T, sim *simulator, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	for end := sim.clock.now.Add(timeout); !cond(); {
+		if sim.err != nil {
+			t.Fatal(sim.err)
+		}
+		if !sim.clock.now.Before(end) {
+			t.Fatalf("no %s after %v", what, timeout)
+		}
+		sim.runFor(tickInterval)
+	}
+	if sim.err != nil {
+		t.Fatal(sim.err)
+	}
+}
+
+// awaitLeader runs sim until some server leads and returns it.
+func awaitLeader(t *testing.T, sim *simulator) int {
+	t.Helper()
+	waitFor(t, sim, 5*time.Second, "leader", sim.hasLeader)
+	return sim.leader()
+}
+
+// recordApplied has every server of sim record the commands it applies, in
+// order, and snapshot the record every snapshotEvery entries. The record is
+// the application's state, so a server that catches up by snapshot or
+// restarts gets it back from the snapshot like any other state.
+func recordApplied(sim *simulator, snapshotEvery int) [][]string {
+	applied := make([][]string, len(sim.nodes))
+	sim.newApp = func(id int) simApp {
+		applied[id] = nil
+		return func(msg ApplyMsg) []byte {
+			if msg.SnapshotValid {
+				applied[id] = nil
+				if err := json.Unmarshal(msg.Snapshot, &applied[id]); err != nil {
+					sim.fail("server%d got a corrupt snapshot: %v", id, err)
+				}
+				return nil
+			}
+			if msg.CommandValid {
+				applied[id] = append(applied[id], string(msg.Command))
+			}
+			if msg.CommandIndex%snapshotEvery != 0 {
+				return nil
+			}
+			data, _ := json.Marshal(applied[id])
+			return data
+		}
+	}
+	for id, n := range sim.nodes {
+		if n.up {
+			n.app = sim.newApp(id)
+		}
+	}
+	return applied
+}
+
+func sameSequence(applied [][]string) bool {
+	for _, seq := range applied {
+		if !slices.Equal(seq, applied[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSameSequence fails the test unless every server applied the same,
+// non-empty sequence of commands.
+func checkSameSequence(t *testing.T, applied [][]string) {
+	t.Helper()
+	if len(applied[0]) == 0 {
+		t.Fatal("server0 applied nothing")
+	}
+	for id, seq := range applied {
+		if !slices.Equal(seq, applied[0]) {
+			t.Fatalf("server%d applied %d commands %v\nserver0 applied %d commands %v", id, len(seq), seq, len(applied[0]), applied[0])
+		}
+	}
+}
+
+// proposeFor proposes a new command to every server that thinks it leads,
+// every simProposeEvery, for d.
+func proposeFor(sim *simulator, d time.Duration) {
+	for i := time.Duration(1); i*simProposeEvery <= d; i++ {
+		sim.after(i*simProposeEvery, sim.propose)
+	}
+}
+
+func TestPartitionsApplySameSequence(t *testing.T) {
+	for seed := range int64(5) {
+		sim := newTestSim(seed, 5, 5)
+		sim.startAll()
+		applied := recordApplied(sim, 50)
+		leader := awaitLeader(t, sim)
+		proposeFor(sim, 6*time.Second)
+
+		others := without(sim.peers, leader)
+		steps := []struct {
+			what   string
+			groups [][]int
+		}{
+			{"leader cut off alone", [][]int{{leader}, others}},
+			{"healed", nil},
+			{"leader in the minority", [][]int{{leader, others[0]}, others[1:]}},
+			{"healed", nil},
+			{"one follower cut off", [][]int{{others[2]}, without(sim.peers, others[2])}},
+			{"healed", nil},
+		}
+		for _, step := range steps {
+			if step.groups == nil {
+				sim.heal()
+			} else {
+				sim.partition(step.groups...)
+			}
+			sim.runFor(time.Second)
+			if sim.err != nil {
+				t.Fatalf("seed %d, %s: %v", seed, step.what, sim.err)
+			}
+		}
+
+		waitFor(t, sim, 5*time.Second, "agreement", func() bool { return sameSequence(applied) })
+		checkSameSequence(t, applied)
+		if proposed := sim.proposed; len(applied[0]) < proposed/2 {
+			t.Fatalf("seed %d: only %d of %d proposals applied", seed, len(applied[0]), proposed)
+		}
+	}
+}
+
+// A follower cut off from the leader keeps timing out, but its pre-votes
+// fail, so it never bumps its term and cannot depose the leader when it
+// comes back.
+func TestPreVoteIsolatedFollowerDoesNotDisrupt(t *testing.T) {
+	for seed := range int64(5) {
+		sim := newTestSim(seed, 3, 3)
+		sim.startAll()
+		leader := awaitLeader(t, sim)
+		proposeFor(sim, 4*time.Second)
+		term, _ := sim.nodes[leader].srv.GetState()
+
+		follower := without(sim.peers, leader)[0]
+		sim.partition([]int{follower}, without(sim.peers, follower))
+		sim.runFor(2 * time.Second)
+		if got, _ := sim.nodes[follower].srv.GetState(); got != term {
+			t.Fatalf("seed %d: isolated follower moved from term %d to %d", seed, term, got)
+		}
+
+		sim.heal()
+		sim.runFor(time.Second)
+		if sim.err != nil {
+			t.Fatalf("seed %d: %v", seed, sim.err)
+		}
+		if got, isLeader := sim.nodes[leader].srv.GetState(); !isLeader || got != term {
+			t.Fatalf("seed %d: leader of term %d is now in term %d, leading %v", seed, term, got, isLeader)
+		}
+	}
+}
+
+// A leader cut off from everybody steps down on its own within the election
+// timeout, rather than carrying on while the others elect a new leader.
+func TestCheckQuorumIsolatedLeaderStepsDown(t *testing.T) {
+	for seed := range int64(5) {
+		sim := newTestSim(seed, 5, 5)
+		sim.startAll()
+		leader := awaitLeader(t, sim)
+		proposeFor(sim, 2*time.Second)
+		sim.runFor(time.Second)
+
+		sim.partition([]int{leader}, without(sim.peers, leader))
+		waitFor(t, sim, maxElectionTimeout, "step down", func() bool {
+			_, isLeader := sim.nodes[leader].srv.GetState()
+			return !isLeader
+		})
+	}
+}
@@ -0,0 +1,193 @@
+// Command raftctl talks to a raft cluster whose servers were started with
+// -id and -peers, through their HTTP APIs.
+//
+//	raftctl status             show every server's role, term and progress
+//	raftctl propose VALUE      append VALUE to the log through the leader
+//	raftctl transfer ID        hand leadership to server ID
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// status mirrors the fields of the server's /status reply that raftctl shows.
+type status struct {
+	ID          int    `json:"id"`
+	Role        string `json:"role"`
+	Term        int    `json:"term"`
+	Leader      int    `json:"leader"`
+	Members     []int  `json:"members"`
+	CommitIndex int    `json:"commit_index"`
+	LastApplied int    `json:"last_applied"`
+	LastIndex   int    `json:"last_index"`
+	Peers       map[int]struct {
+		MatchIndex int `json:"match_index"`
+	} `json:"peers"`
+}
+
+type apiError struct {
+	Error  string `json:"error"`
+	Leader int    `json:"leader"`
+}
+
+var client = &http.Client{Timeout: 3 * time.Second}
+
+func main() {
+	cluster := flag.String("cluster", "0=127.0.0.1:8000,1=127.0.0.1:8001,2=127.0.0.1:8002", "HTTP address of every server as id=host:port,...")
+	retries := flag.Int("retries", 10, "how often to look for a leader before giving up")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: raftctl [flags] status | propose VALUE | transfer ID\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(0)
+
+	addrs, err := parseCluster(*cluster)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	args := flag.Args()
+	switch {
+	case len(args) == 1 && args[0] == "status":
+		printStatus(addrs)
+	case len(args) == 2 && args[0] == "propose":
+		var res struct{ Index, Term int }
+		if err := toLeader(addrs, *retries, "/propose", args[1], &res); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("proposed at index %d in term %d\n", res.Index, res.Term)
+	case len(args) == 2 && args[0] == "transfer":
+		if _, err := strconv.Atoi(args[1]); err != nil {
+			log.Fatalf("transfer: %q is not a server id", args[1])
+		}
+		if err := toLeader(addrs, *retries, "/transfer?to="+args[1], "", nil); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("server%s is taking over\n", args[1])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func printStatus(addrs map[int]string) {
+	ids := make([]int, 0, len(addrs))
+	for id := range addrs {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	fmt.Printf("%-4s %-14s %5s %6s %7s %7s %5s  %s\n", "ID", "ROLE", "TERM", "LEADER", "COMMIT", "APPLIED", "LAST", "MATCH")
+	for _, id := range ids {
+		var st status
+		if err := get(addrs[id], "/status", &st); err != nil {
+			fmt.Printf("%-4d unreachable: %v\n", id, err)
+			continue
+		}
+		var match []string
+		for _, peer := range st.Members {
+			if p, ok := st.Peers[peer]; ok {
+				match = append(match, fmt.Sprintf("%d:%d", peer, p.MatchIndex))
+			}
+		}
+		fmt.Printf("%-4d %-14s %5d %6d %7d %7d %5d  %s\n", st.ID, st.Role, st.Term, st.Leader, st.CommitIndex, st.LastApplied, st.LastIndex, strings.Join(match, " "))
+	}
+}
+
+// toLeader posts body to path on the leader. It starts with the first server,
+// follows leader hints, and otherwise tries each server in turn, pausing after
+// every full round in case an election is under way.
+func toLeader(addrs map[int]string, retries int, path, body string, out any) error {
+	ids := make([]int, 0, len(addrs))
+	for id := range addrs {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	next := ids[0]
+	var lastErr error
+	for attempt := 0; attempt < retries*len(ids); attempt++ {
+		if attempt > 0 && attempt%len(ids) == 0 {
+			time.Sleep(300 * time.Millisecond)
+		}
+
+		leader, err := post(addrs[next], path, body, out)
+		if err == nil {
+			return nil
+		}
+		lastErr = fmt.Errorf("server%d: %w", next, err)
+
+		if _, ok := addrs[leader]; ok && leader != next {
+			next = leader
+		} else {
+			next = ids[(slices.Index(ids, next)+1)%len(ids)]
+		}
+	}
+	return lastErr
+}
+
+func get(addr, path string, out any) error {
+	resp, err := client.Get("http://" + addr + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// post returns the leader the server pointed at if it refused the request.
+func post(addr, path, body string, out any) (int, error) {
+	resp, err := client.Post("http://"+addr+path, "application/octet-stream", bytes.NewBufferString(body))
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return -1, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var apiErr apiError
+		if err := json.Unmarshal(data, &apiErr); err != nil {
+			return -1, fmt.Errorf("%s", resp.Status)
+		}
+		return apiErr.Leader, errors.New(apiErr.Error)
+	}
+	if out == nil {
+		return -1, nil
+	}
+	return -1, json.Unmarshal(data, out)
+}
+
+func parseCluster(s string) (map[int]string, error) {
+	addrs := make(map[int]string)
+	for _, server := range strings.Split(s, ",") {
+		idStr, addr, ok := strings.Cut(strings.TrimSpace(server), "=")
+		if !ok {
+			return nil, fmt.Errorf("server %q is not id=host:port", server)
+		}
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, fmt.Errorf("server %q: bad id: %v", server, err)
+		}
+		addrs[id] = addr
+	}
+	return addrs, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+// Clock is where a server reads the time from, so tests can control it.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+type ReadOnlyOption string
+
+const (
+	// ReadOnlySafe confirms leadership with a heartbeat round for every read.
+	ReadOnlySafe ReadOnlyOption = "safe"
+
+	// ReadOnlyLeaseBased skips the heartbeat round while the leader holds a
+	// lease. It is only as safe as the bound on clock drift between servers.
+	ReadOnlyLeaseBased ReadOnlyOption = "lease"
+)
+
+const (
+	readIndexTimeout = 500 * time.Millisecond
+
+	// maxClockDrift is how far apart we assume two servers' clocks can run
+	// over one election timeout. The lease is shortened by this much.
+	maxClockDrift = 15 * time.Millisecond
+)
+
+var errNotReady = errors.New("leader has not committed an entry in its term yet")
+
+// A probe is a counter stamped onto every AppendEntries a leader sends and
+// echoed back in the response. Once a majority has acknowledged probe p, the
+// leader knows it was still leader when p was sent.
+
+// readRequest is a ReadIndex call waiting for a majority to acknowledge its probe.
+type readRequest struct {
+	probe int
+	term  int
+	done  chan struct{}
+}
+
+// ReadIndex returns an index such that once the application has applied
+// everything up to it, reading local state is linearizable. The leader first
+// confirms it has not been deposed, either with a heartbeat round or, in
+// ReadOnlyLeaseBased mode, from its lease.
+func (s *server) ReadIndex() (int, error) {
+	s.mu.Lock()
+	index, req, err := s.beginRead()
+	s.mu.Unlock()
+	if err != nil || req == nil {
+		return index, err
+	}
+
+	select {
+	case <-req.done:
+	case <-time.After(readIndexTimeout):
+		return -1, errTimeout
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.readConfirmed(req); err != nil {
+		return -1, err
+	}
+	return index, nil
+}
+
+// beginRead is the part of ReadIndex that does not wait. It returns the read
+// index and, unless the lease already vouches for it, the request whose done
+// channel closes once a majority has answered.
+func (s *server) beginRead() (int, *readRequest, error) {
+	if s.state != Leader {
+		return -1, nil, errNotLeader
+	}
+	// Until an entry of its own term commits, a new leader does not know
+	// the true commit index (§6.4 of the Raft thesis).
+	if s.termAt(s.commitIndex) != s.currentTerm {
+		return -1, nil, errNotReady
+	}
+
+	index := s.commitIndex
+	if s.readOnly == ReadOnlyLeaseBased && s.transfer == nil && s.inLease() {
+		return index, nil, nil
+	}
+
+	req := &readRequest{probe: s.newProbe(), term: s.currentTerm, done: make(chan struct{})}
+	s.pendingReads = append(s.pendingReads, req)
+	s.broadcastAppend()
+	s.maybeConfirmReads()
+	return index, req, nil
+}
+
+// readConfirmed tells a request a majority answered from one that was woken
+// because we stopped leading.
+func (s *server) readConfirmed(req *readRequest) error {
+	if s.state != Leader || s.currentTerm != req.term {
+		return errNotLeader
+	}
+	return nil
+}
+
+// newProbe starts a new round of probes and remembers when it was sent.
+func (s *server) newProbe() int {
+	s.probe++
+	s.probeSent[s.probe] = s.clock.Now()
+	return s.probe
+}
+
+// quorumProbe is the newest probe a majority of the configuration has acknowledged.
+func (s *server) quorumProbe() int {
+	var acked []int
+	for _, peer := range s.peers {
+		if peer == s.id {
+			acked = append(acked, s.probe)
+		} else {
+			acked = append(acked, s.probeAcked[peer])
+		}
+	}
+	slices.Sort(acked)
+	slices.Reverse(acked)
+	return acked[s.quorum()-1]
+}
+
+func (s *server) handleProbeAck(from, probe int) {
+	if probe <= s.probeAcked[from] {
+		return
+	}
+	s.probeAcked[from] = probe
+	if sent, ok := s.probeSent[probe]; ok {
+		s.heartbeatRTT[from] = s.clock.Now().Sub(sent)
+	}
+	s.maybeConfirmReads()
+}
+
+// maybeConfirmReads releases every pending read whose probe a majority acknowledged.
+func (s *server) maybeConfirmReads() {
+	confirmed := s.quorumProbe()
+	for len(s.pendingReads) > 0 && s.pendingReads[0].probe <= confirmed {
+		close(s.pendingReads[0].done)
+		s.pendingReads = s.pendingReads[1:]
+	}
+
+	// Only the send time of the confirmed probe matters for the lease.
+	for probe := range s.probeSent {
+		if probe < confirmed {
+			delete(s.probeSent, probe)
+		}
+	}
+}
+
+// inLease reports whether no other leader can have been elected yet. Members
+// refuse to vote for minElectionTimeout after hearing from us, and a majority
+// heard from us no earlier than when the confirmed probe was sent. That does
+// not hold during a leadership transfer, whose votes are granted regardless.
+func (s *server) inLease() bool {
+	sent, ok := s.probeSent[s.quorumProbe()]
+	if !ok {
+		return false
+	}
+	return s.clock.Now().Before(sent.Add(minElectionTimeout - maxClockDrift))
+}
+
+// failPendingReads wakes every waiting ReadIndex call when we stop leading; they see we are no longer leader.
+func (s *server) failPendingReads() {
+	for _, req := range s.pendingReads {
+		close(req.done)
+	}
+	s.pendingReads = nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Reads are started on random servers while the simulator partitions,
+// crashes and restarts servers and moves leadership around. No read may be
+// confirmed at an index older than something that had already committed when
+// it started, whoever led at the time.
+func TestReadIndexNoStaleReads(t *testing.T) {
+	for _, mode := range []ReadOnlyOption{ReadOnlySafe, ReadOnlyLeaseBased} {
+		for seed := range int64(10) {
+			sim := newTestSim(seed, 5, 5)
+			sim.dropRate = 0.05
+			sim.readOnly = mode
+			sim.startAll()
+			sim.every(simChaosEvery, func() {
+				if !sim.healed {
+					sim.chaos()
+				}
+			})
+			proposeFor(sim, 4*time.Second)
+
+			started, confirmed := 0, 0
+			sim.every(5*time.Millisecond, func() {
+				id := sim.rand.Intn(len(sim.nodes))
+				n := sim.nodes[id]
+				if !n.up {
+					return
+				}
+				srv := n.srv
+				srv.mu.Lock()
+				index, req, err := srv.beginRead()
+				srv.mu.Unlock()
+				if err != nil {
+					return
+				}
+				started++
+				committed := sim.maxCommitted
+				confirm := func() {
+					if index < committed {
+						sim.fail("server%d confirmed a read at index %d after %d had committed", id, index, committed)
+					}
+					confirmed++
+				}
+				if req == nil {
+					confirm()
+					return
+				}
+
+				deadline := sim.clock.now.Add(readIndexTimeout)
+				var poll func()
+				poll = func() {
+					if !n.up || n.srv != srv || !sim.clock.now.Before(deadline) {
+						return
+					}
+					select {
+					case <-req.done:
+						srv.mu.Lock()
+						err := srv.readConfirmed(req)
+						srv.mu.Unlock()
+						if err == nil {
+							confirm()
+						}
+					default:
+						sim.after(time.Millisecond, poll)
+					}
+				}
+				sim.after(time.Millisecond, poll)
+			})
+
+			sim.runFor(4 * time.Second)
+			if sim.err != nil {
+				t.Fatalf("%s reads, seed %d: %v", mode, seed, sim.err)
+			}
+			if confirmed < started/4 {
+				t.Fatalf("%s reads, seed %d: only %d of %d reads confirmed", mode, seed, confirmed, started)
+			}
+		}
+	}
+}
+
+// A leader cut off from the cluster serves reads from its lease until the
+// lease runs out on its clock, and from then on only after a heartbeat round
+// it can no longer complete.
+func TestLeaseReadRefusedAfterExpiry(t *testing.T) {
+	sim := newTestSim(1, 3, 3)
+	sim.readOnly = ReadOnlyLeaseBased
+	sim.startAll()
+	leader := awaitLeader(t, sim)
+	srv := sim.nodes[leader].srv
+	sim.runFor(time.Second)
+
+	read := func() (*readRequest, error) {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		_, req, err := srv.beginRead()
+		return req, err
+	}
+	if req, err := read(); err != nil || req != nil {
+		t.Fatalf("healthy leader did not read from its lease: request %v, error %v", req, err)
+	}
+
+	// The lease counts from when the last confirmed heartbeat round was sent,
+	// which was no later than now.
+	sim.partition([]int{leader}, without(sim.peers, leader))
+	sim.runFor(minElectionTimeout - maxClockDrift)
+	req, err := read()
+	if err != nil {
+		t.Fatalf("leader refused to start a read: %v", err)
+	}
+	if req == nil {
+		t.Fatalf("leader read from its lease %v after last hearing from a majority", minElectionTimeout-maxClockDrift)
+	}
+
+	sim.runFor(readIndexTimeout)
+	select {
+	case <-req.done:
+		srv.mu.Lock()
+		err = srv.readConfirmed(req)
+		srv.mu.Unlock()
+		if err == nil {
+			t.Fatal("isolated leader confirmed a read")
+		}
+	default:
+	}
+}
+
+// Votes requested by a leadership transfer are granted in spite of the
+// leader's lease, so a leader handing over must stop trusting it. Here the
+// old leader is cut off as the target campaigns, and still holds a lease
+// that would otherwise look valid when the target has won and committed.
+func TestLeaseNotUsedDuringTransfer(t *testing.T) {
+	for seed := range int64(5) {
+		sim := newTestSim(seed, 3, 3)
+		sim.readOnly = ReadOnlyLeaseBased
+		sim.startAll()
+		leader := awaitLeader(t, sim)
+		old := sim.nodes[leader].srv
+		sim.runFor(time.Second)
+
+		target := without(sim.peers, leader)[0]
+		old.mu.Lock()
+		_, err := old.transferLeadership(target)
+		old.mu.Unlock()
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		// Cut the old leader off as soon as the target campaigns, before it
+		// can hear of the new term.
+		for sim.nodes[target].srv.Status().Role != Candidate {
+			if sim.err != nil || sim.clock.now.After(simEpoch.Add(5*time.Second)) {
+				t.Fatalf("seed %d: server%d never campaigned: %v", seed, target, sim.err)
+			}
+			sim.runFor(100 * time.Microsecond)
+		}
+		sim.partition([]int{leader}, without(sim.peers, leader))
+		waitFor(t, sim, time.Second, "new leader", func() bool {
+			_, isLeader := sim.nodes[target].srv.GetState()
+			return isLeader
+		})
+		sim.nodes[target].srv.Start([]byte("after the transfer"))
+		sim.runFor(50 * time.Millisecond)
+
+		old.mu.Lock()
+		index, req, err := old.beginRead()
+		old.mu.Unlock()
+		if err == nil && req == nil {
+			t.Fatalf("seed %d: old leader read index %d from its lease after handing over; %d is committed", seed, index, sim.maxCommitted)
+		}
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// The simulator runs a whole cluster in a single goroutine against a virtual
+// clock. Servers are driven by calling tick and Step directly, the network is
+// a queue of timed deliveries, and every random choice, the servers' election
+// timeouts included, comes from one seed. A seed therefore always produces
+// the same run, and a failing one can be replayed as often as needed.
+
+const (
+	simDuration     = 10 * time.Second // virtual time a run lasts before the cluster is healed
+	simSettle       = 3 * time.Second  // virtual time the healed cluster gets to elect a leader
+	simChaosEvery   = 100 * time.Millisecond
+	simProposeEvery = 20 * time.Millisecond
+)
+
+// simEpoch is where virtual time starts. Any fixed instant will do.
+var simEpoch = time.Unix(1_000_000_000, 0)
+
+// simClock only moves when the simulator advances it.
+type simClock struct {
+	now time.Time
+}
+
+func (c *simClock) Now() time.Time { return c.now }
+
+type simEventKind int
+
+const (
+	simTick simEventKind = iota
+	simDeliver
+	simCall
+)
+
+type simEvent struct {
+	at   time.Time
+	seq  int // orders events scheduled for the same instant
+	kind simEventKind
+	node int
+	gen  int // ticks only: the incarnation of node that scheduled it
+	msg  Message
+	fn   func() // calls only
+}
+
+// simQueue is a min-heap of events by time.
+type simQueue []*simEvent
+
+func (q simQueue) Len() int { return len(q) }
+func (q simQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+func (q simQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *simQueue) Push(x any)   { *q = append(*q, x.(*simEvent)) }
+func (q *simQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// simApp is the application on one simulated server. It is handed every
+// message the server applies and returns data to snapshot, if it wants to
+// snapshot there.
+type simApp func(msg ApplyMsg) []byte
+
+type simNode struct {
+	srv     *server
+	storage Storage
+	app     simApp
+	up      bool
+	gen     int // bumped on every restart so ticks and sends of the previous incarnation are dropped
+
+	applied   int // last index handed to the application
+	committed int // commitIndex as of the last invariant check
+}
+
+// simKey identifies a log entry. Two logs holding an entry with the same index
+// and term must agree on it and on everything before it.
+type simKey struct {
+	index, term int
+}
+
+type simEntry struct {
+	prevTerm int
+	typ      EntryType
+	command  string
+}
+
+type simulator struct {
+	rand    *rand.Rand
+	clock   *simClock
+	queue   simQueue
+	seq     int
+	trace   hash.Hash64 // fingerprint of every event run, to confirm a replay matches
+	verbose bool        // stamp server logs with virtual time
+
+	peers    []int // the configuration the cluster is bootstrapped with
+	nodes    []*simNode
+	newApp   func(id int) simApp // nil runs the counting application of main
+	readOnly ReadOnlyOption      // how servers confirm reads; ReadOnlySafe if empty
+	group    map[int]int         // partition group of each server, as in memNetwork
+	dropRate float64
+	maxDelay time.Duration
+	proposed int
+	healed   bool // no more chaos
+
+	// What the invariants are checked against, accumulated over the whole run.
+	leaders      map[int]int         // term -> the server that led it
+	committed    map[int]LogEntry    // index -> the entry some server committed there
+	maxCommitted int                 // highest index in committed
+	entries      map[simKey]simEntry // every entry seen in any log
+
+	err error
+}
+
+type simTransport struct {
+	id  int
+	gen int
+	sim *simulator
+}
+
+// Send drops whatever a crashed incarnation of the server still tries to send.
+func (t *simTransport) Send(m Message) {
+	if n := t.sim.nodes[t.id]; !n.up || n.gen != t.gen {
+		return
+	}
+	m.From = t.id
+	t.sim.send(m)
+}
+
+// newSimulator sets up a random run: a cluster of three or five servers on a
+// lossy network, a stream of proposals, and chaos until simDuration.
+func newSimulator(seed int64) *simulator {
+	r := rand.New(rand.NewSource(seed))
+	dropRate := r.Float64() * 0.1
+	maxDelay := time.Millisecond + time.Duration(r.Int63n(int64(30*time.Millisecond)))
+	size := 3
+	if r.Intn(2) == 0 {
+		size = 5
+	}
+
+	sim := newSimCluster(r, size, size)
+	sim.dropRate, sim.maxDelay = dropRate, maxDelay
+	sim.startAll()
+	sim.every(simProposeEvery, sim.propose)
+	sim.every(simChaosEvery, func() {
+		if !sim.healed {
+			sim.chaos()
+		}
+		sim.checkLogs()
+	})
+	return sim
+}
+
+// newSimCluster sets up nodes servers on a reliable network, none of them
+// started yet. The first members of them make up the initial configuration;
+// the rest start outside the cluster, to be added later.
+func newSimCluster(r *rand.Rand, nodes, members int) *simulator {
+	sim := &simulator{
+		rand:      r,
+		clock:     &simClock{now: simEpoch},
+		trace:     fnv.New64a(),
+		group:     make(map[int]int),
+		maxDelay:  time.Millisecond,
+		leaders:   make(map[int]int),
+		committed: make(map[int]LogEntry),
+		entries:   make(map[simKey]simEntry),
+	}
+	for id := range nodes {
+		if id < members {
+			sim.peers = append(sim.peers, id)
+		}
+		sim.nodes = append(sim.nodes, &simNode{storage: newMemStorage()})
+	}
+	return sim
+}
+
+// run plays the simulation to the end and returns the trace fingerprint. The
+// error describes the first invariant that broke, if any did.
+func (sim *simulator) run() (uint64, error) {
+	sim.runUntil(simEpoch.Add(simDuration))
+	if sim.err != nil {
+		return sim.trace.Sum64(), sim.err
+	}
+
+	// Heal everything and make sure the cluster can still elect a leader.
+	sim.healed = true
+	sim.heal()
+	for id, n := range sim.nodes {
+		if !n.up {
+			sim.start(id)
+		}
+	}
+	sim.runUntil(sim.clock.now.Add(simSettle))
+	if sim.err == nil && !sim.hasLeader() {
+		sim.fail("no leader %v after the cluster was healed", simSettle)
+	}
+	return sim.trace.Sum64(), sim.err
+}
+
+func (sim *simulator) runUntil(end time.Time) {
+	for sim.err == nil && len(sim.queue) > 0 && !sim.queue[0].at.After(end) {
+		e := heap.Pop(&sim.queue).(*simEvent)
+		sim.clock.now = e.at
+		if sim.verbose {
+			log.SetPrefix(fmt.Sprintf("%12v ", e.at.Sub(simEpoch)))
+		}
+		fmt.Fprintf(sim.trace, "%d %d %d %s %d %d %d|", e.at.UnixNano(), e.kind, e.node, e.msg.Type, e.msg.From, e.msg.Term, len(e.msg.Entries))
+
+		switch e.kind {
+		case simTick:
+			n := sim.nodes[e.node]
+			if !n.up || n.gen != e.gen {
+				continue
+			}
+			n.srv.tick()
+			sim.schedule(&simEvent{at: e.at.Add(tickInterval), kind: simTick, node: e.node, gen: e.gen})
+		case simDeliver:
+			n := sim.nodes[e.msg.To]
+			if !n.up || sim.group[e.msg.From] != sim.group[e.msg.To] {
+				continue
+			}
+			n.srv.Step(e.msg)
+		case simCall:
+			e.fn()
+		}
+
+		for id, n := range sim.nodes {
+			if n.up {
+				sim.apply(id)
+				sim.check(id)
+			}
+		}
+	}
+	if sim.err == nil && sim.clock.now.Before(end) {
+		sim.clock.now = end
+	}
+	sim.checkLogs()
+}
+
+// runFor runs the simulation for d of virtual time.
+func (sim *simulator) runFor(d time.Duration) {
+	sim.runUntil(sim.clock.now.Add(d))
+}
+
+func (sim *simulator) schedule(e *simEvent) {
+	sim.seq++
+	e.seq = sim.seq
+	heap.Push(&sim.queue, e)
+}
+
+// after calls fn once d of virtual time has passed.
+func (sim *simulator) after(d time.Duration, fn func()) {
+	sim.schedule(&simEvent{at: sim.clock.now.Add(d), kind: simCall, fn: fn})
+}
+
+// every calls fn each time d of virtual time passes.
+func (sim *simulator) every(d time.Duration, fn func()) {
+	sim.after(d, func() {
+		fn()
+		sim.every(d, fn)
+	})
+}
+
+func (sim *simulator) send(m Message) {
+	if sim.rand.Float64() < sim.dropRate {
+		return
+	}
+	delay := time.Duration(sim.rand.Int63n(int64(sim.maxDelay)))
+	sim.schedule(&simEvent{at: sim.clock.now.Add(delay), kind: simDeliver, msg: m})
+}
+
+// start boots server id from its storage, as after a crash. Servers outside
+// the initial configuration start with none and wait to be added.
+func (sim *simulator) start(id int) {
+	n := sim.nodes[id]
+	var peers []int
+	if slices.Contains(sim.peers, id) {
+		peers = sim.peers
+	}
+	n.gen++
+	n.srv = newServer(id, peers, &simTransport{id: id, gen: n.gen, sim: sim}, n.storage, nil)
+	// newServer armed the election timer with the real clock and its own
+	// randomness. Swap in the simulation's and arm it again.
+	n.srv.clock = sim.clock
+	n.srv.rand = rand.New(rand.NewSource(sim.rand.Int63()))
+	n.srv.resetElectionTimer()
+	if sim.readOnly != "" {
+		n.srv.readOnly = sim.readOnly
+	}
+
+	n.up = true
+	n.applied, n.committed = 0, 0
+	if sim.newApp != nil {
+		n.app = sim.newApp(id)
+	}
+	phase := time.Duration(sim.rand.Int63n(int64(tickInterval)))
+	sim.schedule(&simEvent{at: sim.clock.now.Add(phase), kind: simTick, node: id, gen: n.gen})
+}
+
+func (sim *simulator) startAll() {
+	for id := range sim.nodes {
+		sim.start(id)
+	}
+}
+
+// crash stops server id. Only its storage survives to the next start.
+func (sim *simulator) crash(id int) {
+	n := sim.nodes[id]
+	n.srv.Kill()
+	n.up = false
+}
+
+// partition splits the network so that servers can only reach others in the
+// same group. Servers not named in any group are isolated from everybody.
+func (sim *simulator) partition(groups ...[]int) {
+	sim.group = make(map[int]int)
+	for id := range sim.nodes {
+		sim.group[id] = -1 - id
+	}
+	for g, ids := range groups {
+		for _, id := range ids {
+			sim.group[id] = g
+		}
+	}
+}
+
+// heal removes every partition.
+func (sim *simulator) heal() {
+	sim.group = make(map[int]int)
+}
+
+// propose hands the next command to every server that thinks it leads,
+// deposed leaders included, so they have uncommitted entries to lose.
+func (sim *simulator) propose() {
+	for _, n := range sim.nodes {
+		if !n.up {
+			continue
+		}
+		if _, _, isLeader := n.srv.Start([]byte(strconv.Itoa(sim.proposed))); isLeader {
+			sim.proposed++
+		}
+	}
+}
+
+// chaos randomly partitions, heals, crashes or restarts servers, or has a
+// leader hand over to a random server, which may be lagging or unreachable.
+func (sim *simulator) chaos() {
+	switch sim.rand.Intn(10) {
+	case 0, 1:
+		ids := append([]int(nil), sim.peers...)
+		sim.rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+		cut := 1 + sim.rand.Intn(len(ids)-1)
+		sim.partition(ids[:cut], ids[cut:])
+	case 2, 3:
+		sim.heal()
+	case 4:
+		if id := sim.rand.Intn(len(sim.nodes)); sim.nodes[id].up {
+			sim.crash(id)
+		}
+	case 5, 6:
+		if id := sim.rand.Intn(len(sim.nodes)); !sim.nodes[id].up {
+			sim.start(id)
+		}
+	case 7:
+		target := sim.rand.Intn(len(sim.nodes))
+		for _, n := range sim.nodes {
+			if n.up {
+				n.srv.mu.Lock()
+				n.srv.transferLeadership(target)
+				n.srv.mu.Unlock()
+			}
+		}
+	}
+}
+
+// apply plays the application on server id: it takes whatever has committed
+// and snapshots every few entries, like the demo application in main.
+func (sim *simulator) apply(id int) {
+	n := sim.nodes[id]
+	n.srv.mu.Lock()
+	msgs := n.srv.takeCommitted()
+	n.srv.mu.Unlock()
+
+	for _, msg := range msgs {
+		if msg.SnapshotValid {
+			n.applied = msg.SnapshotIndex
+			if n.app != nil {
+				n.app(msg)
+			}
+			continue
+		}
+		if msg.CommandIndex != n.applied+1 {
+			sim.fail("server%d applied index %d after %d", id, msg.CommandIndex, n.applied)
+			return
+		}
+		n.applied = msg.CommandIndex
+
+		var snapshot []byte
+		if n.app != nil {
+			snapshot = n.app(msg)
+		} else if n.applied%snapshotEvery == 0 {
+			snapshot = []byte(strconv.Itoa(n.applied))
+		}
+		if snapshot != nil {
+			n.srv.Snapshot(n.applied, snapshot)
+		}
+	}
+}
+
+// check verifies election safety, state machine safety and leader
+// completeness (§5.2 and §5.4 of the Raft paper) for server id.
+func (sim *simulator) check(id int) {
+	n := sim.nodes[id]
+	s := n.srv
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Nothing committed may ever change.
+	for i := max(n.committed, s.log[0].Index) + 1; i <= s.commitIndex; i++ {
+		e := s.entry(i)
+		if c, ok := sim.committed[i]; ok {
+			if c.Term != e.Term || !bytes.Equal(c.Command, e.Command) {
+				sim.fail("server%d committed %v at index %d where %v was committed before", id, e, i, c)
+				return
+			}
+			continue
+		}
+		sim.committed[i] = e
+		sim.maxCommitted = max(sim.maxCommitted, i)
+	}
+	n.committed = s.commitIndex
+
+	if s.state != Leader {
+		return
+	}
+	if leader, ok := sim.leaders[s.currentTerm]; ok {
+		if leader != id {
+			sim.fail("server%d and server%d both led term %d", leader, id, s.currentTerm)
+		}
+		return
+	}
+	sim.leaders[s.currentTerm] = id
+
+	// A new leader must hold every entry committed before it was elected.
+	if s.lastIndex() < sim.maxCommitted {
+		sim.fail("server%d leads term %d without index %d, which is committed", id, s.currentTerm, sim.maxCommitted)
+		return
+	}
+	for i := s.log[0].Index + 1; i <= sim.maxCommitted; i++ {
+		c, ok := sim.committed[i]
+		if e := s.entry(i); ok && (e.Term != c.Term || !bytes.Equal(e.Command, c.Command)) {
+			sim.fail("server%d leads term %d with %v at index %d, but %v is committed there", id, s.currentTerm, e, i, c)
+			return
+		}
+	}
+}
+
+// checkLogs verifies the log matching property across all servers. It walks
+// every log, so it runs periodically rather than after every event.
+func (sim *simulator) checkLogs() {
+	for id, n := range sim.nodes {
+		if !n.up {
+			continue
+		}
+		n.srv.mu.Lock()
+		for i := 1; i < len(n.srv.log); i++ {
+			e := n.srv.log[i]
+			key := simKey{index: e.Index, term: e.Term}
+			want := simEntry{prevTerm: n.srv.log[i-1].Term, typ: e.Type, command: string(e.Command)}
+			if got, ok := sim.entries[key]; ok && got != want {
+				sim.fail("server%d holds %v at index %d term %d where another log holds %v", id, want, e.Index, e.Term, got)
+				break
+			}
+			sim.entries[key] = want
+		}
+		n.srv.mu.Unlock()
+	}
+}
+
+func (sim *simulator) hasLeader() bool {
+	return sim.leader() >= 0
+}
+
+// leader returns the running server that leads the newest term, or -1 if
+// none does.
+func (sim *simulator) leader() int {
+	leader, newest := -1, -1
+	for id, n := range sim.nodes {
+		if !n.up {
+			continue
+		}
+		if term, isLeader := n.srv.GetState(); isLeader && term > newest {
+			leader, newest = id, term
+		}
+	}
+	return leader
+}
+
+func (sim *simulator) fail(format string, args ...any) {
+	if sim.err == nil {
+		sim.err = fmt.Errorf("at %v: %s", sim.clock.now.Sub(simEpoch), fmt.Sprintf(format, args...))
+	}
+}
+
+// runSimulations runs count seeds starting at first and stops at the first
+// one that breaks an invariant. Server logs are only shown for a single seed,
+// which is how a failure is replayed.
+func runSimulations(count int, first int64) {
+	if count > 1 {
+		log.SetOutput(io.Discard)
+	} else {
+		log.SetFlags(0)
+	}
+	for seed := first; seed < first+int64(count); seed++ {
+		sim := newSimulator(seed)
+		sim.verbose = count == 1
+		trace, err := sim.run()
+		log.SetPrefix("")
+		if err != nil {
+			log.SetOutput(os.Stderr)
+			log.Fatalf("seed %d failed %v (trace %016x); replay it with -sim 1 -seed %d", seed, err, trace, seed)
+		}
+		if count == 1 {
+			log.Printf("seed %d passed (trace %016x)\n", seed, trace)
+			return
+		}
+	}
+	log.SetOutput(os.Stderr)
+	log.Printf("all %d seeds from %d passed\n", count, first)
+}
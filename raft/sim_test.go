@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+var (
+	simSeeds     = flag.Int("seeds", 1000, "number of seeds TestSimulations runs; -short runs fewer")
+	simFirstSeed = flag.Int64("first-seed", 1, "first seed TestSimulations runs")
+)
+
+// Every seed plays a random run of partitions, crashes, restarts, lost
+// messages and leadership transfers, checking raft's safety invariants
+// throughout and that the cluster elects a leader once it is healed. A
+// failing seed is replayed with its server logs by
+//
+//	go test -run TestSimulations -v -seeds 1 -first-seed N
+func TestSimulations(t *testing.T) {
+	count := *simSeeds
+	if testing.Short() {
+		count = min(count, 50)
+	}
+	for seed := *simFirstSeed; seed < *simFirstSeed+int64(count); seed++ {
+		sim := newSimulator(seed)
+		sim.verbose = count == 1 && testing.Verbose()
+		trace, err := sim.run()
+		if err != nil {
+			t.Fatalf("seed %d failed %v (trace %016x)", seed, err, trace)
+		}
+	}
+}
+
+// The same seed must make the same run, or a failing one could not be
+// replayed.
+func TestSimulationReplays(t *testing.T) {
+	for seed := range int64(5) {
+		first, err := newSimulator(seed).run()
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		if again, _ := newSimulator(seed).run(); again != first {
+			t.Fatalf("seed %d: trace %016x the first time, %016x the second", seed, first, again)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import "log"
+
+// snapshotChunkSize is how much snapshot data rides on one InstallSnapshot message.
+const snapshotChunkSize = 32 << 10
+
+// Snapshot is the application state as of LastIncludedIndex. Once taken, the
+// log only needs entries after LastIncludedIndex.
+type Snapshot struct {
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	Peers             []int // configuration as of LastIncludedIndex
+	Data              []byte
+}
+
+// incomingSnapshot collects the chunks of a snapshot a follower is being sent.
+type incomingSnapshot struct {
+	lastIncludedIndex int
+	lastIncludedTerm  int
+	peers             []int
+	data              []byte
+}
+
+// Snapshot tells raft the application has captured its state up to and
+// including index, so the log can be discarded up to there. Applications call
+// it from their apply loop once the log grows past a size they care about.
+func (s *server) Snapshot(index int, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index <= s.log[0].Index || index > s.lastApplied {
+		return
+	}
+
+	peers, _ := s.configAt(index)
+	snap := Snapshot{LastIncludedIndex: index, LastIncludedTerm: s.termAt(index), Peers: peers, Data: data}
+	if err := s.storage.SaveSnapshot(snap); err != nil {
+		log.Fatalf("server%d failed to persist its snapshot: %v", s.id, err)
+	}
+	s.snapshot = snap
+	s.compactLog(index, snap.LastIncludedTerm)
+	log.Printf("server%d compacted its log up to index %d\n", s.id, index)
+}
+
+// compactLog drops every entry up to index and makes index the new sentinel.
+// The remaining entries are copied so the old array can be freed.
+func (s *server) compactLog(index, term int) {
+	rest := []LogEntry{{Index: index, Term: term}}
+	if index < s.lastIndex() {
+		rest = append(rest, s.log[index-s.log[0].Index+1:]...)
+	}
+	s.log = rest
+}
+
+// sendSnapshot sends peer the next chunk of our snapshot. It is used instead
+// of AppendEntries once the entries peer needs have been compacted away.
+func (s *server) sendSnapshot(peer int) {
+	offset, ok := s.snapshotOffset[peer]
+	if !ok {
+		offset = 0
+		s.snapshotOffset[peer] = 0
+		log.Printf("server%d sending snapshot at index %d to server%d\n", s.id, s.snapshot.LastIncludedIndex, peer)
+	}
+	end := min(offset+snapshotChunkSize, len(s.snapshot.Data))
+
+	s.send(Message{
+		Type:              MsgInstallSnapshot,
+		To:                peer,
+		Term:              s.currentTerm,
+		LastIncludedIndex: s.snapshot.LastIncludedIndex,
+		LastIncludedTerm:  s.snapshot.LastIncludedTerm,
+		Peers:             s.snapshot.Peers,
+		Offset:            offset,
+		Data:              s.snapshot.Data[offset:end],
+		Done:              end == len(s.snapshot.Data),
+	})
+}
+
+func (s *server) handleInstallSnapshot(m Message) {
+	reply := Message{Type: MsgInstallSnapshotResp, To: m.From, Term: s.currentTerm, LastIncludedIndex: m.LastIncludedIndex}
+	if m.Term < s.currentTerm {
+		s.send(reply)
+		return
+	}
+
+	s.becomeFollower(m.Term)
+	s.leaderID = m.From
+	s.resetElectionTimer()
+
+	// We already have everything the snapshot covers.
+	if m.LastIncludedIndex <= s.commitIndex {
+		s.incoming = nil
+		reply.Success = true
+		reply.MatchIndex = m.LastIncludedIndex
+		s.send(reply)
+		return
+	}
+
+	if m.Offset == 0 {
+		s.incoming = &incomingSnapshot{lastIncludedIndex: m.LastIncludedIndex, lastIncludedTerm: m.LastIncludedTerm, peers: m.Peers}
+	}
+	// Chunks must arrive in order; tell the leader where to resume otherwise.
+	if s.incoming == nil || s.incoming.lastIncludedIndex != m.LastIncludedIndex || m.Offset != len(s.incoming.data) {
+		if s.incoming != nil && s.incoming.lastIncludedIndex == m.LastIncludedIndex {
+			reply.Offset = len(s.incoming.data)
+		}
+		s.send(reply)
+		return
+	}
+
+	s.incoming.data = append(s.incoming.data, m.Data...)
+	if !m.Done {
+		reply.Offset = len(s.incoming.data)
+		s.send(reply)
+		return
+	}
+
+	snap := Snapshot{
+		LastIncludedIndex: m.LastIncludedIndex,
+		LastIncludedTerm:  m.LastIncludedTerm,
+		Peers:             s.incoming.peers,
+		Data:              s.incoming.data,
+	}
+	s.incoming = nil
+	if err := s.storage.SaveSnapshot(snap); err != nil {
+		log.Fatalf("server%d failed to persist its snapshot: %v", s.id, err)
+	}
+
+	// Keep our log past the snapshot only if it agrees with the snapshot at
+	// its last index; otherwise all of it is stale and goes.
+	if snap.LastIncludedIndex <= s.lastIndex() && s.termAt(snap.LastIncludedIndex) == snap.LastIncludedTerm {
+		s.compactLog(snap.LastIncludedIndex, snap.LastIncludedTerm)
+	} else {
+		s.log = []LogEntry{{Index: snap.LastIncludedIndex, Term: snap.LastIncludedTerm}}
+		s.persistEntries(s.log)
+	}
+
+	s.snapshot = snap
+	s.updateConfig()
+	s.snapshotPending = true
+	s.commitTo(snap.LastIncludedIndex)
+	log.Printf("server%d installed snapshot at index %d from server%d\n", s.id, snap.LastIncludedIndex, m.From)
+
+	reply.Success = true
+	reply.MatchIndex = snap.LastIncludedIndex
+	s.send(reply)
+}
+
+func (s *server) handleInstallSnapshotResp(m Message) {
+	if s.state != Leader || m.Term != s.currentTerm {
+		return
+	}
+	s.lastActive[m.From] = s.clock.Now()
+
+	// Success means the whole snapshot landed; otherwise Offset says which chunk to send next.
+	if m.Success {
+		delete(s.snapshotOffset, m.From)
+		if m.MatchIndex > s.matchIndex[m.From] {
+			s.matchIndex[m.From] = m.MatchIndex
+			s.nextIndex[m.From] = m.MatchIndex + 1
+			s.maybeCommit()
+			s.maybeSendTimeoutNow()
+		}
+		if s.nextIndex[m.From] <= s.lastIndex() {
+			s.sendAppend(m.From)
+		}
+		return
+	}
+
+	if _, ok := s.snapshotOffset[m.From]; !ok {
+		return
+	}
+	// We took a newer snapshot since this transfer began, so start over.
+	if m.LastIncludedIndex != s.snapshot.LastIncludedIndex {
+		m.Offset = 0
+	}
+	s.snapshotOffset[m.From] = m.Offset
+	s.sendSnapshot(m.From)
+}
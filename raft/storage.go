@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Storage persists the raft state that must survive a crash. Every method
+// returns only once the data is durable, because raft promises a vote or
+// acknowledges entries as soon as it replies.
+type Storage interface {
+	// SaveState records currentTerm and votedFor.
+	SaveState(term, votedFor int) error
+
+	// Append adds entries to the log. If entries[0].Index is already in the
+	// log, that entry and everything after it is replaced.
+	Append(entries []LogEntry) error
+
+	// Load returns what was saved before the last crash. A fresh storage
+	// returns term 0, votedFor -1 and no entries. Entries already covered by
+	// the snapshot may or may not be returned.
+	Load() (term, votedFor int, entries []LogEntry, err error)
+
+	// SaveSnapshot replaces the stored snapshot and lets the storage drop log
+	// entries before snap.LastIncludedIndex. The entry at LastIncludedIndex is
+	// kept so a restart can tell whether the entries after it belong with the
+	// snapshot.
+	SaveSnapshot(snap Snapshot) error
+
+	// LoadSnapshot returns the latest snapshot, or an empty one at index 0.
+	LoadSnapshot() (Snapshot, error)
+}
+
+// memStorage keeps everything in memory. It survives a simulated crash as long
+// as the restarted server is handed the same memStorage.
+type memStorage struct {
+	mu       sync.Mutex
+	term     int
+	votedFor int
+	entries  []LogEntry
+	snapshot Snapshot
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{votedFor: -1}
+}
+
+func (ms *memStorage) SaveState(term, votedFor int) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.term, ms.votedFor = term, votedFor
+	return nil
+}
+
+func (ms *memStorage) Append(entries []LogEntry) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, e := range entries {
+		ms.entries = truncateAndAppend(ms.entries, e)
+	}
+	return nil
+}
+
+func (ms *memStorage) Load() (int, int, []LogEntry, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.term, ms.votedFor, append([]LogEntry(nil), ms.entries...), nil
+}
+
+func (ms *memStorage) SaveSnapshot(snap Snapshot) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.snapshot = snap
+	for len(ms.entries) > 0 && ms.entries[0].Index < snap.LastIncludedIndex {
+		ms.entries = ms.entries[1:]
+	}
+	return nil
+}
+
+func (ms *memStorage) LoadSnapshot() (Snapshot, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.snapshot, nil
+}
+
+// truncateAndAppend appends e to entries, first dropping any entry at or
+// after e.Index. The entries are in index order but not always contiguous: a
+// snapshot installed from the leader can put the next entry far past the last
+// one.
+func truncateAndAppend(entries []LogEntry, e LogEntry) []LogEntry {
+	keep, _ := slices.BinarySearchFunc(entries, e.Index, func(x LogEntry, index int) int {
+		return cmp.Compare(x.Index, index)
+	})
+	return append(entries[:keep], e)
+}
+
+const (
+	segmentSize   = 4 << 20 // roll over to a new log segment past 4MB
+	maxRecordSize = 64 << 20
+	stateFile     = "state"
+	snapshotFile  = "snapshot"
+	segmentSuffix = ".seg"
+)
+
+var errCorrupt = errors.New("corrupt log record")
+
+// fileStorage keeps term and vote in a small state file and the snapshot in
+// another, both replaced atomically, and the log in append-only segment files.
+// Each log record is framed as [crc32][length][payload]; truncating the log
+// never rewrites a file, it just appends the replacement entry, and replay
+// lets later records win. Old segments are deleted once a snapshot covers them.
+type fileStorage struct {
+	dir string
+
+	mu          sync.Mutex
+	active      *os.File
+	activeSize  int64
+	nextSegment int
+	lastInSeg   map[int]int // highest index written to each segment
+}
+
+func newFileStorage(dir string) (*fileStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	fs := &fileStorage{dir: dir, lastInSeg: make(map[int]int)}
+	seqs, err := fs.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(seqs) > 0 {
+		fs.nextSegment = seqs[len(seqs)-1] + 1
+	}
+	return fs, nil
+}
+
+// Close closes the active segment. The storage is not used afterwards.
+func (fs *fileStorage) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.active == nil {
+		return nil
+	}
+	err := fs.active.Close()
+	fs.active = nil
+	return err
+}
+
+func (fs *fileStorage) SaveState(term, votedFor int) error {
+	buf := make([]byte, 20)
+	binary.BigEndian.PutUint64(buf[4:], uint64(term))
+	binary.BigEndian.PutUint64(buf[12:], uint64(int64(votedFor)))
+	binary.BigEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	return fs.replaceFile(stateFile, buf)
+}
+
+// replaceFile atomically swaps the contents of name for buf.
+func (fs *fileStorage) replaceFile(name string, buf []byte) error {
+	tmp := filepath.Join(fs.dir, name+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(fs.dir, name)); err != nil {
+		return err
+	}
+	return syncDir(fs.dir)
+}
+
+func (fs *fileStorage) loadState() (int, int, error) {
+	buf, err := os.ReadFile(filepath.Join(fs.dir, stateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, -1, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(buf) != 20 || binary.BigEndian.Uint32(buf) != crc32.ChecksumIEEE(buf[4:]) {
+		return 0, 0, fmt.Errorf("%s: %w", stateFile, errCorrupt)
+	}
+	return int(binary.BigEndian.Uint64(buf[4:])), int(int64(binary.BigEndian.Uint64(buf[12:]))), nil
+}
+
+func (fs *fileStorage) Append(entries []LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.active == nil || fs.activeSize >= segmentSize {
+		if err := fs.roll(); err != nil {
+			return err
+		}
+	}
+
+	var buf []byte
+	for _, e := range entries {
+		buf = appendRecord(buf, e)
+	}
+	fs.lastInSeg[fs.nextSegment-1] = max(fs.lastInSeg[fs.nextSegment-1], entries[len(entries)-1].Index)
+	n, err := fs.active.Write(buf)
+	fs.activeSize += int64(n)
+	if err != nil {
+		return err
+	}
+	return fs.active.Sync()
+}
+
+// roll closes the active segment and starts a new one.
+func (fs *fileStorage) roll() error {
+	if fs.active != nil {
+		if err := fs.active.Close(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(fs.segmentPath(fs.nextSegment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fs.active, fs.activeSize = f, 0
+	fs.nextSegment++
+	return syncDir(fs.dir)
+}
+
+func (fs *fileStorage) segmentPath(seq int) string {
+	return filepath.Join(fs.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// segments lists the sequence numbers of the segment files on disk, oldest first.
+func (fs *fileStorage) segments() ([]int, error) {
+	names, err := filepath.Glob(filepath.Join(fs.dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var seqs []int
+	for _, name := range names {
+		var seq int
+		if _, err := fmt.Sscanf(strings.TrimSuffix(filepath.Base(name), segmentSuffix), "%d", &seq); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+// Load replays every segment in order. A bad record at the tail of the last
+// segment is a write torn by the crash and is cut off; anywhere else it means
+// the log is damaged and Load fails.
+func (fs *fileStorage) Load() (int, int, []LogEntry, error) {
+	term, votedFor, err := fs.loadState()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	seqs, err := fs.segments()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var entries []LogEntry
+	for i, seq := range seqs {
+		path := fs.segmentPath(seq)
+		valid, err := replaySegment(path, func(e LogEntry) {
+			entries = truncateAndAppend(entries, e)
+			fs.lastInSeg[seq] = max(fs.lastInSeg[seq], e.Index)
+		})
+		if errors.Is(err, errCorrupt) && i == len(seqs)-1 {
+			log.Printf("truncating torn write at offset %d of %s\n", valid, path)
+			err = os.Truncate(path, valid)
+		}
+		if err != nil {
+			return 0, 0, nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	return term, votedFor, entries, nil
+}
+
+func (fs *fileStorage) SaveSnapshot(snap Snapshot) error {
+	if err := fs.replaceFile(snapshotFile, encodeSnapshot(snap)); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// A snapshot installed from the leader can cover the whole log, the
+	// active segment included. Start a new one so the old one can go too.
+	if last, ok := fs.lastInSeg[fs.nextSegment-1]; ok && last < snap.LastIncludedIndex {
+		if err := fs.roll(); err != nil {
+			return err
+		}
+	}
+
+	// Delete the oldest segments while everything in them is covered. The
+	// active segment and the one holding LastIncludedIndex are always kept.
+	seqs, err := fs.segments()
+	if err != nil {
+		return err
+	}
+	for _, seq := range seqs {
+		last, ok := fs.lastInSeg[seq]
+		if seq == fs.nextSegment-1 || !ok || last >= snap.LastIncludedIndex {
+			break
+		}
+		if err := os.Remove(fs.segmentPath(seq)); err != nil {
+			return err
+		}
+		delete(fs.lastInSeg, seq)
+	}
+	return syncDir(fs.dir)
+}
+
+func (fs *fileStorage) LoadSnapshot() (Snapshot, error) {
+	buf, err := os.ReadFile(filepath.Join(fs.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return Snapshot{}, nil
+	}
+	if err != nil {
+		return Snapshot{}, err
+	}
+	snap, err := decodeSnapshot(buf)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("%s: %w", snapshotFile, err)
+	}
+	return snap, nil
+}
+
+// An encoded snapshot is a crc32 followed by index, term, the number of
+// peers, the peers and finally the application's data.
+func encodeSnapshot(snap Snapshot) []byte {
+	buf := make([]byte, 24, 24+8*len(snap.Peers)+len(snap.Data))
+	binary.BigEndian.PutUint64(buf[4:], uint64(snap.LastIncludedIndex))
+	binary.BigEndian.PutUint64(buf[12:], uint64(snap.LastIncludedTerm))
+	binary.BigEndian.PutUint32(buf[20:], uint32(len(snap.Peers)))
+	for _, peer := range snap.Peers {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(peer))
+	}
+	buf = append(buf, snap.Data...)
+	binary.BigEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+func decodeSnapshot(buf []byte) (Snapshot, error) {
+	if len(buf) < 24 || binary.BigEndian.Uint32(buf) != crc32.ChecksumIEEE(buf[4:]) {
+		return Snapshot{}, errCorrupt
+	}
+
+	snap := Snapshot{
+		LastIncludedIndex: int(binary.BigEndian.Uint64(buf[4:])),
+		LastIncludedTerm:  int(binary.BigEndian.Uint64(buf[12:])),
+	}
+	n := int(binary.BigEndian.Uint32(buf[20:]))
+	if len(buf) < 24+8*n {
+		return Snapshot{}, errCorrupt
+	}
+	for i := 0; i < n; i++ {
+		snap.Peers = append(snap.Peers, int(binary.BigEndian.Uint64(buf[24+8*i:])))
+	}
+	snap.Data = buf[24+8*n:]
+	return snap, nil
+}
+
+// replaySegment calls fn for every intact record and returns the offset just past the last one.
+func replaySegment(path string, fn func(LogEntry)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		e, n, err := readRecord(r)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		fn(e)
+		offset += int64(n)
+	}
+}
+
+// A record is framed as [crc32][length][payload]. For the log, the payload
+// is one entry.
+func appendRecord(buf []byte, e LogEntry) []byte {
+	return appendFrame(buf, encodeEntry(e))
+}
+
+func readRecord(r io.Reader) (LogEntry, int, error) {
+	payload, n, err := readFrame(r)
+	if err != nil {
+		return LogEntry{}, 0, err
+	}
+	e, err := decodeEntry(payload)
+	return e, n, err
+}
+
+func appendFrame(buf, payload []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(payload))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+// readFrame returns io.EOF at a clean end of input and errCorrupt for a frame
+// that is cut short or fails its checksum.
+func readFrame(r io.Reader) ([]byte, int, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, errCorrupt
+	}
+
+	size := binary.BigEndian.Uint32(header[4:])
+	if size > maxRecordSize {
+		return nil, 0, errCorrupt
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, errCorrupt
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[:4]) {
+		return nil, 0, errCorrupt
+	}
+	return payload, len(header) + len(payload), nil
+}
+
+// An encoded entry is index, term, type length, type and command.
+func encodeEntry(e LogEntry) []byte {
+	buf := make([]byte, 0, 18+len(e.Type)+len(e.Command))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(e.Index))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(e.Term))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(e.Type)))
+	buf = append(buf, e.Type...)
+	return append(buf, e.Command...)
+}
+
+func decodeEntry(buf []byte) (LogEntry, error) {
+	if len(buf) < 18 {
+		return LogEntry{}, errCorrupt
+	}
+	typeLen := int(binary.BigEndian.Uint16(buf[16:]))
+	if len(buf) < 18+typeLen {
+		return LogEntry{}, errCorrupt
+	}
+	e := LogEntry{
+		Index: int(binary.BigEndian.Uint64(buf)),
+		Term:  int(binary.BigEndian.Uint64(buf[8:])),
+		Type:  EntryType(buf[18 : 18+typeLen]),
+	}
+	if cmd := buf[18+typeLen:]; len(cmd) > 0 {
+		e.Command = cmd
+	}
+	return e, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
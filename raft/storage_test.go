@@ -0,0 +1,286 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func entries(term int, indexes ...int) []LogEntry {
+	var es []LogEntry
+	for _, i := range indexes {
+		es = append(es, LogEntry{Index: i, Term: term, Type: EntryNormal, Command: []byte{byte(i)}})
+	}
+	return es
+}
+
+func span(from, to int) []int {
+	var is []int
+	for i := from; i <= to; i++ {
+		is = append(is, i)
+	}
+	return is
+}
+
+// openStorage opens the file storage in dir, failing the test if it cannot.
+func openStorage(t *testing.T, dir string) *fileStorage {
+	t.Helper()
+	fs, err := newFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	return fs
+}
+
+func loadIndexes(t *testing.T, fs *fileStorage) ([]int, []LogEntry) {
+	t.Helper()
+	_, _, es, err := fs.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var is []int
+	for _, e := range es {
+		is = append(is, e.Index)
+	}
+	return is, es
+}
+
+// A snapshot installed from the leader can be far ahead of the local log. The
+// entries after it must then replace each other by index as usual, across a
+// reload.
+func TestFileStorageSnapshotAheadOfLog(t *testing.T) {
+	dir := t.TempDir()
+	fs := openStorage(t, dir)
+	must(t, fs.Append(entries(1, span(1, 10)...)))
+	must(t, fs.SaveSnapshot(Snapshot{LastIncludedIndex: 500, LastIncludedTerm: 2}))
+	must(t, fs.Append(entries(2, 500, 501, 502)))
+	must(t, fs.Append(entries(3, 502)))
+	fs.Close()
+
+	fs = openStorage(t, dir)
+	is, es := loadIndexes(t, fs)
+	if !slices.Equal(is[len(is)-3:], []int{500, 501, 502}) || es[len(es)-1].Term != 3 {
+		t.Fatalf("reloaded %v, want a log ending in 500, 501, 502 at term 3", es)
+	}
+
+	// Overwriting after the reload works from the reloaded log.
+	must(t, fs.Append(entries(4, 501)))
+	fs.Close()
+	fs = openStorage(t, dir)
+	if is, es := loadIndexes(t, fs); is[len(is)-1] != 501 || es[len(es)-1].Term != 4 {
+		t.Fatalf("reloaded %v, want a log ending in 501 at term 4", es)
+	}
+}
+
+// Entries the snapshot covers are gone from disk once it is saved, however
+// far ahead of the log it is.
+func TestFileStorageSnapshotDropsCoveredSegments(t *testing.T) {
+	fs := openStorage(t, t.TempDir())
+	must(t, fs.Append(entries(1, span(1, 10)...)))
+	must(t, fs.SaveSnapshot(Snapshot{LastIncludedIndex: 500, LastIncludedTerm: 2}))
+	must(t, fs.Append(entries(2, 500)))
+	if is, _ := loadIndexes(t, fs); !slices.Equal(is, []int{500}) {
+		t.Fatalf("after a snapshot at 500 the log holds %v, want [500]", is)
+	}
+}
+
+// A follower installs a snapshot far ahead of its log, has an entry after it
+// overwritten by a new leader, and restarts from disk with the log the
+// leaders left it.
+func TestRestartAfterInstallSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	srv := newServer(1, []int{0, 1, 2}, &recordingTransport{}, openStorage(t, dir), nil)
+	step := func(m Message) {
+		m.From, m.To = 0, 1
+		srv.Step(m)
+	}
+	step(Message{Type: MsgAppendEntries, Term: 1, Entries: entries(1, span(1, 10)...), LeaderCommit: 10})
+	step(Message{Type: MsgInstallSnapshot, Term: 2, LastIncludedIndex: 500, LastIncludedTerm: 2, Peers: []int{0, 1, 2}, Data: []byte("snapshot"), Done: true})
+	step(Message{Type: MsgAppendEntries, Term: 2, PrevLogIndex: 500, PrevLogTerm: 2, Entries: entries(2, 501, 502), LeaderCommit: 500})
+	step(Message{Type: MsgAppendEntries, Term: 3, PrevLogIndex: 501, PrevLogTerm: 2, Entries: entries(3, 502), LeaderCommit: 502})
+	srv.Kill()
+	srv.storage.(*fileStorage).Close()
+
+	srv = newServer(1, []int{0, 1, 2}, &recordingTransport{}, openStorage(t, dir), nil)
+	want := []LogEntry{{Index: 500, Term: 2}, entries(2, 501)[0], entries(3, 502)[0]}
+	if !slices.EqualFunc(srv.log, want, sameEntry) {
+		t.Fatalf("restarted with log %v, want %v", srv.log, want)
+	}
+	if srv.currentTerm != 3 || srv.snapshot.LastIncludedIndex != 500 || string(srv.snapshot.Data) != "snapshot" {
+		t.Fatalf("restarted in term %d with snapshot %+v, want term 3 and the snapshot at 500", srv.currentTerm, srv.snapshot)
+	}
+}
+
+// A follower cut off long enough to need a snapshot catches up by one rather
+// than by the entries it missed, and still does after restarting from disk.
+func TestLaggingFollowerCatchesUpBySnapshot(t *testing.T) {
+	sim := newTestSim(1, 3, 3)
+	dirs := useFileStorage(t, sim)
+	sim.startAll()
+	applied := recordApplied(sim, snapshotEvery)
+	leader := awaitLeader(t, sim)
+	proposeFor(sim, 3*time.Second)
+
+	lagging := without(sim.peers, leader)[0]
+	sim.partition([]int{lagging}, without(sim.peers, lagging))
+	sim.runFor(time.Second)
+	before := sim.nodes[lagging].srv.Status()
+
+	sim.heal()
+	waitFor(t, sim, 2*time.Second, "snapshot installed", func() bool {
+		return sim.nodes[lagging].srv.Status().SnapshotIndex > before.LastIndex
+	})
+	restartFromDisk(t, sim, lagging, dirs[lagging])
+
+	waitFor(t, sim, 5*time.Second, "agreement", func() bool { return sameSequence(applied) })
+	checkSameSequence(t, applied)
+}
+
+func sameEntry(a, b LogEntry) bool {
+	return a.Index == b.Index && a.Term == b.Term && a.Type == b.Type && string(a.Command) == string(b.Command)
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tornAppend writes only the first n bytes of the records for entries, as a
+// crash partway through Append would leave them.
+func tornAppend(t *testing.T, fs *fileStorage, entries []LogEntry, n func(size int) int) {
+	t.Helper()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.active == nil {
+		must(t, fs.roll())
+	}
+	var buf []byte
+	for _, e := range entries {
+		buf = appendRecord(buf, e)
+	}
+	_, err := fs.active.Write(buf[:n(len(buf))])
+	must(t, err)
+}
+
+func TestFileStorageTornAppend(t *testing.T) {
+	torn := entries(2, 4, 5, 6)
+	for _, cut := range []int{1, 8, 20, -1} {
+		dir := t.TempDir()
+		fs := openStorage(t, dir)
+		must(t, fs.SaveState(3, 1))
+		must(t, fs.Append(entries(1, span(1, 5)...)))
+		tornAppend(t, fs, torn, func(size int) int {
+			if cut < 0 {
+				cut = size - 1
+			}
+			return cut
+		})
+		fs.Close()
+
+		// Records wholly written before the tear survive it; the rest is cut
+		// off.
+		want := entries(1, span(1, 5)...)
+		for i, size := 0, 0; i < len(torn); i++ {
+			if size = len(appendRecord(nil, torn[i])) + size; size > cut {
+				break
+			}
+			want = truncateAndAppend(want, torn[i])
+		}
+		fs = openStorage(t, dir)
+		term, votedFor, es, err := fs.Load()
+		must(t, err)
+		if term != 3 || votedFor != 1 || !slices.EqualFunc(es, want, sameEntry) {
+			t.Fatalf("cut after %d bytes: reloaded term %d, vote %d, log %v, want %v", cut, term, votedFor, es, want)
+		}
+
+		// The torn tail is gone for good: what is appended next follows the
+		// intact records.
+		for _, e := range entries(2, 5, 6) {
+			want = truncateAndAppend(want, e)
+		}
+		must(t, fs.Append(entries(2, 5, 6)))
+		fs.Close()
+		fs = openStorage(t, dir)
+		_, _, es, err = fs.Load()
+		must(t, err)
+		if !slices.EqualFunc(es, want, sameEntry) {
+			t.Fatalf("cut after %d bytes: reloaded %v, want %v", cut, es, want)
+		}
+	}
+}
+
+// tornStorage is the storage of a simulated server that crashes partway
+// through an append whenever crash says so. Only part of the records reach
+// the disk, and the server sends nothing more until it is restarted.
+type tornStorage struct {
+	*fileStorage
+	t     *testing.T
+	crash func() bool
+	down  func()
+	cut   func(size int) int
+}
+
+func (ts *tornStorage) Append(entries []LogEntry) error {
+	if !ts.crash() {
+		return ts.fileStorage.Append(entries)
+	}
+	tornAppend(ts.t, ts.fileStorage, entries, ts.cut)
+	ts.down()
+	return nil
+}
+
+// Servers crash in the middle of appending to their logs, leave torn records
+// behind, and restart from disk. Nothing committed may be lost, and they must
+// all end up applying the same sequence.
+func TestCrashMidAppend(t *testing.T) {
+	for seed := range int64(5) {
+		sim := newTestSim(seed, 5, 5)
+		dirs := useFileStorage(t, sim)
+		crashes := 0
+		for id, n := range sim.nodes {
+			n.storage = &tornStorage{
+				fileStorage: n.storage.(*fileStorage),
+				t:           t,
+				crash:       func() bool { return !sim.healed && sim.rand.Intn(50) == 0 },
+				cut:         func(size int) int { return sim.rand.Intn(size) },
+				down: func() {
+					// The server is mid-Step, so it cannot be killed; cut it
+					// off and restart it a little later.
+					crashes++
+					sim.nodes[id].up = false
+					sim.after(100*time.Millisecond, func() { restartTorn(t, sim, id, dirs[id]) })
+				},
+			}
+		}
+		sim.startAll()
+		applied := recordApplied(sim, snapshotEvery)
+		proposeFor(sim, 5*time.Second)
+		sim.runFor(5 * time.Second)
+		if sim.err != nil {
+			t.Fatalf("seed %d: %v", seed, sim.err)
+		}
+
+		sim.healed = true
+		sim.runFor(200 * time.Millisecond)
+		for i := range 10 {
+			sim.after(time.Duration(i)*simProposeEvery, sim.propose)
+		}
+		waitFor(t, sim, 5*time.Second, "agreement", func() bool { return sameSequence(applied) })
+		checkSameSequence(t, applied)
+		if crashes == 0 {
+			t.Fatalf("seed %d: no server crashed", seed)
+		}
+	}
+}
+
+// restartTorn restarts server id from its directory, keeping its storage
+// ready to crash again.
+func restartTorn(t *testing.T, sim *simulator, id int, dir string) {
+	ts := sim.nodes[id].storage.(*tornStorage)
+	ts.Close()
+	ts.fileStorage = openStorage(t, dir)
+	sim.start(id)
+}
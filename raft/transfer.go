@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"time"
+)
+
+// leaderTransferTimeout is how long a leader waits for the target to take
+// over before it gives up and resumes leading.
+const leaderTransferTimeout = 500 * time.Millisecond
+
+var (
+	errTransferInProgress = errors.New("a leadership transfer is already in progress")
+	errTransferTimeout    = errors.New("leadership transfer timed out")
+)
+
+// leaderTransfer is a handover to target that the leader is working on (§3.10
+// of the Raft thesis). While it is in progress the leader accepts no new
+// proposals, so the target can catch up with a log that is no longer growing.
+type leaderTransfer struct {
+	target      int
+	start       time.Time
+	timeoutSent bool
+	done        chan struct{}
+	err         error
+}
+
+// TransferLeadership hands leadership to target and waits until this server
+// has stepped down. It returns errTransferTimeout if target did not take over
+// in time, in which case this server carries on leading.
+func (s *server) TransferLeadership(target int) error {
+	s.mu.Lock()
+	t, err := s.transferLeadership(target)
+	s.mu.Unlock()
+	if err != nil || t == nil {
+		return err
+	}
+
+	select {
+	case <-t.done:
+	case <-time.After(2 * leaderTransferTimeout):
+		// Only reached if the server stopped ticking, i.e. it was killed.
+		return errTransferTimeout
+	}
+	return t.err
+}
+
+// transferLeadership starts a transfer without waiting for it. It returns nil
+// if there is nothing to do because we are the target.
+func (s *server) transferLeadership(target int) (*leaderTransfer, error) {
+	if s.state != Leader {
+		return nil, errNotLeader
+	}
+	if target == s.id {
+		return nil, nil
+	}
+	if !slices.Contains(s.peers, target) {
+		return nil, errNotMember
+	}
+	if s.transfer != nil {
+		return nil, errTransferInProgress
+	}
+
+	log.Printf("server%d transferring leadership to server%d\n", s.id, target)
+	s.transfer = &leaderTransfer{target: target, start: s.clock.Now(), done: make(chan struct{})}
+	s.maybeSendTimeoutNow()
+	if !s.transfer.timeoutSent {
+		s.sendAppend(target)
+	}
+	return s.transfer, nil
+}
+
+// maybeSendTimeoutNow tells the target to campaign once its log has caught up
+// with ours.
+func (s *server) maybeSendTimeoutNow() {
+	t := s.transfer
+	if t == nil || t.timeoutSent || s.matchIndex[t.target] != s.lastIndex() {
+		return
+	}
+	t.timeoutSent = true
+	s.send(Message{Type: MsgTimeoutNow, To: t.target, Term: s.currentTerm})
+}
+
+// checkTransfer gives up on a transfer that is taking too long or whose
+// target has left the configuration.
+func (s *server) checkTransfer() {
+	t := s.transfer
+	if t == nil {
+		return
+	}
+	if !slices.Contains(s.peers, t.target) {
+		log.Printf("server%d aborts leadership transfer: server%d was removed\n", s.id, t.target)
+		s.finishTransfer(errNotMember)
+		return
+	}
+	if s.clock.Now().Sub(t.start) >= leaderTransferTimeout {
+		log.Printf("server%d aborts leadership transfer: server%d did not take over in time\n", s.id, t.target)
+		s.finishTransfer(errTransferTimeout)
+	}
+}
+
+func (s *server) finishTransfer(err error) {
+	if s.transfer == nil {
+		return
+	}
+	// Votes for the target were granted regardless of our lease, so once it
+	// may have campaigned, heartbeats answered before now prove nothing.
+	if s.transfer.timeoutSent {
+		clear(s.probeSent)
+	}
+	s.transfer.err = err
+	close(s.transfer.done)
+	s.transfer = nil
+}
+
+// handleTimeoutNow starts an election right away, skipping the pre-vote: the
+// leader asked for it, so there is no leader to protect from disruption.
+func (s *server) handleTimeoutNow(m Message) {
+	if m.Term != s.currentTerm || !s.isMember() {
+		return
+	}
+	log.Printf("server%d asked by server%d to take over leadership\n", s.id, m.From)
+	s.campaign(true)
+}
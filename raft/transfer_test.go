@@ -0,0 +1,142 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// startTransfer has the leader of sim start handing over to target.
+func startTransfer(t *testing.T, sim *simulator, leader, target int) *leaderTransfer {
+	t.Helper()
+	s := sim.nodes[leader].srv
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tr, err := s.transferLeadership(target)
+	if err != nil || tr == nil {
+		t.Fatalf("server%d could not start a transfer to server%d: %v", leader, target, err)
+	}
+	return tr
+}
+
+// A target that missed entries is caught up before it is told to campaign,
+// and takes over.
+func TestTransferToLaggingTarget(t *testing.T) {
+	for seed := range int64(5) {
+		sim := newTestSim(seed, 3, 3)
+		sim.startAll()
+		applied := recordApplied(sim, 20)
+		leader := awaitLeader(t, sim)
+		proposeFor(sim, 3*time.Second)
+
+		target := without(sim.peers, leader)[0]
+		sim.partition([]int{target}, without(sim.peers, target))
+		sim.runFor(time.Second)
+		sim.heal()
+
+		tr := startTransfer(t, sim, leader, target)
+		if _, _, isLeader := sim.nodes[leader].srv.Start([]byte("during")); isLeader {
+			t.Fatalf("seed %d: leader took a proposal while handing over", seed)
+		}
+		waitFor(t, sim, leaderTransferTimeout, "transfer", func() bool {
+			select {
+			case <-tr.done:
+				return true
+			default:
+				return false
+			}
+		})
+		if tr.err != nil {
+			t.Fatalf("seed %d: transfer failed: %v", seed, tr.err)
+		}
+		if _, isLeader := sim.nodes[target].srv.GetState(); !isLeader {
+			t.Fatalf("seed %d: server%d does not lead after the transfer", seed, target)
+		}
+
+		sim.runFor(2 * time.Second)
+		waitFor(t, sim, 5*time.Second, "agreement", func() bool { return sameSequence(applied) })
+		checkSameSequence(t, applied)
+	}
+}
+
+// A target that cannot be reached never takes over. The leader gives up
+// after leaderTransferTimeout, keeps leading, and takes proposals again.
+func TestTransferToUnreachableTargetTimesOut(t *testing.T) {
+	sim := newTestSim(1, 5, 5)
+	sim.startAll()
+	leader := awaitLeader(t, sim)
+	s := sim.nodes[leader].srv
+	sim.runFor(time.Second)
+
+	target := without(sim.peers, leader)[0]
+	sim.partition([]int{target}, without(sim.peers, target))
+	term, _ := s.GetState()
+	tr := startTransfer(t, sim, leader, target)
+
+	s.mu.Lock()
+	_, err := s.transferLeadership(without(sim.peers, leader)[1])
+	s.mu.Unlock()
+	if err != errTransferInProgress {
+		t.Fatalf("second transfer started with %v, want %v", err, errTransferInProgress)
+	}
+	if _, _, isLeader := s.Start([]byte("during")); isLeader {
+		t.Fatal("leader took a proposal while handing over")
+	}
+
+	sim.runFor(leaderTransferTimeout + tickInterval)
+	select {
+	case <-tr.done:
+	default:
+		t.Fatalf("transfer still in progress after %v", leaderTransferTimeout)
+	}
+	if tr.err != errTransferTimeout {
+		t.Fatalf("transfer ended with %v, want %v", tr.err, errTransferTimeout)
+	}
+	if got, isLeader := s.GetState(); !isLeader || got != term {
+		t.Fatalf("leader of term %d is in term %d after the transfer, leading %v", term, got, isLeader)
+	}
+	index, _, isLeader := s.Start([]byte("after"))
+	if !isLeader {
+		t.Fatal("leader refused a proposal after the transfer was aborted")
+	}
+	waitFor(t, sim, time.Second, "commit", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.commitIndex >= index
+	})
+}
+
+// TransferLeadership itself reports the timeout, on servers running in real
+// time.
+func TestTransferLeadershipReturnsTimeout(t *testing.T) {
+	peers := []int{0, 1, 2}
+	network := newMemNetwork()
+	var servers []*server
+	for _, id := range peers {
+		srv := newServer(id, peers, network.Transport(id), newMemStorage(), make(chan ApplyMsg, 1000))
+		network.Register(id, srv.Step)
+		servers = append(servers, srv)
+		go srv.run()
+		defer srv.Kill()
+	}
+
+	var leader *server
+	for deadline := time.Now().Add(5 * time.Second); leader == nil; time.Sleep(tickInterval) {
+		if time.Now().After(deadline) {
+			t.Fatal("no leader")
+		}
+		for _, srv := range servers {
+			if _, isLeader := srv.GetState(); isLeader {
+				leader = srv
+			}
+		}
+	}
+
+	target := without(peers, leader.id)[0]
+	network.Partition([]int{target}, without(peers, target))
+	if err := leader.TransferLeadership(target); err != errTransferTimeout {
+		t.Fatalf("transfer to an unreachable server returned %v, want %v", err, errTransferTimeout)
+	}
+	if _, _, isLeader := leader.Start([]byte("after")); !isLeader {
+		t.Fatal("leader refused a proposal after the transfer was aborted")
+	}
+}
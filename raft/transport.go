@@ -0,0 +1,222 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// Transport carries messages between raft servers. Send must never block on
+// the receiver: delivery is best effort and raft copes with lost, delayed,
+// duplicated and reordered messages on its own.
+type Transport interface {
+	Send(m Message)
+}
+
+// memNetwork is an in-process network for tests and demos. Every message is
+// handed to the receiver on its own goroutine after a random delay, so
+// messages are reordered as soon as maxDelay > minDelay, and a duplicate of
+// it may follow after a delay of its own.
+type memNetwork struct {
+	mu       sync.Mutex
+	handlers map[int]func(Message)
+	group    map[int]int // partition group of each server; only servers in the same group can talk
+	rand     *rand.Rand
+
+	dropRate float64
+	dupRate  float64
+	minDelay time.Duration
+	maxDelay time.Duration
+}
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{
+		handlers: make(map[int]func(Message)),
+		group:    make(map[int]int),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Register routes messages addressed to id into handler.
+func (n *memNetwork) Register(id int, handler func(Message)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.handlers[id] = handler
+}
+
+// Transport returns the endpoint server id sends through.
+func (n *memNetwork) Transport(id int) Transport {
+	return &memTransport{id: id, net: n}
+}
+
+// SetUnreliable drops each message with probability dropRate and delays the rest by a random amount in [minDelay, maxDelay).
+func (n *memNetwork) SetUnreliable(dropRate float64, minDelay, maxDelay time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dropRate, n.minDelay, n.maxDelay = dropRate, minDelay, maxDelay
+}
+
+// SetDuplicating delivers each message that is not dropped a second time
+// with probability dupRate.
+func (n *memNetwork) SetDuplicating(dupRate float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dupRate = dupRate
+}
+
+// Partition splits the network so that servers can only reach others in the
+// same group. Servers not named in any group are isolated from everybody.
+func (n *memNetwork) Partition(groups ...[]int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.group = make(map[int]int)
+	for id := range n.handlers {
+		n.group[id] = -1 - id
+	}
+	for g, ids := range groups {
+		for _, id := range ids {
+			n.group[id] = g
+		}
+	}
+}
+
+// Heal removes every partition.
+func (n *memNetwork) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.group = make(map[int]int)
+}
+
+func (n *memNetwork) connected(from, to int) bool {
+	return n.group[from] == n.group[to]
+}
+
+func (n *memNetwork) deliver(m Message) {
+	n.mu.Lock()
+	handler, ok := n.handlers[m.To]
+	if !ok || !n.connected(m.From, m.To) || n.rand.Float64() < n.dropRate {
+		n.mu.Unlock()
+		return
+	}
+	copies := 1
+	if n.rand.Float64() < n.dupRate {
+		copies++
+	}
+	for range copies {
+		delay := n.minDelay
+		if n.maxDelay > n.minDelay {
+			delay += time.Duration(n.rand.Int63n(int64(n.maxDelay - n.minDelay)))
+		}
+		go func() {
+			time.Sleep(delay)
+
+			// The partition may have changed while the message was in flight.
+			n.mu.Lock()
+			ok := n.connected(m.From, m.To)
+			n.mu.Unlock()
+			if ok {
+				handler(m)
+			}
+		}()
+	}
+	n.mu.Unlock()
+}
+
+type memTransport struct {
+	id  int
+	net *memNetwork
+}
+
+func (t *memTransport) Send(m Message) {
+	m.From = t.id
+	t.net.deliver(m)
+}
+
+// outboxSize bounds how many messages may queue for one peer before new ones are dropped.
+const outboxSize = 1024
+
+// tcpTransport sends messages over net/rpc. Each peer gets its own outbox and
+// sender goroutine, so a dead peer only ever fills its own queue.
+type tcpTransport struct {
+	id    int
+	addrs map[int]string
+
+	mu      sync.Mutex
+	outbox  map[int]chan Message
+	handler func(Message)
+}
+
+func newTCPTransport(id int, addrs map[int]string) *tcpTransport {
+	return &tcpTransport{id: id, addrs: addrs, outbox: make(map[int]chan Message)}
+}
+
+// RaftRPC is the net/rpc service a tcpTransport exposes to its peers.
+type RaftRPC struct {
+	t *tcpTransport
+}
+
+func (r *RaftRPC) Step(m Message, ack *bool) error {
+	r.t.handler(m)
+	*ack = true
+	return nil
+}
+
+// Serve listens on this server's own address and hands every incoming message to handler.
+func (t *tcpTransport) Serve(handler func(Message)) error {
+	t.handler = handler
+
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Raft", &RaftRPC{t: t}); err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", t.addrs[t.id])
+	if err != nil {
+		return err
+	}
+	go srv.Accept(ln)
+	return nil
+}
+
+func (t *tcpTransport) Send(m Message) {
+	m.From = t.id
+
+	t.mu.Lock()
+	ch, ok := t.outbox[m.To]
+	if !ok {
+		ch = make(chan Message, outboxSize)
+		t.outbox[m.To] = ch
+		go t.sender(m.To, ch)
+	}
+	t.mu.Unlock()
+
+	select {
+	case ch <- m:
+	default:
+		// Outbox full, the peer is down or too slow. Raft will retry.
+	}
+}
+
+func (t *tcpTransport) sender(peer int, ch chan Message) {
+	var client *rpc.Client
+	for m := range ch {
+		if client == nil {
+			c, err := rpc.Dial("tcp", t.addrs[peer])
+			if err != nil {
+				continue
+			}
+			client = c
+		}
+
+		var ack bool
+		if err := client.Call("Raft.Step", m, &ack); err != nil {
+			log.Printf("server%d lost connection to server%d: %v\n", t.id, peer, err)
+			client.Close()
+			client = nil
+		}
+	}
+}
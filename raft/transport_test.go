@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// inbox collects the messages a server receives.
+type inbox struct {
+	mu   sync.Mutex
+	msgs []Message
+}
+
+func (in *inbox) handle(m Message) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.msgs = append(in.msgs, m)
+}
+
+// terms returns the Term of every message received so far, in the order
+// they arrived.
+func (in *inbox) terms() []int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	var terms []int
+	for _, m := range in.msgs {
+		terms = append(terms, m.Term)
+	}
+	return terms
+}
+
+// settle waits until in has received want messages and then for a while
+// longer, to catch any that were not meant to arrive.
+func (in *inbox) settle(t *testing.T, want int, timeout time.Duration) []int {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); len(in.terms()) < want && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	return in.terms()
+}
+
+// newMemInboxes returns a memNetwork with n servers registered, each
+// collecting what it receives.
+func newMemInboxes(n int) (*memNetwork, []*inbox) {
+	network := newMemNetwork()
+	var inboxes []*inbox
+	for id := range n {
+		in := &inbox{}
+		network.Register(id, in.handle)
+		inboxes = append(inboxes, in)
+	}
+	return network, inboxes
+}
+
+// sendTerms sends count messages from one server to another, numbered by
+// their Term from 1.
+func sendTerms(tr Transport, to, count int) {
+	for i := 1; i <= count; i++ {
+		tr.Send(Message{Type: MsgAppendEntries, To: to, Term: i})
+	}
+}
+
+// A reliable memNetwork delivers every message once, stamped with its
+// sender, and one that drops messages loses about the share it is told to.
+func TestMemNetworkDrop(t *testing.T) {
+	const count = 2000
+	for _, rate := range []float64{0, 0.3, 1} {
+		network, inboxes := newMemInboxes(2)
+		network.SetUnreliable(rate, 0, 0)
+		sendTerms(network.Transport(0), 1, count)
+
+		want := int(float64(count) * (1 - rate))
+		got := inboxes[1].settle(t, want, time.Second)
+		if lo, hi := want-count/20, want+count/20; len(got) < lo || len(got) > hi {
+			t.Errorf("drop rate %v: %d of %d messages arrived, want %d to %d", rate, len(got), count, lo, hi)
+		}
+		slices.Sort(got)
+		if len(slices.Compact(got)) != len(got) {
+			t.Errorf("drop rate %v: a message arrived twice without duplication", rate)
+		}
+		inboxes[1].mu.Lock()
+		for _, m := range inboxes[1].msgs {
+			if m.From != 0 {
+				t.Fatalf("message from server0 arrived as from server%d", m.From)
+			}
+		}
+		inboxes[1].mu.Unlock()
+	}
+}
+
+// Messages are delayed by at least minDelay and reordered when the delays
+// differ, and every one still arrives.
+func TestMemNetworkDelayReorders(t *testing.T) {
+	const count, minDelay = 200, 20 * time.Millisecond
+	network, inboxes := newMemInboxes(2)
+	network.SetUnreliable(0, minDelay, 2*minDelay)
+	sent := time.Now()
+	sendTerms(network.Transport(0), 1, count)
+
+	time.Sleep(minDelay / 2)
+	if n := len(inboxes[1].terms()); n > 0 {
+		t.Fatalf("%d messages arrived before the minimum delay", n)
+	}
+	got := inboxes[1].settle(t, count, time.Second)
+	if time.Since(sent) < minDelay {
+		t.Fatalf("messages arrived before the minimum delay")
+	}
+	if slices.IsSorted(got) {
+		t.Errorf("%d messages with random delays arrived in the order they were sent", count)
+	}
+	slices.Sort(got)
+	if len(got) != count || len(slices.Compact(got)) != count {
+		t.Errorf("%d of %d messages arrived, want each once", len(got), count)
+	}
+}
+
+// A duplicating memNetwork delivers some messages twice, and never a message
+// that was not sent.
+func TestMemNetworkDuplicates(t *testing.T) {
+	const count = 1000
+	network, inboxes := newMemInboxes(2)
+	network.SetDuplicating(0.5)
+	sendTerms(network.Transport(0), 1, count)
+
+	got := inboxes[1].settle(t, count*3/2, time.Second)
+	if lo, hi := count*3/2-count/10, count*3/2+count/10; len(got) < lo || len(got) > hi {
+		t.Errorf("%d messages arrived for %d sent, want %d to %d", len(got), count, lo, hi)
+	}
+	counts := make(map[int]int)
+	for _, term := range got {
+		counts[term]++
+	}
+	for i := 1; i <= count; i++ {
+		if n := counts[i]; n < 1 || n > 2 {
+			t.Fatalf("message %d arrived %d times", i, n)
+		}
+	}
+	if len(counts) != count {
+		t.Errorf("%d distinct messages arrived, %d were sent", len(counts), count)
+	}
+}
+
+// Servers reach only the others in their own group, servers in no group
+// reach nobody, messages in flight when a partition starts are lost, and
+// healing lets everything through again.
+func TestMemNetworkPartition(t *testing.T) {
+	network, inboxes := newMemInboxes(4)
+	network.Partition([]int{0, 1}, []int{2})
+	for from := range 4 {
+		for to := range 4 {
+			if from != to {
+				network.Transport(from).Send(Message{To: to, Term: from})
+			}
+		}
+	}
+	want := [][]int{{1}, {0}, nil, nil}
+	for id, in := range inboxes {
+		if got := in.settle(t, len(want[id]), 100*time.Millisecond); !slices.Equal(got, want[id]) {
+			t.Errorf("server%d heard from %v, want %v", id, got, want[id])
+		}
+	}
+
+	network.Heal()
+	network.SetUnreliable(0, 50*time.Millisecond, 50*time.Millisecond)
+	network.Transport(2).Send(Message{To: 3, Term: 2})
+	network.Partition([]int{2}, []int{3})
+	if got := inboxes[3].settle(t, 1, 100*time.Millisecond); len(got) > 0 {
+		t.Errorf("a message in flight when the partition started arrived")
+	}
+
+	network.Heal()
+	network.Transport(2).Send(Message{To: 3, Term: 2})
+	if got := inboxes[3].settle(t, 1, time.Second); !slices.Equal(got, []int{2}) {
+		t.Errorf("server3 heard %v after healing, want [2]", got)
+	}
+}
+
+// freeAddrs returns n addresses on localhost that nothing listens on.
+func freeAddrs(t *testing.T, n int) map[int]string {
+	t.Helper()
+	addrs := make(map[int]string)
+	for id := range n {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[id] = ln.Addr().String()
+		ln.Close()
+	}
+	return addrs
+}
+
+// A tcpTransport delivers messages whole, in the order they were sent to
+// each peer, and reaches a peer that only starts listening later.
+func TestTCPTransportRoundTrip(t *testing.T) {
+	addrs := freeAddrs(t, 2)
+	var ins [2]inbox
+	a, b := newTCPTransport(0, addrs), newTCPTransport(1, addrs)
+	if err := a.Serve(ins[0].handle); err != nil {
+		t.Fatal(err)
+	}
+
+	// b is not up yet; what a sends meanwhile may be lost, but a keeps trying.
+	a.Send(Message{To: 1, Term: 0})
+	if err := b.Serve(ins[1].handle); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Message{
+		Type:         MsgAppendEntries,
+		To:           1,
+		Term:         7,
+		PrevLogIndex: 3,
+		PrevLogTerm:  6,
+		Entries:      []LogEntry{{Index: 4, Term: 7, Command: []byte("x")}},
+		LeaderCommit: 3,
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(ins[1].terms()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("server1 heard nothing once it started listening")
+		}
+		a.Send(Message{To: 1, Term: 0})
+	}
+	// Let the retries through before counting.
+	time.Sleep(50 * time.Millisecond)
+	ins[1].mu.Lock()
+	ins[1].msgs = nil
+	ins[1].mu.Unlock()
+
+	a.Send(want)
+	for i := 1; i <= 100; i++ {
+		a.Send(Message{To: 1, Term: 100 + i})
+		b.Send(Message{To: 0, Term: i})
+	}
+	got := ins[1].settle(t, 101, 5*time.Second)
+	if len(got) != 101 || !slices.IsSorted(got) {
+		t.Fatalf("server1 received terms %v, want 7 and 101 to 200 in order", got)
+	}
+	ins[1].mu.Lock()
+	first := ins[1].msgs[0]
+	ins[1].mu.Unlock()
+	want.From = 0
+	if fmt.Sprint(first) != fmt.Sprint(want) {
+		t.Errorf("server1 received %+v, want %+v", first, want)
+	}
+	if got := ins[0].settle(t, 100, 5*time.Second); len(got) != 100 || !slices.IsSorted(got) {
+		t.Errorf("server0 received terms %v, want 1 to 100 in order", got)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+const (
+	walFile = "wal"
+
+	// walCheckpointSize is how large the shared log may grow before it is
+	// rewritten to hold only what the groups still need.
+	walCheckpointSize = 64 << 20
+)
+
+// Kinds of record in the shared log. Every record payload starts with the
+// group it belongs to and its kind.
+const (
+	walState    byte = 1 // term, votedFor
+	walEntry    byte = 2 // one log entry, encoded as by encodeEntry
+	walSnapshot byte = 3 // encoded as by encodeSnapshot
+)
+
+// sharedStorage keeps the raft state of every group a Host runs in a single
+// append-only file, so hundreds of groups cost one file and one fsync per
+// batch of writes rather than a directory and an fsync each. Writers that
+// arrive while an fsync is under way are made durable together by the next
+// one. The file is replayed into an in-memory image of each group on open,
+// and rewritten from that image once it has grown past walCheckpointSize.
+type sharedStorage struct {
+	dir            string
+	checkpointSize int64 // walCheckpointSize, unless a test wants checkpoints sooner
+
+	mu       sync.Mutex // guards everything below except file and size
+	groups   map[int]*memStorage
+	pending  []byte // records not yet written to the file
+	appended int    // number of records ever appended
+	synced   int    // number of records known to be durable
+
+	syncMu sync.Mutex // held while writing and syncing the file
+	file   *os.File
+	size   int64
+}
+
+func openSharedStorage(dir string) (*sharedStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	ss := &sharedStorage{dir: dir, checkpointSize: walCheckpointSize, groups: make(map[int]*memStorage)}
+	path := filepath.Join(dir, walFile)
+	valid, err := ss.replay(path)
+	if errors.Is(err, errCorrupt) {
+		log.Printf("truncating torn write at offset %d of %s\n", valid, path)
+		err = os.Truncate(path, valid)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	ss.file, ss.size = f, valid
+	return ss, syncDir(dir)
+}
+
+// Group returns the Storage of one group. It may be called for groups the
+// file has never seen.
+func (ss *sharedStorage) Group(group int) Storage {
+	return &groupStorage{ss: ss, group: group}
+}
+
+func (ss *sharedStorage) Close() error {
+	ss.syncMu.Lock()
+	defer ss.syncMu.Unlock()
+	return ss.file.Close()
+}
+
+// replay applies every intact record in path to the image and returns the
+// offset just past the last one.
+func (ss *sharedStorage) replay(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		payload, n, err := readFrame(r)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err == nil {
+			err = ss.apply(payload)
+		}
+		if err != nil {
+			return offset, err
+		}
+		offset += int64(n)
+	}
+}
+
+// apply updates the image with one record payload.
+func (ss *sharedStorage) apply(payload []byte) error {
+	if len(payload) < 9 {
+		return errCorrupt
+	}
+	g := ss.image(int(binary.BigEndian.Uint64(payload)))
+	body := payload[9:]
+
+	switch payload[8] {
+	case walState:
+		if len(body) != 16 {
+			return errCorrupt
+		}
+		return g.SaveState(int(binary.BigEndian.Uint64(body)), int(int64(binary.BigEndian.Uint64(body[8:]))))
+	case walEntry:
+		e, err := decodeEntry(body)
+		if err != nil {
+			return err
+		}
+		return g.Append([]LogEntry{e})
+	case walSnapshot:
+		snap, err := decodeSnapshot(body)
+		if err != nil {
+			return err
+		}
+		return g.SaveSnapshot(snap)
+	}
+	return errCorrupt
+}
+
+func (ss *sharedStorage) image(group int) *memStorage {
+	g, ok := ss.groups[group]
+	if !ok {
+		g = newMemStorage()
+		ss.groups[group] = g
+	}
+	return g
+}
+
+// write appends records for group and returns once they are durable.
+func (ss *sharedStorage) write(group int, kind byte, bodies ...[]byte) error {
+	ss.mu.Lock()
+	for _, body := range bodies {
+		payload := walPayload(group, kind, body)
+		if err := ss.apply(payload); err != nil {
+			ss.mu.Unlock()
+			return err
+		}
+		ss.pending = appendFrame(ss.pending, payload)
+		ss.appended++
+	}
+	seq := ss.appended
+	ss.mu.Unlock()
+
+	return ss.sync(seq)
+}
+
+// sync makes the first seq records durable, along with whatever else is
+// pending by the time it gets the file.
+func (ss *sharedStorage) sync(seq int) error {
+	ss.syncMu.Lock()
+	defer ss.syncMu.Unlock()
+
+	ss.mu.Lock()
+	if ss.synced >= seq {
+		ss.mu.Unlock()
+		return nil
+	}
+	buf, upTo := ss.pending, ss.appended
+	ss.pending = nil
+	ss.mu.Unlock()
+
+	n, err := ss.file.Write(buf)
+	ss.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if err := ss.file.Sync(); err != nil {
+		return err
+	}
+
+	ss.mu.Lock()
+	ss.synced = upTo
+	ss.mu.Unlock()
+
+	if ss.size >= ss.checkpointSize {
+		return ss.checkpoint()
+	}
+	return nil
+}
+
+// checkpoint replaces the file with one holding just the current image:
+// each group's snapshot, state and the entries after its snapshot. It is
+// called with syncMu held.
+func (ss *sharedStorage) checkpoint() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ids := make([]int, 0, len(ss.groups))
+	for id := range ss.groups {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	var buf []byte
+	for _, id := range ids {
+		g := ss.groups[id]
+		term, votedFor, entries, _ := g.Load()
+		snap, _ := g.LoadSnapshot()
+
+		state := binary.BigEndian.AppendUint64(nil, uint64(term))
+		state = binary.BigEndian.AppendUint64(state, uint64(int64(votedFor)))
+		buf = appendFrame(buf, walPayload(id, walSnapshot, encodeSnapshot(snap)))
+		buf = appendFrame(buf, walPayload(id, walState, state))
+		for _, e := range entries {
+			buf = appendFrame(buf, walPayload(id, walEntry, encodeEntry(e)))
+		}
+	}
+
+	path := filepath.Join(ss.dir, walFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o644); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		f.Close()
+		return err
+	}
+	if err := syncDir(ss.dir); err != nil {
+		f.Close()
+		return err
+	}
+
+	// Anything still pending is in the image, and so in the new file already.
+	ss.file.Close()
+	ss.file, ss.size = f, int64(len(buf))
+	ss.pending = nil
+	ss.synced = ss.appended
+	log.Printf("checkpointed shared log of %d groups to %d bytes\n", len(ids), len(buf))
+	return nil
+}
+
+func walPayload(group int, kind byte, body []byte) []byte {
+	payload := make([]byte, 9, 9+len(body))
+	binary.BigEndian.PutUint64(payload, uint64(group))
+	payload[8] = kind
+	return append(payload, body...)
+}
+
+// groupStorage is one group's view of a sharedStorage.
+type groupStorage struct {
+	ss    *sharedStorage
+	group int
+}
+
+func (gs *groupStorage) SaveState(term, votedFor int) error {
+	body := binary.BigEndian.AppendUint64(nil, uint64(term))
+	body = binary.BigEndian.AppendUint64(body, uint64(int64(votedFor)))
+	return gs.ss.write(gs.group, walState, body)
+}
+
+func (gs *groupStorage) Append(entries []LogEntry) error {
+	bodies := make([][]byte, len(entries))
+	for i, e := range entries {
+		bodies[i] = encodeEntry(e)
+	}
+	return gs.ss.write(gs.group, walEntry, bodies...)
+}
+
+func (gs *groupStorage) Load() (int, int, []LogEntry, error) {
+	gs.ss.mu.Lock()
+	g := gs.ss.image(gs.group)
+	gs.ss.mu.Unlock()
+	return g.Load()
+}
+
+func (gs *groupStorage) SaveSnapshot(snap Snapshot) error {
+	return gs.ss.write(gs.group, walSnapshot, encodeSnapshot(snap))
+}
+
+func (gs *groupStorage) LoadSnapshot() (Snapshot, error) {
+	gs.ss.mu.Lock()
+	g := gs.ss.image(gs.group)
+	gs.ss.mu.Unlock()
+	return g.LoadSnapshot()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// openShared opens the shared storage in dir, failing the test if it cannot.
+func openShared(t *testing.T, dir string) *sharedStorage {
+	t.Helper()
+	ss, err := openSharedStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ss.Close() })
+	return ss
+}
+
+// writeRandom makes n random writes, each to a random one of groups, to ss
+// and to models, which keep what each group should have.
+func writeRandom(t *testing.T, rng *rand.Rand, ss *sharedStorage, models map[int]*memStorage, groups, n int) {
+	t.Helper()
+	for range n {
+		g := rng.Intn(groups)
+		if models[g] == nil {
+			models[g] = newMemStorage()
+		}
+		model, gs := models[g], ss.Group(g)
+		_, _, es, _ := model.Load()
+		snap, _ := model.LoadSnapshot()
+		last := snap.LastIncludedIndex
+		if len(es) > 0 {
+			last = es[len(es)-1].Index
+		}
+		switch r := rng.Intn(20); {
+		case r == 0:
+			// A snapshot somewhere in the log, or past its end as one from
+			// the leader may be.
+			s := Snapshot{LastIncludedIndex: last - rng.Intn(3) + 1, LastIncludedTerm: 5, Peers: []int{0, 1, 2}, Data: []byte(fmt.Sprint(g, last))}
+			s.LastIncludedIndex = max(s.LastIncludedIndex, snap.LastIncludedIndex+1)
+			must(t, model.SaveSnapshot(s))
+			must(t, gs.SaveSnapshot(s))
+		case r < 4:
+			term, _, _, _ := model.Load()
+			vote := rng.Intn(3)
+			must(t, model.SaveState(term+1, vote))
+			must(t, gs.SaveState(term+1, vote))
+		default:
+			// Append after the last entry, or overwrite the last few.
+			from := max(last-rng.Intn(3)+1, snap.LastIncludedIndex+1)
+			batch := entries(rng.Intn(5)+1, span(from, from+rng.Intn(4))...)
+			must(t, model.Append(batch))
+			must(t, gs.Append(batch))
+		}
+	}
+}
+
+// checkGroups fails the test unless every group of ss has what its model
+// has.
+func checkGroups(t *testing.T, ss *sharedStorage, models map[int]*memStorage) {
+	t.Helper()
+	for g, model := range models {
+		term, vote, es, err := ss.Group(g).Load()
+		must(t, err)
+		snap, err := ss.Group(g).LoadSnapshot()
+		must(t, err)
+		wantTerm, wantVote, wantEs, _ := model.Load()
+		wantSnap, _ := model.LoadSnapshot()
+		if term != wantTerm || vote != wantVote || !slices.EqualFunc(es, wantEs, sameEntry) {
+			t.Fatalf("group %d has term %d, vote %d, log %v; want term %d, vote %d, log %v", g, term, vote, es, wantTerm, wantVote, wantEs)
+		}
+		if snap.LastIncludedIndex != wantSnap.LastIncludedIndex || string(snap.Data) != string(wantSnap.Data) || !slices.Equal(snap.Peers, wantSnap.Peers) {
+			t.Fatalf("group %d has snapshot %+v, want %+v", g, snap, wantSnap)
+		}
+	}
+}
+
+// Writes of many groups interleaved in one file, overwriting entries and
+// installing snapshots, are each group's own again once the file is
+// replayed.
+func TestSharedStorageReplay(t *testing.T) {
+	for seed := range int64(5) {
+		rng := rand.New(rand.NewSource(seed))
+		dir := t.TempDir()
+		models := make(map[int]*memStorage)
+		ss := openShared(t, dir)
+		writeRandom(t, rng, ss, models, 10, 1000)
+		checkGroups(t, ss, models)
+		ss.Close()
+
+		ss = openShared(t, dir)
+		checkGroups(t, ss, models)
+		if term, vote, es, _ := ss.Group(99).Load(); term != 0 || vote != -1 || len(es) != 0 {
+			t.Fatalf("seed %d: a group never written has term %d, vote %d, log %v", seed, term, vote, es)
+		}
+
+		// Writes after a replay follow the replayed ones.
+		writeRandom(t, rng, ss, models, 10, 200)
+		ss.Close()
+		checkGroups(t, openShared(t, dir), models)
+	}
+}
+
+// Once the file grows past the checkpoint size it is rewritten to hold only
+// what the groups still need, which is less than was written, and replays
+// to the same groups.
+func TestSharedStorageCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	rng := rand.New(rand.NewSource(1))
+	models := make(map[int]*memStorage)
+	ss := openShared(t, dir)
+	ss.checkpointSize = 16 << 10
+	writeRandom(t, rng, ss, models, 5, 2000)
+	info, err := os.Stat(filepath.Join(dir, walFile))
+	must(t, err)
+	if info.Size() >= ss.checkpointSize || info.Size() != ss.size {
+		t.Fatalf("file is %d bytes after %d records, %d by the storage's count, want under %d", info.Size(), ss.appended, ss.size, ss.checkpointSize)
+	}
+	if _, err := os.Stat(filepath.Join(dir, walFile+".tmp")); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint left its temporary file behind: %v", err)
+	}
+	checkGroups(t, ss, models)
+	writeRandom(t, rng, ss, models, 5, 50)
+	ss.Close()
+	checkGroups(t, openShared(t, dir), models)
+}
+
+// A record cut short by a crash is dropped on replay with everything after
+// it, the records before it survive, and what is written next follows them.
+func TestSharedStorageTornTail(t *testing.T) {
+	for _, cut := range []int{1, 8, 20, -1} {
+		dir := t.TempDir()
+		ss := openShared(t, dir)
+		must(t, ss.Group(1).SaveState(3, 1))
+		must(t, ss.Group(1).Append(entries(1, span(1, 5)...)))
+		must(t, ss.Group(2).Append(entries(1, 1, 2)))
+		ss.Close()
+
+		// Half a record for group 2 at the end of the file.
+		frame := appendFrame(nil, walPayload(2, walEntry, encodeEntry(entries(1, 3)[0])))
+		if cut < 0 {
+			cut = len(frame) - 1
+		}
+		f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_WRONLY|os.O_APPEND, 0o644)
+		must(t, err)
+		_, err = f.Write(frame[:cut])
+		must(t, err)
+		f.Close()
+
+		ss = openShared(t, dir)
+		models := map[int]*memStorage{1: newMemStorage(), 2: newMemStorage()}
+		must(t, models[1].SaveState(3, 1))
+		must(t, models[1].Append(entries(1, span(1, 5)...)))
+		must(t, models[2].Append(entries(1, 1, 2)))
+		checkGroups(t, ss, models)
+
+		must(t, ss.Group(2).Append(entries(2, 3, 4)))
+		must(t, models[2].Append(entries(2, 3, 4)))
+		ss.Close()
+		checkGroups(t, openShared(t, dir), models)
+	}
+}
+
+// Groups writing at the same time each get their own writes back, in the
+// order they made them, whichever fsync made them durable.
+func TestSharedStorageConcurrentGroups(t *testing.T) {
+	dir := t.TempDir()
+	ss := openShared(t, dir)
+	const groups, writes = 20, 50
+	var wg sync.WaitGroup
+	for g := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 1; i <= writes; i++ {
+				if err := ss.Group(g).Append(entries(g+1, i)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	ss.Close()
+
+	ss = openShared(t, dir)
+	for g := range groups {
+		_, _, es, err := ss.Group(g).Load()
+		must(t, err)
+		if want := entries(g+1, span(1, writes)...); !slices.EqualFunc(es, want, sameEntry) {
+			t.Fatalf("group %d replayed %v, want %v", g, es, want)
+		}
+	}
+}
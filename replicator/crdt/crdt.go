@@ -0,0 +1,523 @@
+// Package crdt provides conflict-free replicated data types: counters, sets
+// and registers that replicas write to independently and merge into the same
+// state whatever order the merges come in.
+package crdt
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// CRDT is a replicated data type: replicas take writes independently, with
+// no master to order them, and merge each other's state in any order, any
+// grouping and any number of times to reach the same state.
+//
+// Every write returns a delta, a value of the same type holding just what
+// the write changed, which the writer has already merged. Merging the delta
+// into another replica has the same effect as merging the whole state, so
+// replicas need only send each other deltas.
+type CRDT interface {
+	// Merge joins other, of the same type, into the receiver.
+	Merge(other CRDT) error
+	// MarshalBinary encodes the state. Equal states encode the same.
+	MarshalBinary() ([]byte, error)
+	// UnmarshalBinary replaces the state with one MarshalBinary encoded.
+	UnmarshalBinary(data []byte) error
+}
+
+var (
+	ErrType      = errors.New("cannot merge CRDTs of different types")
+	ErrMalformed = errors.New("malformed CRDT encoding")
+)
+
+// Kinds are the CRDTs newCRDT makes.
+var Kinds = []string{"gcounter", "pncounter", "orset", "lww", "mvregister"}
+
+// New returns an empty CRDT of kind, one of Kinds.
+func New(kind string) (CRDT, error) {
+	switch kind {
+	case "gcounter":
+		return NewGCounter(), nil
+	case "pncounter":
+		return NewPNCounter(), nil
+	case "orset":
+		return NewORSet(), nil
+	case "lww":
+		return &LWWRegister{}, nil
+	case "mvregister":
+		return &MVRegister{}, nil
+	}
+	return nil, fmt.Errorf("unknown CRDT %q", kind)
+}
+
+// GCounter is a counter that only grows. Each node counts its own
+// increments, and the value is the sum of every node's count.
+type GCounter struct {
+	counts map[int]uint64
+}
+
+// NewGCounter returns a counter at zero.
+func NewGCounter() *GCounter {
+	return &GCounter{counts: make(map[int]uint64)}
+}
+
+// Inc adds n on behalf of node.
+func (g *GCounter) Inc(node int, n uint64) *GCounter {
+	g.counts[node] += n
+	return &GCounter{counts: map[int]uint64{node: g.counts[node]}}
+}
+
+func (g *GCounter) Value() uint64 {
+	var v uint64
+	for _, n := range g.counts {
+		v += n
+	}
+	return v
+}
+
+func (g *GCounter) Merge(other CRDT) error {
+	o, ok := other.(*GCounter)
+	if !ok {
+		return ErrType
+	}
+	for node, n := range o.counts {
+		g.counts[node] = max(g.counts[node], n)
+	}
+	return nil
+}
+
+func (g *GCounter) MarshalBinary() ([]byte, error) {
+	data := binary.AppendUvarint(nil, uint64(len(g.counts)))
+	for _, node := range slices.Sorted(maps.Keys(g.counts)) {
+		data = binary.AppendUvarint(data, uint64(node))
+		data = binary.AppendUvarint(data, g.counts[node])
+	}
+	return data, nil
+}
+
+func (g *GCounter) UnmarshalBinary(data []byte) error {
+	counts, rest, err := readCounts(data)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return ErrMalformed
+	}
+	g.counts = counts
+	return nil
+}
+
+// readCounts reads a node -> count map as GCounter encodes it.
+func readCounts(data []byte) (map[int]uint64, []byte, error) {
+	n, data, err := readUvarint(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	counts := make(map[int]uint64)
+	for range n {
+		var node, count uint64
+		if node, data, err = readUvarint(data); err != nil {
+			return nil, nil, err
+		}
+		if count, data, err = readUvarint(data); err != nil {
+			return nil, nil, err
+		}
+		counts[int(node)] = count
+	}
+	return counts, data, nil
+}
+
+func readUvarint(b []byte) (uint64, []byte, error) {
+	v, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, ErrMalformed
+	}
+	return v, b[n:], nil
+}
+
+// PNCounter is a counter that goes both ways: one GCounter of increments
+// and one of decrements.
+type PNCounter struct {
+	inc, dec *GCounter
+}
+
+// NewPNCounter returns a counter at zero.
+func NewPNCounter() *PNCounter {
+	return &PNCounter{inc: NewGCounter(), dec: NewGCounter()}
+}
+
+// Add adds delta, which may be negative, on behalf of node.
+func (p *PNCounter) Add(node int, delta int64) *PNCounter {
+	d := NewPNCounter()
+	if delta >= 0 {
+		d.inc = p.inc.Inc(node, uint64(delta))
+	} else {
+		d.dec = p.dec.Inc(node, uint64(-delta))
+	}
+	return d
+}
+
+func (p *PNCounter) Value() int64 {
+	return int64(p.inc.Value() - p.dec.Value())
+}
+
+func (p *PNCounter) Merge(other CRDT) error {
+	o, ok := other.(*PNCounter)
+	if !ok {
+		return ErrType
+	}
+	p.inc.Merge(o.inc)
+	p.dec.Merge(o.dec)
+	return nil
+}
+
+func (p *PNCounter) MarshalBinary() ([]byte, error) {
+	inc, _ := p.inc.MarshalBinary()
+	dec, _ := p.dec.MarshalBinary()
+	return append(inc, dec...), nil
+}
+
+func (p *PNCounter) UnmarshalBinary(data []byte) error {
+	inc, rest, err := readCounts(data)
+	if err != nil {
+		return err
+	}
+	dec, rest, err := readCounts(rest)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return ErrMalformed
+	}
+	p.inc, p.dec = &GCounter{counts: inc}, &GCounter{counts: dec}
+	return nil
+}
+
+// tag identifies one add to an ORSet: the node that made it and how many
+// adds that node had made.
+type tag struct {
+	node int
+	seq  uint64
+}
+
+func compareTags(a, b tag) int {
+	return cmp.Or(cmp.Compare(a.node, b.node), cmp.Compare(a.seq, b.seq))
+}
+
+// ORSet is an observed-remove set of strings. Every add is tagged, and a
+// remove removes only the tags of the element its replica has seen, so an
+// add concurrent with a remove wins. Removed tags are kept as tombstones so
+// a replica that has not seen the remove cannot bring them back.
+type ORSet struct {
+	clock   map[int]uint64          // node -> adds it has made, as far as this replica knows
+	adds    map[string]map[tag]bool // element -> tags that have not been removed
+	removed map[tag]bool
+}
+
+// NewORSet returns an empty set.
+func NewORSet() *ORSet {
+	return &ORSet{clock: make(map[int]uint64), adds: make(map[string]map[tag]bool), removed: make(map[tag]bool)}
+}
+
+// Add adds elem on behalf of node.
+func (s *ORSet) Add(node int, elem string) *ORSet {
+	s.clock[node]++
+	t := tag{node: node, seq: s.clock[node]}
+	if s.adds[elem] == nil {
+		s.adds[elem] = make(map[tag]bool)
+	}
+	s.adds[elem][t] = true
+
+	d := NewORSet()
+	d.clock[node] = t.seq
+	d.adds[elem] = map[tag]bool{t: true}
+	return d
+}
+
+// Remove removes elem as far as this replica has seen it added.
+func (s *ORSet) Remove(elem string) *ORSet {
+	d := NewORSet()
+	for t := range s.adds[elem] {
+		s.removed[t], d.removed[t] = true, true
+	}
+	delete(s.adds, elem)
+	return d
+}
+
+func (s *ORSet) Contains(elem string) bool {
+	return len(s.adds[elem]) > 0
+}
+
+func (s *ORSet) Elements() []string {
+	return slices.Sorted(maps.Keys(s.adds))
+}
+
+func (s *ORSet) Merge(other CRDT) error {
+	o, ok := other.(*ORSet)
+	if !ok {
+		return ErrType
+	}
+	for node, n := range o.clock {
+		s.clock[node] = max(s.clock[node], n)
+	}
+	for t := range o.removed {
+		s.removed[t] = true
+	}
+	for elem, tags := range o.adds {
+		if s.adds[elem] == nil {
+			s.adds[elem] = make(map[tag]bool)
+		}
+		for t := range tags {
+			s.adds[elem][t] = true
+		}
+	}
+	for elem, tags := range s.adds {
+		for t := range tags {
+			if s.removed[t] {
+				delete(tags, t)
+			}
+		}
+		if len(tags) == 0 {
+			delete(s.adds, elem)
+		}
+	}
+	return nil
+}
+
+func appendTags(b []byte, tags map[tag]bool) []byte {
+	b = binary.AppendUvarint(b, uint64(len(tags)))
+	for _, t := range slices.SortedFunc(maps.Keys(tags), compareTags) {
+		b = binary.AppendUvarint(b, uint64(t.node))
+		b = binary.AppendUvarint(b, t.seq)
+	}
+	return b
+}
+
+func readTags(b []byte) (map[tag]bool, []byte, error) {
+	n, b, err := readUvarint(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	tags := make(map[tag]bool)
+	for range n {
+		var node, seq uint64
+		if node, b, err = readUvarint(b); err != nil {
+			return nil, nil, err
+		}
+		if seq, b, err = readUvarint(b); err != nil {
+			return nil, nil, err
+		}
+		tags[tag{node: int(node), seq: seq}] = true
+	}
+	return tags, b, nil
+}
+
+// MarshalBinary encodes the clock, then each element with its tags in
+// element order, then the tombstones.
+func (s *ORSet) MarshalBinary() ([]byte, error) {
+	data, _ := (&GCounter{counts: s.clock}).MarshalBinary()
+	data = binary.AppendUvarint(data, uint64(len(s.adds)))
+	for _, elem := range s.Elements() {
+		data = appendString(data, elem)
+		data = appendTags(data, s.adds[elem])
+	}
+	return appendTags(data, s.removed), nil
+}
+
+func (s *ORSet) UnmarshalBinary(data []byte) error {
+	clock, data, err := readCounts(data)
+	if err != nil {
+		return err
+	}
+	n, data, err := readUvarint(data)
+	if err != nil {
+		return err
+	}
+	adds := make(map[string]map[tag]bool)
+	for range n {
+		var elem string
+		if elem, data, err = readString(data); err != nil {
+			return err
+		}
+		if adds[elem], data, err = readTags(data); err != nil {
+			return err
+		}
+	}
+	removed, data, err := readTags(data)
+	if err != nil {
+		return err
+	}
+	if len(data) != 0 {
+		return ErrMalformed
+	}
+	s.clock, s.adds, s.removed = clock, adds, removed
+	return nil
+}
+
+// LWWRegister holds the value set last by the hybrid logical clock.
+type LWWRegister struct {
+	Value string
+	TS    Timestamp // zero until the register is first set
+}
+
+// Set sets the register to value as written at ts.
+func (r *LWWRegister) Set(value string, ts Timestamp) *LWWRegister {
+	d := &LWWRegister{Value: value, TS: ts}
+	r.Merge(d)
+	return d
+}
+
+func (r *LWWRegister) Merge(other CRDT) error {
+	o, ok := other.(*LWWRegister)
+	if !ok {
+		return ErrType
+	}
+	if r.TS.Less(o.TS) {
+		*r = *o
+	}
+	return nil
+}
+
+func (r *LWWRegister) MarshalBinary() ([]byte, error) {
+	return appendString(AppendTimestamp(nil, r.TS), r.Value), nil
+}
+
+func (r *LWWRegister) UnmarshalBinary(data []byte) error {
+	ts, rest, err := ReadTimestamp(data)
+	if err != nil {
+		return err
+	}
+	value, rest, err := readString(rest)
+	if err != nil || len(rest) != 0 {
+		return ErrMalformed
+	}
+	r.Value, r.TS = value, ts
+	return nil
+}
+
+// mvValue is one value of an MVRegister with the version vector of the set
+// that wrote it: node -> sets that node had made, that the writer had seen.
+type mvValue struct {
+	value   string
+	version map[int]uint64
+}
+
+// descends reports whether v has seen every set w has, and more.
+func (v mvValue) descends(w mvValue) bool {
+	for node, n := range w.version {
+		if v.version[node] < n {
+			return false
+		}
+	}
+	return !maps.Equal(v.version, w.version)
+}
+
+func (v mvValue) encode() []byte {
+	b, _ := (&GCounter{counts: v.version}).MarshalBinary()
+	return appendString(b, v.value)
+}
+
+// MVRegister is a multi-value register. A set replaces every value its
+// replica has seen; sets that did not see each other are all kept, for the
+// reader to choose from or for a later set to replace.
+type MVRegister struct {
+	values []mvValue // none descending from another, ordered by encoding
+}
+
+// Set replaces every value the register holds with value, on behalf of
+// node.
+func (r *MVRegister) Set(node int, value string) *MVRegister {
+	version := make(map[int]uint64)
+	for _, v := range r.values {
+		for n, c := range v.version {
+			version[n] = max(version[n], c)
+		}
+	}
+	version[node]++
+	r.values = []mvValue{{value: value, version: version}}
+	return &MVRegister{values: []mvValue{{value: value, version: maps.Clone(version)}}}
+}
+
+// Values returns the concurrently set values, sorted.
+func (r *MVRegister) Values() []string {
+	var values []string
+	for _, v := range r.values {
+		values = append(values, v.value)
+	}
+	slices.Sort(values)
+	return slices.Compact(values)
+}
+
+func (r *MVRegister) Merge(other CRDT) error {
+	o, ok := other.(*MVRegister)
+	if !ok {
+		return ErrType
+	}
+	all := append(slices.Clone(r.values), o.values...)
+	var kept []mvValue
+	for i, v := range all {
+		superseded := false
+		for j, w := range all {
+			if w.descends(v) || (j < i && maps.Equal(w.version, v.version)) {
+				superseded = true
+				break
+			}
+		}
+		if !superseded {
+			kept = append(kept, mvValue{value: v.value, version: maps.Clone(v.version)})
+		}
+	}
+	slices.SortFunc(kept, func(a, b mvValue) int { return bytes.Compare(a.encode(), b.encode()) })
+	r.values = kept
+	return nil
+}
+
+func (r *MVRegister) MarshalBinary() ([]byte, error) {
+	data := binary.AppendUvarint(nil, uint64(len(r.values)))
+	for _, v := range r.values {
+		data = append(data, v.encode()...)
+	}
+	return data, nil
+}
+
+func (r *MVRegister) UnmarshalBinary(data []byte) error {
+	n, data, err := readUvarint(data)
+	if err != nil {
+		return err
+	}
+	var values []mvValue
+	for range n {
+		var v mvValue
+		if v.version, data, err = readCounts(data); err != nil {
+			return err
+		}
+		if v.value, data, err = readString(data); err != nil {
+			return err
+		}
+		values = append(values, v)
+	}
+	if len(data) != 0 {
+		return ErrMalformed
+	}
+	r.values = values
+	return nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	n, size := binary.Uvarint(b)
+	if size <= 0 || n > uint64(len(b)-size) {
+		return "", nil, ErrMalformed
+	}
+	b = b[size:]
+	return string(b[:n]), b[n:], nil
+}
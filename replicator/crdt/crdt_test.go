@@ -0,0 +1,95 @@
+package crdt
+
+import (
+	"flag"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+var seeds = flag.Int("seeds", 100, "number of random states each CRDT is checked on; -short checks fewer")
+
+// checkCRDT checks that merging states of a CRDT of kind is commutative,
+// associative and idempotent, that merging a write's delta has the same
+// effect as the write, and that states survive serialization, on states
+// three replicas reach by random writes.
+func checkCRDT(t *testing.T, seed int64, kind string) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(seed))
+	encode := func(c CRDT) string {
+		data, err := c.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s seed %d: %v", kind, seed, err)
+		}
+		return string(data)
+	}
+	clone := func(c CRDT) CRDT {
+		d, _ := New(kind)
+		if err := d.UnmarshalBinary([]byte(encode(c))); err != nil {
+			t.Fatalf("%s seed %d: %v", kind, seed, err)
+		}
+		return d
+	}
+	join := func(cs ...CRDT) CRDT {
+		j := clone(cs[0])
+		for _, c := range cs[1:] {
+			if err := j.Merge(clone(c)); err != nil {
+				t.Fatalf("%s seed %d: %v", kind, seed, err)
+			}
+		}
+		return j
+	}
+
+	// The replicas share some history before they diverge, and merge each
+	// other's deltas now and then while they do.
+	states := make([]CRDT, 3)
+	for i := range states {
+		states[i], _ = New(kind)
+		if i > 0 && rng.Intn(2) == 0 {
+			states[i] = clone(states[0])
+		}
+		clock := NewHLC(i, time.Duration(rng.Intn(10))*time.Millisecond)
+		for range rng.Intn(30) {
+			before := clone(states[i])
+			d, _ := RandomWrite(rng, i, clock, states[i])
+			if got, want := encode(join(before, d)), encode(states[i]); got != want {
+				t.Fatalf("%s seed %d: merging a write's delta gives %x, the write gives %x", kind, seed, got, want)
+			}
+			if j := rng.Intn(3); j != i && states[j] != nil && rng.Intn(4) == 0 {
+				if err := states[j].Merge(clone(d)); err != nil {
+					t.Fatalf("%s seed %d: %v", kind, seed, err)
+				}
+			}
+		}
+	}
+
+	a, b, c := states[0], states[1], states[2]
+	for _, s := range states {
+		if encode(clone(s)) != encode(s) {
+			t.Fatalf("%s seed %d: %x changes when serialized and back", kind, seed, encode(s))
+		}
+	}
+	if encode(join(a, b)) != encode(join(b, a)) {
+		t.Fatalf("%s seed %d: merge is not commutative", kind, seed)
+	}
+	if encode(join(join(a, b), c)) != encode(join(a, join(b, c))) {
+		t.Fatalf("%s seed %d: merge is not associative", kind, seed)
+	}
+	if encode(join(a, a)) != encode(a) || encode(join(a, b, b)) != encode(join(a, b)) {
+		t.Fatalf("%s seed %d: merge is not idempotent", kind, seed)
+	}
+}
+
+// Merging every CRDT is commutative, associative and idempotent on random
+// states.
+func TestCRDTMerge(t *testing.T) {
+	for _, kind := range Kinds {
+		count := *seeds
+		if testing.Short() {
+			count = min(count, 20)
+		}
+		for seed := range int64(count) {
+			checkCRDT(t, seed, kind)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package crdt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Timestamp is a hybrid logical clock reading: the wall clock in unix
+// nanoseconds as far as the clock has seen it, a counter for events within
+// the same nanosecond, and the node that took the reading to break ties.
+// Timestamps are totally ordered, and every event is later than any event
+// its node had heard of.
+type Timestamp struct {
+	Wall    int64
+	Logical uint32
+	Node    int
+}
+
+func (t Timestamp) Less(u Timestamp) bool {
+	if t.Wall != u.Wall {
+		return t.Wall < u.Wall
+	}
+	if t.Logical != u.Logical {
+		return t.Logical < u.Logical
+	}
+	return t.Node < u.Node
+}
+
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%d.%d@%d", t.Wall, t.Logical, t.Node)
+}
+
+// AppendTimestamp appends the encoding of t to b.
+func AppendTimestamp(b []byte, t Timestamp) []byte {
+	b = binary.BigEndian.AppendUint64(b, uint64(t.Wall))
+	b = binary.AppendUvarint(b, uint64(t.Logical))
+	return binary.AppendUvarint(b, uint64(t.Node))
+}
+
+// ReadTimestamp reads a timestamp AppendTimestamp encoded from the start of b,
+// and returns the rest of b.
+func ReadTimestamp(b []byte) (Timestamp, []byte, error) {
+	if len(b) < 8 {
+		return Timestamp{}, nil, ErrMalformed
+	}
+	t := Timestamp{Wall: int64(binary.BigEndian.Uint64(b))}
+	b = b[8:]
+	logical, n := binary.Uvarint(b)
+	if n <= 0 || logical > 1<<32-1 {
+		return Timestamp{}, nil, ErrMalformed
+	}
+	b = b[n:]
+	node, n := binary.Uvarint(b)
+	if n <= 0 {
+		return Timestamp{}, nil, ErrMalformed
+	}
+	t.Logical, t.Node = uint32(logical), int(node)
+	return t, b[n:], nil
+}
+
+// HLC is a hybrid logical clock. It follows the wall clock, but never goes
+// back, and never reads earlier than a timestamp it has been updated with,
+// so a write that overwrites one it has seen is always the later of the two
+// however skewed the nodes' wall clocks are.
+type HLC struct {
+	node int
+	skew time.Duration // added to the wall clock, to simulate a node whose clock is off
+
+	mu   sync.Mutex
+	last Timestamp
+}
+
+// NewHLC returns a clock for node whose wall clock is off by skew.
+func NewHLC(node int, skew time.Duration) *HLC {
+	return &HLC{node: node, skew: skew, last: Timestamp{Node: node}}
+}
+
+func (c *HLC) wall() int64 {
+	return time.Now().Add(c.skew).UnixNano()
+}
+
+// Now returns a timestamp later than every one the clock has returned or
+// been updated with.
+func (c *HLC) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if wall := c.wall(); wall > c.last.Wall {
+		c.last = Timestamp{Wall: wall, Node: c.node}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Update moves the clock past t, a timestamp from another node.
+func (c *HLC) Update(t Timestamp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wall := max(c.wall(), c.last.Wall, t.Wall)
+	var logical uint32
+	switch {
+	case wall == c.last.Wall && wall == t.Wall:
+		logical = max(c.last.Logical, t.Logical) + 1
+	case wall == c.last.Wall:
+		logical = c.last.Logical + 1
+	case wall == t.Wall:
+		logical = t.Logical + 1
+	}
+	c.last = Timestamp{Wall: wall, Logical: logical, Node: c.node}
+}
@@ -0,0 +1,32 @@
+package crdt
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// RandomWrite makes a random write to state on behalf of node, reading the
+// time from clock for registers that need it, and returns its delta and what
+// it added to a counter, 0 for other kinds. It is for tests and demos that
+// need replicas to diverge.
+func RandomWrite(rng *rand.Rand, node int, clock *HLC, state CRDT) (CRDT, int64) {
+	switch s := state.(type) {
+	case *GCounter:
+		inc := rng.Intn(10)
+		return s.Inc(node, uint64(inc)), int64(inc)
+	case *PNCounter:
+		add := rng.Intn(21) - 10
+		return s.Add(node, int64(add)), int64(add)
+	case *ORSet:
+		elem := fmt.Sprintf("e%d", rng.Intn(8))
+		if rng.Intn(3) == 0 {
+			return s.Remove(elem), 0
+		}
+		return s.Add(node, elem), 0
+	case *LWWRegister:
+		return s.Set(fmt.Sprintf("r%dv%d", node, rng.Intn(1000)), clock.Now()), 0
+	case *MVRegister:
+		return s.Set(node, fmt.Sprintf("r%dv%d", node, rng.Intn(1000))), 0
+	}
+	panic(fmt.Sprintf("no random writes for %T", state))
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+// heartbeat queues a heartbeat for every follower each heartbeatInterval
+// until the master is closed. A killed master sends none until it is
+// revived.
+func (m *Master) heartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.sendMu.Lock()
+		if m.closed {
+			m.sendMu.Unlock()
+			return
+		}
+		if !m.dead.Load() {
+			last, now := int(m.last.Load()), time.Now()
+			for _, s := range m.streams {
+				s.beat(last, now)
+			}
+		}
+		m.sendMu.Unlock()
+	}
+}
+
+// Kill stops the master as if it crashed or hung: it sends no heartbeats,
+// takes no writes and accepts no followers. Entries already queued for a
+// follower are still delivered, as if they were in flight.
+func (m *Master) Kill() {
+	m.dead.Store(true)
+	m.mu.Lock()
+	m.cond.Broadcast()
+	m.mu.Unlock()
+}
+
+// Revive undoes Kill, as if the master came back from a long pause without
+// knowing it has been replaced in the meantime.
+func (m *Master) Revive() {
+	m.dead.Store(false)
+}
+
+// fence records that a follower refused the master for a newer epoch.
+func (m *Master) fence(epoch int) {
+	for {
+		old := m.fencedBy.Load()
+		if int64(epoch) <= old || m.fencedBy.CompareAndSwap(old, int64(epoch)) {
+			return
+		}
+	}
+}
+
+// Followers fail over to a new master by exchanging messages, in process
+// through a Cluster and over TCP as frames. A follower that has heard
+// nothing from its master for peerTimeout campaigns to replace it:
+//
+//  1. it polls the other followers for the next epoch; each one that has not
+//     heard from a master lately, nor promised the epoch to another
+//     candidate, promises it to this one, stops applying anything from older
+//     masters, so its position is final, and answers with that position,
+//  2. once a majority of the followers, itself included, have promised, it
+//     picks the one whose entries are from the newest epoch, and of those the
+//     one that applied the most, and tells it to promote itself; every write
+//     acknowledged with WriteMajority or WriteAll reached one of them, and
+//  3. the promoted follower announces itself as the master of the epoch to
+//     the others, which replicate from it from then on and tell the master
+//     they followed it has been replaced, so it refuses writes if it comes
+//     back.
+//
+// A candidate without a majority gives up; it or another follower tries
+// again for a newer epoch once it has gone peerTimeout more without news.
+
+// poll is a candidate's request for a follower's position in epoch.
+type poll struct {
+	epoch, candidate int
+}
+
+// position is a follower's answer to a poll.
+type position struct {
+	epoch   int  // newest epoch the follower knows of
+	leader  int  // follower promoted to master of epoch, -1 if none is known
+	source  int  // epoch of the master the follower applied its entries from
+	applied int  // seq of the last entry it applied
+	granted bool // whether it promised epoch to the candidate
+}
+
+// newer reports whether p holds entries no older than q's, and more of
+// them.
+func (p position) newer(q position) bool {
+	return p.source > q.source || p.source == q.source && p.applied > q.applied
+}
+
+// announcement tells followers which of them is the master of epoch, and
+// who its followers are.
+type announcement struct {
+	epoch, leader int
+	followers     []int
+}
+
+// peerTransport carries failover messages from one follower to another,
+// which handles each with handlePoll, handlePromote or handleAnnounce, and
+// gossip for the replica of a CRDT the other keeps.
+type peerTransport interface {
+	poll(to int, p poll) (position, error)
+	promote(to int, p poll) error
+	announce(to int, a announcement) error
+	gossip(to int, data []byte) error
+}
+
+var errNotPromised = errors.New("follower did not promise the epoch to the candidate")
+
+// handlePoll answers a candidate's poll, promising it the epoch if the
+// follower can.
+func (f *Follower) handlePoll(p poll) position {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pos := position{epoch: f.epoch, leader: f.leader, source: f.source, applied: f.applied}
+	switch {
+	case f.leading != nil:
+		return pos
+	case p.epoch < f.epoch, p.epoch == f.epoch && f.promised != p.candidate:
+		return pos
+	case time.Since(f.heard) < peerTimeout/2:
+		// Its master, or another candidate, is still around.
+		return pos
+	}
+	f.promise(p.epoch, p.candidate)
+	pos.epoch, pos.leader, pos.granted = p.epoch, -1, true
+	return pos
+}
+
+// promise promises epoch to candidate and stops applying anything from the
+// master the follower was following. It is called with mu held.
+func (f *Follower) promise(epoch, candidate int) {
+	f.epoch, f.promised, f.leader = epoch, candidate, -1
+	f.heard = time.Now()
+	if f.stream != nil {
+		f.stream.disconnect()
+	}
+}
+
+// handlePromote promotes the follower to master of the epoch p.candidate
+// polled it for.
+func (f *Follower) handlePromote(p poll) error {
+	f.mu.Lock()
+	promised := f.epoch == p.epoch && f.promised == p.candidate && f.leading == nil
+	f.mu.Unlock()
+	if !promised {
+		return errNotPromised
+	}
+	_, err := f.promote(p.epoch)
+	return err
+}
+
+// handleAnnounce has the follower replicate from the master a announces,
+// unless it knows of a newer one.
+func (f *Follower) handleAnnounce(a announcement) {
+	f.mu.Lock()
+	if a.epoch < f.epoch || a.epoch == f.epoch && f.leader == a.leader || f.leading != nil {
+		f.mu.Unlock()
+		return
+	}
+	f.epoch, f.leader, f.promised = a.epoch, a.leader, a.leader
+	f.others = slices.DeleteFunc(slices.Clone(a.followers), func(id int) bool { return id == f.id })
+	f.heard = time.Now()
+	if f.stream != nil {
+		f.stream.disconnect()
+	}
+	old, oldAddr := f.master, f.masterAddr
+	if f.addrs != nil {
+		f.masterAddr = f.addrs[a.leader]
+	}
+	if oldAddr == f.masterAddr {
+		oldAddr = ""
+	}
+	f.changed.Broadcast()
+	f.mu.Unlock()
+
+	log.Printf("Follower%d replicates from follower%d, the master of epoch %d, now\n", f.id, a.leader, a.epoch)
+	f.tellReplaced(old, oldAddr, a.epoch)
+}
+
+// learn records that a poll was answered by a follower that knows of a
+// newer epoch than the candidate, or of the master of its epoch.
+func (f *Follower) learn(pos position) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if pos.epoch < f.epoch || pos.epoch == f.epoch && (pos.leader < 0 || f.leader == pos.leader) {
+		return
+	}
+	f.epoch, f.leader, f.promised = pos.epoch, pos.leader, pos.leader
+	if f.addrs != nil && pos.leader >= 0 {
+		f.masterAddr = f.addrs[pos.leader]
+	}
+	f.changed.Broadcast()
+}
+
+// tellReplaced tells the master the follower was following, in process or at
+// addr, that there is a master of epoch now, as a follower reconnecting to
+// it would.
+func (f *Follower) tellReplaced(old *Master, addr string, epoch int) {
+	f.mu.Lock()
+	applied, source := f.applied, f.source
+	f.mu.Unlock()
+	switch {
+	case old != nil && old.epoch < epoch:
+		old.Connect(f.id, applied, epoch, source)
+	case addr != "":
+		fenceMaster(addr, f.id, applied, epoch, source)
+	}
+}
+
+// failover is what a follower that cannot follow a master does: try again
+// in a moment or, once it has heard from no master or candidate for
+// peerTimeout, campaign to replace the master. It waits a random part of
+// peerTimeout first, so that followers that lost the master together
+// seldom campaign at once.
+func (f *Follower) failover() {
+	f.mu.Lock()
+	silent := time.Since(f.heard) > peerTimeout
+	f.mu.Unlock()
+	if !silent || f.peers == nil {
+		time.Sleep(reconnectDelay)
+		return
+	}
+	time.Sleep(time.Duration(rand.Int63n(int64(peerTimeout / 2))))
+	f.campaign()
+}
+
+// campaign runs one round of failover with the follower as candidate for
+// the next epoch, and reports whether it got a master promoted.
+func (f *Follower) campaign() bool {
+	f.mu.Lock()
+	if time.Since(f.heard) <= peerTimeout || f.leading != nil {
+		f.mu.Unlock()
+		return false
+	}
+	epoch := f.epoch + 1
+	f.promise(epoch, f.id)
+	best, bestID := position{source: f.source, applied: f.applied}, f.id
+	others := f.others
+	f.mu.Unlock()
+	log.Printf("Follower%d campaigns for epoch %d at seq %d\n", f.id, epoch, best.applied)
+
+	type reply struct {
+		from int
+		pos  position
+		err  error
+	}
+	replies := make(chan reply, len(others))
+	for _, id := range others {
+		go func() {
+			pos, err := f.peers.poll(id, poll{epoch: epoch, candidate: f.id})
+			replies <- reply{id, pos, err}
+		}()
+	}
+	granted, learned := 1, false
+	for range others {
+		r := <-replies
+		switch {
+		case r.err != nil:
+			log.Printf("Follower%d cannot poll follower%d: %v\n", f.id, r.from, r.err)
+		case r.pos.granted:
+			granted++
+			if r.pos.newer(best) || !best.newer(r.pos) && r.from < bestID {
+				best, bestID = r.pos, r.from
+			}
+		case r.pos.epoch > epoch || r.pos.epoch == epoch && r.pos.leader >= 0:
+			f.learn(r.pos)
+			learned = true
+		}
+	}
+	if learned {
+		return false
+	}
+	if quorum := (len(others)+1)/2 + 1; granted < quorum {
+		log.Printf("Follower%d got %d of the %d promises it needs for epoch %d\n", f.id, granted, quorum, epoch)
+		return false
+	}
+
+	if bestID == f.id {
+		_, err := f.promote(epoch)
+		return err == nil
+	}
+	if err := f.peers.promote(bestID, poll{epoch: epoch, candidate: f.id}); err != nil {
+		log.Printf("Follower%d cannot promote follower%d: %v\n", f.id, bestID, err)
+		return false
+	}
+	return true
+}
+
+// promote makes the follower the master of epoch, with its state machine and
+// applied seq, stops it following, and announces it to the other followers.
+func (f *Follower) promote(epoch int) (*Master, error) {
+	f.mu.Lock()
+	if f.epoch != epoch || f.leading != nil {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("follower%d cannot be promoted for epoch %d, it knows of epoch %d", f.id, epoch, f.epoch)
+	}
+	data, err := f.sm.Snapshot()
+	if err != nil {
+		f.mu.Unlock()
+		return nil, err
+	}
+	others := slices.Clone(f.others)
+	m := newMaster(f.sm, others)
+	m.epoch, m.prev, m.start = epoch, f.source, f.applied
+	m.snap = snapshot{Seq: f.applied, Data: data}
+	m.last.Store(int64(f.applied))
+	old, oldAddr := f.master, f.masterAddr
+	f.leading, f.master, f.leader, f.promised = m, nil, f.id, f.id
+	if f.stream != nil {
+		f.stream.disconnect()
+	}
+	f.changed.Broadcast()
+	f.mu.Unlock()
+
+	f.tellReplaced(old, oldAddr, epoch)
+	if f.cluster != nil {
+		f.cluster.promoted(f, m)
+	}
+	log.Printf("Promoted follower%d to master of epoch %d at seq %d, followers %v replicate from it now\n", f.id, epoch, m.start, others)
+	a := announcement{epoch: epoch, leader: f.id, followers: others}
+	for _, id := range others {
+		if err := f.peers.announce(id, a); err != nil {
+			log.Printf("Follower%d cannot announce itself to follower%d: %v\n", f.id, id, err)
+		}
+	}
+	return m, nil
+}
+
+// Cluster is a master and its followers in this process. It stands in for
+// the network between them: followers find the master of an epoch in it, as
+// they would dial its address, and send each other failover messages
+// through it. It also keeps, for clients, which master is current and the
+// seq each epoch's master started from.
+type Cluster struct {
+	mu        sync.Mutex
+	master    *Master
+	masters   map[int]*Master   // by epoch
+	peers     map[int]*Follower // every follower, promoted or not
+	followers []*Follower       // those of the current master
+	starts    map[int]int       // epoch -> seq its master started from
+	changed   *sync.Cond        // broadcast when the master changes
+}
+
+func newCluster(m *Master, fs []*Follower) *Cluster {
+	c := &Cluster{
+		master:    m,
+		masters:   map[int]*Master{m.epoch: m},
+		peers:     make(map[int]*Follower),
+		followers: fs,
+		starts:    map[int]int{m.epoch: 0},
+	}
+	c.changed = sync.NewCond(&c.mu)
+	for _, f := range fs {
+		c.peers[f.id] = f
+	}
+	for _, f := range fs {
+		f.cluster, f.peers, f.master, f.epoch = c, c, m, m.epoch
+		f.others = slices.DeleteFunc(slices.Clone(m.followers), func(id int) bool { return id == f.id })
+	}
+	return c
+}
+
+func (c *Cluster) Master() *Master {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.master
+}
+
+func (c *Cluster) Followers() []*Follower {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Follower(nil), c.followers...)
+}
+
+// masterOf returns the master of epoch, or nil if there is none yet.
+func (c *Cluster) masterOf(epoch int) *Master {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.masters[epoch]
+}
+
+// promoted records that f has been promoted to m, which takes over the
+// settings of the master it replaces.
+func (c *Cluster) promoted(f *Follower, m *Master) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old := c.master
+	m.compactEvery, m.queueSize, m.overflow = old.compactEvery, old.queueSize, old.overflow
+	c.masters[m.epoch], c.starts[m.epoch] = m, m.start
+	if m.epoch > c.master.epoch {
+		c.master = m
+		c.followers = slices.DeleteFunc(slices.Clone(c.followers), func(g *Follower) bool { return g == f })
+		c.changed.Broadcast()
+	}
+}
+
+func (c *Cluster) peer(id int) (*Follower, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.peers[id]
+	if !ok {
+		return nil, fmt.Errorf("no follower%d", id)
+	}
+	return f, nil
+}
+
+func (c *Cluster) poll(to int, p poll) (position, error) {
+	f, err := c.peer(to)
+	if err != nil {
+		return position{}, err
+	}
+	return f.handlePoll(p), nil
+}
+
+func (c *Cluster) promote(to int, p poll) error {
+	f, err := c.peer(to)
+	if err != nil {
+		return err
+	}
+	return f.handlePromote(p)
+}
+
+func (c *Cluster) announce(to int, a announcement) error {
+	f, err := c.peer(to)
+	if err != nil {
+		return err
+	}
+	f.handleAnnounce(a)
+	return nil
+}
+
+func (c *Cluster) gossip(to int, data []byte) error {
+	f, err := c.peer(to)
+	if err != nil {
+		return err
+	}
+	if f.replica == nil {
+		return errNoReplica
+	}
+	f.replica.deliver(data)
+	return nil
+}
+
+// awaitFailover waits up to timeout for old to be replaced and returns the
+// master the cluster has then.
+func (c *Cluster) awaitFailover(old *Master, timeout time.Duration) *Master {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	timer := time.AfterFunc(timeout, func() {
+		c.mu.Lock()
+		c.changed.Broadcast()
+		c.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	deadline := time.Now().Add(timeout)
+	for c.master == old && time.Now().Before(deadline) {
+		c.changed.Wait()
+	}
+	return c.master
+}
+
+// acked is a write a master acknowledged.
+type acked struct {
+	epoch, seq int
+}
+
+// writeThrough writes cmds through the cluster's master, as a client would.
+// A write the master is down for waits for the failover and is not retried,
+// since it may or may not have been applied. If killAt is positive the master
+// is killed just before write killAt. It returns every acknowledged write,
+// and the killed master, if any.
+func writeThrough(c *Cluster, cmds [][]byte, concern WriteConcern, timeout time.Duration, killAt int) ([]acked, *Master) {
+	log.Println("Master writing update")
+
+	var acks []acked
+	var killed *Master
+	for i, cmd := range cmds {
+		m := c.Master()
+		if i > 0 && i == killAt {
+			log.Printf("Killing the master of epoch %d at seq %d\n", m.epoch, m.last.Load())
+			m.Kill()
+			killed = m
+		}
+		if i > 0 && i%25 == 0 {
+			m.logLag()
+		}
+
+		res, err := m.Write(cmd, concern, timeout)
+		switch {
+		case err == nil:
+			acks = append(acks, acked{epoch: m.epoch, seq: res.Seq})
+			if len(res.Lagging) > 0 {
+				log.Printf("Write %d done with concern %q, followers %v still lagging\n", res.Seq, concern, res.Lagging)
+			}
+		case errors.Is(err, errMasterDown), errors.Is(err, errStaleEpoch):
+			log.Printf("Write failed: %v, waiting for a new master\n", err)
+			c.awaitFailover(m, 10*peerTimeout)
+		case errors.Is(err, errWriteTimeout), errors.Is(err, errFollowersDown):
+			log.Printf("Write %d with concern %q failed: %v, followers %v lagging\n", res.Seq, concern, err, res.Lagging)
+		default:
+			log.Printf("Write refused: %v\n", err)
+		}
+	}
+
+	m := c.Master()
+	m.logLag()
+	m.Close()
+	return acks, killed
+}
+
+// lost returns the acknowledged writes the cluster no longer has: those
+// after the seq the next master after theirs started from. Epochs a
+// campaign failed for have no master.
+func (c *Cluster) lost(acks []acked) []acked {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var lost []acked
+	for _, a := range acks {
+		next := -1
+		for epoch := range c.starts {
+			if epoch > a.epoch && (next < 0 || epoch < next) {
+				next = epoch
+			}
+		}
+		if next >= 0 && a.seq > c.starts[next] {
+			lost = append(lost, a)
+		}
+	}
+	return lost
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+// The master is killed partway through, in process and over TCP. The
+// followers notice from the heartbeats stopping, promote the one that
+// applied the most rather than the slow one, lose no write acknowledged by a
+// majority, and fence the old master so that it refuses writes once it is
+// revived.
+func TestFailover(t *testing.T) {
+	for _, loopback := range []bool{false, true} {
+		m, fs := newCounters(3)
+		fs[2].delay = 5 * time.Millisecond
+		c, acks, killed := replicate(m, fs, demoCommands("counter"), WriteMajority, time.Second, loopback, 30)
+		if killed != m {
+			t.Fatalf("loopback %v: the master was not killed", loopback)
+		}
+		promoted := c.Master()
+		if promoted == m || promoted.epoch != 2 {
+			t.Fatalf("loopback %v: the master of epoch %d is the master at the end", loopback, promoted.epoch)
+		}
+		fs[2].mu.Lock()
+		slow := fs[2].leading
+		fs[2].mu.Unlock()
+		if slow == promoted {
+			t.Errorf("loopback %v: the slow follower was promoted", loopback)
+		}
+		if err := verify(c, acks, killed, WriteMajority, "counter"); err != nil {
+			t.Errorf("loopback %v: %v", loopback, err)
+		}
+	}
+}
+
+// Closing a master and its followers leaves none of its goroutines behind.
+func TestCloseLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	m, fs := newCounters(3)
+	replicate(m, fs, demoCommands("counter"), WriteMajority, time.Second, false, 0)
+
+	deadline := time.Now().Add(2 * heartbeatInterval)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(heartbeatInterval / 10)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		buf := make([]byte, 1<<16)
+		t.Fatalf("%d goroutines left running after the master closed:\n%s", n-before, buf[:runtime.Stack(buf, true)])
+	}
+}
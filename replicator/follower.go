@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Read only
+type Follower struct {
+	id      int
+	cluster *Cluster      // the master and followers in this process, if any
+	peers   peerTransport // carries failover messages to the other followers, nil for none
+	delay   time.Duration // how long applying an entry takes, to simulate a slow follower
+
+	disconnectAt int            // drop the connection after applying this seq, 0 for never
+	away         time.Duration  // how long to stay disconnected before rejoining
+	repairEvery  time.Duration  // how often to compare state with the master while idle, 0 for never
+	addrs        map[int]string // over TCP, where each follower listens for the others
+	replica      *Replica       // a CRDT the follower takes writes to itself, nil for none
+
+	mu         sync.Mutex
+	master     *Master   // in process, the master being followed
+	masterAddr string    // over TCP, the address of the master being followed
+	leading    *Master   // the master the follower was promoted to, if it was
+	epoch      int       // newest master epoch the follower knows of
+	leader     int       // follower promoted to master of epoch, -1 if none is known
+	promised   int       // candidate the follower promised epoch to, or its master once known
+	others     []int     // the other followers of the master
+	heard      time.Time // when the follower last heard from a master or a candidate
+	stream     *stream   // from master
+	sm         StateMachine
+	source     int        // epoch of the master the follower applied its entries from
+	applied    int        // seq of the last entry applied
+	current    time.Time  // by the master's clock, the latest time as of which the follower had applied everything the master had written
+	changed    *sync.Cond // broadcast whenever applied, current or the master changes
+	repairs    Repairs
+	repaired   time.Time // when the follower last compared state with the master
+}
+
+func newFollower(id int, sm StateMachine) *Follower {
+	f := &Follower{id: id, sm: sm, leader: -1, promised: -1, heard: time.Now()}
+	f.changed = sync.NewCond(&f.mu)
+	return f
+}
+
+// followResult is why a follower stopped following a stream.
+type followResult int
+
+const (
+	streamClosed  followResult = iota // the master has sent its whole log
+	streamDropped                     // either side disconnected
+	masterSilent                      // nothing came from the master for peerTimeout
+)
+
+func (f *Follower) recvUpdate(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	log.Println("Follower receiving update")
+
+	for {
+		m, epoch, promoted := f.currentMaster()
+		if promoted {
+			return
+		}
+		if m == nil {
+			f.failover()
+			continue
+		}
+
+		f.mu.Lock()
+		from, source := f.applied, f.source
+		f.mu.Unlock()
+		s, err := m.Connect(f.id, from, epoch, source)
+		res := masterSilent
+		if err == nil {
+			f.mu.Lock()
+			f.stream = s
+			f.mu.Unlock()
+			res = f.follow(s)
+		} else if !errors.Is(err, errMasterDown) {
+			log.Printf("Follower%d: %v, reconnecting in %v\n", f.id, err, reconnectDelay)
+			time.Sleep(reconnectDelay)
+			continue
+		}
+
+		switch res {
+		case streamClosed:
+			return
+		case streamDropped:
+			if f.applied == f.disconnectAt {
+				log.Printf("Follower%d disconnected at seq %d, rejoining in %v\n", f.id, f.applied, f.away)
+				time.Sleep(f.away)
+			}
+		case masterSilent:
+			log.Printf("Follower%d lost the master of epoch %d at seq %d\n", f.id, m.epoch, f.applied)
+			f.failover()
+		}
+	}
+}
+
+// currentMaster returns the master of the newest epoch the follower knows
+// of, nil if it does not know where that is yet, or reports that the
+// follower has been promoted itself.
+func (f *Follower) currentMaster() (*Master, int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.leading != nil {
+		return nil, 0, true
+	}
+	if (f.master == nil || f.master.epoch < f.epoch) && f.cluster != nil {
+		if m := f.cluster.masterOf(f.epoch); m != nil {
+			f.master = m
+		}
+	}
+	if f.master == nil || f.master.epoch < f.epoch {
+		return nil, f.epoch, false
+	}
+	return f.master, f.epoch, false
+}
+
+// follow applies what comes on s until the master closes it, the connection
+// drops or the master goes silent. Whatever was still queued on s is lost and
+// has to be asked for again.
+func (f *Follower) follow(s *stream) followResult {
+	check := time.NewTicker(heartbeatInterval)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-s.gone:
+			return streamDropped
+		default:
+		}
+		it, ok, closed := s.pop()
+		if closed {
+			return streamClosed
+		}
+		if !ok {
+			select {
+			case <-s.ready:
+			case <-s.gone:
+				return streamDropped
+			case <-check.C:
+				f.mu.Lock()
+				silent := time.Since(f.heard) > peerTimeout
+				f.mu.Unlock()
+				if silent {
+					return masterSilent
+				}
+				if f.repairEvery > 0 && time.Since(f.repaired) >= f.repairEvery {
+					f.repaired = time.Now()
+					f.repair(s.master)
+				}
+			}
+			continue
+		}
+
+		// The epoch is checked under the same lock as applying, so once the
+		// follower has promised a newer epoch to a candidate nothing more
+		// from the old master gets in.
+		f.mu.Lock()
+		if s.epoch < f.epoch {
+			f.mu.Unlock()
+			log.Printf("Follower%d refused the master of epoch %d, it knows of epoch %d\n", f.id, s.epoch, f.epoch)
+			s.disconnect()
+			return streamDropped
+		}
+		f.heard = time.Now()
+		switch {
+		case it.beat:
+		case it.snap != nil:
+			f.restore(*it.snap)
+			f.source = s.epoch
+		default:
+			f.apply(it.entry)
+			f.source = s.epoch
+		}
+		if !it.sent.IsZero() && f.applied >= it.seq() {
+			f.markCurrent(it.sent)
+		}
+		applied := f.applied
+		f.mu.Unlock()
+		s.ack(applied)
+
+		if !it.beat && applied == f.disconnectAt {
+			s.disconnect()
+			return streamDropped
+		}
+	}
+}
+
+func (f *Follower) apply(e Entry) {
+	if e.Seq != f.applied+1 {
+		log.Fatalf("Follower%d got entry %d after applying %d\n", f.id, e.Seq, f.applied)
+	}
+	time.Sleep(f.delay)
+	if err := f.sm.Apply(e.Command); err != nil {
+		log.Fatalf("Follower%d cannot apply entry %d the master applied: %v\n", f.id, e.Seq, err)
+	}
+	f.applied = e.Seq
+	f.changed.Broadcast()
+	log.Printf("Follower%d applied entry %d\n", f.id, e.Seq)
+}
+
+func (f *Follower) restore(snap snapshot) {
+	if err := f.sm.Restore(snap.Data); err != nil {
+		log.Fatalf("Follower%d cannot restore snapshot at seq %d: %v\n", f.id, snap.Seq, err)
+	}
+	f.applied = snap.Seq
+	f.changed.Broadcast()
+	log.Printf("Follower%d restored snapshot at seq %d\n", f.id, snap.Seq)
+}
+
+// markCurrent records that the follower has applied everything the master
+// had written at t, by the master's clock. It is called with mu held.
+func (f *Follower) markCurrent(t time.Time) {
+	if t.After(f.current) {
+		f.current = t
+		f.changed.Broadcast()
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// recorder is a Counter that counts how it was brought up to date.
+type recorder struct {
+	Counter
+	applies, restores int
+}
+
+func (r *recorder) Apply(cmd []byte) error {
+	r.applies++
+	return r.Counter.Apply(cmd)
+}
+
+func (r *recorder) Restore(data []byte) error {
+	r.restores++
+	return r.Counter.Restore(data)
+}
+
+// A follower that drops its connection mid-stream rejoins from the seq it
+// had applied and is sent what it missed: the entries themselves while the
+// log still has them, or a snapshot once the log has been compacted past
+// them.
+func TestDisconnectMidStream(t *testing.T) {
+	tests := []struct {
+		what         string
+		compactEvery int
+		restores     bool
+	}{
+		{"from the log", 0, false},
+		{"from a snapshot", 10, true},
+	}
+	for _, tt := range tests {
+		m := newMaster(&Counter{}, []int{0, 1})
+		m.compactEvery = tt.compactEvery
+		steady, dropped := newFollower(0, &recorder{}), newFollower(1, &recorder{})
+		dropped.disconnectAt, dropped.away = 20, 50*time.Millisecond
+		c := startFollowers(t, m, []*Follower{steady, dropped})
+
+		for range 100 {
+			if _, err := m.Write(counterAdd(1), WriteLeaderOnly, 0); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		awaitConverged(t, c, 5*time.Second)
+
+		dropped.mu.Lock()
+		r := dropped.sm.(*recorder)
+		dropped.mu.Unlock()
+		if got := r.restores > 0; got != tt.restores {
+			t.Errorf("%s: follower rejoined with %d snapshots and %d entries", tt.what, r.restores, r.applies)
+		}
+		if !tt.restores && r.applies != 100 {
+			t.Errorf("%s: follower applied %d entries, the master wrote 100", tt.what, r.applies)
+		}
+	}
+}
+
+// A follower that asks for entries past the end of the master's log is
+// refused rather than sent entries it already has.
+func TestConnectAheadOfLog(t *testing.T) {
+	m := newMaster(&Counter{}, []int{0})
+	defer m.Close()
+	if _, err := m.Write(counterAdd(1), WriteLeaderOnly, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Connect(0, 2, m.epoch, m.epoch); !errors.Is(err, errAheadOfLog) {
+		t.Fatalf("follower at seq 2 connected to a log up to seq 1 with %v, want %v", err, errAheadOfLog)
+	}
+}
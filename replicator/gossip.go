@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"replicator/crdt"
+)
+
+const (
+	gossipInterval = 5 * time.Millisecond
+	gossipFanout   = 2  // peers each delta is sent to
+	antiEntropy    = 20 // every this many rounds a replica sends its whole state instead
+)
+
+// Replica is a follower's copy of a CRDT, which it takes writes to itself
+// rather than from the master, so concurrent writes need no lock on a single
+// master. The follower gossips the deltas of its writes to a few random
+// other followers every gossipInterval, and passes on the deltas it receives
+// that were news to it, so every write reaches every follower. Deltas may be
+// lost; every antiEntropy rounds a follower sends one other its whole state,
+// which makes up for any it missed.
+type Replica struct {
+	kind string
+	drop float64 // chance that a gossip message is lost
+
+	mu     sync.Mutex
+	state  crdt.CRDT
+	delta  crdt.CRDT // join of every delta not yet gossiped, nil for none
+	inbox  chan []byte
+	rounds int
+}
+
+var errNoReplica = errors.New("follower keeps no CRDT")
+
+func newReplica(kind string, drop float64) (*Replica, error) {
+	state, err := crdt.New(kind)
+	if err != nil {
+		return nil, err
+	}
+	return &Replica{kind: kind, drop: drop, state: state, inbox: make(chan []byte, 64)}, nil
+}
+
+// Update runs write on the follower's CRDT, and queues the delta it returns
+// for gossip.
+func (f *Follower) Update(write func(state crdt.CRDT) crdt.CRDT) error {
+	if f.replica == nil {
+		return errNoReplica
+	}
+	r := f.replica
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queue(write(r.state))
+}
+
+// queue joins d into the deltas to gossip. It is called with mu held.
+func (r *Replica) queue(d crdt.CRDT) error {
+	if r.delta == nil {
+		var err error
+		if r.delta, err = crdt.New(r.kind); err != nil {
+			return err
+		}
+	}
+	return r.delta.Merge(d)
+}
+
+// State returns the encoding of the replica's state.
+func (r *Replica) State() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state.MarshalBinary()
+}
+
+// Read calls read with the replica's state.
+func (r *Replica) Read(read func(state crdt.CRDT)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	read(r.state)
+}
+
+// deliver hands the replica a delta or a whole state gossiped to it. If it is
+// behind on those, the message is lost, and anti-entropy catches it up.
+func (r *Replica) deliver(data []byte) {
+	select {
+	case r.inbox <- data:
+	default:
+	}
+}
+
+// gossip sends and receives the deltas of the follower's CRDT until done is
+// closed.
+func (f *Follower) gossip(wg *sync.WaitGroup, rng *rand.Rand, done chan struct{}) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(gossipInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case data := <-f.replica.inbox:
+			if err := f.replica.receive(data); err != nil {
+				log.Printf("Follower%d: dropping gossip: %v\n", f.id, err)
+			}
+		case <-ticker.C:
+			if err := f.sendGossip(rng); err != nil {
+				log.Printf("Follower%d: cannot gossip: %v\n", f.id, err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// sendGossip gossips the queued deltas to gossipFanout other followers, or
+// every antiEntropy rounds the whole state to one.
+func (f *Follower) sendGossip(rng *rand.Rand) error {
+	r := f.replica
+	r.mu.Lock()
+	r.rounds++
+	full := r.rounds%antiEntropy == 0
+	msg, fanout := r.delta, gossipFanout
+	if full {
+		msg, fanout = r.state, 1
+	}
+	var data []byte
+	var err error
+	if msg != nil {
+		data, err = msg.MarshalBinary()
+	}
+	if !full {
+		r.delta = nil
+	}
+	r.mu.Unlock()
+	if msg == nil || err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	others := f.others
+	f.mu.Unlock()
+	for _, i := range rng.Perm(len(others))[:min(fanout, len(others))] {
+		if rng.Float64() < r.drop {
+			continue
+		}
+		if err := f.peers.gossip(others[i], data); err != nil {
+			log.Printf("Follower%d cannot gossip to follower%d: %v\n", f.id, others[i], err)
+		}
+	}
+	return nil
+}
+
+// receive merges a delta or a whole state from another follower, and passes
+// it on if it changed anything.
+func (r *Replica) receive(data []byte) error {
+	d, err := crdt.New(r.kind)
+	if err != nil {
+		return err
+	}
+	if err := d.UnmarshalBinary(data); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	before, err := r.state.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := r.state.Merge(d); err != nil {
+		return err
+	}
+	after, err := r.state.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(before, after) {
+		return nil
+	}
+	return r.queue(d)
+}
+
+// runGossip has n followers keep replicas of a CRDT of kind and make writes
+// to them at once, with gossip messages lost at rate drop, over TCP on
+// localhost if loopback is set, and checks they all end in the same state and
+// that counters count every write. Their master takes no writes.
+func runGossip(seed int64, kind string, n, writes int, drop float64, loopback bool) error {
+	rng := rand.New(rand.NewSource(seed))
+	var ids []int
+	var fs []*Follower
+	for id := range n {
+		r, err := newReplica(kind, drop)
+		if err != nil {
+			return err
+		}
+		f := newFollower(id, &Counter{})
+		f.replica = r
+		ids = append(ids, id)
+		fs = append(fs, f)
+	}
+	m := newMaster(&Counter{}, ids)
+	defer m.Close()
+	newCluster(m, fs)
+	if loopback {
+		addrs := make(netPeers)
+		for _, f := range fs {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return err
+			}
+			defer ln.Close()
+			addrs[f.id] = ln.Addr().String()
+			go f.listen(ln)
+		}
+		for _, f := range fs {
+			f.peers = addrs
+		}
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for _, f := range fs {
+		wg.Add(1)
+		go f.gossip(&wg, rand.New(rand.NewSource(rng.Int63())), done)
+	}
+
+	// Every follower writes its share at once.
+	var writers sync.WaitGroup
+	total := make([]int64, n)
+	for i, f := range fs {
+		writers.Add(1)
+		rng := rand.New(rand.NewSource(rng.Int63()))
+		clock := crdt.NewHLC(i, 0)
+		go func() {
+			defer writers.Done()
+			for range writes / n {
+				err := f.Update(func(state crdt.CRDT) crdt.CRDT {
+					d, n := crdt.RandomWrite(rng, f.id, clock, state)
+					total[i] += n
+					return d
+				})
+				if err != nil {
+					log.Printf("Follower%d: %v\n", f.id, err)
+				}
+				time.Sleep(time.Duration(rng.Int63n(int64(time.Millisecond))))
+			}
+		}()
+	}
+	writers.Wait()
+
+	// Anti-entropy makes up for lost deltas within a few rounds of it.
+	start := time.Now()
+	deadline := start.Add(20 * antiEntropy * gossipInterval * time.Duration(n))
+	var states [][]byte
+	for {
+		states = states[:0]
+		for _, f := range fs {
+			state, err := f.replica.State()
+			if err != nil {
+				return err
+			}
+			states = append(states, state)
+		}
+		same := true
+		for _, s := range states[1:] {
+			same = same && bytes.Equal(s, states[0])
+		}
+		if same {
+			break
+		}
+		if time.Now().After(deadline) {
+			close(done)
+			wg.Wait()
+			return fmt.Errorf("replicas of %s still differ %v after the last write", kind, time.Since(start).Round(time.Millisecond))
+		}
+		time.Sleep(gossipInterval)
+	}
+	close(done)
+	wg.Wait()
+
+	var want int64
+	for _, t := range total {
+		want += t
+	}
+	var value any
+	fs[0].replica.Read(func(state crdt.CRDT) {
+		switch s := state.(type) {
+		case *crdt.GCounter:
+			value = int64(s.Value())
+		case *crdt.PNCounter:
+			value = s.Value()
+		case *crdt.ORSet:
+			value = s.Elements()
+		case *crdt.LWWRegister:
+			value = s.Value
+		case *crdt.MVRegister:
+			value = s.Values()
+		}
+	})
+	if v, ok := value.(int64); ok && v != want {
+		return fmt.Errorf("%s converged on %d, the writes add up to %d", kind, v, want)
+	}
+	log.Printf("All %d replicas of %s converged on %v %v after the last write, losing %.0f%% of gossip\n", n, kind, value, time.Since(start).Round(time.Millisecond), 100*drop)
+	return nil
+}
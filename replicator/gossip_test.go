@@ -0,0 +1,30 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"replicator/crdt"
+)
+
+// Replicas of every CRDT that take writes at once and lose some of the
+// deltas they gossip converge, see runGossip.
+func TestGossipConverges(t *testing.T) {
+	for _, kind := range crdt.Kinds {
+		for seed := range int64(3) {
+			rng := rand.New(rand.NewSource(seed))
+			if err := runGossip(seed, kind, 2+rng.Intn(4), 50+rng.Intn(200), rng.Float64()/2, false); err != nil {
+				t.Fatalf("seed %d: %v", seed, err)
+			}
+		}
+	}
+}
+
+// The same over TCP: followers gossip to the addresses the others listen on.
+func TestGossipConvergesLoopback(t *testing.T) {
+	for _, kind := range []string{"pncounter", "orset"} {
+		if err := runGossip(1, kind, 3, 150, 0.2, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -1,76 +1,292 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net"
+	"strconv"
 	"sync"
+	"time"
 )
 
-var counter int
+// WriteConcern says how many followers must have applied a write before it
+// counts as done.
+type WriteConcern string
 
-// Read only
-type Follower struct {
-	id int
-	ch chan int
-}
+const (
+	WriteLeaderOnly WriteConcern = "leader"   // done once the master has it
+	WriteMajority   WriteConcern = "majority" // done once a majority of master and followers have it
+	WriteAll        WriteConcern = "all"      // done once every follower has it
+)
+
+var (
+	errWriteTimeout  = errors.New("write concern not satisfied before the timeout")
+	errFollowersDown = errors.New("write concern cannot be satisfied while followers are down")
+)
 
-// Write/Read
-type Master struct {
-	mu sync.Mutex
+// Entry is one write in the master's log: a command for the state machine.
+// Seq numbers start at 1 and have no gaps.
+type Entry struct {
+	Seq     int
+	Command []byte
+}
 
-	followersChan []chan int
+// snapshot is the state machine as of the entry with seq Seq.
+type snapshot struct {
+	Seq  int
+	Data []byte
 }
 
-func (m *Master) WriteUpdate(wg *sync.WaitGroup) {
-	defer wg.Done()
+// ack tells the master a follower has applied every entry up to seq.
+type ack struct {
+	follower int
+	seq      int
+}
 
-	log.Println("Master writing update")
+// WriteResult says which followers had applied a write when it returned.
+type WriteResult struct {
+	Epoch   int // of the master that took the write
+	Seq     int
+	Acked   []int
+	Lagging []int
+}
 
-	for i := 0; i < 100; i++ {
-		m.mu.Lock()
-		counter++
-		m.mu.Unlock()
+// demoFollower returns follower id as the demo runs it: follower1 drops its
+// connection mid-stream and rejoins, and follower2 applies entries slowly.
+func demoFollower(id int, sm StateMachine, slow time.Duration, disconnect int, away time.Duration) *Follower {
+	f := newFollower(id, sm)
+	switch id {
+	case 1:
+		f.disconnectAt, f.away = disconnect, away
+	case 2:
+		f.delay = slow
+	}
+	return f
+}
 
-		for i, fChan := range m.followersChan {
-			log.Printf("Sending update to follower%d => Update counter value to %d\n", i, counter)
-			fChan <- counter
+// demoCommands is the demo's workload: 100 increments of a counter, or 100
+// puts over ten keys of a key-value store.
+func demoCommands(kind string) [][]byte {
+	var cmds [][]byte
+	for i := 1; i <= 100; i++ {
+		if kind == "kv" {
+			cmds = append(cmds, kvPutCmd(fmt.Sprintf("key%d", i%10), strconv.Itoa(i)))
+		} else {
+			cmds = append(cmds, counterAdd(1))
 		}
+	}
+	return cmds
+}
 
+// noopCommand returns a command that leaves a state machine of kind as it
+// is.
+func noopCommand(kind string) []byte {
+	if kind == "kv" {
+		return kvDeleteCmd("")
 	}
+	return counterAdd(0)
+}
 
-	// Close the channel once communication is done
-	for _, fChan := range m.followersChan {
-		close(fChan)
+// replicate runs fs as the followers of m and writes cmds through m until
+// every follower has the whole log, over TCP on localhost if loopback is set
+// and over in-process streams otherwise. If killAt is positive the master is
+// killed before write killAt and the cluster fails over to a follower. It
+// returns the cluster as it ends up, the writes that were acknowledged and the
+// killed master, if any.
+func replicate(m *Master, fs []*Follower, cmds [][]byte, concern WriteConcern, timeout time.Duration, loopback bool, killAt int) (*Cluster, []acked, *Master) {
+	c := newCluster(m, fs)
+	var wg sync.WaitGroup
+	wg.Add(len(fs))
+
+	if !loopback {
+		for _, f := range fs {
+			go f.recvUpdate(&wg)
+		}
+		acks, killed := writeThrough(c, cmds, concern, timeout, killAt)
+		wg.Wait()
+		return c, acks, killed
 	}
 
+	// Each follower listens for the others' failover messages, and for
+	// followers of its own once it is promoted.
+	addrs := make(netPeers)
+	var lns []net.Listener
+	for _, f := range fs {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		lns = append(lns, ln)
+		addrs[f.id] = ln.Addr().String()
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	lns = append(lns, ln)
+	served := make(chan error, len(lns))
+	go func() { served <- m.Serve(ln) }()
+	for i, f := range fs {
+		// Only messages reach the master now, not calls.
+		f.master, f.addrs, f.peers = nil, addrs, addrs
+		go func() { served <- f.listen(lns[i]) }()
+		go f.followMaster(&wg, ln.Addr().String())
+	}
+	acks, killed := writeThrough(c, cmds, concern, timeout, killAt)
+	wg.Wait()
+	for _, ln := range lns {
+		ln.Close()
+		<-served
+	}
+	return c, acks, killed
 }
 
-func (f *Follower) recvUpdate(wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	log.Println("Follower receiving update")
+// verify checks how the cluster ended up: every follower in the master's
+// state, no acknowledged write lost unless the concern allowed it, and a
+// killed master refusing writes once it is revived.
+func verify(c *Cluster, acks []acked, killed *Master, concern WriteConcern, kind string) error {
+	if lost := c.lost(acks); len(lost) > 0 {
+		if concern != WriteLeaderOnly {
+			return fmt.Errorf("lost %d acknowledged writes, the first at seq %d of epoch %d", len(lost), lost[0].seq, lost[0].epoch)
+		}
+		log.Printf("Lost %d writes acknowledged with concern %q in the failover\n", len(lost), concern)
+	}
 
-	for value := range f.ch {
-		log.Printf("Follower%d received update from master. Counter value updated to %d \n", f.id, value)
+	if killed != nil {
+		killed.Revive()
+		defer killed.Close()
+		res, err := killed.Write(noopCommand(kind), WriteMajority, heartbeatInterval)
+		if !errors.Is(err, errStaleEpoch) {
+			return fmt.Errorf("the replaced master of epoch %d took write %d: %v", killed.epoch, res.Seq, err)
+		}
+		log.Printf("The replaced master of epoch %d refused a write once revived: %v\n", killed.epoch, err)
 	}
 
+	return converged(c)
 }
 
-func main() {
+// converged checks that every follower has applied the whole log and is in
+// the same state as the master.
+func converged(c *Cluster) error {
+	want, err := c.Master().State()
+	if err != nil {
+		return err
+	}
+	for _, f := range c.Followers() {
+		f.mu.Lock()
+		got, err := f.sm.Snapshot()
+		applied := f.applied
+		f.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if applied != want.Seq || !bytes.Equal(got, want.Data) {
+			return fmt.Errorf("follower%d stopped at seq %d in state %x, master is at seq %d in state %x", f.id, applied, got, want.Seq, want.Data)
+		}
+	}
+	return nil
+}
 
-	f1 := &Follower{ch: make(chan int)}
-	f2 := &Follower{id: 1, ch: make(chan int)}
-	f3 := &Follower{id: 2, ch: make(chan int)}
+func main() {
+	concern := flag.String("concern", string(WriteMajority), "write concern: leader, majority or all")
+	timeout := flag.Duration("timeout", 50*time.Millisecond, "how long a write waits for its concern")
+	slow := flag.Duration("slow", 10*time.Millisecond, "how long follower2 takes to apply each update")
+	disconnect := flag.Int("disconnect", 40, "drop follower1 after it applies this seq; 0 keeps it connected")
+	away := flag.Duration("away", 100*time.Millisecond, "how long follower1 stays disconnected")
+	kind := flag.String("sm", "counter", "state machine to replicate: counter or kv")
+	compact := flag.Int("compact", 0, "compact the master's log into a snapshot every this many entries; 0 never does")
+	queue := flag.Int("queue", defaultQueueSize, "how many entries may queue for a follower")
+	overflow := flag.String("overflow", string(OverflowBlock), "what a write does when a follower's queue is full: block, resync or coalesce")
+	loopback := flag.Bool("loopback", false, "replicate over TCP on localhost instead of in-process channels")
+	listen := flag.String("listen", "", "run only the master, serving followers over TCP on this address")
+	followers := flag.Int("followers", 3, "with -listen or -crdt, how many followers the master has")
+	linger := flag.Duration("linger", 10*time.Second, "with -listen, how long to wait for every follower to catch up after the last write")
+	masterAddr := flag.String("master", "", "run only follower -id, replicating from the master at this address")
+	id := flag.Int("id", 0, "with -master, this follower's id")
+	kill := flag.Int("kill", 0, "kill the master before this write, failing over to the most up-to-date follower; 0 never does")
+	leaders := flag.Int("leaders", 0, "run this many leaders that all take writes to a key-value store and merge each other's instead")
+	resolve := flag.String("resolve", "lww", "with -leaders, how to resolve conflicting writes: lww keeps the last by hybrid logical clock, union merges comma-separated sets")
+	skew := flag.Duration("skew", 20*time.Millisecond, "with -leaders, how far apart the leaders' clocks may be")
+	crdtKind := flag.String("crdt", "", "have -followers followers take writes to this CRDT and gossip them to each other instead: gcounter, pncounter, orset, lww or mvregister")
+	drop := flag.Float64("drop", 0.2, "with -crdt, the chance that a gossip message is lost")
+	seed := flag.Int64("seed", 1, "seed of the random writes and delays of -leaders and -crdt")
+	flag.Parse()
 
-	m := &Master{followersChan: make([]chan int, 0)}
-	m.followersChan = append(m.followersChan, f1.ch, f2.ch, f3.ch)
+	switch WriteConcern(*concern) {
+	case WriteLeaderOnly, WriteMajority, WriteAll:
+	default:
+		log.Fatalf("unknown write concern %q", *concern)
+	}
+	switch Overflow(*overflow) {
+	case OverflowBlock, OverflowResync, OverflowCoalesce:
+	default:
+		log.Fatalf("unknown overflow policy %q", *overflow)
+	}
+	if *queue < 1 {
+		log.Fatal("-queue must be at least 1")
+	}
+	newMasterFromFlags := func(followers []int) *Master {
+		sm, err := newStateMachine(*kind)
+		if err != nil {
+			log.Fatal(err)
+		}
+		m := newMaster(sm, followers)
+		m.compactEvery = *compact
+		m.queueSize = *queue
+		m.overflow = Overflow(*overflow)
+		return m
+	}
+	newSM := func() StateMachine {
+		sm, err := newStateMachine(*kind)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return sm
+	}
 
-	var wg sync.WaitGroup
+	switch {
+	case *crdtKind != "":
+		if err := runGossip(*seed, *crdtKind, *followers, 300, *drop, *loopback); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case *leaders > 0:
+		if err := runMultiLeader(*seed, *leaders, 100, *resolve, *skew, *slow, *loopback); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case *listen != "":
+		var ids []int
+		for id := range *followers {
+			ids = append(ids, id)
+		}
+		m := newMasterFromFlags(ids)
+		runMaster(m, *listen, demoCommands(*kind), WriteConcern(*concern), *timeout, *linger)
+		return
+	case *masterAddr != "":
+		f := demoFollower(*id, newSM(), *slow, *disconnect, *away)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		f.followMaster(&wg, *masterAddr)
+		log.Printf("Follower%d done at seq %d\n", f.id, f.applied)
+		return
+	}
 
-	wg.Add(4)
-	go m.WriteUpdate(&wg)
-	go f1.recvUpdate(&wg)
-	go f2.recvUpdate(&wg)
-	go f3.recvUpdate(&wg)
+	m := newMasterFromFlags([]int{0, 1, 2})
+	fs := []*Follower{
+		demoFollower(0, newSM(), *slow, *disconnect, *away),
+		demoFollower(1, newSM(), *slow, *disconnect, *away),
+		demoFollower(2, newSM(), *slow, *disconnect, *away),
+	}
+	c, acks, killed := replicate(m, fs, demoCommands(*kind), WriteConcern(*concern), *timeout, *loopback, *kill)
 
-	wg.Wait()
+	// Every follower, including the one that missed entries while it was
+	// away, must end up in the master's state.
+	if err := verify(c, acks, killed, WriteConcern(*concern), *kind); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("All followers converged at seq %d of epoch %d, %d writes acknowledged\n", c.Master().last.Load(), c.Master().epoch, len(acks))
 }
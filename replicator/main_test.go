@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+var (
+	workloadSeeds     = flag.Int("seeds", 20, "number of seeds each randomized test runs; -short runs fewer")
+	workloadFirstSeed = flag.Int64("first-seed", 1, "first seed the randomized tests run")
+)
+
+// forSeeds runs check on -seeds random workloads from -first-seed and fails
+// at the first one that fails. A failing seed is replayed with its logs by
+//
+//	go test -run <test> -v -seeds 1 -first-seed N
+func forSeeds(t *testing.T, check func(seed int64) error) {
+	t.Helper()
+	count := *workloadSeeds
+	if testing.Short() {
+		count = min(count, 5)
+	}
+	for seed := *workloadFirstSeed; seed < *workloadFirstSeed+int64(count); seed++ {
+		if err := check(seed); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+	}
+}
+
+// workloadKeys is how many distinct keys a random key-value workload uses,
+// few enough that puts and deletes keep hitting the same ones.
+const workloadKeys = 16
+
+// randomCommand returns a command for a state machine of kind. One in fifty
+// is malformed, which the master must refuse without logging it.
+func randomCommand(rng *rand.Rand, kind string) []byte {
+	if rng.Intn(50) == 0 {
+		cmd := make([]byte, rng.Intn(4))
+		rng.Read(cmd)
+		return cmd
+	}
+	if kind == "counter" {
+		return counterAdd(rng.Intn(21) - 10)
+	}
+	key := fmt.Sprintf("key%d", rng.Intn(workloadKeys))
+	if rng.Intn(4) == 0 {
+		return kvDeleteCmd(key)
+	}
+	return kvPutCmd(key, fmt.Sprintf("%x", rng.Int63()))
+}
+
+// checkWorkload replicates a random workload and fails if a follower does
+// not end in the master's state. The workload picks a state machine, a
+// number of followers, how often the master compacts its log, the
+// followers' queue size and overflow policy, which followers are slow or
+// drop out mid-stream and for how long, and whether and when the master
+// dies.
+func checkWorkload(seed int64, loopback bool) error {
+	rng := rand.New(rand.NewSource(seed))
+	kind := []string{"counter", "kv"}[rng.Intn(2)]
+	newSM := func() StateMachine {
+		sm, _ := newStateMachine(kind)
+		return sm
+	}
+
+	writes := 50 + rng.Intn(250)
+	var ids []int
+	for id := range 1 + rng.Intn(4) {
+		ids = append(ids, id)
+	}
+	m := newMaster(newSM(), ids)
+	if rng.Intn(2) == 0 {
+		m.compactEvery = 1 + rng.Intn(50)
+	}
+	m.overflow = []Overflow{OverflowBlock, OverflowResync, OverflowCoalesce}[rng.Intn(3)]
+	m.queueSize = 1 + rng.Intn(64)
+
+	var fs []*Follower
+	for _, id := range ids {
+		f := newFollower(id, newSM())
+		if rng.Intn(2) == 0 {
+			f.disconnectAt = 1 + rng.Intn(writes)
+			f.away = time.Duration(rng.Intn(20)) * time.Millisecond
+		}
+		if rng.Intn(4) == 0 {
+			f.delay = time.Duration(rng.Intn(200)) * time.Microsecond
+		}
+		fs = append(fs, f)
+	}
+
+	cmds := make([][]byte, writes)
+	for i := range cmds {
+		cmds[i] = randomCommand(rng, kind)
+	}
+
+	// Half the workloads kill the master partway through, and
+	// write with a concern that must not lose acknowledged writes to the
+	// failover.
+	concern, timeout, killAt := WriteLeaderOnly, time.Duration(0), 0
+	if rng.Intn(2) == 0 {
+		concern = []WriteConcern{WriteMajority, WriteAll}[rng.Intn(2)]
+		timeout = 20 * time.Millisecond
+		killAt = 1 + rng.Intn(writes-1)
+	}
+	c, acks, killed := replicate(m, fs, cmds, concern, timeout, loopback, killAt)
+	return verify(c, acks, killed, concern, kind)
+}
+
+// Random workloads of counter and key-value writes, with followers that are
+// slow, overflow their queues, drop out and rejoin, and masters that die,
+// must leave every follower in the master's state.
+func TestRandomWorkloads(t *testing.T) {
+	forSeeds(t, func(seed int64) error { return checkWorkload(seed, false) })
+}
+
+func TestRandomWorkloadsLoopback(t *testing.T) {
+	forSeeds(t, func(seed int64) error { return checkWorkload(seed, true) })
+}
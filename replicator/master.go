@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errMasterDown = errors.New("master is down")
+	errStaleEpoch = errors.New("master has been replaced by one with a newer epoch")
+	errAheadOfLog = errors.New("follower is ahead of the master's log")
+)
+
+// Write/Read
+type Master struct {
+	epoch        int      // fencing epoch: followers refuse masters older than the newest they know of
+	prev         int      // epoch of the master this one was promoted from following, 0 for none
+	start        int      // seq it was promoted at; up to it, its log is that of epoch prev
+	followers    []int    // ids of the followers
+	compactEvery int      // entries to keep before compacting the log into a snapshot, 0 for never
+	queueSize    int      // entries that may queue for a follower before overflow applies
+	overflow     Overflow // what a write does when a follower's queue is full
+
+	sendMu  sync.Mutex // keeps entries in sequence order on every stream
+	sm      StateMachine
+	snap    snapshot // state up to the first entry in log
+	log     []Entry  // log[i] has seq snap.Seq+i+1
+	streams map[int]*stream
+	closed  bool
+	last    atomic.Int64 // seq of the last entry, readable without sendMu
+
+	dead     atomic.Bool  // set by Kill: no heartbeats, writes or connections
+	fencedBy atomic.Int64 // newest epoch a follower has refused this master for
+
+	mu          sync.Mutex
+	acked       map[int]int // follower -> highest seq it acknowledged
+	cond        *sync.Cond  // broadcast whenever acked changes
+	written     []time.Time // when each entry after writtenBase was written, back to the oldest one not every follower acknowledged
+	writtenBase int
+	resyncs     map[int]int
+	coalesced   map[int]int
+	down        map[int]bool // followers the membership saw fail or leave; writes that need them fail at once
+}
+
+func newMaster(sm StateMachine, followers []int) *Master {
+	m := &Master{
+		epoch:     1,
+		followers: followers,
+		queueSize: defaultQueueSize,
+		overflow:  OverflowBlock,
+		sm:        sm,
+		streams:   make(map[int]*stream),
+		acked:     make(map[int]int),
+		resyncs:   make(map[int]int),
+		coalesced: make(map[int]int),
+		down:      make(map[int]bool),
+	}
+	m.cond = sync.NewCond(&m.mu)
+	go m.heartbeat()
+	return m
+}
+
+// Connect attaches follower id, which has applied the log up to seq from, and
+// returns a stream of every entry after from: first the ones already in the
+// log, then each new one as it is written. A follower further behind than the
+// log reaches back gets a snapshot instead of what it missed, as does one
+// more than a queue behind unless the overflow policy is OverflowBlock. The
+// stream is closed once the master has nothing more to write.
+//
+// epoch is the newest epoch the follower knows of. A master older than that
+// has been replaced, and from then on refuses every write, even if it is
+// down. source is the epoch of the master the follower applied its entries
+// from. If those may differ from the master's own, the follower gets a
+// snapshot rather than the rest of the log.
+func (m *Master) Connect(id, from, epoch, source int) (*stream, error) {
+	m.sendMu.Lock()
+	defer m.sendMu.Unlock()
+
+	last := int(m.last.Load())
+	diverged := m.diverged(from, source)
+	switch {
+	case epoch > m.epoch:
+		m.fence(epoch)
+		return nil, fmt.Errorf("%w: follower%d knows of epoch %d, master is at %d", errStaleEpoch, id, epoch, m.epoch)
+	case m.dead.Load():
+		return nil, errMasterDown
+	case from > last && !diverged:
+		return nil, fmt.Errorf("%w: follower%d is at seq %d, master at %d", errAheadOfLog, id, from, last)
+	}
+
+	var backlog []item
+	if diverged {
+		data, err := m.sm.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Follower%d applied up to seq %d from the master of epoch %d, resyncing it with a snapshot at seq %d\n", id, from, source, last)
+		backlog = append(backlog, item{snap: &snapshot{Seq: last, Data: data}})
+		from = last
+	} else {
+		m.noteAck(ack{follower: id, seq: from})
+	}
+	if m.overflow != OverflowBlock && last-from > m.queueSize {
+		if data, err := m.sm.Snapshot(); err != nil {
+			log.Printf("Follower%d cannot be resynced with a snapshot: %v\n", id, err)
+		} else {
+			log.Printf("Follower%d is %d entries behind, resyncing it with a snapshot at seq %d\n", id, last-from, last)
+			backlog = append(backlog, item{snap: &snapshot{Seq: last, Data: data}})
+			from = last
+		}
+	}
+	if from < m.snap.Seq {
+		log.Printf("Follower%d needs compacted entries, sending snapshot at seq %d\n", id, m.snap.Seq)
+		backlog = append(backlog, item{snap: &snapshot{Seq: m.snap.Seq, Data: m.snap.Data}})
+		from = m.snap.Seq
+	}
+	entries := m.log[min(from-m.snap.Seq, len(m.log)):]
+	for _, e := range entries {
+		backlog = append(backlog, item{entry: e})
+	}
+	if from > 0 && len(entries) > 0 {
+		log.Printf("Follower%d rejoined at seq %d, sending %d missed entries\n", id, from, len(entries))
+	}
+	// Whatever the backlog ends with is the master's last seq as of now.
+	if n := len(backlog); n > 0 && backlog[n-1].seq() == last {
+		backlog[n-1].sent = time.Now()
+	}
+
+	s := newStream(m, id, backlog)
+	if old, ok := m.streams[id]; ok {
+		old.disconnect()
+		delete(m.streams, id)
+	}
+	if m.closed {
+		s.close()
+	} else {
+		m.streams[id] = s
+	}
+	return s, nil
+}
+
+// diverged reports whether a follower that applied entries up to from, the
+// last of them from the master of epoch source, may have entries this
+// master's log does not. Up to start a promoted master's log is that of the
+// master it followed, and after that it is its own.
+func (m *Master) diverged(from, source int) bool {
+	switch {
+	case from == 0 || source == m.epoch:
+		return false
+	case source == m.prev:
+		return from > m.start
+	}
+	return true
+}
+
+// State returns a snapshot of the master's state machine.
+func (m *Master) State() (snapshot, error) {
+	m.sendMu.Lock()
+	defer m.sendMu.Unlock()
+	data, err := m.sm.Snapshot()
+	return snapshot{Seq: int(m.last.Load()), Data: data}, err
+}
+
+// compact replaces the log with a snapshot of the state machine. It is called
+// with sendMu held.
+func (m *Master) compact() {
+	data, err := m.sm.Snapshot()
+	if err != nil {
+		log.Printf("Master: not compacting the log: %v\n", err)
+		return
+	}
+	m.snap = snapshot{Seq: int(m.last.Load()), Data: data}
+	m.log = nil
+}
+
+// Close ends every stream once the followers have been sent the whole log.
+func (m *Master) Close() {
+	m.sendMu.Lock()
+	defer m.sendMu.Unlock()
+	m.closed = true
+	for id, s := range m.streams {
+		s.close()
+		delete(m.streams, id)
+	}
+}
+
+func (m *Master) noteAck(a ack) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if a.seq > m.acked[a.follower] {
+		m.acked[a.follower] = a.seq
+		m.trimWritten()
+		m.cond.Broadcast()
+	}
+}
+
+// Write applies cmd to the master's state machine, appends it to the log,
+// sends it to every connected follower and waits until concern is satisfied,
+// timeout has passed or followers it needs are known to be down. Either way
+// the result lists the followers that had not applied the write yet. A command the state machine refuses is not
+// logged, and a master that is down or has been replaced refuses every
+// write.
+func (m *Master) Write(cmd []byte, concern WriteConcern, timeout time.Duration) (WriteResult, error) {
+	m.sendMu.Lock()
+	if err := m.writable(); err != nil {
+		m.sendMu.Unlock()
+		return WriteResult{}, err
+	}
+	if err := m.sm.Apply(cmd); err != nil {
+		m.sendMu.Unlock()
+		return WriteResult{}, err
+	}
+	e := Entry{Seq: int(m.last.Load()) + 1, Command: cmd}
+	m.log = append(m.log, e)
+	m.last.Store(int64(e.Seq))
+	now := m.recordWrite(e.Seq)
+	for id, s := range m.streams {
+		if !m.enqueue(id, s, e, now) {
+			delete(m.streams, id)
+		}
+	}
+	if m.compactEvery > 0 && len(m.log) >= m.compactEvery {
+		m.compact()
+	}
+	err := m.writable()
+	m.sendMu.Unlock()
+
+	if err != nil {
+		return WriteResult{Epoch: m.epoch, Seq: e.Seq}, err
+	}
+	return m.wait(e.Seq, concern, timeout)
+}
+
+// writable reports why the master cannot take writes, if it cannot.
+func (m *Master) writable() error {
+	if m.dead.Load() {
+		return errMasterDown
+	}
+	if epoch := m.fencedBy.Load(); epoch > int64(m.epoch) {
+		return fmt.Errorf("%w: master is at epoch %d, followers at %d", errStaleEpoch, m.epoch, epoch)
+	}
+	return nil
+}
+
+// wait blocks until concern is satisfied for seq, timeout has passed or
+// followers it needs are down.
+func (m *Master) wait(seq int, concern WriteConcern, timeout time.Duration) (WriteResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	timer := time.AfterFunc(timeout, func() {
+		m.mu.Lock()
+		m.cond.Broadcast()
+		m.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	deadline := time.Now().Add(timeout)
+	for !m.satisfied(seq, concern) {
+		if m.dead.Load() {
+			return m.result(seq), errMasterDown
+		}
+		if down := m.blocking(seq, concern); len(down) > 0 {
+			return m.result(seq), fmt.Errorf("%w: followers %v", errFollowersDown, down)
+		}
+		if !time.Now().Before(deadline) {
+			return m.result(seq), errWriteTimeout
+		}
+		m.cond.Wait()
+	}
+	return m.result(seq), nil
+}
+
+// satisfied reports whether enough followers acknowledged seq for concern.
+// The master itself always has the write.
+func (m *Master) satisfied(seq int, concern WriteConcern) bool {
+	n := len(m.followers)
+	acked := 0
+	for _, id := range m.followers {
+		if m.acked[id] >= seq {
+			acked++
+		}
+	}
+
+	switch concern {
+	case WriteMajority:
+		return 1+acked >= (n+1)/2+1
+	case WriteAll:
+		return acked == n
+	default:
+		return true
+	}
+}
+
+// blocking returns the followers that are down and have not acknowledged
+// seq, if without them concern cannot be satisfied until some come back.
+func (m *Master) blocking(seq int, concern WriteConcern) []int {
+	var down []int
+	for _, id := range m.followers {
+		if m.down[id] && m.acked[id] < seq {
+			down = append(down, id)
+		}
+	}
+	n := len(m.followers)
+	switch {
+	case concern == WriteMajority && 1+n-len(down) < (n+1)/2+1:
+		return down
+	case concern == WriteAll:
+		return down
+	}
+	return nil
+}
+
+func (m *Master) result(seq int) WriteResult {
+	r := WriteResult{Epoch: m.epoch, Seq: seq}
+	for _, id := range m.followers {
+		if m.acked[id] >= seq {
+			r.Acked = append(r.Acked, id)
+		} else {
+			r.Lagging = append(r.Lagging, id)
+		}
+	}
+	return r
+}
+
+func (m *Master) WriteUpdate(wg *sync.WaitGroup, cmds [][]byte, concern WriteConcern, timeout time.Duration) {
+	defer wg.Done()
+
+	log.Println("Master writing update")
+
+	for i, cmd := range cmds {
+		if i > 0 && i%25 == 0 {
+			m.logLag()
+		}
+		res, err := m.Write(cmd, concern, timeout)
+		if err != nil && !errors.Is(err, errWriteTimeout) && !errors.Is(err, errFollowersDown) {
+			log.Printf("Write refused: %v\n", err)
+		} else if err != nil {
+			log.Printf("Write %d with concern %q failed: %v, followers %v lagging\n", res.Seq, concern, err, res.Lagging)
+		} else if len(res.Lagging) > 0 {
+			log.Printf("Write %d done with concern %q, followers %v still lagging\n", res.Seq, concern, res.Lagging)
+		}
+	}
+
+	m.logLag()
+
+	// Close the streams once communication is done
+	m.Close()
+}
+
+func (m *Master) logLag() {
+	for _, l := range m.Lag() {
+		log.Printf("Follower%d is %d entries and %v behind, resynced %d times, coalesced %d times\n", l.Follower, l.Entries, l.Time.Round(time.Millisecond), l.Resyncs, l.Coalesced)
+	}
+}
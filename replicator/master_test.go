@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// startFollowers runs fs as the in-process followers of m until the test
+// ends, when m is closed and every follower has been sent the whole log.
+func startFollowers(t *testing.T, m *Master, fs []*Follower) *Cluster {
+	t.Helper()
+	c := newCluster(m, fs)
+	var wg sync.WaitGroup
+	wg.Add(len(fs))
+	for _, f := range fs {
+		go f.recvUpdate(&wg)
+	}
+	t.Cleanup(func() {
+		c.Master().Close()
+		wg.Wait()
+	})
+	return c
+}
+
+// newCounters returns a master of a Counter and n followers of their own.
+func newCounters(n int) (*Master, []*Follower) {
+	var ids []int
+	var fs []*Follower
+	for id := range n {
+		ids = append(ids, id)
+		fs = append(fs, newFollower(id, &Counter{}))
+	}
+	return newMaster(&Counter{}, ids), fs
+}
+
+// awaitConverged waits for every follower of c to be in the master's state.
+func awaitConverged(t *testing.T, c *Cluster, timeout time.Duration) {
+	t.Helper()
+	var err error
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if err = converged(c); err == nil {
+			return
+		}
+	}
+	t.Fatal(err)
+}
+
+// Three followers, one of which takes slow to apply each entry. A write
+// with each concern returns once its followers have applied it, and lists
+// the slow follower as lagging for as long as it is.
+func TestWriteConcernSlowFollower(t *testing.T) {
+	const slow = 20 * time.Millisecond
+	tests := []struct {
+		concern WriteConcern
+		timeout time.Duration
+		err     error
+		acked   int // followers that must have applied the write when it returns
+	}{
+		{WriteLeaderOnly, 0, nil, 0},
+		{WriteMajority, time.Second, nil, 2},
+		{WriteAll, time.Second, nil, 3},
+		{WriteAll, slow / 4, errWriteTimeout, 0},
+	}
+	for _, tt := range tests {
+		m, fs := newCounters(3)
+		fs[2].delay = slow
+		c := startFollowers(t, m, fs)
+
+		for range 5 {
+			res, err := m.Write(counterAdd(1), tt.concern, tt.timeout)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("%s write with timeout %v returned %v, want %v", tt.concern, tt.timeout, err, tt.err)
+			}
+			if len(res.Acked) < tt.acked {
+				t.Fatalf("%s write %d returned with followers %v acked, want at least %d", tt.concern, res.Seq, res.Acked, tt.acked)
+			}
+			if len(res.Acked)+len(res.Lagging) != 3 {
+				t.Fatalf("%s write %d: acked %v and lagging %v do not cover the followers", tt.concern, res.Seq, res.Acked, res.Lagging)
+			}
+			if err == nil && tt.concern != WriteAll && !slices.Contains(res.Lagging, 2) {
+				t.Fatalf("%s write %d returned after the slow follower applied it", tt.concern, res.Seq)
+			}
+			if err != nil && !slices.Contains(res.Lagging, 2) {
+				t.Fatalf("%s write %d timed out without the slow follower lagging: %v", tt.concern, res.Seq, res.Lagging)
+			}
+		}
+		awaitConverged(t, c, 5*time.Second)
+	}
+}
+
+// Lag reports how many entries and how long a follower that takes slow
+// to apply each entry is behind, and nothing for one that keeps up.
+func TestLagSlowFollower(t *testing.T) {
+	const slow = 10 * time.Millisecond
+	m, fs := newCounters(2)
+	fs[1].delay = slow
+	c := startFollowers(t, m, fs)
+
+	for range 20 {
+		if _, err := m.Write(counterAdd(1), WriteMajority, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lags := m.Lag()
+	if lags[0].Entries != 0 {
+		t.Errorf("follower0 is %d entries behind after majority writes", lags[0].Entries)
+	}
+	if lags[1].Entries == 0 || lags[1].Time == 0 {
+		t.Errorf("slow follower1 is %d entries and %v behind", lags[1].Entries, lags[1].Time)
+	}
+
+	awaitConverged(t, c, 5*time.Second)
+	if res, err := m.wait(int(m.last.Load()), WriteAll, time.Second); err != nil {
+		t.Fatalf("followers %v did not acknowledge the last write: %v", res.Lagging, err)
+	}
+	for _, l := range m.Lag() {
+		if l.Entries != 0 {
+			t.Errorf("follower%d still %d entries behind after converging", l.Follower, l.Entries)
+		}
+	}
+}
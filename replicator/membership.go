@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"slices"
+
+	"membership"
+)
+
+// followMembership has the master follow a SWIM group its followers belong
+// to. A follower the group sees fail or leave is dropped, and writes whose
+// concern cannot be satisfied without it fail at once with
+// errFollowersDown rather than wait out their timeout; it still counts
+// towards every concern, so none is weakened. A follower that joins again
+// catches up when it reconnects. idOf gives the id of the follower at a member's address, or
+// false for a member that is not one. It runs until ml stops.
+func (m *Master) followMembership(ml *membership.Memberlist, idOf func(addr string) (int, bool)) {
+	events := ml.Subscribe()
+	go func() {
+		for e := range events {
+			id, ok := idOf(e.Member.Addr)
+			if !ok {
+				continue
+			}
+			switch e.Type {
+			case membership.EventJoin:
+				m.setDown(id, false)
+			case membership.EventLeave, membership.EventFail:
+				m.setDown(id, true)
+			}
+		}
+	}()
+}
+
+// setDown records whether follower id is down. A follower going down has its
+// stream dropped, and the writes waiting on it fail if the followers left
+// are not enough for their concern.
+func (m *Master) setDown(id int, down bool) {
+	if !slices.Contains(m.followers, id) {
+		return
+	}
+	if down {
+		m.sendMu.Lock()
+		if s, ok := m.streams[id]; ok {
+			s.disconnect()
+			delete(m.streams, id)
+		}
+		m.sendMu.Unlock()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.down[id] == down {
+		return
+	}
+	if down {
+		m.down[id] = true
+		log.Printf("Master dropping follower%d, which the membership saw go\n", id)
+	} else {
+		delete(m.down, id)
+		log.Printf("Master counting follower%d again, which the membership saw join\n", id)
+	}
+	m.cond.Broadcast()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"membership"
+)
+
+// A master following a SWIM group stops waiting on a follower once the
+// group sees it crash: WriteAll fails at once rather than timing out, while
+// WriteMajority still needs acknowledgements from the followers left. Once
+// the follower rejoins and catches up, WriteAll goes through again.
+func TestMasterFollowsMembership(t *testing.T) {
+	network := membership.NewMemNetwork(1)
+	start := func(name string, seeds ...string) *membership.Memberlist {
+		cfg := membership.DefaultConfig(name)
+		cfg.ProbeInterval = 10 * time.Millisecond
+		cfg.ProbeTimeout = 4 * time.Millisecond
+		cfg.SuspicionTimeout = 100 * time.Millisecond
+		ml := membership.NewMemberlist(cfg, network.Transport(name))
+		network.Register(name, ml.Handle)
+		ml.Start(seeds...)
+		t.Cleanup(ml.Shutdown)
+		return ml
+	}
+
+	m, fs := newCounters(3)
+	newCluster(m, fs)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer m.Close()
+	ml := start("master")
+	m.followMembership(ml, func(addr string) (int, bool) {
+		id, err := strconv.Atoi(addr)
+		return id, err == nil
+	})
+	var members []*membership.Memberlist
+	for _, f := range fs {
+		members = append(members, start(strconv.Itoa(f.id), "master"))
+	}
+	for deadline := time.Now().Add(time.Second); len(ml.Members()) < 4; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the master sees only %d members", len(ml.Members()))
+		}
+	}
+
+	// follower2 crashed before it connected.
+	wg.Add(2)
+	go fs[0].recvUpdate(&wg)
+	go fs[1].recvUpdate(&wg)
+	if _, err := m.Write(counterAdd(1), WriteAll, 50*time.Millisecond); !errors.Is(err, errWriteTimeout) {
+		t.Fatalf("WriteAll without follower2 returned %v before it was seen to fail", err)
+	}
+	members[2].Shutdown()
+	began := time.Now()
+	res, err := m.Write(counterAdd(1), WriteAll, 5*time.Second)
+	if !errors.Is(err, errFollowersDown) || !slices.Equal(res.Lagging, []int{2}) {
+		t.Fatalf("WriteAll once follower2 failed: %v, followers %v lagging", err, res.Lagging)
+	}
+	if took := time.Since(began); took > time.Second {
+		t.Fatalf("WriteAll took %v to fail once follower2 failed", took)
+	}
+	if res, err := m.Write(counterAdd(1), WriteMajority, 5*time.Second); err != nil || len(res.Acked) < 2 {
+		t.Fatalf("WriteMajority once follower2 failed: %v, followers %v acked", err, res.Acked)
+	}
+
+	wg.Add(1)
+	go fs[2].recvUpdate(&wg)
+	start("2", "master")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		m.mu.Lock()
+		down := m.down[2]
+		m.mu.Unlock()
+		if !down {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("follower2 still down after it rejoined")
+		}
+	}
+	res, err = m.Write(counterAdd(1), WriteAll, 5*time.Second)
+	if err != nil || len(res.Acked) != 3 {
+		t.Fatalf("WriteAll once follower2 rejoined: %v, followers %v acked", err, res.Acked)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"log"
+	"maps"
+	"slices"
+)
+
+// merkleDepth is how many levels a Merkle tree has below its root. Keys are
+// hashed into its 1<<merkleDepth leaves, so up to tens of thousands of keys a
+// leaf holds only a few.
+const merkleDepth = 10
+
+// merkleTree is a hash tree over a KV's keyspace: each leaf hashes the
+// pairs whose keys hash into it, and each node above hashes its two
+// children. Two KVs are the same where their trees are, so comparing from
+// the root down finds the leaves that differ without looking at any other.
+// A KV keeps its tree up to date as it applies each command, which rehashes
+// only the leaf of the key and the nodes above it.
+type merkleTree struct {
+	nodes   [][sha256.Size]byte // node i has children 2i+1 and 2i+2; the last 1<<merkleDepth are the leaves
+	buckets []map[string]string // each leaf's pairs, nil for none
+}
+
+func leafOf(key string) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(h.Sum64() % (1 << merkleDepth))
+}
+
+func newMerkleTree(data map[string]string) *merkleTree {
+	leaves := 1 << merkleDepth
+	t := &merkleTree{
+		nodes:   make([][sha256.Size]byte, 2*leaves-1),
+		buckets: make([]map[string]string, leaves),
+	}
+	for k, v := range data {
+		leaf := leafOf(k)
+		if t.buckets[leaf] == nil {
+			t.buckets[leaf] = make(map[string]string)
+		}
+		t.buckets[leaf][k] = v
+	}
+
+	first := leaves - 1
+	for i, bucket := range t.buckets {
+		t.nodes[first+i] = hashBucket(bucket)
+	}
+	for i := first - 1; i >= 0; i-- {
+		t.nodes[i] = t.hashChildren(i)
+	}
+	return t
+}
+
+func hashBucket(bucket map[string]string) [sha256.Size]byte {
+	return sha256.Sum256(appendBucket(nil, bucket))
+}
+
+// appendBucket appends the number of pairs in bucket, then each pair in key
+// order.
+func appendBucket(b []byte, bucket map[string]string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(bucket)))
+	for _, k := range slices.Sorted(maps.Keys(bucket)) {
+		b = appendString(appendString(b, k), bucket[k])
+	}
+	return b
+}
+
+func readBucket(b []byte) (map[string]string, []byte, error) {
+	n, size := binary.Uvarint(b)
+	if size <= 0 {
+		return nil, nil, errBadFrame
+	}
+	b = b[size:]
+	bucket := make(map[string]string)
+	for range n {
+		var k, v string
+		var err error
+		if k, b, err = readString(b); err != nil {
+			return nil, nil, err
+		}
+		if v, b, err = readString(b); err != nil {
+			return nil, nil, err
+		}
+		bucket[k] = v
+	}
+	return bucket, b, nil
+}
+
+func (t *merkleTree) hashChildren(i int) [sha256.Size]byte {
+	return sha256.Sum256(append(t.nodes[2*i+1][:], t.nodes[2*i+2][:]...))
+}
+
+// set records that key is set to value.
+func (t *merkleTree) set(key, value string) {
+	leaf := leafOf(key)
+	if t.buckets[leaf] == nil {
+		t.buckets[leaf] = make(map[string]string)
+	}
+	t.buckets[leaf][key] = value
+	t.rehash(leaf)
+}
+
+// remove records that key is deleted.
+func (t *merkleTree) remove(key string) {
+	leaf := leafOf(key)
+	if _, ok := t.buckets[leaf][key]; !ok {
+		return
+	}
+	delete(t.buckets[leaf], key)
+	t.rehash(leaf)
+}
+
+// rehash hashes leaf again, and every node from it up to the root.
+func (t *merkleTree) rehash(leaf int) {
+	i := len(t.nodes)/2 + leaf
+	t.nodes[i] = hashBucket(t.buckets[leaf])
+	for i > 0 {
+		i = (i - 1) / 2
+		t.nodes[i] = t.hashChildren(i)
+	}
+}
+
+// Repairs counts what a follower's anti-entropy has done.
+type Repairs struct {
+	Rounds  int // times the follower compared its tree with the master's
+	Hashes  int // tree nodes it compared
+	Fetched int // pairs it was sent from the leaves that differed
+	Fixed   int // keys it put or deleted to match the master
+}
+
+// treeQuery asks the master for the hashes of some nodes of its Merkle tree,
+// or for the pairs of some of its leaves.
+type treeQuery struct {
+	nodes  []int
+	leaves []int
+}
+
+// treeReply answers a treeQuery with the master's tree as of its write seq.
+type treeReply struct {
+	seq     int
+	hashes  [][sha256.Size]byte // one per node asked for
+	buckets []map[string]string // one per leaf asked for
+}
+
+// treeSource answers a follower's queries about the master's tree: the
+// master itself in process, or its address over TCP.
+type treeSource interface {
+	queryTree(q treeQuery) (treeReply, error)
+}
+
+var errNoTree = errors.New("master keeps no Merkle tree, or is busy writing")
+
+// queryTree answers q from the master's KV as of its last write. A master
+// whose state machine is not a KV, or that is busy writing, answers nothing.
+func (m *Master) queryTree(q treeQuery) (treeReply, error) {
+	if !m.sendMu.TryLock() {
+		return treeReply{}, errNoTree
+	}
+	defer m.sendMu.Unlock()
+
+	kv, ok := m.sm.(*KV)
+	if !ok {
+		return treeReply{}, errNoTree
+	}
+	r := treeReply{seq: int(m.last.Load())}
+	for _, i := range q.nodes {
+		if i < 0 || i >= len(kv.tree.nodes) {
+			return treeReply{}, errNoTree
+		}
+		r.hashes = append(r.hashes, kv.tree.nodes[i])
+	}
+	for _, leaf := range q.leaves {
+		if leaf < 0 || leaf >= len(kv.tree.buckets) {
+			return treeReply{}, errNoTree
+		}
+		r.buckets = append(r.buckets, maps.Clone(kv.tree.buckets[leaf]))
+	}
+	return r, nil
+}
+
+// repair compares the follower's KV with the master's and fixes where they
+// differ. Acknowledgements only say a follower applied every entry, not that
+// its state is right, so a follower that went wrong some other way would
+// never know. They are compared only when the follower has applied as much
+// as the master has written, descending from the root into the subtrees
+// whose hashes differ one level per query, and then only the differing
+// leaves' pairs are fetched, so a repair costs in proportion to how much
+// differs rather than to the size of the keyspace. It gives up if either
+// side applies anything in the meantime.
+//
+// It is called only by the goroutine that applies what the master sends.
+func (f *Follower) repair(src treeSource) {
+	f.mu.Lock()
+	kv, ok := f.sm.(*KV)
+	applied := f.applied
+	f.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	// compare sends q, and calls check with the reply under mu if it is of
+	// the state the follower is in.
+	compare := func(q treeQuery, check func(treeReply)) bool {
+		r, err := src.queryTree(q)
+		if err != nil || r.seq != applied {
+			return false
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.applied != applied {
+			return false
+		}
+		check(r)
+		return true
+	}
+
+	diff := []int{0}
+	first := 1<<merkleDepth - 1
+	for rounds := 0; ; rounds++ {
+		var next []int
+		ok := compare(treeQuery{nodes: diff}, func(r treeReply) {
+			if rounds == 0 {
+				f.repairs.Rounds++
+			}
+			for i, n := range diff {
+				f.repairs.Hashes++
+				if kv.tree.nodes[n] != r.hashes[i] {
+					next = append(next, n)
+				}
+			}
+		})
+		if !ok || len(next) == 0 {
+			return
+		}
+		if next[0] >= first {
+			diff = next
+			break
+		}
+		diff = diff[:0]
+		for _, i := range next {
+			diff = append(diff, 2*i+1, 2*i+2)
+		}
+	}
+
+	var leaves []int
+	for _, i := range diff {
+		leaves = append(leaves, i-first)
+	}
+	fixed := 0
+	compare(treeQuery{leaves: leaves}, func(r treeReply) {
+		for i, leaf := range leaves {
+			want, got := r.buckets[i], maps.Clone(kv.tree.buckets[leaf])
+			f.repairs.Fetched += len(want)
+			for k := range got {
+				if _, ok := want[k]; !ok {
+					kv.delete(k)
+					fixed++
+				}
+			}
+			for k, v := range want {
+				if old, ok := got[k]; !ok || old != v {
+					kv.put(k, v)
+					fixed++
+				}
+			}
+		}
+		f.repairs.Fixed += fixed
+	})
+	if fixed > 0 {
+		log.Printf("Follower%d differed from the master in %d leaves at seq %d, fixed %d keys\n", f.id, len(leaves), applied, fixed)
+	}
+}
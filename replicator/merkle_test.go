@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A KV's tree, kept up to date command by command, is the tree of its
+// pairs.
+func TestMerkleIncremental(t *testing.T) {
+	forSeeds(t, func(seed int64) error {
+		rng := rand.New(rand.NewSource(seed))
+		kv := newKV()
+		for range 500 {
+			kv.Apply(randomCommand(rng, "kv"))
+		}
+		if want := newMerkleTree(kv.data); kv.tree.nodes[0] != want.nodes[0] {
+			return fmt.Errorf("tree of %d pairs has root %x, built from them %x", len(kv.data), kv.tree.nodes[0], want.nodes[0])
+		}
+
+		data, err := kv.Snapshot()
+		if err != nil {
+			return err
+		}
+		restored := newKV()
+		if err := restored.Restore(data); err != nil {
+			return err
+		}
+		if restored.tree.nodes[0] != kv.tree.nodes[0] {
+			return fmt.Errorf("restored tree has root %x, not %x", restored.tree.nodes[0], kv.tree.nodes[0])
+		}
+		return nil
+	})
+}
+
+// checkMerkleRepair writes keys pairs through a master to a follower that
+// compares Merkle trees with it every heartbeatInterval, over TCP on
+// localhost if loopback is set, changes corrupt of the follower's keys
+// behind the master's back, and waits for the follower to repair them. It
+// fails if the follower does not end in the master's state, or fetches more
+// than a few pairs per corrupted key.
+func checkMerkleRepair(seed int64, keys, corrupt int, loopback bool) error {
+	rng := rand.New(rand.NewSource(seed))
+	m := newMaster(newKV(), []int{0})
+	f := newFollower(0, newKV())
+	f.master, f.epoch = m, m.epoch
+	f.repairEvery = heartbeatInterval
+	var wg sync.WaitGroup
+	wg.Add(1)
+	if loopback {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		go m.Serve(ln)
+		f.master = nil
+		go f.followMaster(&wg, ln.Addr().String())
+	} else {
+		go f.recvUpdate(&wg)
+	}
+	defer wg.Wait()
+	defer m.Close()
+	corrupt = min(corrupt, keys)
+
+	var last WriteResult
+	for i := range keys {
+		var err error
+		if last, err = m.Write(kvPutCmd(fmt.Sprintf("key%d", i), fmt.Sprintf("%x", rng.Int63())), WriteLeaderOnly, 0); err != nil {
+			return err
+		}
+	}
+	if res, err := m.wait(last.Seq, WriteAll, 10*time.Second); err != nil {
+		return fmt.Errorf("followers %v did not catch up: %w", res.Lagging, err)
+	}
+
+	// Change, delete or add keys, each a different one, as a follower that
+	// went wrong without a command would.
+	f.mu.Lock()
+	kv := f.sm.(*KV)
+	for i, k := range rng.Perm(keys)[:corrupt] {
+		key := fmt.Sprintf("key%d", k)
+		switch i % 3 {
+		case 0:
+			kv.put(key, "corrupt")
+		case 1:
+			kv.delete(key)
+		case 2:
+			kv.put(fmt.Sprintf("stray%d", i), "corrupt")
+		}
+	}
+	before := f.repairs
+	f.mu.Unlock()
+
+	want, err := m.State()
+	if err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(heartbeatInterval) {
+		f.mu.Lock()
+		got, err := f.sm.Snapshot()
+		r := f.repairs
+		f.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		r.Rounds -= before.Rounds
+		r.Fetched -= before.Fetched
+		r.Fixed -= before.Fixed
+		if string(got) == string(want.Data) {
+			if r.Fixed != corrupt {
+				return fmt.Errorf("fixed %d keys, %d were corrupted", r.Fixed, corrupt)
+			}
+			if limit := corrupt * 4 * (keys>>merkleDepth + 1); r.Fetched > limit {
+				return fmt.Errorf("fetched %d pairs to fix %d keys, more than %d", r.Fetched, corrupt, limit)
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("follower0 still differs from the master after %d repair rounds", r.Rounds)
+		}
+	}
+}
+
+// A follower whose keys were changed behind the master's back finds and
+// fixes them by comparing Merkle trees with the master, fetching only the
+// pairs of the leaves that differ.
+func TestMerkleRepair(t *testing.T) {
+	for _, loopback := range []bool{false, true} {
+		for seed := range int64(3) {
+			if err := checkMerkleRepair(seed, 2000, 10+int(seed)*10, loopback); err != nil {
+				t.Fatalf("loopback %v, seed %d: %v", loopback, seed, err)
+			}
+		}
+	}
+}
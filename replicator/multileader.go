@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"replicator/crdt"
+)
+
+// Version is one value of a key in a MultiKV, stamped with when it was
+// written.
+type Version struct {
+	Value   string
+	Deleted bool
+	TS      crdt.Timestamp
+}
+
+// Resolver decides the version of key a leader keeps when it has local and
+// another comes in, from one of its own writes or another leader's. Leaders
+// merge versions in whatever order they reach them, so to converge a
+// Resolver must not care which of the two is local, nor how versions are
+// grouped, and merging a version twice must change nothing.
+type Resolver func(key string, local, remote Version) Version
+
+// lastWriterWins keeps the version written last by the hybrid logical clock.
+// A delete wins or loses like any other write.
+func lastWriterWins(key string, local, remote Version) Version {
+	if local.TS.Less(remote.TS) {
+		return remote
+	}
+	return local
+}
+
+// unionValues treats values as comma-separated sets and keeps every member
+// written to the key on any leader. A delete counts as the empty set, so it
+// removes nothing.
+func unionValues(key string, local, remote Version) Version {
+	members := make(map[string]bool)
+	for _, v := range []Version{local, remote} {
+		if v.Deleted || v.Value == "" {
+			continue
+		}
+		for _, m := range strings.Split(v.Value, ",") {
+			members[m] = true
+		}
+	}
+	keys := make([]string, 0, len(members))
+	for m := range members {
+		keys = append(keys, m)
+	}
+	slices.Sort(keys)
+
+	ts := local.TS
+	if ts.Less(remote.TS) {
+		ts = remote.TS
+	}
+	return Version{Value: strings.Join(keys, ","), Deleted: len(keys) == 0, TS: ts}
+}
+
+func newResolver(name string) (Resolver, error) {
+	switch name {
+	case "lww":
+		return lastWriterWins, nil
+	case "union":
+		return unionValues, nil
+	}
+	return nil, fmt.Errorf("unknown conflict resolution %q", name)
+}
+
+// MultiKV is a map of strings to strings that several leaders write to at
+// once. Every write carries the hybrid logical clock timestamp it was made
+// at, and a version that meets another of the same key is merged with it by
+// the resolver. A deleted key stays as a tombstone, so that a delete can
+// win over a write that reaches a leader after it.
+type MultiKV struct {
+	clock   *crdt.HLC
+	resolve Resolver
+
+	mu   sync.Mutex
+	data map[string]Version
+}
+
+func newMultiKV(clock *crdt.HLC, resolve Resolver) *MultiKV {
+	return &MultiKV{clock: clock, resolve: resolve, data: make(map[string]Version)}
+}
+
+// multiPutCmd returns the command that sets key to value in a MultiKV, as
+// written at ts.
+func multiPutCmd(key, value string, ts crdt.Timestamp) []byte {
+	cmd := appendString([]byte{kvPut}, key)
+	cmd = crdt.AppendTimestamp(cmd, ts)
+	return appendString(cmd, value)
+}
+
+// multiDeleteCmd returns the command that removes key from a MultiKV, as
+// written at ts.
+func multiDeleteCmd(key string, ts crdt.Timestamp) []byte {
+	cmd := appendString([]byte{kvDelete}, key)
+	return crdt.AppendTimestamp(cmd, ts)
+}
+
+func (kv *MultiKV) Get(key string) (string, bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	v, ok := kv.data[key]
+	return v.Value, ok && !v.Deleted
+}
+
+func (kv *MultiKV) Apply(cmd []byte) error {
+	if len(cmd) == 0 {
+		return errBadCommand
+	}
+	key, rest, err := readString(cmd[1:])
+	if err != nil {
+		return err
+	}
+	ts, rest, err := crdt.ReadTimestamp(rest)
+	if err != nil {
+		return err
+	}
+	v := Version{TS: ts}
+	switch cmd[0] {
+	case kvPut:
+		if v.Value, rest, err = readString(rest); err != nil {
+			return err
+		}
+	case kvDelete:
+		v.Deleted = true
+	default:
+		return errBadCommand
+	}
+	if len(rest) != 0 {
+		return errBadCommand
+	}
+
+	kv.clock.Update(ts)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.merge(key, v)
+	return nil
+}
+
+// merge is called with mu held.
+func (kv *MultiKV) merge(key string, v Version) {
+	if local, ok := kv.data[key]; ok {
+		v = kv.resolve(key, local, v)
+	}
+	kv.data[key] = v
+}
+
+// Snapshot encodes every version, tombstones included, in key order.
+func (kv *MultiKV) Snapshot() ([]byte, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	keys := make([]string, 0, len(kv.data))
+	for k := range kv.data {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var data []byte
+	for _, k := range keys {
+		v := kv.data[k]
+		data = appendString(data, k)
+		data = crdt.AppendTimestamp(data, v.TS)
+		if v.Deleted {
+			data = append(data, kvDelete)
+		} else {
+			data = appendString(append(data, kvPut), v.Value)
+		}
+	}
+	return data, nil
+}
+
+// Restore merges in the versions of a snapshot rather than replacing the
+// state with it: the leader that took it may not have had every write this
+// one has.
+func (kv *MultiKV) Restore(data []byte) error {
+	for len(data) > 0 {
+		k, rest, err := readString(data)
+		if err != nil {
+			return err
+		}
+		ts, rest, err := crdt.ReadTimestamp(rest)
+		if err != nil {
+			return err
+		}
+		if len(rest) == 0 {
+			return errBadCommand
+		}
+		v := Version{TS: ts}
+		switch rest[0] {
+		case kvPut:
+			if v.Value, rest, err = readString(rest[1:]); err != nil {
+				return err
+			}
+		case kvDelete:
+			v.Deleted, rest = true, rest[1:]
+		default:
+			return errBadCommand
+		}
+
+		kv.clock.Update(ts)
+		kv.mu.Lock()
+		kv.merge(k, v)
+		kv.mu.Unlock()
+		data = rest
+	}
+	return nil
+}
+
+// Leader is one of several masters of the same MultiKV. Its Master logs only
+// the writes made at this leader, and it follows every other leader's
+// Master to merge their writes into its own copy.
+type Leader struct {
+	id      int
+	kv      *MultiKV
+	master  *Master
+	follows []*Follower // one per other leader, all applying to kv
+}
+
+// Put sets key to value and returns the timestamp it was written at.
+func (l *Leader) Put(key, value string) (crdt.Timestamp, error) {
+	ts := l.kv.clock.Now()
+	_, err := l.master.Write(multiPutCmd(key, value, ts), WriteLeaderOnly, 0)
+	return ts, err
+}
+
+// Delete removes key and returns the timestamp it was deleted at.
+func (l *Leader) Delete(key string) (crdt.Timestamp, error) {
+	ts := l.kv.clock.Now()
+	_, err := l.master.Write(multiDeleteCmd(key, ts), WriteLeaderOnly, 0)
+	return ts, err
+}
+
+// multiKeys is how many keys the multi-leader workload writes, few enough
+// that the leaders' writes keep conflicting.
+const multiKeys = 4
+
+// runMultiLeader has n leaders, with clocks up to skew apart, write to the
+// same few keys at once while they replicate to each other through
+// followers that take up to slow to apply each write, over TCP on
+// localhost if loopback is set. Once every leader has every write it checks
+// that all of them ended up in the same state, and that each key holds
+// what resolve says it should: the last write to it for lww, or the union
+// of every value written to it for union.
+func runMultiLeader(seed int64, n, writes int, resolve string, skew, slow time.Duration, loopback bool) error {
+	resolver, err := newResolver(resolve)
+	if err != nil {
+		return err
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	leaders := make([]*Leader, n)
+	for i := range leaders {
+		var offset time.Duration
+		if skew > 0 {
+			offset = time.Duration(rng.Int63n(int64(skew)))
+		}
+		kv := newMultiKV(crdt.NewHLC(i, offset), resolver)
+		var others []int
+		for j := range n {
+			if j != i {
+				others = append(others, j)
+			}
+		}
+		leaders[i] = &Leader{id: i, kv: kv, master: newMaster(kv, others)}
+		log.Printf("Leader%d's clock is %v ahead\n", i, offset)
+	}
+
+	// Leader i follows leader j with a follower of id i.
+	var wg sync.WaitGroup
+	var lns []net.Listener
+	var served []chan error
+	for _, from := range leaders {
+		var addr string
+		if loopback {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return err
+			}
+			done := make(chan error, 1)
+			go func() { done <- from.master.Serve(ln) }()
+			lns, served, addr = append(lns, ln), append(served, done), ln.Addr().String()
+		}
+		for _, to := range leaders {
+			if to == from {
+				continue
+			}
+			f := newFollower(to.id, to.kv)
+			if slow > 0 {
+				f.delay = time.Duration(rng.Int63n(int64(slow)))
+			}
+			to.follows = append(to.follows, f)
+			wg.Add(1)
+			if loopback {
+				go f.followMaster(&wg, addr)
+			} else {
+				f.master, f.epoch = from.master, from.master.epoch
+				go f.recvUpdate(&wg)
+			}
+		}
+	}
+
+	// Every leader writes its share at once, each with its own script so the
+	// run depends only on the seed.
+	type write struct {
+		key   string
+		v     Version
+		pause time.Duration // before the next write
+	}
+	scripts := make([][]write, n)
+	for i := range writes {
+		l := rng.Intn(n)
+		w := write{key: fmt.Sprintf("key%d", rng.Intn(multiKeys)), pause: time.Duration(rng.Int63n(int64(time.Millisecond)))}
+		if resolve == "lww" && rng.Intn(5) == 0 {
+			w.v.Deleted = true
+		} else {
+			w.v.Value = fmt.Sprintf("l%dw%d", l, i)
+		}
+		scripts[l] = append(scripts[l], w)
+	}
+	var writers sync.WaitGroup
+	errs := make(chan error, n)
+	for i, l := range leaders {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			defer l.master.Close()
+			for j, w := range scripts[i] {
+				var err error
+				if w.v.Deleted {
+					w.v.TS, err = l.Delete(w.key)
+				} else {
+					w.v.TS, err = l.Put(w.key, w.v.Value)
+				}
+				if err != nil {
+					errs <- fmt.Errorf("leader%d: %w", l.id, err)
+					return
+				}
+				scripts[i][j] = w
+				time.Sleep(w.pause)
+			}
+		}()
+	}
+	writers.Wait()
+	wg.Wait()
+	for i, ln := range lns {
+		ln.Close()
+		<-served[i]
+	}
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+
+	// What each key must end up as.
+	want := make(map[string]Version)
+	for _, script := range scripts {
+		for _, w := range script {
+			if v, ok := want[w.key]; ok {
+				want[w.key] = resolver(w.key, v, w.v)
+			} else {
+				want[w.key] = w.v
+			}
+		}
+	}
+	first, err := leaders[0].kv.Snapshot()
+	if err != nil {
+		return err
+	}
+	for _, l := range leaders {
+		got, err := l.kv.Snapshot()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, first) {
+			return fmt.Errorf("leader%d is in state %x, leader0 in %x", l.id, got, first)
+		}
+		for key, v := range want {
+			value, ok := l.kv.Get(key)
+			if ok == v.Deleted || value != v.Value {
+				return fmt.Errorf("leader%d has %s=%q (present %v), want %q written at %v (deleted %v)", l.id, key, value, ok, v.Value, v.TS, v.Deleted)
+			}
+		}
+	}
+
+	conflicts := 0
+	for key := range want {
+		by := make(map[int]bool)
+		for i, script := range scripts {
+			for _, w := range script {
+				if w.key == key {
+					by[i] = true
+				}
+			}
+		}
+		if len(by) > 1 {
+			conflicts++
+		}
+	}
+	log.Printf("All %d leaders converged with %s over %d writes, %d of %d keys written by more than one leader\n", n, resolve, writes, conflicts, len(want))
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// checkLeaders runs a random multi-leader workload: how many writes there
+// are, how they are resolved, and how skewed the leaders' clocks and how
+// slow their followers are.
+func checkLeaders(seed int64, leaders int, loopback bool) error {
+	rng := rand.New(rand.NewSource(seed))
+	writes := 20 + rng.Intn(200)
+	resolve := []string{"lww", "union"}[rng.Intn(2)]
+	skew := time.Duration(rng.Intn(50)) * time.Millisecond
+	slow := time.Duration(rng.Intn(500)) * time.Microsecond
+	return runMultiLeader(seed, leaders, writes, resolve, skew, slow, loopback)
+}
+
+// Leaders that take conflicting writes to the same keys at once all end in
+// the same state, the one their resolver picks.
+func TestMultiLeaderConverges(t *testing.T) {
+	for _, leaders := range []int{2, 3} {
+		forSeeds(t, func(seed int64) error { return checkLeaders(seed, leaders, false) })
+	}
+}
+
+func TestMultiLeaderConvergesLoopback(t *testing.T) {
+	forSeeds(t, func(seed int64) error { return checkLeaders(seed, 3, true) })
+}
@@ -0,0 +1,698 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The replication protocol runs over one TCP connection per follower. Every
+// frame is a 4-byte big-endian length, then a kind byte and the body. Bodies
+// start with big-endian uint64 fields:
+//
+//	frameHello      both ways, first: version, then the follower's id,
+//	                applied seq, the newest master epoch it knows of and the
+//	                epoch of the master it applied its entries from, or the
+//	                master's last seq and epoch
+//	frameEntry      master to follower: seq, sent, then the command
+//	frameSnapshot   master to follower, in place of every entry up to seq:
+//	                seq, sent, then the state machine's snapshot
+//	frameHeartbeat  master to follower while idle: the master's last seq,
+//	                sent
+//	frameAck        follower to master, after every entry, snapshot and
+//	                heartbeat: the follower's applied seq
+//	frameClose      master to follower: the log is complete
+//
+// sent is when the frame's seq was the master's last, in Unix nanoseconds by
+// the master's clock, or 0 if that is not known. A follower that has applied
+// up to the seq is as current as the master was then, so how stale its reads
+// are is only as exact as the two clocks agree.
+//
+// A follower that reconnects says in its hello where it got to, and the
+// master streams the log from there. Either side hangs up on a master older
+// than the newest epoch the follower knows of.
+//
+// Followers fail over over one short connection per message, each to the
+// address the follower it is for listens on. That follower answers polls
+// and promotions and hangs up:
+//
+//	framePoll      candidate to follower: epoch, candidate id
+//	framePromote   candidate to follower: epoch, candidate id
+//	framePosition  answer to either: epoch, leader id + 1 or 0 for none,
+//	               source epoch, applied seq, and 1 if the epoch was promised
+//	               or the follower promoted, 0 if not
+//	frameAnnounce  new master to follower: epoch, its id, then the id of
+//	               each of its followers
+//
+// Followers that keep a CRDT gossip it the same way, with no answer:
+//
+//	frameGossip    follower to follower: no fields, just a delta or the
+//	               whole state of the CRDT
+//
+// A follower compares its Merkle tree with the master's over one short
+// connection per query, to the master's address:
+//
+//	frameHashes    follower to master: the ids of tree nodes
+//	frameBuckets   follower to master: the ids of leaves
+//	frameTree      answer to either: the seq of the master's state, then each
+//	               node's hash, or each leaf's number of pairs and its pairs
+//
+// A promoted follower serves its own followers on the same address.
+const (
+	frameHello     byte = 1
+	frameEntry     byte = 2
+	frameHeartbeat byte = 3
+	frameAck       byte = 4
+	frameClose     byte = 5
+	frameSnapshot  byte = 6
+	framePoll      byte = 7
+	framePromote   byte = 8
+	framePosition  byte = 9
+	frameAnnounce  byte = 10
+	frameGossip    byte = 11
+	frameHashes    byte = 12
+	frameBuckets   byte = 13
+	frameTree      byte = 14
+)
+
+const (
+	protocolVersion = 7
+	maxFrameSize    = 64 << 20
+
+	heartbeatInterval = 100 * time.Millisecond
+	peerTimeout       = 5 * heartbeatInterval // silence after which the other end is presumed gone
+	dialTimeout       = time.Second
+	reconnectDelay    = 200 * time.Millisecond
+)
+
+var errBadFrame = errors.New("malformed frame")
+
+// writeFrame writes a frame whose body is fields followed by data.
+func writeFrame(w io.Writer, kind byte, data []byte, fields ...uint64) error {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(1+8*len(fields)+len(data)))
+	buf = append(buf, kind)
+	for _, f := range fields {
+		buf = binary.BigEndian.AppendUint64(buf, f)
+	}
+	_, err := w.Write(append(buf, data...))
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n == 0 || n > maxFrameSize {
+		return 0, nil, errBadFrame
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+	return buf[0], buf[1:], nil
+}
+
+// fields splits a frame body into n uint64 fields and the data after them.
+// If exact is set there must be no data.
+func fields(body []byte, n int, exact bool) ([]uint64, []byte, error) {
+	if len(body) < 8*n || (exact && len(body) != 8*n) {
+		return nil, nil, errBadFrame
+	}
+	f := make([]uint64, n)
+	for i := range f {
+		f[i] = binary.BigEndian.Uint64(body[8*i:])
+	}
+	return f, body[8*n:], nil
+}
+
+// expectFrame reads one frame and checks it is of kind with exactly n fields.
+func expectFrame(r io.Reader, kind byte, n int) ([]uint64, error) {
+	k, body, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	if k != kind {
+		return nil, errBadFrame
+	}
+	f, _, err := fields(body, n, true)
+	return f, err
+}
+
+// Serve accepts follower connections on ln until it is closed.
+func (m *Master) Serve(ln net.Listener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.serveConn(conn)
+		}()
+	}
+}
+
+// serveConn streams the log to the follower on conn, starting where its hello
+// says it got to, and passes its acks on to the master, or answers a query
+// about its Merkle tree.
+func (m *Master) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(peerTimeout))
+	kind, body, err := readFrame(conn)
+	switch {
+	case err != nil:
+	case kind == frameHashes || kind == frameBuckets:
+		err = m.serveTreeQuery(conn, kind, body)
+	case kind == frameHello:
+		var hello []uint64
+		if hello, _, err = fields(body, 5, true); err == nil {
+			m.serveFollower(conn, hello)
+		}
+	default:
+		err = errBadFrame
+	}
+	if err != nil {
+		log.Printf("Master: message from %v: %v\n", conn.RemoteAddr(), err)
+	}
+}
+
+// serveFollower serves a follower whose hello has been read.
+func (m *Master) serveFollower(conn net.Conn, hello []uint64) {
+	if hello[0] != protocolVersion || !slices.Contains(m.followers, int(hello[1])) {
+		log.Printf("Master: refusing %v speaking version %d as follower%d\n", conn.RemoteAddr(), hello[0], hello[1])
+		return
+	}
+	id, from, epoch, source := int(hello[1]), int(hello[2]), int(hello[3]), int(hello[4])
+
+	s, err := m.Connect(id, from, epoch, source)
+	if err != nil {
+		log.Printf("Master: refusing follower%d: %v\n", id, err)
+		return
+	}
+	defer s.disconnect()
+
+	w := bufio.NewWriter(conn)
+	if err := writeFrame(w, frameHello, nil, protocolVersion, uint64(m.last.Load()), uint64(m.epoch)); err != nil {
+		return
+	}
+
+	acksDone := make(chan struct{})
+	go func() {
+		defer close(acksDone)
+		m.readAcks(conn, s)
+	}()
+
+	for {
+		select {
+		case <-s.gone:
+			return
+		default:
+		}
+
+		var err error
+		it, ok, closed := s.pop()
+		switch {
+		case closed:
+			// Wait for the follower to hang up, so its last acks are read
+			// rather than reset by closing on them.
+			if err := writeFrame(w, frameClose, nil); err == nil && w.Flush() == nil {
+				<-acksDone
+			}
+			return
+		case ok && it.beat:
+			err = writeFrame(w, frameHeartbeat, nil, uint64(it.entry.Seq), sentField(it.sent))
+		case ok && it.snap != nil:
+			err = writeFrame(w, frameSnapshot, it.snap.Data, uint64(it.snap.Seq), sentField(it.sent))
+		case ok:
+			err = writeFrame(w, frameEntry, it.entry.Command, uint64(it.entry.Seq), sentField(it.sent))
+		default:
+			// Everything queued is written, so send it before waiting for
+			// more.
+			if err = w.Flush(); err != nil {
+				break
+			}
+			select {
+			case <-s.ready:
+			case <-s.gone:
+				return
+			}
+		}
+		if err != nil {
+			log.Printf("Master: lost follower%d: %v\n", id, err)
+			return
+		}
+	}
+}
+
+// sentField is when an item was sent, as frames carry it.
+func sentField(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+func (m *Master) readAcks(conn net.Conn, s *stream) {
+	defer s.disconnect()
+
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(peerTimeout))
+		f, err := expectFrame(r, frameAck, 1)
+		if err != nil {
+			return
+		}
+		s.ack(int(f[0]))
+	}
+}
+
+// followMaster keeps f replicating from the master at addr, reconnecting
+// from its applied seq whenever the connection drops, and failing over
+// when it has heard nothing from the master for peerTimeout, until the
+// master says the log is complete or f is promoted itself.
+func (f *Follower) followMaster(wg *sync.WaitGroup, addr string) {
+	defer wg.Done()
+
+	log.Println("Follower receiving update")
+
+	f.mu.Lock()
+	f.masterAddr = addr
+	f.mu.Unlock()
+	for {
+		f.mu.Lock()
+		addr, leading := f.masterAddr, f.leading
+		if f.leader < 0 && f.promised >= 0 {
+			// Promised to a candidate, with no master of that epoch known.
+			addr = ""
+		}
+		f.mu.Unlock()
+		if leading != nil {
+			return
+		}
+		if addr == "" {
+			f.failover()
+			continue
+		}
+
+		done, err := f.followConn(addr)
+		if done {
+			return
+		}
+		if err == nil {
+			log.Printf("Follower%d disconnected at seq %d, rejoining in %v\n", f.id, f.applied, f.away)
+			time.Sleep(f.away)
+			continue
+		}
+		log.Printf("Follower%d: %v\n", f.id, err)
+		f.failover()
+	}
+}
+
+// followConn runs one connection to the master. It reports whether the log is
+// complete, and a nil error if the follower dropped the connection itself.
+func (f *Follower) followConn(addr string) (bool, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	f.mu.Lock()
+	hello := []uint64{protocolVersion, uint64(f.id), uint64(f.applied), uint64(f.epoch), uint64(f.source)}
+	f.mu.Unlock()
+	if err := writeFrame(conn, frameHello, nil, hello...); err != nil {
+		return false, err
+	}
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(peerTimeout))
+	reply, err := expectFrame(r, frameHello, 3)
+	if err != nil {
+		return false, fmt.Errorf("handshake: %w", err)
+	}
+	if reply[0] != protocolVersion {
+		return false, fmt.Errorf("master speaks version %d", reply[0])
+	}
+	epoch := int(reply[2])
+	f.mu.Lock()
+	if epoch < f.epoch {
+		f.mu.Unlock()
+		return false, fmt.Errorf("%w: master is at epoch %d, follower knows of %d", errStaleEpoch, epoch, f.epoch)
+	}
+	f.epoch = epoch
+	f.mu.Unlock()
+	log.Printf("Follower%d connected at seq %d, master is at seq %d of epoch %d\n", f.id, f.applied, reply[1], epoch)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(peerTimeout))
+		kind, body, err := readFrame(r)
+		if err != nil {
+			return false, err
+		}
+		if kind == frameClose {
+			return true, nil
+		}
+
+		// The epoch is checked under the same lock as applying, as in
+		// follow.
+		f.mu.Lock()
+		if epoch < f.epoch {
+			f.mu.Unlock()
+			return false, fmt.Errorf("%w: master is at epoch %d, follower knows of %d", errStaleEpoch, epoch, f.epoch)
+		}
+		f.heard = time.Now()
+		idle := false
+		var head []uint64
+		switch kind {
+		case frameEntry, frameSnapshot:
+			var data []byte
+			if head, data, err = fields(body, 2, false); err != nil {
+				break
+			}
+			if kind == frameSnapshot {
+				f.restore(snapshot{Seq: int(head[0]), Data: data})
+			} else {
+				f.apply(Entry{Seq: int(head[0]), Command: data})
+			}
+			f.source = epoch
+		case frameHeartbeat:
+			if head, _, err = fields(body, 2, true); err != nil {
+				break
+			}
+			idle = f.applied >= int(head[0])
+		default:
+			err = errBadFrame
+		}
+		if err == nil && head[1] != 0 && f.applied >= int(head[0]) {
+			f.markCurrent(time.Unix(0, int64(head[1])))
+		}
+		applied := f.applied
+		f.mu.Unlock()
+		if err != nil {
+			return false, err
+		}
+		if err := writeFrame(conn, frameAck, nil, uint64(applied)); err != nil {
+			return false, err
+		}
+		if kind != frameHeartbeat && applied == f.disconnectAt {
+			return false, nil
+		}
+		if idle && f.repairEvery > 0 && time.Since(f.repaired) >= f.repairEvery {
+			f.repaired = time.Now()
+			f.repair(masterTree(addr))
+		}
+	}
+}
+
+// fenceMaster tells the master at addr that there is a master of epoch now,
+// by saying hello with it.
+func fenceMaster(addr string, id, applied, epoch, source int) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(peerTimeout))
+	if writeFrame(conn, frameHello, nil, protocolVersion, uint64(id), uint64(applied), uint64(epoch), uint64(source)) == nil {
+		// The master hangs up once it has refused the hello.
+		io.Copy(io.Discard, conn)
+	}
+}
+
+// listen has f answer the other followers' failover messages on ln, and
+// once it is promoted serve its followers there too, until ln is closed.
+func (f *Follower) listen(ln net.Listener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			if err := f.serveMessage(conn); err != nil {
+				log.Printf("Follower%d: message from %v: %v\n", f.id, conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (f *Follower) serveMessage(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(peerTimeout))
+	kind, body, err := readFrame(conn)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case frameHello:
+		hello, _, err := fields(body, 5, true)
+		if err != nil {
+			return err
+		}
+		f.mu.Lock()
+		m := f.leading
+		f.mu.Unlock()
+		if m == nil {
+			return fmt.Errorf("follower%d is not a master", hello[1])
+		}
+		m.serveFollower(conn, hello)
+		return nil
+	case frameHashes, frameBuckets:
+		f.mu.Lock()
+		m := f.leading
+		f.mu.Unlock()
+		if m == nil {
+			return errNoTree
+		}
+		return m.serveTreeQuery(conn, kind, body)
+	case framePoll, framePromote:
+		p, _, err := fields(body, 2, true)
+		if err != nil {
+			return err
+		}
+		q := poll{epoch: int(p[0]), candidate: int(p[1])}
+		var pos position
+		if kind == framePoll {
+			pos = f.handlePoll(q)
+		} else {
+			pos.granted = f.handlePromote(q) == nil
+		}
+		conn.SetWriteDeadline(time.Now().Add(peerTimeout))
+		return writeFrame(conn, framePosition, nil, encodePosition(pos)...)
+	case frameAnnounce:
+		if len(body)%8 != 0 || len(body) < 16 {
+			return errBadFrame
+		}
+		a, _, err := fields(body, len(body)/8, true)
+		if err != nil {
+			return err
+		}
+		ann := announcement{epoch: int(a[0]), leader: int(a[1])}
+		for _, id := range a[2:] {
+			ann.followers = append(ann.followers, int(id))
+		}
+		f.handleAnnounce(ann)
+		return nil
+	case frameGossip:
+		if f.replica == nil {
+			return errNoReplica
+		}
+		f.replica.deliver(body)
+		return nil
+	}
+	return errBadFrame
+}
+
+func encodePosition(p position) []uint64 {
+	granted := uint64(0)
+	if p.granted {
+		granted = 1
+	}
+	return []uint64{uint64(p.epoch), uint64(p.leader + 1), uint64(p.source), uint64(p.applied), granted}
+}
+
+// netPeers carries failover messages over TCP to the address each follower
+// listens on.
+type netPeers map[int]string
+
+// send sends one message to follower to, and if want is non-zero reads its
+// answer, a frame of that kind with n fields.
+func (p netPeers) send(to int, kind byte, data []byte, fields []uint64, want byte, n int) ([]uint64, error) {
+	addr, ok := p[to]
+	if !ok {
+		return nil, fmt.Errorf("no address for follower%d", to)
+	}
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(peerTimeout))
+	if err := writeFrame(conn, kind, data, fields...); err != nil || want == 0 {
+		return nil, err
+	}
+	return expectFrame(conn, want, n)
+}
+
+func (p netPeers) poll(to int, q poll) (position, error) {
+	f, err := p.send(to, framePoll, nil, []uint64{uint64(q.epoch), uint64(q.candidate)}, framePosition, 5)
+	if err != nil {
+		return position{}, err
+	}
+	return position{epoch: int(f[0]), leader: int(f[1]) - 1, source: int(f[2]), applied: int(f[3]), granted: f[4] == 1}, nil
+}
+
+func (p netPeers) promote(to int, q poll) error {
+	f, err := p.send(to, framePromote, nil, []uint64{uint64(q.epoch), uint64(q.candidate)}, framePosition, 5)
+	if err != nil {
+		return err
+	}
+	if f[4] != 1 {
+		return errNotPromised
+	}
+	return nil
+}
+
+func (p netPeers) announce(to int, a announcement) error {
+	fields := []uint64{uint64(a.epoch), uint64(a.leader)}
+	for _, id := range a.followers {
+		fields = append(fields, uint64(id))
+	}
+	_, err := p.send(to, frameAnnounce, nil, fields, 0, 0)
+	return err
+}
+
+// runMaster runs the master on its own, for followers started with -master,
+// and waits up to linger after the last write for all of them to catch up.
+func runMaster(m *Master, addr string, cmds [][]byte, concern WriteConcern, timeout, linger time.Duration) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Master serving followers %v on %v\n", m.followers, ln.Addr())
+
+	served := make(chan error, 1)
+	go func() { served <- m.Serve(ln) }()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	m.WriteUpdate(&wg, cmds, concern, timeout)
+
+	res, err := m.wait(int(m.last.Load()), WriteAll, linger)
+	if err != nil {
+		log.Printf("Master: followers %v did not catch up: %v\n", res.Lagging, err)
+	}
+	// Serve returns once every connected follower has been told the log is
+	// complete.
+	ln.Close()
+	<-served
+}
+
+func (p netPeers) gossip(to int, data []byte) error {
+	_, err := p.send(to, frameGossip, data, nil, 0, 0)
+	return err
+}
+
+// serveTreeQuery answers a follower's query about the master's Merkle tree.
+func (m *Master) serveTreeQuery(conn net.Conn, kind byte, body []byte) error {
+	if len(body)%8 != 0 {
+		return errBadFrame
+	}
+	ids, _, err := fields(body, len(body)/8, true)
+	if err != nil {
+		return err
+	}
+	var q treeQuery
+	for _, id := range ids {
+		if kind == frameHashes {
+			q.nodes = append(q.nodes, int(id))
+		} else {
+			q.leaves = append(q.leaves, int(id))
+		}
+	}
+	r, err := m.queryTree(q)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	for _, h := range r.hashes {
+		data = append(data, h[:]...)
+	}
+	for _, bucket := range r.buckets {
+		data = appendBucket(data, bucket)
+	}
+	conn.SetWriteDeadline(time.Now().Add(peerTimeout))
+	return writeFrame(conn, frameTree, data, uint64(r.seq))
+}
+
+// masterTree queries the Merkle tree of the master at this address.
+type masterTree string
+
+func (addr masterTree) queryTree(q treeQuery) (treeReply, error) {
+	kind, ids := frameHashes, q.nodes
+	if len(q.leaves) > 0 {
+		kind, ids = frameBuckets, q.leaves
+	}
+	var fs []uint64
+	for _, id := range ids {
+		fs = append(fs, uint64(id))
+	}
+
+	conn, err := net.DialTimeout("tcp", string(addr), dialTimeout)
+	if err != nil {
+		return treeReply{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(peerTimeout))
+	if err := writeFrame(conn, kind, nil, fs...); err != nil {
+		return treeReply{}, err
+	}
+	k, body, err := readFrame(bufio.NewReader(conn))
+	if err != nil {
+		return treeReply{}, err
+	}
+	seq, data, err := fields(body, 1, false)
+	if err != nil || k != frameTree {
+		return treeReply{}, cmp.Or(err, errBadFrame)
+	}
+
+	r := treeReply{seq: int(seq[0])}
+	if kind == frameHashes {
+		if len(data) != len(ids)*sha256.Size {
+			return treeReply{}, errBadFrame
+		}
+		for range ids {
+			r.hashes = append(r.hashes, [sha256.Size]byte(data))
+			data = data[sha256.Size:]
+		}
+		return r, nil
+	}
+	for range ids {
+		var bucket map[string]string
+		if bucket, data, err = readBucket(data); err != nil {
+			return treeReply{}, err
+		}
+		r.buckets = append(r.buckets, bucket)
+	}
+	if len(data) != 0 {
+		return treeReply{}, errBadFrame
+	}
+	return r, nil
+}
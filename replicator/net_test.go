@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// One master and three followers on localhost ports: one follower takes a
+// while to apply each entry and another drops its connection mid-stream.
+// Every write is acknowledged by a majority, and every follower ends in the
+// master's state.
+func TestLoopbackThreeFollowers(t *testing.T) {
+	for _, kind := range []string{"counter", "kv"} {
+		sm, _ := newStateMachine(kind)
+		m := newMaster(sm, []int{0, 1, 2})
+		var fs []*Follower
+		for id := range 3 {
+			sm, _ := newStateMachine(kind)
+			fs = append(fs, demoFollower(id, sm, 2*time.Millisecond, 40, 50*time.Millisecond))
+		}
+
+		c, acks, _ := replicate(m, fs, demoCommands(kind), WriteMajority, time.Second, true, 0)
+		if len(acks) != 100 {
+			t.Errorf("%s: %d of 100 writes acknowledged by a majority", kind, len(acks))
+		}
+		if err := converged(c); err != nil {
+			t.Errorf("%s: %v", kind, err)
+		}
+	}
+}
+
+func TestFrames(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, frameEntry, []byte("cmd"), 7); err != nil {
+		t.Fatal(err)
+	}
+	kind, body, err := readFrame(&buf)
+	if err != nil || kind != frameEntry {
+		t.Fatalf("read frame of kind %d: %v", kind, err)
+	}
+	f, data, err := fields(body, 1, false)
+	if err != nil || f[0] != 7 || string(data) != "cmd" {
+		t.Fatalf("entry frame read back as %v %q: %v", f, data, err)
+	}
+	if _, _, err := fields(body, 1, true); !errors.Is(err, errBadFrame) {
+		t.Errorf("frame with data read as fields only: %v", err)
+	}
+
+	for _, n := range []uint32{0, maxFrameSize + 1} {
+		hdr := binary.BigEndian.AppendUint32(nil, n)
+		if _, _, err := readFrame(bytes.NewReader(slices.Concat(hdr, []byte{frameAck}))); !errors.Is(err, errBadFrame) {
+			t.Errorf("frame of length %d read with %v, want %v", n, err, errBadFrame)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Overflow says what a write does when a follower's queue is full.
+type Overflow string
+
+const (
+	OverflowBlock    Overflow = "block"    // wait for the follower to make room
+	OverflowResync   Overflow = "resync"   // drop the follower; it rejoins with a snapshot
+	OverflowCoalesce Overflow = "coalesce" // replace everything queued with one snapshot
+)
+
+// defaultQueueSize is how many entries may queue for a follower before its
+// overflow policy applies.
+const defaultQueueSize = 128
+
+// item is what a stream carries: an entry, a snapshot standing in for every
+// entry up to its seq, or a heartbeat.
+type item struct {
+	entry Entry
+	snap  *snapshot
+	beat  bool      // a heartbeat; entry.Seq is the master's last seq when it was sent
+	sent  time.Time // when the item's seq was the master's last, zero if not known
+}
+
+// seq is the seq a follower has applied once it has taken it.
+func (it item) seq() int {
+	if it.snap != nil {
+		return it.snap.Seq
+	}
+	return it.entry.Seq
+}
+
+// stream is the queue of everything one connected follower has still to be
+// sent. The master pushes to it under sendMu, and the follower's own
+// goroutine pops from it and acknowledges what it applied, so writes never
+// wait on a follower unless its queue is full and the policy is
+// OverflowBlock.
+type stream struct {
+	master   *Master
+	epoch    int // the master's
+	follower int
+	limit    int
+
+	mu     sync.Mutex
+	items  []item
+	closed bool          // nothing more will be pushed
+	ready  chan struct{} // signalled when an item is pushed or the stream closed
+	space  chan struct{} // signalled when an item is popped
+
+	gone chan struct{} // closed once the follower has disconnected
+	once sync.Once
+}
+
+func newStream(m *Master, follower int, backlog []item) *stream {
+	return &stream{
+		master:   m,
+		epoch:    m.epoch,
+		follower: follower,
+		limit:    m.queueSize,
+		items:    backlog,
+		ready:    make(chan struct{}, 1),
+		space:    make(chan struct{}, 1),
+		gone:     make(chan struct{}),
+	}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push queues it unless the queue is full.
+func (s *stream) push(it item) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.items) >= s.limit {
+		return false
+	}
+	s.items = append(s.items, it)
+	signal(s.ready)
+	return true
+}
+
+// beat queues a heartbeat sent at now, when last was the master's last seq,
+// unless there is something queued already, which tells the follower just
+// as well that the master is alive. Heartbeats do not count towards the
+// limit, so they never wait.
+func (s *stream) beat(last int, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || len(s.items) > 0 {
+		return
+	}
+	s.items = append(s.items, item{entry: Entry{Seq: last}, beat: true, sent: now})
+	signal(s.ready)
+}
+
+// replace drops everything queued in favour of it.
+func (s *stream) replace(it item) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items = []item{it}
+	signal(s.ready)
+}
+
+// pop takes the next item if there is one. Once it reports closed there
+// never will be.
+func (s *stream) pop() (it item, ok, closed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.items) == 0 {
+		return item{}, false, s.closed
+	}
+	it = s.items[0]
+	s.items = s.items[1:]
+	signal(s.space)
+	return it, true, false
+}
+
+func (s *stream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	signal(s.ready)
+}
+
+func (s *stream) disconnect() {
+	s.once.Do(func() { close(s.gone) })
+}
+
+// ack tells the master the follower has applied every entry up to seq.
+func (s *stream) ack(seq int) {
+	s.master.noteAck(ack{follower: s.follower, seq: seq})
+}
+
+// enqueue queues e, written at now, for follower id, applying the overflow
+// policy if its queue is full, and reports whether the follower is still
+// connected. It is called with sendMu held, after e has been applied to the
+// state machine.
+func (m *Master) enqueue(id int, s *stream, e Entry, now time.Time) bool {
+	select {
+	case <-s.gone:
+		return false
+	default:
+	}
+
+	for !s.push(item{entry: e, sent: now}) {
+		switch m.overflow {
+		case OverflowResync:
+			log.Printf("Follower%d overflowed its queue at seq %d, dropping it until it resyncs\n", id, e.Seq)
+			m.count(m.resyncs, id)
+			s.disconnect()
+			return false
+		case OverflowCoalesce:
+			data, err := m.sm.Snapshot()
+			if err != nil {
+				log.Printf("Follower%d overflowed its queue and cannot be sent a snapshot, dropping it: %v\n", id, err)
+				s.disconnect()
+				return false
+			}
+			s.replace(item{snap: &snapshot{Seq: e.Seq, Data: data}, sent: now})
+			m.count(m.coalesced, id)
+			return true
+		default:
+			select {
+			case <-s.space:
+			case <-s.gone:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (m *Master) count(counts map[int]int, id int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts[id]++
+}
+
+// Lag is how far one follower is behind the master.
+type Lag struct {
+	Follower  int
+	Entries   int           // entries written that it has not acknowledged
+	Time      time.Duration // since the oldest of those was written
+	Resyncs   int           // times it was dropped for overflowing its queue
+	Coalesced int           // times its queue was replaced by a snapshot
+}
+
+// recordWrite notes when seq was written, for Lag, and returns it.
+func (m *Master) recordWrite(seq int) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.written) == 0 {
+		m.writtenBase = seq - 1
+	}
+	now := time.Now()
+	m.written = append(m.written, now)
+	return now
+}
+
+// trimWritten forgets the write times every follower has acknowledged. It is
+// called with mu held.
+func (m *Master) trimWritten() {
+	low := m.writtenBase + len(m.written)
+	for _, id := range m.followers {
+		low = min(low, m.acked[id])
+	}
+	if n := low - m.writtenBase; n > 0 {
+		m.written = m.written[n:]
+		m.writtenBase = low
+	}
+}
+
+// Lag reports how far behind each follower is.
+func (m *Master) Lag() []Lag {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	last := m.writtenBase + len(m.written)
+	var lags []Lag
+	for _, id := range m.followers {
+		l := Lag{Follower: id, Resyncs: m.resyncs[id], Coalesced: m.coalesced[id]}
+		if acked := m.acked[id]; acked < last {
+			l.Entries = last - acked
+			l.Time = now.Sub(m.written[max(acked-m.writtenBase, 0)])
+		}
+		lags = append(lags, l)
+	}
+	return lags
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// stalled connects follower id of m as a follower that has applied nothing
+// and never takes anything off its stream, so its queue fills as m is
+// written to. Connecting it after some writes means its queue is never
+// empty, so no heartbeat takes up a place in it.
+func stalled(t *testing.T, m *Master, id int) *stream {
+	t.Helper()
+	s, err := m.Connect(id, 0, m.epoch, m.epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	return s
+}
+
+// queued returns what s has still to send.
+func queued(s *stream) []item {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]item(nil), s.items...)
+}
+
+// writeN makes n writes to m that wait for no follower.
+func writeN(t *testing.T, m *Master, n int) {
+	t.Helper()
+	for range n {
+		if _, err := m.Write(counterAdd(1), WriteLeaderOnly, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkSnapshot fails unless it is a snapshot of a Counter at value seq.
+func checkSnapshot(t *testing.T, it item, seq int) {
+	t.Helper()
+	if it.snap == nil {
+		t.Fatalf("got %+v, want a snapshot at seq %d", it, seq)
+	}
+	var c Counter
+	if err := c.Restore(it.snap.Data); err != nil {
+		t.Fatal(err)
+	}
+	if it.snap.Seq != seq || c.Value != seq {
+		t.Fatalf("got a snapshot at seq %d of value %d, want both %d", it.snap.Seq, c.Value, seq)
+	}
+}
+
+// With OverflowBlock a write to a follower with a full queue waits until
+// the follower takes an entry off it.
+func TestOverflowBlock(t *testing.T) {
+	const size = 4
+	m, _ := newCounters(1)
+	m.queueSize, m.overflow = size, OverflowBlock
+	writeN(t, m, size)
+	s := stalled(t, m, 0)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.Write(counterAdd(1), WriteLeaderOnly, 0)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("write to a full queue returned %v without waiting", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if it, ok, _ := s.pop(); !ok || it.entry.Seq != 1 {
+		t.Fatalf("popped %+v, %v, want entry 1", it, ok)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write still waiting after the follower made room")
+	}
+	items := queued(s)
+	if len(items) != size || items[size-1].entry.Seq != size+1 {
+		t.Fatalf("queue holds %+v, want entries 2 to %d", items, size+1)
+	}
+	if l := m.Lag()[0]; l.Resyncs != 0 || l.Coalesced != 0 {
+		t.Fatalf("lag %+v, want no resyncs or coalescing", l)
+	}
+}
+
+// With OverflowResync a follower whose queue is full is dropped and counted,
+// writes go on without it, and when it reconnects it is sent a snapshot
+// rather than the entries it missed.
+func TestOverflowResync(t *testing.T) {
+	const size = 4
+	m, _ := newCounters(1)
+	m.queueSize, m.overflow = size, OverflowResync
+	writeN(t, m, size)
+	s := stalled(t, m, 0)
+	writeN(t, m, 1)
+
+	select {
+	case <-s.gone:
+	default:
+		t.Fatal("follower still connected after overflowing its queue")
+	}
+	writeN(t, m, size)
+	if l := m.Lag()[0]; l.Resyncs != 1 || l.Coalesced != 0 {
+		t.Fatalf("lag %+v, want one resync", l)
+	}
+
+	s = stalled(t, m, 0)
+	items := queued(s)
+	if len(items) != 1 {
+		t.Fatalf("rejoining follower was sent %+v, want one snapshot", items)
+	}
+	checkSnapshot(t, items[0], 2*size+1)
+}
+
+// With OverflowCoalesce everything queued for a follower whose queue is full
+// is replaced by a single snapshot, which is counted, and the follower stays
+// connected.
+func TestOverflowCoalesce(t *testing.T) {
+	const size = 4
+	m, _ := newCounters(1)
+	m.queueSize, m.overflow = size, OverflowCoalesce
+	writeN(t, m, size)
+	s := stalled(t, m, 0)
+	writeN(t, m, 1)
+
+	items := queued(s)
+	if len(items) != 1 {
+		t.Fatalf("queue holds %+v after overflowing, want one snapshot", items)
+	}
+	checkSnapshot(t, items[0], size+1)
+	if l := m.Lag()[0]; l.Coalesced != 1 || l.Resyncs != 0 {
+		t.Fatalf("lag %+v, want the queue coalesced once", l)
+	}
+
+	writeN(t, m, size)
+	items = queued(s)
+	if len(items) != 1 {
+		t.Fatalf("queue holds %+v after overflowing again, want one snapshot", items)
+	}
+	checkSnapshot(t, items[0], 2*size+1)
+	if l := m.Lag()[0]; l.Coalesced != 2 {
+		t.Fatalf("lag %+v, want the queue coalesced twice", l)
+	}
+	select {
+	case <-s.gone:
+		t.Fatal("follower dropped instead of coalescing its queue")
+	default:
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	errNotCaughtUp       = errors.New("follower has not caught up")
+	errStalenessTooSmall = errors.New("staleness bound below the heartbeat interval")
+)
+
+// ReadToken is a point in the log: seq as the master of epoch wrote it.
+type ReadToken struct {
+	Epoch int
+	Seq   int
+}
+
+// Token returns the token that reads the write r is the result of.
+func (r WriteResult) Token() ReadToken {
+	return ReadToken{Epoch: r.Epoch, Seq: r.Seq}
+}
+
+// ReadOptions says how up to date a follower must be to serve a read.
+//
+// A follower that has applied the log as far as an entry is known to be as
+// current as the master was when it wrote it, and an idle one only as of
+// the master's last heartbeat, so MaxStaleness must be at least
+// heartbeatInterval.
+type ReadOptions struct {
+	After        ReadToken     // point the follower must have applied; a write's WriteResult.Token reads your own writes
+	MaxStaleness time.Duration // how long ago the follower may last have had everything the master wrote, 0 for no bound
+	Wait         time.Duration // how long to wait for the follower to catch up, 0 to fail at once
+}
+
+// Read calls read with the follower's state machine once the follower
+// satisfies opts, and returns the seq it had applied. If the follower does
+// not catch up within opts.Wait, read is not called and the error wraps
+// errNotCaughtUp. read must not change the state machine, and nothing is
+// applied while it runs.
+func (f *Follower) Read(opts ReadOptions, read func(StateMachine) error) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if opts.MaxStaleness > 0 && opts.MaxStaleness < heartbeatInterval {
+		return f.applied, fmt.Errorf("%w: %v is less than %v", errStalenessTooSmall, opts.MaxStaleness, heartbeatInterval)
+	}
+
+	timer := time.AfterFunc(opts.Wait, func() {
+		f.mu.Lock()
+		f.changed.Broadcast()
+		f.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	deadline := time.Now().Add(opts.Wait)
+	for {
+		err := f.readable(opts)
+		if err == nil {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			return f.applied, err
+		}
+		f.changed.Wait()
+	}
+	return f.applied, read(f.sm)
+}
+
+// readable reports why the follower cannot serve a read with opts yet, if it
+// cannot. It is called with mu held.
+// A follower still applying entries from a master older than the token's
+// may have diverged from its log, so it has not caught up whatever its seq.
+// One applying entries from a newer master has the write unless it was lost
+// when that master replaced the one that took it.
+func (f *Follower) readable(opts ReadOptions) error {
+	if f.source < opts.After.Epoch || f.applied < opts.After.Seq {
+		return fmt.Errorf("%w: follower%d is at seq %d of epoch %d, the read needs seq %d of epoch %d", errNotCaughtUp, f.id, f.applied, f.source, opts.After.Seq, opts.After.Epoch)
+	}
+	if opts.MaxStaleness > 0 {
+		if stale := time.Since(f.current); stale > opts.MaxStaleness {
+			return fmt.Errorf("%w: follower%d was last current %v ago, the read allows %v", errNotCaughtUp, f.id, stale.Round(time.Millisecond), opts.MaxStaleness)
+		}
+	}
+	return nil
+}
+
+// readCounter returns a read that stores a Counter's value in v.
+func readCounter(v *int) func(StateMachine) error {
+	return func(sm StateMachine) error {
+		c, ok := sm.(*Counter)
+		if !ok {
+			return fmt.Errorf("cannot read a counter from a %T", sm)
+		}
+		*v = c.Value
+		return nil
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runReads writes increments through a master with only the leader's
+// acknowledgement and reads them back from a follower that takes slow to
+// apply each one, as a client offloading reads would. Every write is read
+// back with read-your-writes, first failing at once and then waiting. Then
+// the follower is read with a staleness bound while it is idle, and while
+// it takes longer than the bound to apply each of a burst of writes. It
+// fails if a read sees less than it asked for.
+func runReads(writes int, slow time.Duration, loopback bool) error {
+	m := newMaster(&Counter{}, []int{0})
+	f := newFollower(0, &Counter{})
+	f.delay = slow
+	wait := time.Duration(writes)*slow + peerTimeout
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var ln net.Listener
+	served := make(chan error, 1)
+	if loopback {
+		var err error
+		if ln, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			return err
+		}
+		go func() { served <- m.Serve(ln) }()
+		go f.followMaster(&wg, ln.Addr().String())
+	} else {
+		f.master, f.epoch = m, m.epoch
+		go f.recvUpdate(&wg)
+	}
+
+	// Read your own writes: a read that may not wait fails while the
+	// follower is still applying the write, and one that waits long enough
+	// sees it.
+	refused := 0
+	for range writes {
+		res, err := m.Write(counterAdd(1), WriteLeaderOnly, 0)
+		if err != nil {
+			return err
+		}
+		var v int
+		if _, err := f.Read(ReadOptions{After: res.Token()}, readCounter(&v)); errors.Is(err, errNotCaughtUp) {
+			refused++
+		} else if err != nil {
+			return err
+		} else if v < res.Seq {
+			return fmt.Errorf("read of write %d saw %d", res.Seq, v)
+		}
+		seq, err := f.Read(ReadOptions{After: res.Token(), Wait: wait}, readCounter(&v))
+		if err != nil {
+			return err
+		}
+		if v < res.Seq {
+			return fmt.Errorf("read of write %d at seq %d saw %d", res.Seq, seq, v)
+		}
+	}
+	log.Printf("Read your writes: %d of %d reads that could not wait were refused, every waiting read saw its write\n", refused, writes)
+
+	// Bounded staleness: a follower that has caught up serves reads within
+	// a heartbeat of the master, but a bound tighter than that is refused.
+	bound := ReadOptions{MaxStaleness: heartbeatInterval, Wait: wait}
+	var v int
+	if _, err := f.Read(bound, readCounter(&v)); err != nil {
+		return fmt.Errorf("caught up follower: %w", err)
+	}
+	if _, err := f.Read(ReadOptions{MaxStaleness: heartbeatInterval / 2, Wait: wait}, readCounter(&v)); !errors.Is(err, errStalenessTooSmall) {
+		return fmt.Errorf("read with staleness below the heartbeat interval returned %v", err)
+	}
+
+	// Once the follower has been behind a burst of writes for longer than
+	// the bound, it refuses reads until it has caught up again.
+	const burst = 4
+	f.mu.Lock()
+	f.delay = bound.MaxStaleness
+	f.mu.Unlock()
+	for range burst {
+		if _, err := m.Write(counterAdd(1), WriteLeaderOnly, 0); err != nil {
+			return err
+		}
+	}
+	last := int(m.last.Load())
+	time.Sleep(2 * bound.MaxStaleness)
+	if seq, err := f.Read(ReadOptions{MaxStaleness: bound.MaxStaleness}, readCounter(&v)); err == nil {
+		return fmt.Errorf("follower read at seq %d within %v of the master at seq %d", seq, bound.MaxStaleness, last)
+	} else if !errors.Is(err, errNotCaughtUp) {
+		return err
+	} else {
+		log.Printf("Read with staleness up to %v refused: %v\n", bound.MaxStaleness, err)
+	}
+	bound.Wait = burst*bound.MaxStaleness + peerTimeout
+	seq, err := f.Read(bound, readCounter(&v))
+	if err != nil {
+		return err
+	}
+	if v != last {
+		return fmt.Errorf("read within %v of the master at seq %d saw %d at seq %d", bound.MaxStaleness, last, v, seq)
+	}
+	log.Printf("Read with staleness up to %v saw all %d writes once the follower caught up\n", bound.MaxStaleness, v)
+
+	m.Close()
+	wg.Wait()
+	if ln != nil {
+		ln.Close()
+		<-served
+	}
+	return nil
+}
+
+// A follower that takes a while to apply each write refuses reads that need
+// more than it has applied, and serves them once it has caught up.
+func TestReadsFromSlowFollower(t *testing.T) {
+	for _, loopback := range []bool{false, true} {
+		if err := runReads(20, 5*time.Millisecond, loopback); err != nil {
+			t.Fatalf("loopback %v: %v", loopback, err)
+		}
+	}
+}
+
+// A read-your-writes token needs the follower to have applied its seq from
+// the master of its epoch or a newer one: a follower further along the log
+// of an older master may not have the write at all.
+func TestReadToken(t *testing.T) {
+	tests := []struct {
+		source, applied int
+		after           ReadToken
+		ok              bool
+	}{
+		{1, 5, ReadToken{1, 5}, true},
+		{1, 4, ReadToken{1, 5}, false},
+		{1, 9, ReadToken{2, 5}, false},
+		{2, 5, ReadToken{2, 5}, true},
+		{3, 5, ReadToken{2, 5}, true},
+		{3, 4, ReadToken{2, 5}, false},
+	}
+	for _, tt := range tests {
+		f := newFollower(0, &Counter{})
+		f.source, f.applied = tt.source, tt.applied
+		var v int
+		_, err := f.Read(ReadOptions{After: tt.after}, readCounter(&v))
+		if ok := err == nil; ok != tt.ok || !ok && !errors.Is(err, errNotCaughtUp) {
+			t.Errorf("follower at seq %d of epoch %d reading after %+v: %v", tt.applied, tt.source, tt.after, err)
+		}
+	}
+}
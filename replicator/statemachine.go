@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// StateMachine is what the replicator replicates. The master applies every
+// command before it logs it, and each follower applies the same commands in
+// the same order, so all of them end up in the same state.
+type StateMachine interface {
+	// Apply executes one command. A command the master's state machine
+	// refuses is never logged.
+	Apply(cmd []byte) error
+	// Snapshot encodes the whole state. Equal states must encode the same.
+	Snapshot() ([]byte, error)
+	// Restore replaces the state with one encoded by Snapshot.
+	Restore(data []byte) error
+}
+
+var errBadCommand = errors.New("malformed command")
+
+func newStateMachine(kind string) (StateMachine, error) {
+	switch kind {
+	case "counter":
+		return &Counter{}, nil
+	case "kv":
+		return newKV(), nil
+	}
+	return nil, fmt.Errorf("unknown state machine %q", kind)
+}
+
+// Counter is a single integer. Its only command adds to it.
+type Counter struct {
+	Value int
+}
+
+// counterAdd returns the command that adds delta to a Counter.
+func counterAdd(delta int) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(int64(delta)))
+}
+
+func (c *Counter) Apply(cmd []byte) error {
+	if len(cmd) != 8 {
+		return errBadCommand
+	}
+	c.Value += int(int64(binary.BigEndian.Uint64(cmd)))
+	return nil
+}
+
+func (c *Counter) Snapshot() ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, uint64(int64(c.Value))), nil
+}
+
+func (c *Counter) Restore(data []byte) error {
+	if len(data) != 8 {
+		return errBadCommand
+	}
+	c.Value = int(int64(binary.BigEndian.Uint64(data)))
+	return nil
+}
+
+// KV is a map of strings to strings.
+type KV struct {
+	data map[string]string
+	tree *merkleTree // of data, for followers' anti-entropy
+}
+
+const (
+	kvPut    byte = 1
+	kvDelete byte = 2
+)
+
+func newKV() *KV {
+	return &KV{data: make(map[string]string), tree: newMerkleTree(nil)}
+}
+
+// kvPutCmd returns the command that sets key to value in a KV.
+func kvPutCmd(key, value string) []byte {
+	cmd := appendString([]byte{kvPut}, key)
+	return appendString(cmd, value)
+}
+
+// kvDeleteCmd returns the command that removes key from a KV.
+func kvDeleteCmd(key string) []byte {
+	return appendString([]byte{kvDelete}, key)
+}
+
+func (kv *KV) Get(key string) (string, bool) {
+	v, ok := kv.data[key]
+	return v, ok
+}
+
+func (kv *KV) Apply(cmd []byte) error {
+	if len(cmd) == 0 {
+		return errBadCommand
+	}
+	key, rest, err := readString(cmd[1:])
+	if err != nil {
+		return err
+	}
+	switch cmd[0] {
+	case kvPut:
+		value, rest, err := readString(rest)
+		if err != nil || len(rest) != 0 {
+			return errBadCommand
+		}
+		kv.put(key, value)
+	case kvDelete:
+		if len(rest) != 0 {
+			return errBadCommand
+		}
+		kv.delete(key)
+	default:
+		return errBadCommand
+	}
+	return nil
+}
+
+func (kv *KV) put(key, value string) {
+	kv.data[key] = value
+	kv.tree.set(key, value)
+}
+
+func (kv *KV) delete(key string) {
+	delete(kv.data, key)
+	kv.tree.remove(key)
+}
+
+// Snapshot encodes the pairs in key order.
+func (kv *KV) Snapshot() ([]byte, error) {
+	keys := make([]string, 0, len(kv.data))
+	for k := range kv.data {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var data []byte
+	for _, k := range keys {
+		data = appendString(data, k)
+		data = appendString(data, kv.data[k])
+	}
+	return data, nil
+}
+
+func (kv *KV) Restore(data []byte) error {
+	m := make(map[string]string)
+	for len(data) > 0 {
+		k, rest, err := readString(data)
+		if err != nil {
+			return err
+		}
+		v, rest, err := readString(rest)
+		if err != nil {
+			return err
+		}
+		m[k], data = v, rest
+	}
+	kv.data, kv.tree = m, newMerkleTree(m)
+	return nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	n, size := binary.Uvarint(b)
+	if size <= 0 || n > uint64(len(b)-size) {
+		return "", nil, errBadCommand
+	}
+	b = b[size:]
+	return string(b[:n]), b[n:], nil
+}